@@ -25,6 +25,11 @@ const (
 	MBitPerSecond         = 1000 * KBitPerSecond
 )
 
+// srtpKey is the pre-shared SRTP key used by all experiments.
+// It only serves to include the cost of SRTP in the results and does not
+// protect anything.
+const srtpKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b"
+
 type experiment struct {
 	ID                string                      `json:"id"`
 	Filename          string                      `json:"filename"`
@@ -33,9 +38,11 @@ type experiment struct {
 	Bandwidth         Bitrate                     `json:"bandwidth"`
 	CongestionControl string                      `json:"congestion_control"`
 	Handler           string                      `json:"handler"`
+	Codec             string                      `json:"codec"`
 	FeedbackFrequency time.Duration               `json:"feedback_frequency"`
 	RequestKeyFrames  bool                        `json:"request_key_frames"`
 	Iperf             bool                        `json:"iperf"`
+	SRTP              bool                        `json:"srtp"`
 	FeedbackAlgorithm transport.FeedbackAlgorithm `json:"feedback_algorithm"`
 
 	ServeCMD  string `json:"server_cmd"`
@@ -63,9 +70,10 @@ type experiment struct {
 
 func (e experiment) String() string {
 	name := fmt.Sprintf(
-		"%v-%v-%v-%v-%v",
+		"%v-%v-%v-%v-%v-%v",
 		e.BaseFile,
 		e.Handler,
+		e.Codec,
 		e.Bandwidth,
 		e.CongestionControl,
 		e.FeedbackFrequency,
@@ -80,6 +88,9 @@ func (e experiment) String() string {
 	} else {
 		name = fmt.Sprintf("%v-ni", name)
 	}
+	if e.SRTP {
+		name = fmt.Sprintf("%v-srtp", name)
+	}
 	return name
 }
 
@@ -116,20 +127,27 @@ func (e experiment) serveCmd() []string {
 		fmt.Sprintf("%v:%v", e.addr, e.port),
 		"--qlog",
 		"server.qlog",
+		"--report-logger",
+		"sender_reports.log",
 		"--video-src",
 		e.AbsFile,
 		"--handler",
 		e.Handler,
+		"--codec",
+		e.Codec,
 		"--feedback-algorithm",
 		fmt.Sprintf("%v", e.FeedbackAlgorithm),
 	}
 
-	if e.CongestionControl == "scream" {
-		cmd = append(cmd, "-s", "--scream-logger", "scream.log")
+	if e.CongestionControl != "none" {
+		cmd = append(cmd, "--cc", e.CongestionControl, "--cc-logger", "cc.log")
 	}
 	if e.RequestKeyFrames {
 		cmd = append(cmd, "-k")
 	}
+	if e.SRTP {
+		cmd = append(cmd, "--srtp-key", srtpKey, "--srtp-logger", "server_srtp.log")
+	}
 	return cmd
 }
 
@@ -141,24 +159,32 @@ func (e experiment) clientCmd() []string {
 		fmt.Sprintf("%v:%v", e.addr, e.port),
 		"--qlog",
 		"client.qlog",
+		"--report-logger",
+		"receiver_reports.log",
 		"--video-sink",
 		fmt.Sprintf("streamed-%v", e.BaseFile),
 		"--handler",
 		e.Handler,
+		"--codec",
+		e.Codec,
 		"--feedback-algorithm",
 		fmt.Sprintf("%v", e.FeedbackAlgorithm),
 	}
 
-	if e.CongestionControl == "scream" {
+	if e.CongestionControl != "none" {
 		cmd = append(
 			cmd,
-			"-s",
+			"--cc",
+			e.CongestionControl,
 			"--feedback-frequency",
 			fmt.Sprintf("%v", e.FeedbackFrequency.Milliseconds()),
 			"--rtcp-logger",
 			"rtcp.log",
 		)
 	}
+	if e.SRTP {
+		cmd = append(cmd, "--srtp-key", srtpKey, "--srtp-logger", "client_srtp.log")
+	}
 	return cmd
 }
 
@@ -483,9 +509,11 @@ type Evaluator struct {
 	Bandwidths            []Bitrate
 	CongestionControllers []string
 	Handlers              []string
+	Codecs                []string
 	FeedbackFrequencies   []time.Duration
 	RequestKeyFrames      []bool
 	Iperf                 []bool
+	SRTP                  []bool
 	FeedbackAlgorithms    []transport.FeedbackAlgorithm
 }
 
@@ -499,6 +527,8 @@ func (e *Evaluator) buildExperiments() []*experiment {
 		len(e.FeedbackFrequencies),
 		len(e.RequestKeyFrames),
 		len(e.FeedbackAlgorithms),
+		len(e.Codecs),
+		len(e.SRTP),
 	}
 	gen := combin.NewCartesianGenerator(lens)
 	var experiments []*experiment
@@ -513,13 +543,20 @@ func (e *Evaluator) buildExperiments() []*experiment {
 			FeedbackFrequency: e.FeedbackFrequencies[p[5]],
 			RequestKeyFrames:  e.RequestKeyFrames[p[6]],
 			FeedbackAlgorithm: e.FeedbackAlgorithms[p[7]],
+			Codec:             e.Codecs[p[8]],
+			SRTP:              e.SRTP[p[9]],
 		}
 		// filter redundant none cc settings, RequestKeyFrames and FeedbackFrequency don't make sense without cc
 		if c.CongestionControl == "none" && (c.RequestKeyFrames || c.FeedbackFrequency != 1*time.Millisecond) {
 			continue
 		}
 		// filter inferred feedback for non-datagram handlers
-		if c.FeedbackAlgorithm != transport.Receive && (c.CongestionControl != "scream" || c.Handler != "datagram") {
+		if c.FeedbackAlgorithm != transport.Receive && (c.CongestionControl == "none" || c.Handler != "datagram") {
+			continue
+		}
+		// SRTP is only implemented by the udp handler, the other handlers are
+		// encrypted by QUIC or not at all
+		if c.SRTP && c.Handler != "udp" {
 			continue
 		}
 		experiments = append(experiments, c)
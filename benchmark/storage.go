@@ -38,10 +38,12 @@ type document struct {
 	Bandwidth         int64         `json:"bandwidth" firestore:"bandwidth"`
 	CongestionControl string        `json:"congestion_control" firestore:"congestion_control"`
 	Handler           string        `json:"handler" firestore:"handler"`
+	Codec             string        `json:"codec" firestore:"codec"`
 	FeedbackFrequency time.Duration `json:"feedback_frequency" firestore:"feedback_frequency"`
 	FeedbackAlgorithm string        `json:"feedback_algorithm" firestore:"feedback_algorithm"`
 	RequestKeyFrames  bool          `json:"request_key_frames" firestore:"request_key_frames"`
 	Iperf             bool          `json:"iperf" firestore:"iperf"`
+	SRTP              bool          `json:"srtp" firestore:"srtp"`
 
 	ServeCMD  string `json:"server_cmd" firestore:"server_cmd"`
 	StreamCMD string `json:"client_cmd" firestore:"client_cmd"`
@@ -125,10 +127,12 @@ func (u *uploader) Upload(path string) error {
 		Bandwidth:                int64(e.Bandwidth),
 		CongestionControl:        e.CongestionControl,
 		Handler:                  e.Handler,
+		Codec:                    e.Codec,
 		FeedbackFrequency:        e.FeedbackFrequency,
 		FeedbackAlgorithm:        e.FeedbackAlgorithm.String(),
 		RequestKeyFrames:         e.RequestKeyFrames,
 		Iperf:                    e.Iperf,
+		SRTP:                     e.SRTP,
 		ServeCMD:                 e.ServeCMD,
 		StreamCMD:                e.StreamCMD,
 		Version:                  e.Version,
@@ -235,14 +239,19 @@ func (c converterFunc) convert(path string) (map[string]*DataTable, error) {
 }
 
 var converterMap = map[string]converterFunc{
-	"ssim.log":           getImageMetricConverter(0, 4, "SSIM", strconv.ParseFloat),
-	"psnr.log":           getImageMetricConverter(0, 5, "PSNR", parseAndBound),
-	"rtcp.log":           rtcpConverter,
-	"scream.log":         screamConverter,
-	"server.qlog":        getQLOGConverter("server"),
-	"client.qlog":        getQLOGConverter("client"),
-	"server_vnstat.json": getVnstatConverter("server"),
-	"client_vnstat.json": getVnstatConverter("client"),
+	"ssim.log":             getImageMetricConverter(0, 4, "SSIM", strconv.ParseFloat),
+	"psnr.log":             getImageMetricConverter(0, 5, "PSNR", parseAndBound),
+	"rtcp.log":             rtcpConverter,
+	"sender_reports.log":   getReportConverter("sender"),
+	"receiver_reports.log": getReportConverter("receiver"),
+	"server_srtp.log":      getSRTPConverter("server"),
+	"client_srtp.log":      getSRTPConverter("client"),
+	"scream.log":           screamConverter,
+	"cc.log":               screamConverter,
+	"server.qlog":          getQLOGConverter("server"),
+	"client.qlog":          getQLOGConverter("client"),
+	"server_vnstat.json":   getVnstatConverter("server"),
+	"client_vnstat.json":   getVnstatConverter("client"),
 }
 
 func getVnstatConverter(prefix string) converterFunc {
@@ -704,6 +713,88 @@ func screamConverter(path string) (map[string]*DataTable, error) {
 	}, csvFile.Close()
 }
 
+// getReportConverter converts report logs with the columns time, SSRC, fraction
+// lost, cumulative lost, jitter and RTT.
+func getReportConverter(prefix string) converterFunc {
+	return getTableConverter(
+		fmt.Sprintf("%v-reports", prefix),
+		[]string{"ssrc", "fraction lost", "cumulative lost", "jitter", "rtt"},
+	)
+}
+
+// getSRTPConverter converts SRTP logs with the columns time, protected
+// packets, protected bytes, overhead bytes, protection time, unprotected
+// packets, unprotection time and dropped packets.
+func getSRTPConverter(prefix string) converterFunc {
+	return getTableConverter(
+		fmt.Sprintf("%v-srtp", prefix),
+		[]string{"protected packets", "protected bytes", "overhead bytes", "protect time", "unprotected packets", "unprotect time", "dropped"},
+	)
+}
+
+// getTableConverter converts logs of space separated numbers to a table with
+// the given name. The first column is the time, labels are the labels of the
+// remaining columns.
+func getTableConverter(name string, labels []string) converterFunc {
+	return func(path string) (map[string]*DataTable, error) {
+		csvFile, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		// defer Close for cases of early return in case of another error
+		defer csvFile.Close()
+		r := csv.NewReader(csvFile)
+		r.Comma = ' '
+		r.TrimLeadingSpace = true
+
+		table := &DataTable{
+			Cols: []Col{
+				{
+					T:     "number",
+					ID:    "col_1",
+					Label: "time",
+				},
+			},
+			Rows: []Row{},
+		}
+		for i, l := range labels {
+			table.Cols = append(table.Cols, Col{
+				T:     "number",
+				ID:    fmt.Sprintf("col_%v", i+2),
+				Label: l,
+			})
+		}
+
+		for {
+			record, err := r.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if len(record) != len(table.Cols) {
+				return nil, fmt.Errorf("invalid record: %v", record)
+			}
+			var row Row
+			for _, field := range record {
+				v, err := strconv.ParseFloat(field, 64)
+				if err != nil {
+					return nil, err
+				}
+				row.C = append(row.C, Cell{
+					V: v,
+					F: field,
+				})
+			}
+			table.Rows = append(table.Rows, row)
+		}
+		return map[string]*DataTable{
+			name: table,
+		}, csvFile.Close()
+	}
+}
+
 func rtcpConverter(path string) (map[string]*DataTable, error) {
 	csvFile, err := os.Open(path)
 	if err != nil {
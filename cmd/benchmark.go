@@ -52,11 +52,24 @@ var bandwidths = []benchmark.Bitrate{
 var congestionControllers = []string{
 	"none",
 	"scream",
+	"gcc",
+	"nada",
 }
 var handlers = []string{
 	"udp",
+	"tcp",
 	"streamperframe",
+	"streamperpacket",
+	"singlestream",
 	"datagram",
+	"hybrid",
+}
+var codecs = []string{
+	"h264",
+	"vp8",
+	"vp9",
+	"h265",
+	"av1",
 }
 var feedbackFrequencies = []time.Duration{
 	1 * time.Millisecond,
@@ -78,9 +91,11 @@ func runBenchmark() error {
 		Bandwidths:            bandwidths,
 		CongestionControllers: congestionControllers,
 		Handlers:              handlers,
+		Codecs:                codecs,
 		FeedbackFrequencies:   feedbackFrequencies,
 		RequestKeyFrames:      []bool{false}, //, true},
 		Iperf:                 []bool{false, true},
+		SRTP:                  []bool{false, true},
 		FeedbackAlgorithms:    feedbackAlgorithms,
 	}
 	return evaluator.RunAll(
@@ -1,28 +1,60 @@
 package cmd
 
 import (
+	"encoding/hex"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/mengelbart/cgo-streamer/gst"
 	"github.com/mengelbart/cgo-streamer/transport"
 
 	"github.com/spf13/cobra"
 )
 
 var Scream bool
+var CongestionController string
 var Debug bool
 var Handler string
 var Addr string
 var QLOGFile string
 var FeedbackAlgorithm string
+var FrameDeadline time.Duration
+var RoQ bool
+var RoQFlowID uint64
+var FragmentSize int
+var FECGroupSize int
+var RTX bool
+var TemporalLayers int
+var Codec string
+var Audio bool
+var ReportLogFile string
+var SRTPKey string
+var SRTPLogFile string
+var IdleTimeout time.Duration
 
 func init() {
 	log.SetFlags(log.Lmicroseconds)
-	rootCmd.PersistentFlags().BoolVarP(&Scream, "scream", "s", false, "Use scream congestion control")
+	rootCmd.PersistentFlags().BoolVarP(&Scream, "scream", "s", false, "Use scream congestion control, same as '--cc scream'")
+	rootCmd.PersistentFlags().StringVar(&CongestionController, "cc", "none", fmt.Sprintf("Congestion controller to use. Options are: none, %v", strings.Join(transport.CongestionControllers(), ", ")))
 	rootCmd.PersistentFlags().BoolVarP(&Debug, "verbose", "v", false, "Log debug output")
-	rootCmd.PersistentFlags().StringVar(&Handler, "handler", "datagram", "Handler to use. Options are: udp, datagram, streamperframe")
+	rootCmd.PersistentFlags().StringVar(&Handler, "handler", "datagram", "Handler to use. Options are: udp, tcp, datagram, streamperframe, streamperpacket, singlestream, hybrid")
 	rootCmd.PersistentFlags().StringVarP(&Addr, "address", "a", "localhost:4242", "Address to bind to")
+	rootCmd.PersistentFlags().DurationVar(&FrameDeadline, "frame-deadline", 0, "Cancel streams of frames which could not be delivered within the deadline, only used by stream handlers and for retransmissions of lost datagrams, 0 disables cancellation")
+	rootCmd.PersistentFlags().BoolVar(&RoQ, "roq", false, "Use RTP over QUIC (RoQ) framing with flow identifiers, only used by QUIC handlers")
+	rootCmd.PersistentFlags().Uint64Var(&RoQFlowID, "roq-flow-id", 0, fmt.Sprintf("RoQ flow identifier of the media flow (0-%v)", uint64(transport.MaxRoQFlowID)))
+	rootCmd.PersistentFlags().IntVar(&FragmentSize, "fragment-size", 0, "Split RTP packets into datagrams of at most this size, only used by the datagram handler, 0 disables fragmentation")
+	rootCmd.PersistentFlags().IntVar(&FECGroupSize, "fec-group-size", 0, "Protect groups of this many RTP packets by a FEC packet, only used by udp and datagram handlers, 0 disables FEC")
+	rootCmd.PersistentFlags().BoolVar(&RTX, "rtx", false, "Request lost packets by NACKs and retransmit them, only used by udp and datagram handlers")
+	rootCmd.PersistentFlags().StringVar(&Codec, "codec", "h264", fmt.Sprintf("Video codec to use. Options are: %v", strings.Join(gst.Codecs(), ", ")))
+	rootCmd.PersistentFlags().BoolVar(&Audio, "audio", false, "Send an Opus audio track and RTCP sender reports to measure audio/video synchronization, can not be used with streamperframe and hybrid handlers")
+	rootCmd.PersistentFlags().IntVar(&TemporalLayers, "temporal-layers", 1, "Number of temporal layers (1-3), more than one layer requires '--codec vp8'")
+	rootCmd.PersistentFlags().StringVar(&ReportLogFile, "report-logger", "stdout", "Log file for RTCP receiver report statistics, 'stdout' prints to stdout, otherwise creates a new file")
+	rootCmd.PersistentFlags().StringVar(&SRTPKey, "srtp-key", "", fmt.Sprintf("Hex encoded pre-shared key of at least %v bytes, from which the SRTP keys of each session are derived, only used by the udp handler, empty disables SRTP", transport.MinSRTPPreSharedKeyLength))
+	rootCmd.PersistentFlags().StringVar(&SRTPLogFile, "srtp-logger", "stdout", "Log file for SRTP overhead and processing time, 'stdout' prints to stdout, otherwise creates a new file")
+	rootCmd.PersistentFlags().DurationVar(&IdleTimeout, "idle-timeout", transport.DefaultUDPIdleTimeout, fmt.Sprintf("Close sessions after this time without packets from the peer, at least %v, only used by the udp handler", transport.MinUDPIdleTimeout))
 	rootCmd.PersistentFlags().StringVarP(&QLOGFile, "qlog", "q", "", "Enable QLOG and write to given filename")
 	rootCmd.PersistentFlags().StringVar(
 		&FeedbackAlgorithm,
@@ -38,6 +70,43 @@ func init() {
 
 var rootCmd = &cobra.Command{
 	Use: "qrt",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return validateFlags()
+	},
+}
+
+// validateFlags checks flag values which would otherwise only fail once a
+// session is running.
+func validateFlags() error {
+	if RoQFlowID > transport.MaxRoQFlowID {
+		return fmt.Errorf("invalid --roq-flow-id %v: must not be larger than %v", RoQFlowID, uint64(transport.MaxRoQFlowID))
+	}
+	if IdleTimeout < transport.MinUDPIdleTimeout {
+		return fmt.Errorf("invalid --idle-timeout %v: must be at least %v", IdleTimeout, transport.MinUDPIdleTimeout)
+	}
+	return nil
+}
+
+// congestionController returns the name of the selected congestion controller
+// or "none" if congestion control is disabled.
+func congestionController() string {
+	if Scream && CongestionController == "none" {
+		return "scream"
+	}
+	return CongestionController
+}
+
+// srtpPreSharedKey decodes the pre-shared SRTP key or returns nil if SRTP
+// is disabled.
+func srtpPreSharedKey() ([]byte, error) {
+	if len(SRTPKey) == 0 || Handler != "udp" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(SRTPKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --srtp-key: %w", err)
+	}
+	return key, nil
 }
 
 func Execute() {
@@ -2,11 +2,18 @@ package cmd
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"os"
+	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/lucas-clemente/quic-go/qlog"
 
@@ -22,15 +29,45 @@ import (
 
 var VideoSrc string
 var Bitrate int
-var ScreamLogFile string
+var CCLogFile string
 var RequestKeyFrames bool
+var MTU uint
+var RTXMaxAge time.Duration
+var RetransmitLost bool
+var Broadcast bool
+var Simulcast string
+var MaxLayerDelay time.Duration
+var AudioSrc string
+var AudioBitrate int
+var MaxSessions int
+var SessionLogFile string
+var WebTransport bool
+var WebAddr string
+var WebRoot string
+var ShutdownTimeout time.Duration
 
 func init() {
 	rootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().StringVar(&VideoSrc, "video-src", "videotestsrc", "Video file")
 	serveCmd.Flags().IntVarP(&Bitrate, "bitrate", "b", 10, "initial encoder bitrate")
-	serveCmd.Flags().StringVar(&ScreamLogFile, "scream-logger", "stdout", "Log file for scream statistics, 'stdout' prints to stdout, otherwise creates a new file")
-	serveCmd.Flags().BoolVarP(&RequestKeyFrames, "request-key-frames", "k", false, "Request extra key frames when using SCReAM")
+	serveCmd.Flags().StringVar(&AudioSrc, "audio-src", "audiotestsrc", "Audio file, only used with --audio")
+	serveCmd.Flags().IntVar(&AudioBitrate, "audio-bitrate", 32, "Opus encoder bitrate in kbit/s, only used with --audio")
+	serveCmd.Flags().StringVar(&CCLogFile, "cc-logger", "stdout", "Log file for congestion controller statistics, 'stdout' prints to stdout, otherwise creates a new file")
+	serveCmd.Flags().StringVar(&CCLogFile, "scream-logger", "stdout", "Log file for scream statistics, 'stdout' prints to stdout, otherwise creates a new file")
+	_ = serveCmd.Flags().MarkDeprecated("scream-logger", "use --cc-logger instead")
+	serveCmd.Flags().BoolVarP(&RequestKeyFrames, "request-key-frames", "k", false, "Request extra key frames when using congestion control")
+	serveCmd.Flags().DurationVar(&RTXMaxAge, "rtx-max-age", 200*time.Millisecond, "Maximum time since the original transmission to retransmit a packet, only used with --rtx")
+	serveCmd.Flags().BoolVar(&RetransmitLost, "retransmit-lost", false, "Retransmit RTP packets of datagrams declared lost by QUIC if they are younger than --frame-deadline, only used by the datagram handler")
+	serveCmd.Flags().BoolVar(&Broadcast, "broadcast", false, "Encode the video once and send it to all clients, can not be used with congestion control")
+	serveCmd.Flags().StringVar(&Simulcast, "simulcast", "", "Comma separated list of simulcast layers in the format WIDTHxHEIGHT@KBITPS, ordered by ascending bitrate, e.g. '320x180@150,1280x720@2000'. Implies --broadcast, the layer of each client is selected by its congestion controller or the initial bitrate")
+	serveCmd.Flags().DurationVar(&MaxLayerDelay, "max-layer-delay", 50*time.Millisecond, "Queue delay above which packets of temporal enhancement layers are dropped, only used with --temporal-layers and congestion control")
+	serveCmd.Flags().IntVar(&MaxSessions, "max-sessions", 0, "Maximum number of concurrent sessions, only used by the udp handler, 0 disables the limit")
+	serveCmd.Flags().StringVar(&SessionLogFile, "session-logger", "stdout", "Log file for statistics of closed sessions, only used by the udp handler, 'stdout' prints to stdout, otherwise creates a new file")
+	serveCmd.Flags().BoolVar(&WebTransport, "webtransport", false, "Serve QUIC handlers to WebTransport clients on path "+webTransportPath+" instead of raw QUIC sessions, only for h264 and vp8 video without audio, can not be used with udp, tcp and hybrid handlers")
+	serveCmd.Flags().StringVar(&WebAddr, "web-addr", "", "Address of the HTTP server for the browser receiver, only used with --webtransport, empty disables the HTTP server")
+	serveCmd.Flags().StringVar(&WebRoot, "web-root", "web", "Directory of the browser receiver, only used with --web-addr")
+	serveCmd.Flags().DurationVar(&ShutdownTimeout, "shutdown-timeout", 5*time.Second, "Time to wait for open sessions to end after an interrupt, remaining sessions are closed afterwards")
+	serveCmd.Flags().UintVar(&MTU, "mtu", 1000, "Maximum size of RTP packets created by the payloader, packets larger than the QUIC datagram limit require --fragment-size")
 }
 
 var serveCmd = &cobra.Command{
@@ -41,36 +78,136 @@ var serveCmd = &cobra.Command{
 }
 
 type Runner interface {
-	Run() error
+	Run(ctx context.Context) error
+	Shutdown(ctx context.Context) error
 }
 
 func serve() error {
 	if !Debug {
 		log.SetOutput(ioutil.Discard)
 	}
+	codec, err := gst.GetCodec(Codec)
+	if err != nil {
+		return err
+	}
+	isKeyFrame, err := transport.GetKeyFrameDetector(Codec)
+	if err != nil {
+		return err
+	}
 	src := &Src{
 		videoSrc:         VideoSrc,
 		requestKeyFrames: RequestKeyFrames,
-		scream:           Scream,
 		bitrate:          Bitrate,
+		mtu:              MTU,
+		codec:            codec,
 	}
-	if Scream {
-		if ScreamLogFile != "stdout" {
-			create, err := os.Create(ScreamLogFile)
+	if cc := congestionController(); cc != "none" {
+		factory, err := transport.GetCongestionController(cc)
+		if err != nil {
+			return err
+		}
+		src.ccFactory = factory
+		if CCLogFile != "stdout" {
+			create, err := os.Create(CCLogFile)
 			if err != nil {
 				return err
 			}
-			src.ScreamLogWriter = create
+			src.CCLogWriter = create
 		} else {
-			src.ScreamLogWriter = os.Stdout
+			src.CCLogWriter = os.Stdout
 		}
 	} else {
-		src.ScreamLogWriter = ioutil.Discard
+		src.CCLogWriter = ioutil.Discard
 	}
+	reportLogWriter, err := getLogWriter(ReportLogFile)
+	if err != nil {
+		return err
+	}
+	src.reportLogWriter = reportLogWriter
 	if VideoSrc != "videotestsrc" {
 		src.videoSrc = fmt.Sprintf("filesrc location=%v ! queue ! decodebin ! videoconvert ", VideoSrc)
 	}
 
+	if Audio {
+		// frame based handlers can not interleave packets of other streams
+		if Handler == "streamperframe" || Handler == "hybrid" {
+			return errors.New("--audio can not be used with streamperframe and hybrid handlers")
+		}
+		src.audioSrc = "audiotestsrc ! audioconvert ! audioresample "
+		if AudioSrc != "audiotestsrc" {
+			src.audioSrc = fmt.Sprintf("filesrc location=%v ! queue ! decodebin ! audioconvert ! audioresample ", AudioSrc)
+		}
+		src.audioBitrate = AudioBitrate
+	}
+
+	if Handler == "udp" || Handler == "datagram" {
+		src.fecGroupSize = FECGroupSize
+		if RTX {
+			src.rtxMaxAge = RTXMaxAge
+		}
+	}
+
+	srtpKey, err := srtpPreSharedKey()
+	if err != nil {
+		return err
+	}
+	// FEC packets share the SSRC of the media stream but use their own
+	// sequence numbers, which would reuse SRTP indices
+	if srtpKey != nil && FECGroupSize > 0 {
+		return errors.New("--srtp-key can not be used with --fec-group-size")
+	}
+
+	if TemporalLayers > 1 {
+		if Codec != "vp8" {
+			return errors.New("--temporal-layers requires '--codec vp8'")
+		}
+		if len(Simulcast) > 0 {
+			return errors.New("--temporal-layers can not be used with --simulcast")
+		}
+		pattern, err := transport.TemporalLayerPattern(TemporalLayers)
+		if err != nil {
+			return err
+		}
+		src.svcPattern = pattern
+	}
+
+	if len(Simulcast) > 0 {
+		layers, err := parseSimulcastLayers(Simulcast)
+		if err != nil {
+			return err
+		}
+		src.broadcaster = transport.NewBroadcaster()
+		src.broadcaster.SetKeyFrameDetector(isKeyFrame)
+		p := gst.NewSimulcastSrcPipeline(src.broadcaster, src.videoSrc, src.codec, layers, src.mtu)
+		src.broadcaster.SetKeyFrameRequester(p.ForceKeyFrame)
+		src.requestKeyFrame = p.ForceKeyFrame
+		src.isKeyFrame = isKeyFrame
+		for _, l := range layers {
+			src.simulcastLayers = append(src.simulcastLayers, transport.SimulcastLayer{
+				SSRC:    uint32(l.SSRC),
+				Bitrate: uint(l.Bitrate),
+			})
+		}
+		p.Start()
+		defer func() {
+			p.Stop()
+			p.Destroy()
+		}()
+	} else if Broadcast {
+		if src.ccFactory != nil {
+			return errors.New("--broadcast can not be used with congestion control")
+		}
+		src.broadcaster = transport.NewBroadcaster()
+		src.broadcaster.SetKeyFrameDetector(isKeyFrame)
+		p := src.newPipeline(src.broadcaster)
+		src.broadcaster.SetKeyFrameRequester(p.ForceKeyFrame)
+		p.Start()
+		defer func() {
+			p.Stop()
+			p.Destroy()
+		}()
+	}
+
 	var runner Runner
 	var options []func(*transport.QUICServer)
 	var tracers []logging.Tracer
@@ -85,8 +222,9 @@ func serve() error {
 			return util.NewBufferedWriteCloser(bufio.NewWriter(f), f)
 		}))
 	}
-	if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive {
-		t := transport.NewTracer(func(_ logging.Perspective, connID []byte) io.WriteCloser {
+	var quicTracer *transport.QUICTracer
+	if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive || RetransmitLost {
+		quicTracer = transport.NewTracer(func(_ logging.Perspective, connID []byte) io.WriteCloser {
 			f, err := os.Create(QLOGFile)
 			if err != nil {
 				log.Fatal(err)
@@ -94,8 +232,10 @@ func serve() error {
 			log.Printf("Creating qlog file %s.\n", QLOGFile)
 			return util.NewBufferedWriteCloser(bufio.NewWriter(f), f)
 		})
-		tracers = append(tracers, t)
-		src.ackChan = t.GetACKChan()
+		tracers = append(tracers, quicTracer)
+		if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive {
+			src.ackChan = quicTracer.GetACKChan()
+		}
 	}
 
 	var tracer logging.Tracer
@@ -104,18 +244,113 @@ func serve() error {
 		options = append(options, transport.SetQLOGTracer(tracer))
 	}
 
+	if WebTransport {
+		if Handler == "udp" || Handler == "tcp" || Handler == "hybrid" {
+			return errors.New("--webtransport can not be used with udp, tcp and hybrid handlers")
+		}
+		// the browser receiver only depacketizes H.264 and VP8 video
+		if Codec != "h264" && Codec != "vp8" {
+			return fmt.Errorf("--webtransport can not be used with codec %v, only h264 and vp8 are supported", Codec)
+		}
+		if Audio || RoQ || FragmentSize > 0 {
+			return errors.New("--webtransport can not be used with --audio, --roq or --fragment-size")
+		}
+		options = append(options, transport.EnableWebTransport(webTransportPath))
+	}
+
 	switch Handler {
 	case "udp":
-		runner = transport.NewUDPServer(Addr, transport.SetPacketHandler(transport.NewUDPPacketHandler(src)))
+		h := transport.NewUDPPacketHandler(src)
+		h.SetMaxSessions(MaxSessions)
+		if err := h.SetIdleTimeout(IdleTimeout); err != nil {
+			return err
+		}
+		sessionLogWriter, err := getLogWriter(SessionLogFile)
+		if err != nil {
+			return err
+		}
+		h.SetSessionLogger(sessionLogWriter)
+		if srtpKey != nil {
+			srtpLogWriter, err := getLogWriter(SRTPLogFile)
+			if err != nil {
+				return err
+			}
+			if err := h.EnableSRTP(srtpKey, srtpLogWriter); err != nil {
+				return err
+			}
+		}
+		runner = transport.NewUDPServer(Addr, transport.SetPacketHandler(h))
+	case "tcp":
+		runner = transport.NewTCPServer(Addr, transport.SetConnHandler(transport.NewTCPConnHandler(src)))
 	case "streamperframe":
-		options = append(options, transport.SetSessionHandler(transport.NewStreamPerFrameHandler(src)))
+		h := transport.NewStreamPerFrameHandler(src)
+		h.SetFrameDeadline(FrameDeadline)
+		if RoQ {
+			h.EnableRoQ(RoQFlowID)
+		}
+		options = append(options, transport.SetSessionHandler(h))
+		s, err := transport.NewQUICServer(Addr, nil, options...)
+		if err != nil {
+			return err
+		}
+		runner = s
+	case "streamperpacket":
+		h := transport.NewStreamPerPacketHandler(src)
+		h.SetFrameDeadline(FrameDeadline)
+		if RoQ {
+			h.EnableRoQ(RoQFlowID)
+		}
+		options = append(options, transport.SetSessionHandler(h))
+		s, err := transport.NewQUICServer(Addr, nil, options...)
+		if err != nil {
+			return err
+		}
+		runner = s
+	case "singlestream":
+		h := transport.NewSingleStreamHandler(src)
+		if RoQ {
+			h.EnableRoQ(RoQFlowID)
+		}
+		options = append(options, transport.SetSessionHandler(h))
+		s, err := transport.NewQUICServer(Addr, nil, options...)
+		if err != nil {
+			return err
+		}
+		runner = s
+	case "hybrid":
+		h := transport.NewHybridHandler(src)
+		h.SetFrameDeadline(FrameDeadline)
+		h.SetKeyFrameDetector(isKeyFrame)
+		if RoQ {
+			h.EnableRoQ(RoQFlowID)
+		}
+		options = append(options, transport.SetSessionHandler(h))
+		options = append(options, transport.SetDatagramEnabled(true))
 		s, err := transport.NewQUICServer(Addr, nil, options...)
 		if err != nil {
 			return err
 		}
 		runner = s
 	case "datagram":
-		options = append(options, transport.SetSessionHandler(transport.NewDatagramHandler(src)))
+		h := transport.NewDatagramHandler(src)
+		h.SetKeyFrameDetector(isKeyFrame)
+		if RoQ {
+			h.EnableRoQ(RoQFlowID)
+		}
+		if FragmentSize > 0 {
+			err := h.EnableFragmentation(FragmentSize)
+			if err != nil {
+				return err
+			}
+		}
+		if RetransmitLost {
+			// the tracer has to map each datagram to a packet of the video stream
+			if RoQ || FragmentSize > 0 || FECGroupSize > 0 || RTX || Audio || WebTransport {
+				return errors.New("--retransmit-lost can not be used with --roq, --fragment-size, --fec-group-size, --rtx, --audio or --webtransport")
+			}
+			h.EnableRetransmissions(quicTracer, videoSSRC, FrameDeadline)
+		}
+		options = append(options, transport.SetSessionHandler(h))
 		options = append(options, transport.SetDatagramEnabled(true))
 		fallthrough
 	default:
@@ -126,34 +361,164 @@ func serve() error {
 		runner = s
 	}
 
-	return runner.Run()
+	if s, ok := runner.(*transport.QUICServer); ok && WebTransport {
+		log.Printf("WebTransport certificate hash: %v\n", base64.StdEncoding.EncodeToString(s.CertificateHash()))
+		if len(WebAddr) > 0 {
+			go func() {
+				err := serveWebReceiver(WebAddr, WebRoot, s.CertificateHash())
+				if err != nil {
+					log.Printf("web receiver server failed: %v\n", err)
+				}
+			}()
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("%v, shutting down\n", sig)
+		case <-done:
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		defer cancel()
+		err := runner.Shutdown(ctx)
+		if err != nil {
+			log.Printf("closed open sessions: %v\n", err)
+		}
+	}()
+
+	err = runner.Run(context.Background())
+	if errors.Is(err, transport.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
+const (
+	// simulcastSSRCBase is the SSRC of the first simulcast layer, the
+	// following layers use consecutive SSRCs.
+	simulcastSSRCBase = 1000
+	// videoSSRC is the SSRC of the video track
+	videoSSRC = 1
+	// audioSSRC is the SSRC of the audio track
+	audioSSRC = 2
+)
+
 type Src struct {
-	scream           bool
+	ccFactory        transport.CongestionControllerFactory
 	requestKeyFrames bool
-	ScreamLogWriter  io.Writer
+	CCLogWriter      io.Writer
 	videoSrc         string
 	bitrate          int
+	mtu              uint
+	codec            gst.Codec
+	fecGroupSize     int
+	rtxMaxAge        time.Duration
+	broadcaster      *transport.Broadcaster
+	simulcastLayers  []transport.SimulcastLayer
+	requestKeyFrame  func()
+	isKeyFrame       transport.KeyFrameDetector
+	svcPattern       []int
+	audioSrc         string
+	audioBitrate     int
+	reportLogWriter  io.Writer
 	ackChan          <-chan []*transport.Packet
 }
 
-func (s *Src) MakeSrc(w io.WriteCloser, fb <-chan []byte) func() {
-	if s.scream {
-		return s.MakeScreamSrc(w, fb)
+// MakeSrc creates the sources of a session. Sender reports are sent for all
+// streams and receiver reports are removed from the feedback before any other
+// processing.
+func (s *Src) MakeSrc(ctx context.Context, w io.WriteCloser, fb <-chan []byte) func() {
+	clockRates := map[uint8]uint32{
+		s.codec.PayloadType: s.codec.ClockRate,
+	}
+	if len(s.audioSrc) > 0 {
+		clockRates[gst.Opus.PayloadType] = gst.Opus.ClockRate
+	}
+	sr := transport.NewSenderReportWriter(w, clockRates)
+	sr.SetReportLogger(s.reportLogWriter)
+	fb = sr.FilterFeedback(ctx, fb)
+	go sr.Run(ctx)
+	if len(s.audioSrc) == 0 {
+		return s.makeVideoSrc(ctx, sr, fb, nil)
+	}
+	// Audio is neither queued by the congestion controller nor protected by
+	// FEC or retransmissions, it shares the session with the video packets
+	// and the sender reports. The congestion controller counts the audio
+	// packets and reduces the video bitrate accordingly. The session is closed
+	// at the end of the video.
+	audioWriter := transport.NewCrossTrafficWriter(util.NopWriteCloser(sr))
+	audio := gst.NewSrcPipeline(audioWriter, s.audioSrc, gst.Opus, s.audioBitrate, s.mtu)
+	audio.SetSSRC(audioSSRC)
+	audio.Start()
+	cancel := s.makeVideoSrc(ctx, sr, fb, audioWriter)
+	return func() {
+		audio.Stop()
+		audio.Destroy()
+		cancel()
+	}
+}
+
+func (s *Src) makeVideoSrc(ctx context.Context, sr *transport.SenderReportWriter, fb <-chan []byte, audio *transport.CrossTrafficWriter) func() {
+	var w io.WriteCloser = sr
+	if s.rtxMaxAge > 0 {
+		rtx := transport.NewRTXSendWriter(w, rand.Uint32(), s.rtxMaxAge)
+		fb = rtx.FilterFeedback(ctx, fb)
+		w = rtx
+	}
+	var fec *transport.FECSendWriter
+	if s.fecGroupSize > 0 {
+		var err error
+		fec, err = transport.NewFECSendWriter(w, s.fecGroupSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		w = fec
+	}
+	if s.simulcastLayers != nil {
+		return s.MakeSimulcastSrc(ctx, w, fb, fec, sr, audio)
+	}
+	if s.broadcaster != nil {
+		return s.broadcaster.MakeSrc(ctx, w, fb)
+	}
+	if s.ccFactory != nil {
+		return s.MakeCCSrc(ctx, w, fb, fec, sr, audio)
+	}
+	return s.MakeSimpleSrc(ctx, w, fb)
+}
+
+// newPipeline creates a pipeline writing to w, using temporal scalability if
+// a layer pattern is configured.
+func (s *Src) newPipeline(w io.WriteCloser) *gst.SrcPipeline {
+	var p *gst.SrcPipeline
+	if s.svcPattern != nil {
+		p = gst.NewSVCSrcPipeline(w, s.videoSrc, s.bitrate, s.mtu, s.svcPattern)
+	} else {
+		p = gst.NewSrcPipeline(w, s.videoSrc, s.codec, s.bitrate, s.mtu)
 	}
-	return s.MakeSimpleSrc(w, fb)
+	p.SetSSRC(videoSSRC)
+	return p
 }
 
-func (s *Src) MakeSimpleSrc(w io.WriteCloser, fb <-chan []byte) func() {
+func (s *Src) MakeSimpleSrc(ctx context.Context, w io.WriteCloser, fb <-chan []byte) func() {
 
-	p := gst.NewSrcPipeline(w, s.videoSrc, s.bitrate)
+	p := s.newPipeline(w)
 
 	p.Start()
 	go func() {
 		for {
+			select {
 			// ignore feedback chan to avoid getting stuck when channel is full
-			<-fb
+			case <-fb:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
@@ -163,28 +528,105 @@ func (s *Src) MakeSimpleSrc(w io.WriteCloser, fb <-chan []byte) func() {
 	}
 }
 
-func (s *Src) MakeScreamSrc(w io.WriteCloser, fb <-chan []byte) func() {
-	ssrc := uint(1)
-	cc := transport.NewScreamWriter(ssrc, s.bitrate, w, fb, s.ScreamLogWriter)
+// MakeCCSrc creates a source using congestion control. If fec is not nil, the
+// protection overhead is subtracted from the target bitrate of the encoder.
+// The sender reports of sr map RTP timestamps to the time packets leave the
+// pipeline, before they are queued by the congestion controller. If audio is
+// not nil, the controller counts the audio packets as cross traffic.
+func (s *Src) MakeCCSrc(ctx context.Context, w io.WriteCloser, fb <-chan []byte, fec *transport.FECSendWriter, sr *transport.SenderReportWriter, audio *transport.CrossTrafficWriter) func() {
+	cc := transport.NewCCSendWriter(s.ccFactory, videoSSRC, s.bitrate, w, fb, s.CCLogWriter)
 	cc.SetReceiveTimeInferFn(transport.FeedbackAlgorithm(FeedbackAlgorithm))
+	if audio != nil {
+		cc.SetCrossTraffic(audio)
+	}
 
-	p := gst.NewSrcPipeline(cc, s.videoSrc, s.bitrate)
-	p.SetSSRC(ssrc)
+	p := s.newPipeline(sr.Capture(cc))
 	if s.requestKeyFrames {
 		cc.SetKeyFrameRequester(p.ForceKeyFrame)
 	}
+	if s.svcPattern != nil {
+		cc.SetTemporalLayers(transport.NewTemporalLayerTagger(), MaxLayerDelay)
+	}
 	p.Start()
 
 	if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive {
-		go cc.RunInferFeedback(s.ackChan)
+		go cc.RunInferFeedback(ctx, s.ackChan)
 	} else {
-		go cc.RunReceiveFeedback()
+		go cc.RunReceiveFeedback(ctx)
 	}
 
-	go cc.RunBitrate(p.SetBitRate)
+	if fec != nil {
+		go cc.RunBitrate(ctx, func(bitrate uint) {
+			p.SetBitRate(fec.MediaBitrate(bitrate))
+		})
+	} else {
+		go cc.RunBitrate(ctx, p.SetBitRate)
+	}
 
 	return func() {
 		p.Stop()
 		p.Destroy()
 	}
 }
+
+// MakeSimulcastSrc adds a session to the simulcast broadcast. The layer sent to
+// the session is selected by the target bitrate of its congestion controller
+// or by the initial bitrate if congestion control is disabled.
+func (s *Src) MakeSimulcastSrc(ctx context.Context, w io.WriteCloser, fb <-chan []byte, fec *transport.FECSendWriter, sr *transport.SenderReportWriter, audio *transport.CrossTrafficWriter) func() {
+	if s.ccFactory == nil {
+		selector := transport.NewSimulcastSelector(w, videoSSRC, s.simulcastLayers)
+		selector.SetKeyFrameDetector(s.isKeyFrame)
+		selector.SetKeyFrameRequester(s.requestKeyFrame)
+		selector.SetTargetBitrate(uint(s.bitrate))
+		return s.broadcaster.MakeSrc(ctx, selector, fb)
+	}
+
+	cc := transport.NewCCSendWriter(s.ccFactory, videoSSRC, s.bitrate, w, fb, s.CCLogWriter)
+	cc.SetReceiveTimeInferFn(transport.FeedbackAlgorithm(FeedbackAlgorithm))
+	if audio != nil {
+		cc.SetCrossTraffic(audio)
+	}
+	if s.requestKeyFrames {
+		cc.SetKeyFrameRequester(s.requestKeyFrame)
+	}
+	selector := transport.NewSimulcastSelector(sr.Capture(cc), videoSSRC, s.simulcastLayers)
+	selector.SetKeyFrameDetector(s.isKeyFrame)
+	selector.SetKeyFrameRequester(s.requestKeyFrame)
+	selector.SetTargetBitrate(uint(s.bitrate))
+
+	if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive {
+		go cc.RunInferFeedback(ctx, s.ackChan)
+	} else {
+		go cc.RunReceiveFeedback(ctx)
+	}
+
+	if fec != nil {
+		go cc.RunBitrate(ctx, func(bitrate uint) {
+			selector.SetTargetBitrate(fec.MediaBitrate(bitrate))
+		})
+	} else {
+		go cc.RunBitrate(ctx, selector.SetTargetBitrate)
+	}
+
+	// feedback is consumed by the congestion controller
+	return s.broadcaster.MakeSrc(ctx, selector, nil)
+}
+
+// parseSimulcastLayers parses a comma separated list of layers in the format
+// WIDTHxHEIGHT@KBITPS.
+func parseSimulcastLayers(spec string) ([]gst.SimulcastLayer, error) {
+	var layers []gst.SimulcastLayer
+	for i, l := range strings.Split(spec, ",") {
+		var layer gst.SimulcastLayer
+		_, err := fmt.Sscanf(strings.TrimSpace(l), "%dx%d@%d", &layer.Width, &layer.Height, &layer.Bitrate)
+		if err != nil {
+			return nil, fmt.Errorf("invalid simulcast layer '%v': %w", l, err)
+		}
+		if i > 0 && layer.Bitrate <= layers[i-1].Bitrate {
+			return nil, fmt.Errorf("simulcast layers have to be ordered by ascending bitrate: %v", spec)
+		}
+		layer.SSRC = uint(simulcastSSRCBase + i)
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
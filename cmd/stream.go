@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,10 +22,12 @@ var VideoSink string
 var FeedbackFreq int
 var SendImmediateFeedback bool
 var RTCPLogFile string
+var AudioSink string
 
 func init() {
 	rootCmd.AddCommand(streamCmd)
 	streamCmd.Flags().StringVar(&VideoSink, "video-sink", "autovideosink", "File to save video")
+	streamCmd.Flags().StringVar(&AudioSink, "audio-sink", "autoaudiosink", "File to save audio as WAV, only used with --audio")
 	streamCmd.Flags().IntVarP(&FeedbackFreq, "feedback-frequency", "f", 500, "Frequency in which scream feedback is sent in ms")
 	streamCmd.Flags().BoolVarP(&SendImmediateFeedback, "immediate-feedback", "i", false, "Send SCReAM Feedback immediately when a new RTP Packet was received.")
 	streamCmd.Flags().StringVar(&RTCPLogFile, "rtcp-logger", "stdout", "Log file for rtcp statistics, 'stdout' prints to stdout, otherwise creates a new file")
@@ -45,58 +49,164 @@ func run() error {
 	} else {
 		VideoSink = "videoconvert ! autovideosink"
 	}
+	if AudioSink != "autoaudiosink" {
+		AudioSink = fmt.Sprintf("audioconvert ! wavenc ! filesink location=%v", AudioSink)
+	} else {
+		AudioSink = "audioconvert ! autoaudiosink"
+	}
+	codec, err := gst.GetCodec(Codec)
+	if err != nil {
+		return err
+	}
 	gst.StartMainLoop()
-	pipeline := gst.CreateSinkPipeline(VideoSink)
+	var pipeline *gst.SinkPipeline
+	if Audio {
+		pipeline = gst.CreateAVSinkPipeline(codec, VideoSink, gst.Opus, AudioSink)
+	} else {
+		pipeline = gst.CreateSinkPipeline(codec, VideoSink)
+	}
 	destroyed := make(chan struct{}, 1)
 	gst.HandleSinkEOS(func() {
 		pipeline.Destroy()
 		destroyed <- struct{}{}
 	})
 	pipeline.Start()
-	var closeChans []chan<- struct{}
+	// ctx is cancelled on interrupt or when the client is done and stops the
+	// client and all goroutines sending feedback
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Retransmissions are restored and FEC packets are removed before any
+	// other processing of received packets
+	var rtx *transport.RTXReceiveWriter
+	var fec *transport.FECReceiveWriter
+	withRecovery := func(w io.Writer) io.Writer {
+		if Handler != "udp" && Handler != "datagram" {
+			return w
+		}
+		if FECGroupSize > 0 {
+			fec = transport.NewFECReceiveWriter(w)
+			w = fec
+		}
+		if RTX {
+			rtx = transport.NewRTXReceiveWriter(w)
+			w = rtx
+		}
+		return w
+	}
+	clockRates := map[uint8]uint32{
+		codec.PayloadType: codec.ClockRate,
+	}
+	// Audio packets are split from the video packets before any other
+	// processing except for reports
+	var av *transport.AVDemuxer
+	withAudio := func(w io.Writer) io.Writer {
+		if !Audio {
+			return w
+		}
+		clockRates[gst.Opus.PayloadType] = gst.Opus.ClockRate
+		av = transport.NewAVDemuxer(w, pipeline.AudioWriter(), gst.Opus.PayloadType, clockRates)
+		return av
+	}
+	// Sender reports are removed and reception statistics are collected
+	// before any other processing
+	reportLogWriter, err := getLogWriter(ReportLogFile)
+	if err != nil {
+		return err
+	}
+	var rr *transport.ReceiverReportWriter
+	withReports := func(w io.Writer) io.Writer {
+		rr = transport.NewReceiverReportWriter(w, clockRates)
+		rr.SetReportLogger(reportLogWriter)
+		if av != nil {
+			rr.SetSenderReportHandler(av.HandleSenderReport)
+		}
+		return rr
+	}
+
+	srtpKey, err := srtpPreSharedKey()
+	if err != nil {
+		return err
+	}
+	var srtpLogWriter io.Writer
+	if srtpKey != nil {
+		srtpLogWriter, err = getLogWriter(SRTPLogFile)
+		if err != nil {
+			return err
+		}
+	}
 
 	var client FeedbackRunner
-	if Scream {
+	if congestionController() != "none" {
 		screamWriter := transport.NewScreamReadWriter(pipeline, time.Duration(FeedbackFreq)*time.Millisecond, SendImmediateFeedback)
-		closeChans = append(closeChans, screamWriter.CloseChan)
-		client = newClient(Handler, Addr, screamWriter, QLOGFile)
-		sender, c, err := client.RunFeedbackSender()
+		client, err = newClient(Handler, Addr, withReports(withAudio(withRecovery(screamWriter))), QLOGFile, srtpKey, srtpLogWriter)
+		if err != nil {
+			return err
+		}
+		sender, err := client.RunFeedbackSender(ctx)
 		if err != nil {
 			return err
 		}
-		closeChans = append(closeChans, c)
 		writer, cancel, err := getRTCPStatWriter(sender, RTCPLogFile)
 		if err != nil {
 			return err
 		}
 		defer cancel()
+		if rtx != nil {
+			rtx.SetNACKWriter(writer)
+		}
+		rr.SetFeedbackWriter(writer)
 		if transport.FeedbackAlgorithm(FeedbackAlgorithm) != transport.Receive {
-			go screamWriter.RunMinimalFeedback(writer)
+			go screamWriter.RunMinimalFeedback(ctx, writer)
 		} else {
-			go screamWriter.RunFullFeedback(writer)
+			go screamWriter.RunFullFeedback(ctx, writer)
 		}
 	} else {
-		client = newClient(Handler, Addr, pipeline, QLOGFile)
+		client, err = newClient(Handler, Addr, withReports(withAudio(withRecovery(pipeline))), QLOGFile, srtpKey, srtpLogWriter)
+		if err != nil {
+			return err
+		}
+		sender, err := client.RunFeedbackSender(ctx)
+		if err != nil {
+			return err
+		}
+		if rtx != nil {
+			rtx.SetNACKWriter(sender)
+		}
+		rr.SetFeedbackWriter(sender)
 	}
-	closeChans = append(closeChans, client.CloseChan())
+	go rr.Run(ctx.Done())
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
 
 	done := make(chan struct{}, 1)
-	var err error
 	go func() {
-		err = client.Run()
+		err = client.Run(ctx)
+		cancel()
 		log.Println("client run done")
-		close(done)
-		for _, c := range closeChans {
-			close(c)
+		reportSessionEnd(err)
+		if rtx != nil {
+			log.Println(rtx.Stats())
+		}
+		if fec != nil {
+			log.Println(fec.Stats())
+		}
+		if av != nil {
+			log.Println(av.Stats())
+		}
+		for _, stats := range rr.Stats() {
+			log.Println(stats)
 		}
+		close(done)
 	}()
 
 	select {
 	case sig := <-signals:
 		log.Println(sig)
+		cancel()
+		<-done
 	case <-done:
 	}
 
@@ -105,13 +215,34 @@ func run() error {
 	<-destroyed
 
 	log.Println("exiting")
+	if errors.Is(err, context.Canceled) {
+		// the client was interrupted
+		return nil
+	}
 	return err
 }
 
+// reportSessionEnd tells whether the stream finished, the client was
+// interrupted, the server failed or the session timed out.
+func reportSessionEnd(err error) {
+	var byeErr *transport.ByeError
+	switch {
+	case err == nil:
+		fmt.Fprintln(os.Stderr, "session ended: stream finished")
+	case errors.Is(err, context.Canceled):
+		fmt.Fprintln(os.Stderr, "session ended: closed by client")
+	case errors.As(err, &byeErr):
+		fmt.Fprintf(os.Stderr, "session ended: %v\n", byeErr.Bye)
+	case errors.Is(err, transport.ErrSessionTimeout):
+		fmt.Fprintf(os.Stderr, "session ended: timeout: %v\n", err)
+	default:
+		fmt.Fprintf(os.Stderr, "session ended: error: %v\n", err)
+	}
+}
+
 type FeedbackRunner interface {
-	Runner
-	RunFeedbackSender() (io.Writer, chan<- struct{}, error)
-	CloseChan() chan struct{}
+	Run(ctx context.Context) error
+	RunFeedbackSender(ctx context.Context) (io.Writer, error)
 }
 
 type rtcpStatsWriter struct {
@@ -161,15 +292,50 @@ func getRTCPStatWriter(w io.Writer, rtcpStatsFile string) (io.Writer, func(), er
 	return io.MultiWriter(w, rtcpWriter), rtcpWriter.Close, nil
 }
 
-func newClient(handler string, addr string, w io.Writer, qlogFile string) FeedbackRunner {
+// getLogWriter returns stdout for 'stdout' and a new file otherwise.
+func getLogWriter(file string) (io.Writer, error) {
+	if file == "stdout" {
+		return os.Stdout, nil
+	}
+	return os.Create(file)
+}
+
+func newClient(handler string, addr string, w io.Writer, qlogFile string, srtpKey []byte, srtpLogWriter io.Writer) (FeedbackRunner, error) {
+	var mode transport.QUICMode
 	switch handler {
 	case "udp":
-		return transport.NewUDPClient(addr, w)
+		c := transport.NewUDPClient(addr, w)
+		if err := c.SetIdleTimeout(IdleTimeout); err != nil {
+			return nil, err
+		}
+		if srtpKey != nil {
+			if err := c.EnableSRTP(srtpKey, srtpLogWriter); err != nil {
+				return nil, err
+			}
+		}
+		return c, nil
+	case "tcp":
+		return transport.NewTCPClient(addr, w), nil
 	case "streamperframe":
-		return transport.NewQUICClient(addr, w, false, qlogFile)
+		mode = transport.StreamPerFrameMode
+	case "streamperpacket":
+		mode = transport.StreamPerPacketMode
+	case "singlestream":
+		mode = transport.SingleStreamMode
+	case "hybrid":
+		mode = transport.HybridMode
 	case "datagram":
 		fallthrough
 	default:
-		return transport.NewQUICClient(addr, w, true, qlogFile)
+		mode = transport.DatagramMode
+	}
+	c := transport.NewQUICClient(addr, w, mode, qlogFile)
+	c.SetFrameDeadline(FrameDeadline)
+	if RoQ {
+		c.EnableRoQ(RoQFlowID)
+	}
+	if FragmentSize > 0 {
+		c.EnableReassembly()
 	}
+	return c, nil
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/mengelbart/cgo-streamer/gst"
+)
+
+// webTransportPath is the path of WebTransport sessions
+const webTransportPath = "/stream"
+
+// webReceiverConfig tells the browser receiver how to reach and decode the
+// stream of the server.
+type webReceiverConfig struct {
+	Port            string `json:"port"`
+	Path            string `json:"path"`
+	CertificateHash string `json:"certificateHash"`
+	Handler         string `json:"handler"`
+	Codec           string `json:"codec"`
+	PayloadType     uint8  `json:"payloadType"`
+	Feedback        bool   `json:"feedback"`
+}
+
+// serveWebReceiver serves the browser receiver from root and its
+// configuration on /config.json.
+func serveWebReceiver(addr, root string, certificateHash []byte) error {
+	_, port, err := net.SplitHostPort(Addr)
+	if err != nil {
+		return err
+	}
+	codec, err := gst.GetCodec(Codec)
+	if err != nil {
+		return err
+	}
+	config := webReceiverConfig{
+		Port:            port,
+		Path:            webTransportPath,
+		CertificateHash: base64.StdEncoding.EncodeToString(certificateHash),
+		Handler:         Handler,
+		Codec:           Codec,
+		PayloadType:     codec.PayloadType,
+		Feedback:        congestionController() != "none",
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir(root)))
+	mux.HandleFunc("/config.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(config)
+		if err != nil {
+			log.Printf("could not write web receiver config: %v\n", err)
+		}
+	})
+	log.Printf("serving web receiver on http://%v\n", addr)
+	return http.ListenAndServe(addr, mux)
+}
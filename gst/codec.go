@@ -0,0 +1,165 @@
+package gst
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Codec describes the GStreamer elements and the RTP payload format used to
+// send and receive a video or audio codec.
+type Codec struct {
+	Name string
+	// EncodingName is the RTP encoding name of the payload format
+	EncodingName string
+	PayloadType  uint8
+	// Media is the RTP media type, video or audio
+	Media string
+	// ClockRate is the RTP clock rate in Hz
+	ClockRate uint32
+
+	encoder        string
+	encoderOptions string
+	// bitrateProperty is the encoder property holding the bitrate in units
+	// of bitrateScale bit/s
+	bitrateProperty string
+	bitrateScale    uint
+
+	payloader        string
+	payloaderOptions string
+
+	// depayloader includes a parser if the decoder requires one
+	depayloader string
+	decoder     string
+
+	// allHeaders requests parameter sets to be sent with forced key frames
+	allHeaders bool
+}
+
+var codecs = map[string]Codec{
+	"h264": {
+		Name:            "h264",
+		EncodingName:    "H264",
+		PayloadType:     96,
+		Media:           "video",
+		ClockRate:       90000,
+		encoder:         "x264enc",
+		encoderOptions:  "pass=5 speed-preset=4 tune=4",
+		bitrateProperty: "bitrate",
+		bitrateScale:    1000,
+		payloader:       "rtph264pay",
+		depayloader:     "rtph264depay ! h264parse",
+		decoder:         "avdec_h264",
+		allHeaders:      true,
+	},
+	"vp8": {
+		Name:             "vp8",
+		EncodingName:     "VP8",
+		PayloadType:      97,
+		Media:            "video",
+		ClockRate:        90000,
+		encoder:          "vp8enc",
+		encoderOptions:   "deadline=1 error-resilient=default keyframe-max-dist=3000",
+		bitrateProperty:  "target-bitrate",
+		bitrateScale:     1,
+		payloader:        "rtpvp8pay",
+		payloaderOptions: "picture-id-mode=15-bit",
+		depayloader:      "rtpvp8depay",
+		decoder:          "vp8dec",
+	},
+	"vp9": {
+		Name:             "vp9",
+		EncodingName:     "VP9",
+		PayloadType:      98,
+		Media:            "video",
+		ClockRate:        90000,
+		encoder:          "vp9enc",
+		encoderOptions:   "deadline=1 cpu-used=8 error-resilient=default keyframe-max-dist=3000",
+		bitrateProperty:  "target-bitrate",
+		bitrateScale:     1,
+		payloader:        "rtpvp9pay",
+		payloaderOptions: "picture-id-mode=15-bit",
+		depayloader:      "rtpvp9depay",
+		decoder:          "vp9dec",
+	},
+	"h265": {
+		Name:            "h265",
+		EncodingName:    "H265",
+		PayloadType:     99,
+		Media:           "video",
+		ClockRate:       90000,
+		encoder:         "x265enc",
+		encoderOptions:  "speed-preset=superfast tune=zerolatency",
+		bitrateProperty: "bitrate",
+		bitrateScale:    1000,
+		payloader:       "rtph265pay",
+		depayloader:     "rtph265depay ! h265parse",
+		decoder:         "avdec_h265",
+		allHeaders:      true,
+	},
+	"av1": {
+		Name:            "av1",
+		EncodingName:    "AV1",
+		PayloadType:     100,
+		Media:           "video",
+		ClockRate:       90000,
+		encoder:         "av1enc",
+		encoderOptions:  "usage-profile=realtime cpu-used=8 end-usage=cbr lag-in-frames=0",
+		bitrateProperty: "target-bitrate",
+		bitrateScale:    1000,
+		payloader:       "rtpav1pay",
+		depayloader:     "rtpav1depay",
+		decoder:         "av1dec",
+	},
+}
+
+// Opus is the audio codec used by audio pipelines.
+var Opus = Codec{
+	Name:            "opus",
+	EncodingName:    "OPUS",
+	PayloadType:     111,
+	Media:           "audio",
+	ClockRate:       48000,
+	encoder:         "opusenc",
+	encoderOptions:  "frame-size=20",
+	bitrateProperty: "bitrate",
+	bitrateScale:    1,
+	payloader:       "rtpopuspay",
+	depayloader:     "rtpopusdepay",
+	decoder:         "opusdec",
+}
+
+// GetCodec returns the video codec with the given name.
+func GetCodec(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return Codec{}, fmt.Errorf("unknown codec: %v", name)
+	}
+	return c, nil
+}
+
+// Codecs returns the sorted names of all supported video codecs.
+func Codecs() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// encoderElement returns the description of an encoder element with the given
+// name and initial bitrate in kbit/s.
+func (c Codec) encoderElement(name string, bitrate int) string {
+	return fmt.Sprintf("%v name=%v %v %v=%v", c.encoder, name, c.encoderOptions, c.bitrateProperty, bitrate*1000/int(c.bitrateScale))
+}
+
+// payloaderElement returns the description of a payloader element with the
+// given name creating packets of at most mtu bytes.
+func (c Codec) payloaderElement(name string, mtu uint) string {
+	return fmt.Sprintf("%v name=%v pt=%v mtu=%v %v", c.payloader, name, c.PayloadType, mtu, c.payloaderOptions)
+}
+
+// caps returns the RTP caps of the payload format.
+func (c Codec) caps() string {
+	return fmt.Sprintf("application/x-rtp,media=%v,clock-rate=%v,encoding-name=%v,payload=%v", c.Media, c.ClockRate, c.EncodingName, c.PayloadType)
+}
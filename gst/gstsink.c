@@ -54,8 +54,8 @@ void go_gst_destroy_sink_pipeline(GstElement* pipeline) {
     gst_object_unref(pipeline);
 }
 
-void go_gst_receive_push_buffer(GstElement *pipeline, void *buffer, int len) {
-    GstElement *src = gst_bin_get_by_name(GST_BIN(pipeline), "src");
+void go_gst_receive_push_buffer(GstElement *pipeline, char *name, void *buffer, int len) {
+    GstElement *src = gst_bin_get_by_name(GST_BIN(pipeline), name);
     if (src != NULL) {
         gpointer p = g_memdup(buffer, len);
         GstBuffer *buffer = gst_buffer_new_wrapped(p, len);
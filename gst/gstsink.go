@@ -7,11 +7,31 @@ package gst
 */
 import "C"
 import (
+	"fmt"
+	"io"
 	"log"
+	"unsafe"
 )
 
-func CreateSinkPipeline(videoSink string) *SinkPipeline {
-	pipelineStr := "appsrc name=src ! application/x-rtp ! rtpjitterbuffer ! queue ! rtph264depay ! h264parse ! avdec_h264 ! " + videoSink
+// CreateSinkPipeline creates a pipeline decoding RTP packets of codec to
+// videoSink.
+func CreateSinkPipeline(codec Codec, videoSink string) *SinkPipeline {
+	pipelineStr := fmt.Sprintf("appsrc name=src ! %v ! rtpjitterbuffer ! queue ! %v ! %v ! %v", codec.caps(), codec.depayloader, codec.decoder, videoSink)
+	log.Printf("creating pipeline: '%v'\n", pipelineStr)
+	return &SinkPipeline{
+		pipeline: C.go_gst_create_sink_pipeline(C.CString(pipelineStr)),
+	}
+}
+
+// CreateAVSinkPipeline creates a pipeline decoding RTP packets of video to
+// videoSink and RTP packets of audio to audioSink. Audio packets have to be
+// written to the writer returned by AudioWriter.
+func CreateAVSinkPipeline(video Codec, videoSink string, audio Codec, audioSink string) *SinkPipeline {
+	pipelineStr := fmt.Sprintf(
+		"appsrc name=src ! %v ! rtpjitterbuffer ! queue ! %v ! %v ! %v appsrc name=audiosrc ! %v ! rtpjitterbuffer ! queue ! %v ! %v ! %v",
+		video.caps(), video.depayloader, video.decoder, videoSink,
+		audio.caps(), audio.depayloader, audio.decoder, audioSink,
+	)
 	log.Printf("creating pipeline: '%v'\n", pipelineStr)
 	return &SinkPipeline{
 		pipeline: C.go_gst_create_sink_pipeline(C.CString(pipelineStr)),
@@ -52,9 +72,30 @@ var countSink = 0
 func (p *SinkPipeline) Write(buffer []byte) (n int, err error) {
 	countSink++
 	//log.Printf("%v: writing %v bytes to pipeline\n", countSink, len(buffer))
-	b := C.CBytes(buffer)
-	defer C.free(b)
-	C.go_gst_receive_push_buffer(p.pipeline, b, C.int(len(buffer)))
+	p.push("src", buffer)
 	numBytes += len(buffer)
 	return len(buffer), nil
 }
+
+// AudioWriter returns a writer for the audio packets of a pipeline created by
+// CreateAVSinkPipeline.
+func (p *SinkPipeline) AudioWriter() io.Writer {
+	return audioWriter{p}
+}
+
+type audioWriter struct {
+	p *SinkPipeline
+}
+
+func (a audioWriter) Write(buffer []byte) (int, error) {
+	a.p.push("audiosrc", buffer)
+	return len(buffer), nil
+}
+
+func (p *SinkPipeline) push(src string, buffer []byte) {
+	name := C.CString(src)
+	defer C.free(unsafe.Pointer(name))
+	b := C.CBytes(buffer)
+	defer C.free(b)
+	C.go_gst_receive_push_buffer(p.pipeline, name, b, C.int(len(buffer)))
+}
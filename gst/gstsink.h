@@ -9,6 +9,6 @@ GstElement *go_gst_create_sink_pipeline(char *pipelineStr);
 void go_gst_start_sink_pipeline(GstElement* pipeline);
 void go_gst_stop_sink_pipeline(GstElement* pipeline);
 void go_gst_destroy_sink_pipeline(GstElement* pipeline);
-void go_gst_receive_push_buffer(GstElement *pipeline, void *buffer, int len);
+void go_gst_receive_push_buffer(GstElement *pipeline, char *name, void *buffer, int len);
 
 #endif
\ No newline at end of file
@@ -88,28 +88,33 @@ void go_gst_destroy_src_pipeline(GstElement* pipeline) {
     gst_object_unref(pipeline);
 }
 
-void go_gst_force_key_frame(GstElement* pipeline) {
+void go_gst_force_key_frame(GstElement* pipeline, int all_headers) {
     GstStructure *s;
     GstEvent *force_key_unit_event;
 
-    s = gst_structure_new ("GstForceKeyUnit", "all-headers", G_TYPE_BOOLEAN, TRUE, NULL);
+    s = gst_structure_new ("GstForceKeyUnit", "all-headers", G_TYPE_BOOLEAN, all_headers, NULL);
     force_key_unit_event = gst_event_new_custom (GST_EVENT_CUSTOM_UPSTREAM, s);
     gst_element_send_event(pipeline, force_key_unit_event);
 }
 
-unsigned int go_gst_get_ssrc(GstElement* pipeline) {
-    GstElement* rtph264pay = gst_bin_get_by_name(GST_BIN(pipeline), "rtph264pay");
+unsigned int go_gst_get_ssrc(GstElement* pipeline, char* payloader) {
+    GstElement* pay = gst_bin_get_by_name(GST_BIN(pipeline), payloader);
     unsigned int ssrc = 0;
-    g_object_get(rtph264pay, "ssrc", &ssrc, NULL);
+    g_object_get(pay, "ssrc", &ssrc, NULL);
     return ssrc;
 }
 
-void go_gst_set_ssrc(GstElement* pipeline, unsigned int ssrc) {
-    GstElement* rtph264pay = gst_bin_get_by_name(GST_BIN(pipeline), "rtph264pay");
-    g_object_set(rtph264pay, "ssrc", ssrc, NULL);
+void go_gst_set_ssrc(GstElement* pipeline, char* payloader, unsigned int ssrc) {
+    GstElement* pay = gst_bin_get_by_name(GST_BIN(pipeline), payloader);
+    g_object_set(pay, "ssrc", ssrc, NULL);
 }
 
-void go_gst_set_bitrate(GstElement* pipeline, unsigned int bitrate) {
-    GstElement* x264enc = gst_bin_get_by_name(GST_BIN(pipeline), "x264enc");
-    g_object_set(x264enc, "bitrate", bitrate, NULL);
+void go_gst_set_element_uint(GstElement* pipeline, char* name, char* property, unsigned int value) {
+    GstElement* element = gst_bin_get_by_name(GST_BIN(pipeline), name);
+    if (element == NULL) {
+        g_printerr("no element named %s\n", name);
+        return;
+    }
+    g_object_set(element, property, value, NULL);
+    gst_object_unref(element);
 }
\ No newline at end of file
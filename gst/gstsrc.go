@@ -12,6 +12,8 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"strings"
 	"sync"
 	"unsafe"
 )
@@ -24,24 +26,145 @@ type SrcPipeline struct {
 	id       int
 	pipeline *C.GstElement
 	writer   io.WriteCloser
+
+	// codec determines the names of the encoder element controlled by
+	// SetBitRate and of the payloader element setting the SSRC
+	codec Codec
+}
+
+// NewSrcPipeline creates a pipeline encoding src using codec with the given
+// initial bitrate and writing RTP packets of at most mtu bytes to w.
+func NewSrcPipeline(w io.WriteCloser, src string, codec Codec, bitrate int, mtu uint) *SrcPipeline {
+	srcPipelinesLock.Lock()
+	defer srcPipelinesLock.Unlock()
+	id := nextPipelineID
+	nextPipelineID++
+	pipelineStr := src + fmt.Sprintf(" ! %v ! %v ! appsink name=appsink", codec.encoderElement(codec.encoder, bitrate), codec.payloaderElement(codec.payloader, mtu))
+	log.Printf("creating pipeline: '%v'\n", pipelineStr)
+	sp := &SrcPipeline{
+		id:       id,
+		pipeline: C.go_gst_create_src_pipeline(C.CString(pipelineStr)),
+		writer:   w,
+		codec:    codec,
+	}
+	srcPipelines[sp.id] = sp
+	return sp
 }
 
-func NewSrcPipeline(w io.WriteCloser, src string, bitrate int) *SrcPipeline {
+// NewSVCSrcPipeline creates a pipeline encoding src with VP8 using temporal
+// scalability. pattern contains the temporal layer of each frame in a
+// periodic group of frames, e.g. [0, 2, 1, 2] for three layers where layer 2
+// frames are not referenced by other frames and layer 1 frames are only
+// referenced by layer 2 frames. bitrate is the initial bitrate of all layers
+// in kbit/s.
+func NewSVCSrcPipeline(w io.WriteCloser, src string, bitrate int, mtu uint, pattern []int) *SrcPipeline {
 	srcPipelinesLock.Lock()
 	defer srcPipelinesLock.Unlock()
 	id := nextPipelineID
 	nextPipelineID++
-	pipelineStr := src + fmt.Sprintf(" ! x264enc name=x264enc pass=5 speed-preset=4 bitrate=%v tune=4 ! rtph264pay name=rtph264pay mtu=1000 ! appsink name=appsink", bitrate)
+	layers := 0
+	var layerIDs []string
+	for _, l := range pattern {
+		if l+1 > layers {
+			layers = l + 1
+		}
+		layerIDs = append(layerIDs, strconv.Itoa(l))
+	}
+	var decimators, bitrates []string
+	for l := 0; l < layers; l++ {
+		frames := 0
+		for _, id := range pattern {
+			if id <= l {
+				frames++
+			}
+		}
+		decimators = append(decimators, strconv.Itoa(len(pattern)/frames))
+		bitrates = append(bitrates, strconv.Itoa(bitrate*1000*svcLayerBitrateShare(l, layers)/100))
+	}
+	codec := codecs["vp8"]
+	pipelineStr := src + fmt.Sprintf(
+		" ! %v temporal-scalability-number-layers=%v temporal-scalability-periodicity=%v"+
+			" temporal-scalability-layer-id=\"<%v>\" temporal-scalability-rate-decimator=\"<%v>\" temporal-scalability-target-bitrate=\"<%v>\""+
+			" ! %v ! appsink name=appsink",
+		codec.encoderElement(codec.encoder, bitrate), layers, len(pattern),
+		strings.Join(layerIDs, ","), strings.Join(decimators, ","), strings.Join(bitrates, ","),
+		codec.payloaderElement(codec.payloader, mtu),
+	)
 	log.Printf("creating pipeline: '%v'\n", pipelineStr)
 	sp := &SrcPipeline{
 		id:       id,
 		pipeline: C.go_gst_create_src_pipeline(C.CString(pipelineStr)),
 		writer:   w,
+		codec:    codec,
 	}
 	srcPipelines[sp.id] = sp
 	return sp
 }
 
+// svcLayerBitrateShare returns the share in percent of the total bitrate used
+// by all layers up to layer.
+func svcLayerBitrateShare(layer, layers int) int {
+	switch {
+	case layer == layers-1:
+		return 100
+	case layers == 2:
+		return 60
+	case layer == 0:
+		return 40
+	default:
+		return 60
+	}
+}
+
+// SimulcastLayer describes one encoding of a simulcast pipeline.
+type SimulcastLayer struct {
+	Width  int
+	Height int
+	// Bitrate is the initial bitrate of the encoder in kbit/s
+	Bitrate int
+	SSRC    uint
+}
+
+// NewSimulcastSrcPipeline creates a pipeline encoding src using codec once per
+// layer, scaled to the resolution of the layer. The RTP packets of all layers are
+// written to w and can be distinguished by SSRC. All layers use the same RTP
+// timestamp offset. The encoder of the first layer can be controlled by
+// SetBitRate, all layers by SetLayerBitRate.
+func NewSimulcastSrcPipeline(w io.WriteCloser, src string, codec Codec, layers []SimulcastLayer, mtu uint) *SrcPipeline {
+	srcPipelinesLock.Lock()
+	defer srcPipelinesLock.Unlock()
+	id := nextPipelineID
+	nextPipelineID++
+	pipelineStr := src + " ! tee name=simulcasttee funnel name=simulcastfunnel ! appsink name=appsink"
+	for i, l := range layers {
+		pipelineStr += fmt.Sprintf(
+			" simulcasttee. ! queue ! videoscale ! video/x-raw,width=%v,height=%v ! %v ! %v ssrc=%v timestamp-offset=0 ! simulcastfunnel.",
+			l.Width, l.Height,
+			codec.encoderElement(layerElementName(codec.encoder, i), l.Bitrate),
+			codec.payloaderElement(layerElementName(codec.payloader, i), mtu),
+			l.SSRC,
+		)
+	}
+	log.Printf("creating pipeline: '%v'\n", pipelineStr)
+	sp := &SrcPipeline{
+		id:       id,
+		pipeline: C.go_gst_create_src_pipeline(C.CString(pipelineStr)),
+		writer:   w,
+		codec:    codec,
+	}
+	srcPipelines[sp.id] = sp
+	return sp
+}
+
+// layerElementName returns the name of an element of a simulcast layer. The
+// elements of the first layer use the same names as a single layer pipeline.
+func layerElementName(element string, layer int) string {
+	if layer == 0 {
+		return element
+	}
+	return fmt.Sprintf("%v%v", element, layer)
+}
+
 func (p *SrcPipeline) Start() {
 	C.go_gst_start_src_pipeline(p.pipeline, C.int(p.id))
 }
@@ -50,8 +173,17 @@ func (p *SrcPipeline) Stop() {
 	C.go_gst_stop_src_pipeline(p.pipeline)
 }
 
+// ForceKeyFrame requests a key frame from the encoders of the pipeline. Codecs
+// with out-of-band parameter sets repeat them before the key frame.
 func (p *SrcPipeline) ForceKeyFrame() {
-	C.go_gst_force_key_frame(p.pipeline)
+	C.go_gst_force_key_frame(p.pipeline, C.int(boolToInt(p.codec.allHeaders)))
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
 }
 
 func (p *SrcPipeline) Destroy() {
@@ -59,15 +191,34 @@ func (p *SrcPipeline) Destroy() {
 }
 
 func (p *SrcPipeline) SSRC() uint {
-	return uint(C.go_gst_get_ssrc(p.pipeline))
+	payloader := C.CString(p.codec.payloader)
+	defer C.free(unsafe.Pointer(payloader))
+	return uint(C.go_gst_get_ssrc(p.pipeline, payloader))
 }
 
 func (p *SrcPipeline) SetSSRC(ssrc uint) {
-	C.go_gst_set_ssrc(p.pipeline, C.uint(ssrc))
+	payloader := C.CString(p.codec.payloader)
+	defer C.free(unsafe.Pointer(payloader))
+	C.go_gst_set_ssrc(p.pipeline, payloader, C.uint(ssrc))
 }
 
+// SetBitRate sets the bitrate of the encoder in kbit/s.
 func (p *SrcPipeline) SetBitRate(bitrate uint) {
-	C.go_gst_set_bitrate(p.pipeline, C.uint(bitrate))
+	p.setEncoderBitRate(p.codec.encoder, bitrate)
+}
+
+// SetLayerBitRate sets the bitrate of the encoder of a simulcast layer in
+// kbit/s.
+func (p *SrcPipeline) SetLayerBitRate(layer int, bitrate uint) {
+	p.setEncoderBitRate(layerElementName(p.codec.encoder, layer), bitrate)
+}
+
+func (p *SrcPipeline) setEncoderBitRate(encoder string, bitrate uint) {
+	name := C.CString(encoder)
+	defer C.free(unsafe.Pointer(name))
+	property := C.CString(p.codec.bitrateProperty)
+	defer C.free(unsafe.Pointer(property))
+	C.go_gst_set_element_uint(p.pipeline, name, property, C.uint(bitrate*1000/p.codec.bitrateScale))
 }
 
 var countSrc = 0
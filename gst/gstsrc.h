@@ -12,11 +12,11 @@ extern void goHandleSrcEOS(int pipelineId);
 GstElement* go_gst_create_src_pipeline(char *pipelineStr);
 void go_gst_start_src_pipeline(GstElement* pipeline, int pipelineId);
 void go_gst_stop_src_pipeline(GstElement* pipeline);
-void go_gst_force_key_frame(GstElement* pipeline);
+void go_gst_force_key_frame(GstElement* pipeline, int all_headers);
 void go_gst_destroy_src_pipeline(GstElement* pipeline);
 
-unsigned int go_gst_get_ssrc(GstElement* pipeline);
-void go_gst_set_ssrc(GstElement* pipeline, unsigned int ssrc);
-void go_gst_set_bitrate(GstElement* pipeline, unsigned int bitrate);
+unsigned int go_gst_get_ssrc(GstElement* pipeline, char* payloader);
+void go_gst_set_ssrc(GstElement* pipeline, char* payloader, unsigned int ssrc);
+void go_gst_set_element_uint(GstElement* pipeline, char* name, char* property, unsigned int value);
 
 #endif
\ No newline at end of file
@@ -0,0 +1,165 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// AVSyncStats holds the audio/video synchronization measured by an AVDemuxer.
+type AVSyncStats struct {
+	// SenderReports is the number of received RTCP Sender Reports.
+	SenderReports uint64
+	// Samples is the number of skew measurements.
+	Samples uint64
+	// Skew is the latest measured skew. Positive values mean that video is
+	// played out later than audio.
+	Skew time.Duration
+	// MeanSkew is the mean of all measured skews.
+	MeanSkew time.Duration
+	// MaxSkew is the measured skew with the largest absolute value.
+	MaxSkew time.Duration
+}
+
+func (s AVSyncStats) String() string {
+	return fmt.Sprintf("received %v sender reports, a/v skew over %v samples: last %v, mean %v, max %v", s.SenderReports, s.Samples, s.Skew, s.MeanSkew, s.MaxSkew)
+}
+
+// senderClock maps RTP timestamps of a stream to the clock of the sender
+// using the latest Sender Report of the stream.
+type senderClock struct {
+	ntp       time.Time
+	timestamp uint32
+	clockRate uint32
+}
+
+func (c *senderClock) time(timestamp uint32) time.Time {
+	diff := int32(timestamp - c.timestamp)
+	return c.ntp.Add(time.Duration(float64(diff) / float64(c.clockRate) * float64(time.Second)))
+}
+
+// AVDemuxer writes received audio RTP packets to the audio writer and all
+// other RTP packets to the video writer. RTCP Sender Reports passed to
+// HandleSenderReport are used to measure the skew between audio and video:
+// the delay from sending to receiving of each stream is calculated from the
+// sender time of the RTP timestamps, the skew is the difference of the delays
+// of video and audio.
+// It is sampled at the end of each video frame. Clock offsets between sender
+// and receiver cancel out, since both streams share the sender clock.
+type AVDemuxer struct {
+	lock       sync.Mutex
+	video      io.Writer
+	audio      io.Writer
+	audioPT    uint8
+	clockRates map[uint8]uint32
+	clocks     map[uint32]*senderClock
+
+	audioDelay time.Duration
+	hasAudio   bool
+
+	reports uint64
+	samples uint64
+	skew    time.Duration
+	sum     time.Duration
+	max     time.Duration
+}
+
+// NewAVDemuxer creates an AVDemuxer which detects audio packets by audioPT and
+// uses clockRates to map payload types to RTP clock rates in Hz.
+func NewAVDemuxer(video, audio io.Writer, audioPT uint8, clockRates map[uint8]uint32) *AVDemuxer {
+	return &AVDemuxer{
+		video:      video,
+		audio:      audio,
+		audioPT:    audioPT,
+		clockRates: clockRates,
+		clocks:     make(map[uint32]*senderClock),
+	}
+}
+
+func (d *AVDemuxer) Write(b []byte) (int, error) {
+	var header rtp.Header
+	err := header.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	d.onPacket(&header, time.Now())
+	if header.PayloadType == d.audioPT {
+		return d.audio.Write(b)
+	}
+	return d.video.Write(b)
+}
+
+// HandleSenderReport updates the mapping of RTP timestamps to the sender clock
+// of the stream of sr.
+func (d *AVDemuxer) HandleSenderReport(sr *rtcp.SenderReport) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.reports++
+	clock, ok := d.clocks[sr.SSRC]
+	if !ok {
+		// the clock rate is set by the RTP packets of the stream
+		clock = &senderClock{}
+		d.clocks[sr.SSRC] = clock
+	}
+	clock.ntp = fromNTP(sr.NTPTime)
+	clock.timestamp = sr.RTPTime
+}
+
+func (d *AVDemuxer) onPacket(header *rtp.Header, arrival time.Time) {
+	clockRate, ok := d.clockRates[header.PayloadType]
+	if !ok {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	clock, ok := d.clocks[header.SSRC]
+	if !ok {
+		return
+	}
+	clock.clockRate = clockRate
+	delay := arrival.Sub(clock.time(header.Timestamp))
+	if header.PayloadType == d.audioPT {
+		d.audioDelay = delay
+		d.hasAudio = true
+		return
+	}
+	if !header.Marker || !d.hasAudio {
+		return
+	}
+	d.skew = delay - d.audioDelay
+	d.samples++
+	d.sum += d.skew
+	if abs(d.skew) > abs(d.max) {
+		d.max = d.skew
+	}
+	if d.samples%100 == 0 {
+		log.Printf("a/v skew: %v\n", d.skew)
+	}
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+func (d *AVDemuxer) Stats() AVSyncStats {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	stats := AVSyncStats{
+		SenderReports: d.reports,
+		Samples:       d.samples,
+		Skew:          d.skew,
+		MaxSkew:       d.max,
+	}
+	if d.samples > 0 {
+		stats.MeanSkew = d.sum / time.Duration(d.samples)
+	}
+	return stats
+}
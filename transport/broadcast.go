@@ -0,0 +1,171 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtp"
+)
+
+// broadcastQueueSize is the number of packets buffered per session before
+// packets for that session are dropped.
+const broadcastQueueSize = 1024
+
+// Broadcaster fans out the RTP packets of a single source pipeline to all
+// sessions. It is used as the writer of the pipeline and as SrcFactory of the
+// handlers. Each session has its own queue, packets are dropped for sessions
+// which can not keep up instead of stalling the other sessions. New sessions
+// receive packets from the next key frame on, which is requested from the
+// encoder when a session joins.
+type Broadcaster struct {
+	lock            sync.Mutex
+	sessions        map[*broadcastSession]struct{}
+	closed          bool
+	requestKeyFrame func()
+	isKeyFrame      KeyFrameDetector
+}
+
+type broadcastSession struct {
+	w       io.WriteCloser
+	packets chan []byte
+	started bool
+	// eos is set if the broadcast ended before the session
+	eos     bool
+	done    chan struct{}
+	dropped uint64
+}
+
+func NewBroadcaster() *Broadcaster {
+	return &Broadcaster{
+		sessions:   make(map[*broadcastSession]struct{}),
+		isKeyFrame: isH264KeyFrameStart,
+	}
+}
+
+// SetKeyFrameDetector sets the function used to detect the key frames at which
+// new sessions start. The default detects H.264 key frames.
+func (b *Broadcaster) SetKeyFrameDetector(isKeyFrame KeyFrameDetector) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.isKeyFrame = isKeyFrame
+}
+
+// SetKeyFrameRequester sets the function used to request a key frame from the
+// encoder when a new session joins.
+func (b *Broadcaster) SetKeyFrameRequester(requestKeyFrame func()) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.requestKeyFrame = requestKeyFrame
+}
+
+// MakeSrc adds a session receiving the broadcast. Feedback is ignored, since
+// the bitrate of the shared encoder can not be adapted to a single session.
+func (b *Broadcaster) MakeSrc(ctx context.Context, w io.WriteCloser, feedback <-chan []byte) func() {
+	s := &broadcastSession{
+		w:       w,
+		packets: make(chan []byte, broadcastQueueSize),
+		done:    make(chan struct{}),
+	}
+	go s.run()
+	go func() {
+		for {
+			select {
+			// ignore feedback chan to avoid getting stuck when channel is full
+			case <-feedback:
+			case <-s.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		s.eos = true
+		close(s.packets)
+		return func() {}
+	}
+	b.sessions[s] = struct{}{}
+	requestKeyFrame := b.requestKeyFrame
+	log.Printf("session joined broadcast, %v sessions\n", len(b.sessions))
+	b.lock.Unlock()
+
+	if requestKeyFrame != nil {
+		requestKeyFrame()
+	}
+
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		if _, ok := b.sessions[s]; !ok {
+			return
+		}
+		delete(b.sessions, s)
+		close(s.packets)
+		log.Printf("session left broadcast, dropped %v packets, %v sessions\n", atomic.LoadUint64(&s.dropped), len(b.sessions))
+	}
+}
+
+// Write queues a copy of p for every session.
+func (b *Broadcaster) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	keyFrame := false
+	packet := &rtp.Packet{}
+	if err := packet.Unmarshal(p); err == nil {
+		keyFrame = b.isKeyFrame(packet.Payload)
+	}
+	for s := range b.sessions {
+		if !s.started {
+			if !keyFrame {
+				continue
+			}
+			s.started = true
+		}
+		buf := make([]byte, len(p))
+		copy(buf, p)
+		select {
+		case s.packets <- buf:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+	return len(p), nil
+}
+
+// Close ends the broadcast and closes the writers of all sessions.
+func (b *Broadcaster) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.closed = true
+	for s := range b.sessions {
+		delete(b.sessions, s)
+		s.eos = true
+		close(s.packets)
+	}
+	return nil
+}
+
+// run writes queued packets to the session until the queue is closed. The
+// writer is closed if the broadcast ended.
+func (s *broadcastSession) run() {
+	defer close(s.done)
+	for p := range s.packets {
+		_, err := s.w.Write(p)
+		if err != nil {
+			log.Printf("failed to write broadcast packet: %v\n", err)
+		}
+	}
+	if !s.eos {
+		return
+	}
+	err := s.w.Close()
+	if err != nil {
+		log.Printf("failed to close broadcast session: %v\n", err)
+	}
+}
@@ -2,11 +2,39 @@ package transport
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 
 	"github.com/pion/rtcp"
 )
 
+const (
+	// ccFeedbackFMT is the RTCP feedback message type of RFC 8888 congestion
+	// control feedback in a transport layer feedback packet
+	ccFeedbackFMT = 11
+
+	ccFeedbackHeaderLength   = 8
+	ssrcReportHeaderLength   = 8
+	streamReportLength       = 2
+	reportTimestampLength    = 4
+	maxStreamReportsPerBlock = 16384
+	maxArrivalTimeOffset     = 0x1FFF
+	maxECN                   = 0x3
+)
+
+var (
+	ErrFeedbackTooShort       = errors.New("feedback packet too short")
+	ErrFeedbackInvalidHeader  = errors.New("invalid feedback header")
+	ErrFeedbackInvalidLength  = errors.New("feedback length does not match header")
+	ErrFeedbackInvalidPadding = errors.New("invalid feedback padding")
+	ErrReportBlockTruncated   = errors.New("report block truncated")
+	ErrTooManyReports         = errors.New("too many reports in report block")
+	ErrReportCountMismatch    = errors.New("number of reports does not match NumReports")
+	ErrInvalidStreamReport    = errors.New("invalid stream report")
+)
+
+// CCFeedback is an RTCP Congestion Control Feedback packet as defined in
+// RFC 8888.
 type CCFeedback struct {
 	Header          *rtcp.Header
 	SenderSSRC      uint32
@@ -19,39 +47,90 @@ func (c *CCFeedback) String() string {
 	s += fmt.Sprintf("Header: %v\n", c.Header)
 	s += fmt.Sprintf("Reports: %v\n", len(c.Reports))
 	for _, r := range c.Reports {
-		//s += "{\n"
 		s += fmt.Sprintf("%v-%v\n", r.BeginSeq, r.NumReports)
-		//s += "}\n"
 	}
 	s += fmt.Sprintf("Timestamp: %v\n", c.ReportTimestamp)
 	return s
 }
 
+// MarshalBinary encodes the feedback packet. The header is generated from the
+// report blocks, c.Header is not used.
+func (c *CCFeedback) MarshalBinary() ([]byte, error) {
+	size := ccFeedbackHeaderLength + reportTimestampLength
+	for _, r := range c.Reports {
+		size += r.marshalSize()
+	}
+	h := rtcp.Header{
+		Count:  ccFeedbackFMT,
+		Type:   rtcp.TypeTransportSpecificFeedback,
+		Length: uint16(size/4 - 1),
+	}
+	hdr, err := h.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	copy(buf, hdr)
+	binary.BigEndian.PutUint32(buf[4:8], c.SenderSSRC)
+	i := ccFeedbackHeaderLength
+	for _, r := range c.Reports {
+		b, err := r.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		i += copy(buf[i:], b)
+	}
+	binary.BigEndian.PutUint32(buf[i:], c.ReportTimestamp)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a feedback packet. Trailing data after the length
+// given in the header, e.g. further packets of a compound RTCP packet, is
+// ignored.
 func (c *CCFeedback) UnmarshalBinary(data []byte) error {
-	c.Header = &rtcp.Header{}
-	err := c.Header.Unmarshal(data[:4])
+	if len(data) < ccFeedbackHeaderLength+reportTimestampLength {
+		return fmt.Errorf("%w: got %v bytes", ErrFeedbackTooShort, len(data))
+	}
+	h := &rtcp.Header{}
+	err := h.Unmarshal(data[:4])
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", ErrFeedbackInvalidHeader, err)
+	}
+	if h.Type != rtcp.TypeTransportSpecificFeedback || h.Count != ccFeedbackFMT {
+		return fmt.Errorf("%w: type %v, fmt %v", ErrFeedbackInvalidHeader, h.Type, h.Count)
+	}
+	length := (int(h.Length) + 1) * 4
+	if length > len(data) || length < ccFeedbackHeaderLength+reportTimestampLength {
+		return fmt.Errorf("%w: header announces %v bytes, got %v", ErrFeedbackInvalidLength, length, len(data))
+	}
+	data = data[:length]
+	if h.Padding {
+		padding := int(data[len(data)-1])
+		if padding == 0 || padding%4 != 0 || len(data)-padding < ccFeedbackHeaderLength+reportTimestampLength {
+			return fmt.Errorf("%w: %v bytes", ErrFeedbackInvalidPadding, padding)
+		}
+		data = data[:len(data)-padding]
 	}
 
+	c.Header = h
 	c.SenderSSRC = binary.BigEndian.Uint32(data[4:8])
-	c.ReportTimestamp = binary.BigEndian.Uint32(data[len(data)-4:])
+	c.ReportTimestamp = binary.BigEndian.Uint32(data[len(data)-reportTimestampLength:])
+	c.Reports = nil
 
-	for i := 8; i+4 < len(data); {
+	blocks := data[ccFeedbackHeaderLength : len(data)-reportTimestampLength]
+	for i := 0; i < len(blocks); {
 		r := &SSRCReport{}
-		err := r.UnmarshalBinary(data[i:])
+		err := r.UnmarshalBinary(blocks[i:])
 		if err != nil {
-			return err
-		}
-		i += 8 + int(r.NumReports)*2
-		if r.NumReports%2 != 0 {
-			i += 2
+			return fmt.Errorf("report block at offset %v: %w", ccFeedbackHeaderLength+i, err)
 		}
+		i += r.marshalSize()
 		c.Reports = append(c.Reports, r)
 	}
 	return nil
 }
 
+// SSRCReport is a report block for a single RTP stream.
 type SSRCReport struct {
 	StreamSSRC uint32
 	BeginSeq   uint16
@@ -67,14 +146,55 @@ func (s *SSRCReport) String() string {
 	return r
 }
 
+// marshalSize returns the size of the report block including padding to the
+// next 32 bit boundary.
+func (s *SSRCReport) marshalSize() int {
+	n := ssrcReportHeaderLength + int(s.NumReports)*streamReportLength
+	if s.NumReports%2 != 0 {
+		n += streamReportLength
+	}
+	return n
+}
+
+func (s *SSRCReport) MarshalBinary() ([]byte, error) {
+	if int(s.NumReports) != len(s.Reports) {
+		return nil, fmt.Errorf("%w: NumReports is %v, got %v reports", ErrReportCountMismatch, s.NumReports, len(s.Reports))
+	}
+	if s.NumReports > maxStreamReportsPerBlock {
+		return nil, fmt.Errorf("%w: %v", ErrTooManyReports, s.NumReports)
+	}
+	buf := make([]byte, s.marshalSize())
+	binary.BigEndian.PutUint32(buf[0:4], s.StreamSSRC)
+	binary.BigEndian.PutUint16(buf[4:6], s.BeginSeq)
+	binary.BigEndian.PutUint16(buf[6:8], s.NumReports)
+	for i, r := range s.Reports {
+		b, err := r.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("report %v: %w", i, err)
+		}
+		copy(buf[ssrcReportHeaderLength+i*streamReportLength:], b)
+	}
+	return buf, nil
+}
+
 func (s *SSRCReport) UnmarshalBinary(data []byte) error {
+	if len(data) < ssrcReportHeaderLength {
+		return fmt.Errorf("%w: got %v bytes of header", ErrReportBlockTruncated, len(data))
+	}
 	s.StreamSSRC = binary.BigEndian.Uint32(data[0:4])
 	s.BeginSeq = binary.BigEndian.Uint16(data[4:6])
 	s.NumReports = binary.BigEndian.Uint16(data[6:8])
-	for i := 0; i <= int(s.NumReports); i++ {
+	if s.NumReports > maxStreamReportsPerBlock {
+		return fmt.Errorf("%w: %v", ErrTooManyReports, s.NumReports)
+	}
+	if n := s.marshalSize(); len(data) < n {
+		return fmt.Errorf("%w: need %v bytes for %v reports, got %v", ErrReportBlockTruncated, n, s.NumReports, len(data))
+	}
+	s.Reports = make([]*StreamReport, 0, s.NumReports)
+	for i := 0; i < int(s.NumReports); i++ {
 		r := &StreamReport{}
-		n := 2*i + 8
-		err := r.UnmarshalBinary(data[n : n+2])
+		n := ssrcReportHeaderLength + streamReportLength*i
+		err := r.UnmarshalBinary(data[n : n+streamReportLength])
 		if err != nil {
 			return err
 		}
@@ -83,13 +203,32 @@ func (s *SSRCReport) UnmarshalBinary(data []byte) error {
 	return nil
 }
 
+// StreamReport is the report for a single RTP packet. The packet was received
+// if L is set, ArrivalTimeOffset is given in 1/1024 seconds before the report
+// timestamp.
 type StreamReport struct {
 	L                 bool
 	ECN               byte
 	ArrivalTimeOffset uint16
 }
 
+func (s *StreamReport) MarshalBinary() ([]byte, error) {
+	if s.ECN > maxECN || s.ArrivalTimeOffset > maxArrivalTimeOffset {
+		return nil, fmt.Errorf("%w: ECN %v, arrival time offset %v", ErrInvalidStreamReport, s.ECN, s.ArrivalTimeOffset)
+	}
+	v := uint16(s.ECN)<<13 | s.ArrivalTimeOffset
+	if s.L {
+		v |= 0x8000
+	}
+	buf := make([]byte, streamReportLength)
+	binary.BigEndian.PutUint16(buf, v)
+	return buf, nil
+}
+
 func (s *StreamReport) UnmarshalBinary(data []byte) error {
+	if len(data) < streamReportLength {
+		return fmt.Errorf("%w: got %v bytes", ErrInvalidStreamReport, len(data))
+	}
 	v := binary.BigEndian.Uint16(data)
 	s.L = data[0]&0x80 == 0x80
 	s.ECN = data[0] & 0x60 >> 5
@@ -0,0 +1,75 @@
+//go:build gofuzz
+// +build gofuzz
+
+package transport
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// Fuzz targets for github.com/dvyukov/go-fuzz. Native fuzzing needs go 1.18,
+// which the quic-go fork does not support yet. Build and run one of them with
+//
+//	go-fuzz-build -func FuzzCCFeedback ./transport
+//	go-fuzz -bin transport-fuzz.zip
+//
+// Every input that decodes must survive a marshal/unmarshal round trip.
+
+func FuzzCCFeedback(data []byte) int {
+	var f CCFeedback
+	if err := f.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	buf, err := f.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("marshal decoded feedback: %v", err))
+	}
+	var g CCFeedback
+	if err := g.UnmarshalBinary(buf); err != nil {
+		panic(fmt.Sprintf("unmarshal marshalled feedback: %v", err))
+	}
+	// padding is not re-encoded, so the headers may differ
+	f.Header, g.Header = nil, nil
+	if !reflect.DeepEqual(&f, &g) {
+		panic(fmt.Sprintf("round trip changed feedback: %v != %v", &f, &g))
+	}
+	return 1
+}
+
+func FuzzSSRCReport(data []byte) int {
+	var r SSRCReport
+	if err := r.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	buf, err := r.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("marshal decoded report block: %v", err))
+	}
+	if len(buf) > len(data) {
+		panic(fmt.Sprintf("report block grew from at most %v to %v bytes", len(data), len(buf)))
+	}
+	var s SSRCReport
+	if err := s.UnmarshalBinary(buf); err != nil {
+		panic(fmt.Sprintf("unmarshal marshalled report block: %v", err))
+	}
+	if !reflect.DeepEqual(&r, &s) {
+		panic(fmt.Sprintf("round trip changed report block: %v != %v", &r, &s))
+	}
+	return 1
+}
+
+func FuzzStreamReport(data []byte) int {
+	var r StreamReport
+	if err := r.UnmarshalBinary(data); err != nil {
+		return 0
+	}
+	buf, err := r.MarshalBinary()
+	if err != nil {
+		panic(fmt.Sprintf("marshal decoded stream report: %v", err))
+	}
+	if !reflect.DeepEqual(buf, data[:streamReportLength]) {
+		panic(fmt.Sprintf("round trip changed stream report: %x != %x", data[:streamReportLength], buf))
+	}
+	return 1
+}
@@ -0,0 +1,242 @@
+package transport
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestStreamReportRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		report StreamReport
+		want   []byte
+	}{
+		{"not received", StreamReport{}, []byte{0x00, 0x00}},
+		{"received", StreamReport{L: true, ArrivalTimeOffset: 1}, []byte{0x80, 0x01}},
+		{"ecn", StreamReport{L: true, ECN: 2, ArrivalTimeOffset: 0x100}, []byte{0xC1, 0x00}},
+		{"max", StreamReport{L: true, ECN: maxECN, ArrivalTimeOffset: maxArrivalTimeOffset}, []byte{0xFF, 0xFF}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := tc.report.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(buf, tc.want) {
+				t.Fatalf("MarshalBinary = %x, want %x", buf, tc.want)
+			}
+			var got StreamReport
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if got != tc.report {
+				t.Fatalf("UnmarshalBinary = %+v, want %+v", got, tc.report)
+			}
+		})
+	}
+}
+
+func TestStreamReportInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		report StreamReport
+	}{
+		{"ecn", StreamReport{ECN: maxECN + 1}},
+		{"arrival time offset", StreamReport{ArrivalTimeOffset: maxArrivalTimeOffset + 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.report.MarshalBinary()
+			if !errors.Is(err, ErrInvalidStreamReport) {
+				t.Fatalf("MarshalBinary error = %v, want %v", err, ErrInvalidStreamReport)
+			}
+		})
+	}
+	var r StreamReport
+	if err := r.UnmarshalBinary([]byte{0x80}); !errors.Is(err, ErrInvalidStreamReport) {
+		t.Fatalf("UnmarshalBinary error = %v, want %v", err, ErrInvalidStreamReport)
+	}
+}
+
+func streamReports(n int) []*StreamReport {
+	rs := make([]*StreamReport, n)
+	for i := range rs {
+		rs[i] = &StreamReport{
+			L:                 i%3 != 0,
+			ECN:               byte(i % 4),
+			ArrivalTimeOffset: uint16(i*7) & maxArrivalTimeOffset,
+		}
+	}
+	return rs
+}
+
+func TestSSRCReportRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		report SSRCReport
+		size   int
+	}{
+		{"empty", SSRCReport{StreamSSRC: 1, BeginSeq: 10, Reports: []*StreamReport{}}, 8},
+		{"odd", SSRCReport{StreamSSRC: 2, BeginSeq: 65535, NumReports: 3, Reports: streamReports(3)}, 16},
+		{"even", SSRCReport{StreamSSRC: 3, BeginSeq: 0, NumReports: 4, Reports: streamReports(4)}, 16},
+		{"max", SSRCReport{StreamSSRC: 4, BeginSeq: 42, NumReports: maxStreamReportsPerBlock, Reports: streamReports(maxStreamReportsPerBlock)}, 8 + 2*maxStreamReportsPerBlock},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := tc.report.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if len(buf) != tc.size {
+				t.Fatalf("MarshalBinary returned %v bytes, want %v", len(buf), tc.size)
+			}
+			if len(buf)%4 != 0 {
+				t.Fatalf("report block of %v bytes is not padded to 32 bits", len(buf))
+			}
+			var got SSRCReport
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !reflect.DeepEqual(&got, &tc.report) {
+				t.Fatalf("UnmarshalBinary = %v, want %v", &got, &tc.report)
+			}
+		})
+	}
+}
+
+func TestSSRCReportInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		report SSRCReport
+		err    error
+	}{
+		{"count mismatch", SSRCReport{NumReports: 2, Reports: streamReports(1)}, ErrReportCountMismatch},
+		{"too many reports", SSRCReport{NumReports: maxStreamReportsPerBlock + 1, Reports: streamReports(maxStreamReportsPerBlock + 1)}, ErrTooManyReports},
+		{"invalid report", SSRCReport{NumReports: 1, Reports: []*StreamReport{{ECN: maxECN + 1}}}, ErrInvalidStreamReport},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := tc.report.MarshalBinary()
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("MarshalBinary error = %v, want %v", err, tc.err)
+			}
+		})
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"short header", []byte{0, 0, 0, 1, 0, 0, 0}, ErrReportBlockTruncated},
+		{"missing reports", []byte{0, 0, 0, 1, 0, 0, 0, 2, 0x80, 0x01}, ErrReportBlockTruncated},
+		{"missing padding", []byte{0, 0, 0, 1, 0, 0, 0, 1, 0x80, 0x01}, ErrReportBlockTruncated},
+		{"too many reports", []byte{0, 0, 0, 1, 0, 0, 0x40, 0x01}, ErrTooManyReports},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var r SSRCReport
+			if err := r.UnmarshalBinary(tc.data); !errors.Is(err, tc.err) {
+				t.Fatalf("UnmarshalBinary error = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestCCFeedbackRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		feedback CCFeedback
+		size     int
+	}{
+		{"no reports", CCFeedback{SenderSSRC: 1, ReportTimestamp: 2}, 12},
+		{"single block", CCFeedback{
+			SenderSSRC: 0xdeadbeef,
+			Reports: []*SSRCReport{
+				{StreamSSRC: 1, BeginSeq: 100, NumReports: 5, Reports: streamReports(5)},
+			},
+			ReportTimestamp: 0xffffffff,
+		}, 32},
+		{"multiple blocks", CCFeedback{
+			SenderSSRC: 7,
+			Reports: []*SSRCReport{
+				{StreamSSRC: 1, BeginSeq: 65534, NumReports: 4, Reports: streamReports(4)},
+				{StreamSSRC: 2, BeginSeq: 3, NumReports: 0, Reports: []*StreamReport{}},
+				{StreamSSRC: 3, BeginSeq: 9, NumReports: 1, Reports: streamReports(1)},
+			},
+			ReportTimestamp: 1024,
+		}, 48},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := tc.feedback.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if len(buf) != tc.size {
+				t.Fatalf("MarshalBinary returned %v bytes, want %v", len(buf), tc.size)
+			}
+			var got CCFeedback
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if got.Header == nil || got.Header.Count != ccFeedbackFMT || int(got.Header.Length+1)*4 != len(buf) {
+				t.Fatalf("UnmarshalBinary returned header %v for %v bytes", got.Header, len(buf))
+			}
+			got.Header = nil
+			if !reflect.DeepEqual(&got, &tc.feedback) {
+				t.Fatalf("UnmarshalBinary = %v, want %v", &got, &tc.feedback)
+			}
+
+			// trailing packets of a compound RTCP packet are ignored
+			got = CCFeedback{}
+			if err := got.UnmarshalBinary(append(buf, 0x81, 0xcb, 0x00, 0x00)); err != nil {
+				t.Fatalf("UnmarshalBinary with trailing data: %v", err)
+			}
+
+			// every truncation must fail without panicking
+			for i := 0; i < len(buf); i++ {
+				var f CCFeedback
+				if err := f.UnmarshalBinary(buf[:i]); err == nil {
+					t.Fatalf("UnmarshalBinary accepted packet truncated to %v bytes", i)
+				}
+			}
+		})
+	}
+}
+
+func TestCCFeedbackInvalid(t *testing.T) {
+	valid := []byte{
+		0x8b, 0xcd, 0x00, 0x05, // V=2, FMT=11, PT=205, length=5
+		0x00, 0x00, 0x00, 0x01, // sender SSRC
+		0x00, 0x00, 0x00, 0x02, // stream SSRC
+		0x00, 0x05, 0x00, 0x01, // begin seq, num reports
+		0x80, 0x01, 0x00, 0x00, // report, padding
+		0x00, 0x00, 0x04, 0x00, // report timestamp
+	}
+	var f CCFeedback
+	if err := f.UnmarshalBinary(valid); err != nil {
+		t.Fatalf("UnmarshalBinary of valid packet: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		modify func([]byte) []byte
+		err    error
+	}{
+		{"too short", func(b []byte) []byte { return b[:11] }, ErrFeedbackTooShort},
+		{"wrong version", func(b []byte) []byte { b[0] = 0x4b; return b }, ErrFeedbackInvalidHeader},
+		{"wrong fmt", func(b []byte) []byte { b[0] = 0x8f; return b }, ErrFeedbackInvalidHeader},
+		{"wrong type", func(b []byte) []byte { b[1] = 0xce; return b }, ErrFeedbackInvalidHeader},
+		{"length too long", func(b []byte) []byte { b[3] = 0x06; return b }, ErrFeedbackInvalidLength},
+		{"length too short", func(b []byte) []byte { b[3] = 0x01; return b }, ErrFeedbackInvalidLength},
+		{"zero padding", func(b []byte) []byte { b[0] |= 0x20; b[len(b)-1] = 0; return b }, ErrFeedbackInvalidPadding},
+		{"unaligned padding", func(b []byte) []byte { b[0] |= 0x20; b[len(b)-1] = 3; return b }, ErrFeedbackInvalidPadding},
+		{"padding too long", func(b []byte) []byte { b[0] |= 0x20; b[len(b)-1] = 20; return b }, ErrFeedbackInvalidPadding},
+		{"truncated block", func(b []byte) []byte { b[15] = 0x03; return b }, ErrReportBlockTruncated},
+		{"too many reports", func(b []byte) []byte { b[14] = 0x40; return b }, ErrTooManyReports},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			data := tc.modify(append([]byte{}, valid...))
+			var f CCFeedback
+			if err := f.UnmarshalBinary(data); !errors.Is(err, tc.err) {
+				t.Fatalf("UnmarshalBinary error = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"github.com/pion/rtp"
+)
+
+// ntpDiffMs returns a-b in milliseconds for NTP Q16 timestamps.
+func ntpDiffMs(a, b uint32) float64 {
+	return float64(int32(a-b)) * 1000 / 65536
+}
+
+type sentPacket struct {
+	seqNr   uint16
+	sent    uint32
+	size    int
+	acked   bool
+	lost    bool
+	arrival uint32
+	// arrival is only valid if hasArrival is set
+	hasArrival bool
+	ecn        byte
+}
+
+type feedbackResult struct {
+	reportTimestamp uint32
+	// acked contains newly acknowledged packets in sequence number order
+	acked []*sentPacket
+	// lost is the number of packets newly reported as lost
+	lost int
+	// recovered is the number of packets previously reported as lost which
+	// arrived late
+	recovered int
+}
+
+// sentPacketHistory keeps track of sent packets of a single stream to match
+// them with RFC 8888 feedback reports.
+type sentPacketHistory struct {
+	ssrc          uint32
+	maxAge        uint32
+	packets       map[uint16]*sentPacket
+	order         []*sentPacket
+	bytesInFlight int
+}
+
+func newSentPacketHistory(ssrc uint, maxAge uint32) *sentPacketHistory {
+	return &sentPacketHistory{
+		ssrc:    uint32(ssrc),
+		maxAge:  maxAge,
+		packets: make(map[uint16]*sentPacket),
+	}
+}
+
+func (h *sentPacketHistory) onSent(now uint32, packet *rtp.Packet) {
+	p := &sentPacket{
+		seqNr: packet.SequenceNumber,
+		sent:  now,
+		size:  len(packet.Raw),
+	}
+	h.packets[p.seqNr] = p
+	h.order = append(h.order, p)
+	h.bytesInFlight += p.size
+
+	for len(h.order) > 0 && int32(now-h.order[0].sent) > int32(h.maxAge) {
+		old := h.order[0]
+		if !old.acked && !old.lost {
+			h.bytesInFlight -= old.size
+		}
+		if h.packets[old.seqNr] == old {
+			delete(h.packets, old.seqNr)
+		}
+		h.order = h.order[1:]
+	}
+}
+
+func (h *sentPacketHistory) onFeedback(feedback []byte) (*feedbackResult, error) {
+	var ccf CCFeedback
+	err := ccf.UnmarshalBinary(feedback)
+	if err != nil {
+		return nil, err
+	}
+	res := &feedbackResult{
+		reportTimestamp: ccf.ReportTimestamp,
+	}
+	for _, report := range ccf.Reports {
+		if report.StreamSSRC != h.ssrc {
+			continue
+		}
+		for i, r := range report.Reports {
+			h.onReport(res, report.BeginSeq+uint16(i), r)
+		}
+	}
+	return res, nil
+}
+
+func (h *sentPacketHistory) onReport(res *feedbackResult, seqNr uint16, r *StreamReport) {
+	p, ok := h.packets[seqNr]
+	if !ok || p.acked {
+		return
+	}
+	if !r.L {
+		if !p.lost {
+			p.lost = true
+			res.lost++
+			h.bytesInFlight -= p.size
+		}
+		return
+	}
+	if p.lost {
+		p.lost = false
+		res.recovered++
+		h.bytesInFlight += p.size
+	}
+	p.acked = true
+	p.ecn = r.ECN
+	h.bytesInFlight -= p.size
+	if r.ArrivalTimeOffset != 0x1FFF {
+		// arrival time offset is given in 1/1024 seconds
+		p.arrival = res.reportTimestamp - uint32(r.ArrivalTimeOffset)*64
+		p.hasArrival = true
+	}
+	res.acked = append(res.acked, p)
+}
+
+// rttSample returns the round trip time in ms of a packet acknowledged by a
+// feedback report received at now.
+func rttSample(now, reportTimestamp uint32, p *sentPacket) float64 {
+	return ntpDiffMs(now, p.sent) - ntpDiffMs(reportTimestamp, p.arrival)
+}
+
+// pacer limits the send rate using a byte budget.
+type pacer struct {
+	budget float64
+	last   uint32
+}
+
+// allow refills the budget according to rate in bit/s and returns true if
+// the budget allows sending another packet.
+func (p *pacer) allow(now uint32, rate float64) bool {
+	if p.last == 0 {
+		p.last = now
+	}
+	dt := ntpDiffMs(now, p.last) / 1000
+	p.last = now
+	bytesPerSecond := rate / 8
+	// allow bursts of up to 40ms
+	if b := p.budget + bytesPerSecond*dt; b < bytesPerSecond*0.04 {
+		p.budget = b
+	} else {
+		p.budget = bytesPerSecond * 0.04
+	}
+	return p.budget > 0
+}
+
+func (p *pacer) sent(size int) {
+	p.budget -= float64(size)
+}
+
+// rateCounter measures the send rate in kbit/s over intervals of at least one
+// second.
+type rateCounter struct {
+	bytes int
+	last  uint32
+	rate  float64
+}
+
+func (r *rateCounter) add(size int) {
+	r.bytes += size
+}
+
+func (r *rateCounter) get(now uint32) float64 {
+	if d := ntpDiffMs(now, r.last); d >= 1000 {
+		r.rate = float64(r.bytes*8) / d
+		r.bytes = 0
+		r.last = now
+	}
+	return r.rate
+}
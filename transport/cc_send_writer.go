@@ -0,0 +1,362 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mengelbart/cgo-streamer/gst"
+
+	"github.com/mengelbart/scream-go"
+	"github.com/pion/rtp"
+)
+
+func (s *CCSendWriter) SetReceiveTimeInferFn(fn InferReceiveTimeFnFactory) {
+	s.inferReceiveTime = fn.getInferReceiveTimeFn()
+}
+
+func (s *CCSendWriter) SetKeyFrameRequester(requestKeyFrame func()) {
+	s.requestKeyFrame = requestKeyFrame
+}
+
+// SetTemporalLayers tags queued packets with their temporal layer using
+// tagger and drops packets of enhancement layers when the queue delay exceeds
+// maxDelay.
+func (s *CCSendWriter) SetTemporalLayers(tagger *TemporalLayerTagger, maxDelay time.Duration) {
+	s.layerTagger = tagger
+	s.maxLayerDelay = maxDelay
+}
+
+// SetCrossTraffic counts the packets written to c as traffic of the
+// controlled path. Controllers implementing CrossTrafficCounter account for
+// them, and their rate is subtracted from the target bitrate of the encoder.
+func (s *CCSendWriter) SetCrossTraffic(c *CrossTrafficWriter) {
+	s.crossTraffic = c
+}
+
+// CCSendWriter queues RTP packets and releases them to the underlying writer
+// whenever the congestion controller allows it.
+type CCSendWriter struct {
+	w               io.WriteCloser
+	q               *Queue
+	cc              CongestionController
+	ssrc            uint
+	packet          chan *rtp.Packet
+	feedback        <-chan []byte
+	done            chan struct{}
+	ccLogWriter     io.Writer
+	requestKeyFrame func()
+
+	layerTagger   *TemporalLayerTagger
+	maxLayerDelay time.Duration
+
+	crossTraffic *CrossTrafficWriter
+
+	// feedbackRx creates feedback from inferred receive times
+	feedbackRx       *scream.Rx
+	inferReceiveTime InferReceiveTime
+}
+
+type Feedback struct {
+	fb    []byte
+	seqNr uint16
+	ts    uint32
+}
+
+func (s *CCSendWriter) Close() error {
+	close(s.done)
+	return nil
+}
+
+func NewCCSendWriter(factory CongestionControllerFactory, ssrc uint, bitrate int, w io.WriteCloser, fb <-chan []byte, ccLogWriter io.Writer) *CCSendWriter {
+	queue := NewQueue()
+	return &CCSendWriter{
+		w:                w,
+		q:                queue,
+		cc:               factory(ssrc, bitrate, queue),
+		ssrc:             ssrc,
+		packet:           make(chan *rtp.Packet, 1024),
+		done:             make(chan struct{}, 1),
+		feedback:         fb,
+		ccLogWriter:      ccLogWriter,
+		feedbackRx:       scream.NewRx(ssrc),
+		inferReceiveTime: staticReceiveTime,
+	}
+}
+
+func (s *CCSendWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	err := packet.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	s.packet <- packet
+	return len(b), nil
+}
+
+// RunBitrate passes the target bitrate of the congestion controller to
+// setBitrate until the writer is closed or ctx is done.
+func (s *CCSendWriter) RunBitrate(ctx context.Context, setBitrate func(uint)) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	var lastBitrate uint
+	ccLogger := log.New(s.ccLogWriter, "", 0)
+	start := time.Now()
+	var crossKbps int
+	var lastCrossBytes uint64
+	lastCross := start
+	//ccLogger.Printf("time len(queue) rtt cwnd bytesInFlightLog fastStart queueDelay targetBitrate rateTransmitted")
+	for {
+		select {
+		case <-ticker.C:
+			now := gst.GetTimeInNTP()
+			ccLogger.Printf("%v %v %v", time.Since(start).Milliseconds(), s.q.Len(), s.cc.Stats(now))
+			if s.crossTraffic != nil {
+				if d := time.Since(lastCross); d >= time.Second {
+					bytes := atomic.LoadUint64(&s.crossTraffic.total)
+					crossKbps = int(float64(bytes-lastCrossBytes) * 8 / 1000 / d.Seconds())
+					lastCrossBytes = bytes
+					lastCross = time.Now()
+				}
+			}
+			kbps := s.cc.TargetBitrate(now) / 1000
+			if kbps <= 0 {
+				if s.requestKeyFrame != nil {
+					s.requestKeyFrame()
+				}
+				continue
+			}
+			if crossKbps < kbps {
+				kbps -= crossKbps
+			}
+			if lastBitrate != uint(kbps) {
+				lastBitrate = uint(kbps)
+				setBitrate(lastBitrate)
+				log.Printf("%v, SET BITRATE to %v\n", time.Since(start).Seconds(), lastBitrate)
+			}
+		case <-s.done:
+			log.Println("leaving RunBitrate")
+			return
+		case <-ctx.Done():
+			return
+		}
+
+	}
+}
+
+// RunReceiveFeedback sends queued packets using the feedback of the receiver
+// until the writer is closed and the queue is empty or ctx is done.
+func (s *CCSendWriter) RunReceiveFeedback(ctx context.Context) {
+	gst.InitT0()
+	for {
+		select {
+		case packet := <-s.packet:
+			s.enqueue(packet)
+
+		case fb := <-s.feedback:
+			s.cc.OnFeedback(gst.GetTimeInNTP(), fb)
+
+		case <-s.done:
+			if s.q.Len() <= 0 {
+				log.Printf("done, closing CCSendWriter, dropped %v enhancement layer packets\n", s.q.Dropped())
+				err := s.w.Close()
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		s.transmit()
+	}
+}
+
+type Packet struct {
+	sentTimestamp     uint32
+	inferredTimestamp uint32
+	rtpSeqNr          uint16
+	ssrc              uint32
+	size              int
+
+	quicPacketNr int64
+	ackTimestamp uint32
+	smoothedRTT  float64
+}
+
+// RunInferFeedback sends queued packets using feedback created from inferred
+// receive times until the writer is closed and the queue is empty or ctx is
+// done. Only acknowledgments of packets with the SSRC of s are used.
+func (s *CCSendWriter) RunInferFeedback(ctx context.Context, ackChan <-chan []*Packet) {
+	sentPackets := make(map[uint16]*Packet) // rtp sequencenumber -> packet
+	var nextReceiveCall []*Packet
+	var lastSeenSmoothedRTT float64
+
+	gst.InitT0()
+	for {
+		select {
+		case packet := <-s.packet:
+			s.enqueue(packet)
+
+		case ack := <-ackChan:
+			for _, n := range ack {
+				// audio packets and retransmissions share the datagrams
+				// of the session, but they are not sent by s
+				if n.ssrc != uint32(s.ssrc) {
+					continue
+				}
+				p, ok := sentPackets[n.rtpSeqNr]
+				if !ok {
+					continue
+				}
+				p.ackTimestamp = n.ackTimestamp
+				p.smoothedRTT = n.smoothedRTT
+				lastSeenSmoothedRTT = n.smoothedRTT
+				nextReceiveCall = append(nextReceiveCall, p)
+			}
+
+		case fb := <-s.feedback:
+			ts := binary.BigEndian.Uint32(fb[0:4])
+			snr := binary.BigEndian.Uint16(fb[4:6])
+
+			if p, ok := sentPackets[snr]; ok {
+				p.ackTimestamp = ts
+				p.smoothedRTT = lastSeenSmoothedRTT
+				nextReceiveCall = append(nextReceiveCall, p)
+			}
+			for _, p := range nextReceiveCall {
+				p.inferredTimestamp = s.inferReceiveTime(p, ts)
+				s.feedbackRx.Receive(uint(p.inferredTimestamp), nil, 1, p.size, int(p.rtpSeqNr), 0)
+			}
+			nextReceiveCall = []*Packet{}
+			if ok, feedback := s.feedbackRx.CreateStandardizedFeedback(
+				uint(ts),
+				true,
+			); ok {
+				fbts := binary.BigEndian.Uint32(feedback[len(feedback)-4:])
+				if fbts != ts {
+					panic(fmt.Sprintf("feedback has wrong ts: %v: %v\n", fbts, feedback))
+				}
+				c := make([]byte, len(feedback))
+				copy(c, feedback)
+				s.cc.OnFeedback(gst.GetTimeInNTP(), c)
+			}
+
+		case <-s.done:
+			if s.q.Len() <= 0 {
+				log.Printf("done, closing CCSendWriter, dropped %v enhancement layer packets\n", s.q.Dropped())
+				err := s.w.Close()
+				if err != nil {
+					log.Println(err)
+				}
+				return
+			}
+		case <-ctx.Done():
+			return
+		default:
+		}
+
+		item := s.transmit()
+		if item == nil {
+			continue
+		}
+		sentPackets[item.Packet.SequenceNumber] = &Packet{
+			sentTimestamp: gst.GetTimeInNTP(),
+			size:          len(item.Packet.Raw),
+			rtpSeqNr:      item.Packet.SequenceNumber,
+		}
+	}
+}
+
+func (s *CCSendWriter) enqueue(packet *rtp.Packet) {
+	now := gst.GetTimeInNTP()
+	item := &RTPQueueItem{
+		Packet:    packet,
+		Timestamp: float64(now) / 65536.0,
+	}
+	if s.layerTagger != nil {
+		item.TemporalLayer = s.layerTagger.Layer(packet)
+	}
+	if !s.q.push(item) {
+		return
+	}
+	s.cc.OnMediaFrame(now, packet)
+	if s.layerTagger != nil {
+		dropped := s.q.DropEnhancementLayers(item.Timestamp, s.maxLayerDelay.Seconds())
+		if dropped > 0 {
+			log.Printf("queue delay exceeded %v, dropped %v enhancement layer packets\n", s.maxLayerDelay, dropped)
+		}
+	}
+}
+
+// transmit sends the next packet from the queue if the congestion controller
+// allows it and returns the sent item or nil if nothing was sent.
+func (s *CCSendWriter) transmit() *RTPQueueItem {
+	s.countCrossTraffic()
+	if !s.cc.IsOkToTransmit(gst.GetTimeInNTP()) {
+		return nil
+	}
+	item := s.q.Pop()
+	if item == nil {
+		return nil
+	}
+	bs, err := item.Packet.Marshal()
+	if err != nil {
+		log.Println(err)
+	}
+	_, err = s.w.Write(bs)
+	if err != nil {
+		log.Println(err)
+	}
+	s.cc.OnPacketSent(gst.GetTimeInNTP(), item.Packet)
+	return item
+}
+
+// countCrossTraffic passes the bytes written to the cross traffic writer since
+// the last call to the controller.
+func (s *CCSendWriter) countCrossTraffic() {
+	if s.crossTraffic == nil {
+		return
+	}
+	bytes := atomic.SwapUint64(&s.crossTraffic.pending, 0)
+	if bytes == 0 {
+		return
+	}
+	if c, ok := s.cc.(CrossTrafficCounter); ok {
+		c.OnCrossTraffic(gst.GetTimeInNTP(), int(bytes))
+	}
+}
+
+// CrossTrafficWriter passes the packets of a stream which shares the path
+// with a congestion controlled stream without being queued, e.g. audio, to
+// the underlying writer and counts their bytes for a CCSendWriter.
+type CrossTrafficWriter struct {
+	w io.WriteCloser
+
+	// pending is the number of bytes not yet passed to the controller
+	pending uint64
+	total   uint64
+}
+
+func NewCrossTrafficWriter(w io.WriteCloser) *CrossTrafficWriter {
+	return &CrossTrafficWriter{
+		w: w,
+	}
+}
+
+func (c *CrossTrafficWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	atomic.AddUint64(&c.pending, uint64(n))
+	atomic.AddUint64(&c.total, uint64(n))
+	return n, err
+}
+
+func (c *CrossTrafficWriter) Close() error {
+	return c.w.Close()
+}
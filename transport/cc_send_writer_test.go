@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// testController allows every packet and ignores feedback.
+type testController struct{}
+
+func (testController) OnMediaFrame(now uint32, packet *rtp.Packet) {}
+func (testController) OnPacketSent(now uint32, packet *rtp.Packet) {}
+func (testController) OnFeedback(now uint32, feedback []byte)      {}
+func (testController) IsOkToTransmit(now uint32) bool              { return true }
+func (testController) TargetBitrate(now uint32) int                { return 1000000 }
+func (testController) Stats(now uint32) string                     { return "" }
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(b []byte) (int, error) { return len(b), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+// ACKs of audio packets and retransmissions, which the QUIC tracer reports for
+// all datagrams, must neither panic nor be credited to video packets with the
+// same sequence number.
+func TestCCSendWriterInferFeedbackSSRC(t *testing.T) {
+	factory := func(ssrc uint, bitrate int, q *Queue) CongestionController { return testController{} }
+	fb := make(chan []byte, 1)
+	s := NewCCSendWriter(factory, 1, 1000, nopWriteCloser{}, fb, nopWriteCloser{})
+	inferred := make(chan *Packet, 8)
+	s.inferReceiveTime = func(p *Packet, ts uint32) uint32 {
+		inferred <- p
+		return ts
+	}
+	ackChan := make(chan []*Packet, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.RunInferFeedback(ctx, ackChan)
+
+	if _, err := s.Write(testRTPPacket(10, 1, []byte("video"))); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	ackChan <- []*Packet{
+		{rtpSeqNr: 10, ssrc: 2, ackTimestamp: 1},  // audio with the same sequence number
+		{rtpSeqNr: 500, ssrc: 2, ackTimestamp: 2}, // audio never sent by s
+		{rtpSeqNr: 11, ssrc: 1, ackTimestamp: 3},  // video never sent by s
+		{rtpSeqNr: 10, ssrc: 1, ackTimestamp: 4},
+	}
+	time.Sleep(50 * time.Millisecond)
+	feedback := make([]byte, 6)
+	binary.BigEndian.PutUint32(feedback, 1000)
+	binary.BigEndian.PutUint16(feedback[4:], 9)
+	fb <- feedback
+
+	select {
+	case p := <-inferred:
+		if p.rtpSeqNr != 10 || p.ackTimestamp != 4 {
+			t.Fatalf("inferred receive time of packet %v acked at %v, want packet 10 acked at 4", p.rtpSeqNr, p.ackTimestamp)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no receive time inferred")
+	}
+	select {
+	case p := <-inferred:
+		t.Fatalf("inferred receive time of unexpected packet %v", p.rtpSeqNr)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// CongestionController decides when packets from the send queue may be
+// transmitted and which bitrate the encoder should target. All timestamps are
+// in NTP Q16 format as returned by gst.GetTimeInNTP.
+type CongestionController interface {
+	// OnMediaFrame is called whenever a new packet was added to the send queue.
+	OnMediaFrame(now uint32, packet *rtp.Packet)
+	// OnPacketSent is called after a packet was written to the network.
+	OnPacketSent(now uint32, packet *rtp.Packet)
+	// OnFeedback consumes RFC 8888 congestion control feedback.
+	OnFeedback(now uint32, feedback []byte)
+	// IsOkToTransmit returns true if the next packet in the queue may be sent.
+	IsOkToTransmit(now uint32) bool
+	// TargetBitrate returns the current target bitrate in bit/s.
+	TargetBitrate(now uint32) int
+	// Stats returns a space separated line of statistics in the format
+	// 'rtt cwnd bytesInFlight fastStart queueDelay targetBitrate rateTransmitted'.
+	Stats(now uint32) string
+}
+
+// CrossTrafficCounter is implemented by congestion controllers which account
+// for packets of other streams sharing the path, e.g. audio, which are sent
+// without passing the send queue.
+type CrossTrafficCounter interface {
+	// OnCrossTraffic is called with the number of bytes of such packets
+	// sent since the last call.
+	OnCrossTraffic(now uint32, bytes int)
+}
+
+// CongestionControllerFactory creates a new controller for a stream with the
+// given SSRC, initial bitrate in kbit/s and send queue.
+type CongestionControllerFactory func(ssrc uint, bitrate int, q *Queue) CongestionController
+
+var congestionControllers = map[string]CongestionControllerFactory{
+	"scream": NewScreamController,
+	"gcc":    NewGCCController,
+	"nada":   NewNADAController,
+}
+var congestionControllersLock sync.Mutex
+
+// RegisterCongestionController makes a controller available by name.
+func RegisterCongestionController(name string, factory CongestionControllerFactory) {
+	congestionControllersLock.Lock()
+	defer congestionControllersLock.Unlock()
+	congestionControllers[name] = factory
+}
+
+// GetCongestionController returns the factory registered for name.
+func GetCongestionController(name string) (CongestionControllerFactory, error) {
+	congestionControllersLock.Lock()
+	defer congestionControllersLock.Unlock()
+	factory, ok := congestionControllers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown congestion controller: %v", name)
+	}
+	return factory, nil
+}
+
+// CongestionControllers returns the sorted names of all registered controllers.
+func CongestionControllers() []string {
+	congestionControllersLock.Lock()
+	defer congestionControllersLock.Unlock()
+	var names []string
+	for name := range congestionControllers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,368 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pion/rtcp"
+)
+
+// CloseCode tells why a session was closed. It is sent in BYE messages and
+// used as QUIC application error code when closing sessions.
+type CloseCode uint64
+
+const (
+	// CloseFinished is used when the stream ended.
+	CloseFinished CloseCode = 0x0
+	// CloseServerError is used when the server failed to send the stream.
+	CloseServerError CloseCode = 0x1
+	// CloseTimeout is used when no packets were received from the peer for
+	// the idle timeout.
+	CloseTimeout CloseCode = 0x2
+	// CloseClientBye is used when the client closed the session.
+	CloseClientBye CloseCode = 0x3
+	// CloseServerBusy is used when the server rejected the session.
+	CloseServerBusy CloseCode = 0x4
+	// CloseServerShutdown is used when the server shut down before the
+	// stream ended.
+	CloseServerShutdown CloseCode = 0x5
+)
+
+func (c CloseCode) String() string {
+	switch c {
+	case CloseFinished:
+		return "stream finished"
+	case CloseServerError:
+		return "server error"
+	case CloseTimeout:
+		return "timeout"
+	case CloseClientBye:
+		return "closed by client"
+	case CloseServerBusy:
+		return "server busy"
+	case CloseServerShutdown:
+		return "server shutdown"
+	}
+	return fmt.Sprintf("unknown close code 0x%x", uint64(c))
+}
+
+const (
+	// byeAppName is the name of the RTCP APP packet carrying the close code
+	// and the statistics of a BYE message.
+	byeAppName = "CGOS"
+	// byeAppHeaderLength is the length of the RTCP header, the SSRC and the
+	// name of the APP packet.
+	byeAppHeaderLength = 12
+	// maxByeReasonLength is the longest reason of an RTCP BYE packet.
+	maxByeReasonLength = 255
+
+	// byeTimeout is the time the server waits for the client to close the
+	// session after sending a BYE message.
+	byeTimeout = 500 * time.Millisecond
+	// byeGracePeriod is the time the client keeps receiving media after a BYE
+	// message, because streams sent before the BYE message may arrive later.
+	byeGracePeriod = 100 * time.Millisecond
+	// maxByeSize is the largest accepted BYE message.
+	maxByeSize = 1 << 12
+)
+
+var (
+	ErrInvalidBye     = errors.New("invalid BYE message")
+	ErrSessionTimeout = errors.New("session timed out")
+)
+
+// Bye is the message ending a session. It carries the reason for closing the
+// session and the statistics of the sender.
+type Bye struct {
+	// SSRC is the source leaving the session, 0 if the sender did not send
+	// any RTP or RTCP packet yet.
+	SSRC   uint32
+	Code   CloseCode
+	Reason string
+	// Packets and Bytes are the number of packets and bytes sent in the
+	// session.
+	Packets  uint64
+	Bytes    uint64
+	Duration time.Duration
+}
+
+func (b Bye) String() string {
+	return fmt.Sprintf("%v, sent %v packets (%v bytes) in %v", b.reason(), b.Packets, b.Bytes, b.Duration)
+}
+
+// reason returns the close code and the reason of b.
+func (b Bye) reason() string {
+	if len(b.Reason) == 0 {
+		return b.Code.String()
+	}
+	return b.Code.String() + ": " + b.Reason
+}
+
+// MarshalBinary encodes b as compound RTCP packet (RFC 3550, Section 6.1),
+// so it can be protected by SRTCP like any other RTCP packet. The compound
+// packet starts with an APP packet named byeAppName, whose data holds the
+// close code, the number of packets and bytes and the duration in
+// milliseconds as QUIC variable-length integers padded to 32 bits. It ends
+// with a BYE packet of b.SSRC carrying the reason, which is truncated to
+// maxByeReasonLength bytes.
+func (b Bye) MarshalBinary() ([]byte, error) {
+	var data []byte
+	data = appendVarint(data, uint64(b.Code))
+	data = appendVarint(data, b.Packets)
+	data = appendVarint(data, b.Bytes)
+	data = appendVarint(data, uint64(b.Duration.Milliseconds()))
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	h := rtcp.Header{
+		Type:   rtcp.TypeApplicationDefined,
+		Length: uint16((byeAppHeaderLength+len(data))/4 - 1),
+	}
+	hdr, err := h.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBye, err)
+	}
+	app := make([]byte, byeAppHeaderLength, byeAppHeaderLength+len(data))
+	copy(app, hdr)
+	binary.BigEndian.PutUint32(app[4:8], b.SSRC)
+	copy(app[8:], byeAppName)
+	app = append(app, data...)
+
+	reason := b.Reason
+	if len(reason) > maxByeReasonLength {
+		reason = reason[:maxByeReasonLength]
+	}
+	bye, err := (&rtcp.Goodbye{Sources: []uint32{b.SSRC}, Reason: reason}).Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBye, err)
+	}
+	return append(app, bye...), nil
+}
+
+func (b *Bye) UnmarshalBinary(data []byte) error {
+	packets, err := rtcp.Unmarshal(data)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidBye, err)
+	}
+	var app []byte
+	var bye *rtcp.Goodbye
+	for _, p := range packets {
+		switch p := p.(type) {
+		case *rtcp.Goodbye:
+			bye = p
+		case *rtcp.RawPacket:
+			if isByeApp(*p) {
+				app = *p
+			}
+		}
+	}
+	if bye == nil {
+		return fmt.Errorf("%w: missing RTCP BYE packet", ErrInvalidBye)
+	}
+	if app == nil {
+		return fmt.Errorf("%w: missing %v APP packet", ErrInvalidBye, byeAppName)
+	}
+	app = app[byeAppHeaderLength:]
+	var fields [4]uint64
+	for i := range fields {
+		v, n, err := parseVarint(app)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidBye, err)
+		}
+		fields[i] = v
+		app = app[n:]
+	}
+	b.SSRC = 0
+	if len(bye.Sources) > 0 {
+		b.SSRC = bye.Sources[0]
+	}
+	b.Code = CloseCode(fields[0])
+	b.Packets = fields[1]
+	b.Bytes = fields[2]
+	b.Duration = time.Duration(fields[3]) * time.Millisecond
+	b.Reason = bye.Reason
+	return nil
+}
+
+// isByeApp returns true if p is the APP packet of a BYE message.
+func isByeApp(p []byte) bool {
+	return len(p) >= byeAppHeaderLength && rtcp.PacketType(p[1]) == rtcp.TypeApplicationDefined &&
+		string(p[8:byeAppHeaderLength]) == byeAppName
+}
+
+// isBye returns true if b is a compound RTCP packet containing a BYE packet.
+// Protected packets must be unprotected first, because SRTCP encrypts all
+// packets of a compound packet but the header of the first one.
+func isBye(b []byte) bool {
+	for isRTCP(b) && len(b) >= 4 && b[0]>>6 == 2 {
+		if rtcp.PacketType(b[1]) == rtcp.TypeGoodbye {
+			return true
+		}
+		n := 4 * (int(binary.BigEndian.Uint16(b[2:4])) + 1)
+		if n > len(b) {
+			return false
+		}
+		b = b[n:]
+	}
+	return false
+}
+
+// ByeError is returned by clients whose session was closed by the server for
+// another reason than the end of the stream.
+type ByeError struct {
+	Bye Bye
+}
+
+func (e *ByeError) Error() string {
+	return fmt.Sprintf("session closed: %v", e.Bye)
+}
+
+// byeResult returns the result of a client run for a received BYE message:
+// nil if the stream finished and a ByeError otherwise.
+func byeResult(bye Bye) error {
+	if bye.Code == CloseFinished {
+		return nil
+	}
+	return &ByeError{Bye: bye}
+}
+
+// sessionCounter counts the packets and bytes written to a session and
+// records the SSRC of the first RTP packet for the BYE message.
+type sessionCounter struct {
+	io.WriteCloser
+	start   time.Time
+	packets uint64
+	bytes   uint64
+	ssrc    uint32
+}
+
+func newSessionCounter(w io.WriteCloser) *sessionCounter {
+	return &sessionCounter{
+		WriteCloser: w,
+		start:       time.Now(),
+	}
+}
+
+func (c *sessionCounter) Write(b []byte) (int, error) {
+	n, err := c.WriteCloser.Write(b)
+	if err == nil {
+		atomic.AddUint64(&c.packets, 1)
+		atomic.AddUint64(&c.bytes, uint64(n))
+		recordSSRC(&c.ssrc, b)
+	}
+	return n, err
+}
+
+// recordSSRC stores the SSRC of the RTP packet b in ssrc, unless an SSRC was
+// stored before.
+func recordSSRC(ssrc *uint32, b []byte) {
+	if isRTP(b) && !isRTCP(b) && atomic.LoadUint32(ssrc) == 0 {
+		atomic.CompareAndSwapUint32(ssrc, 0, binary.BigEndian.Uint32(b[8:12]))
+	}
+}
+
+// bye creates a BYE message with the statistics of c.
+func (c *sessionCounter) bye(code CloseCode, reason string) Bye {
+	return Bye{
+		SSRC:     atomic.LoadUint32(&c.ssrc),
+		Code:     code,
+		Reason:   reason,
+		Packets:  atomic.LoadUint64(&c.packets),
+		Bytes:    atomic.LoadUint64(&c.bytes),
+		Duration: time.Since(c.start),
+	}
+}
+
+// closeSession sends bye on a new unidirectional stream and waits until the
+// client closes the session or byeTimeout passed. The session is closed with
+// the close code of bye afterwards.
+func closeSession(sess quic.Session, bye Bye) error {
+	log.Printf("closing session: %v\n", bye)
+	err := sendBye(sess, bye)
+	if err != nil {
+		log.Printf("could not send bye: %v\n", err)
+	} else {
+		select {
+		case <-sess.Context().Done():
+		case <-time.After(byeTimeout):
+		}
+	}
+	return sess.CloseWithError(quic.ErrorCode(bye.Code), bye.Reason)
+}
+
+func sendBye(sess quic.Session, bye Bye) error {
+	stream, err := sess.OpenUniStream()
+	if err != nil {
+		return err
+	}
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = stream.Write(msg)
+	if err != nil {
+		return err
+	}
+	return stream.Close()
+}
+
+// byeReceiver receives the BYE message of a QUIC session on the client.
+type byeReceiver struct {
+	lock sync.Mutex
+	bye  *Bye
+}
+
+// run waits for the BYE message of the server and closes sess after
+// byeGracePeriod.
+func (r *byeReceiver) run(sess quic.Session) {
+	stream, err := sess.AcceptUniStream(context.Background())
+	if err != nil {
+		return
+	}
+	msg, err := ioutil.ReadAll(io.LimitReader(stream, maxByeSize))
+	if err != nil {
+		log.Printf("could not read bye: %v\n", err)
+		return
+	}
+	bye := &Bye{}
+	err = bye.UnmarshalBinary(msg)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	log.Printf("received bye: %v\n", bye)
+	r.lock.Lock()
+	r.bye = bye
+	r.lock.Unlock()
+	time.Sleep(byeGracePeriod)
+	err = sess.CloseWithError(quic.ErrorCode(CloseFinished), "")
+	if err != nil {
+		log.Printf("could not close session: %v\n", err)
+	}
+}
+
+// result returns the result of a client run which ended with err, which is
+// caused by closing the session after the BYE message or by a failure of the
+// session.
+func (r *byeReceiver) result(err error) error {
+	r.lock.Lock()
+	bye := r.bye
+	r.lock.Unlock()
+	if bye != nil {
+		return byeResult(*bye)
+	}
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+		return fmt.Errorf("%w: %v", ErrSessionTimeout, err)
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+func TestByeRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		bye  Bye
+		want Bye
+	}{
+		{"empty", Bye{}, Bye{}},
+		{"finished", Bye{SSRC: 1, Code: CloseFinished, Packets: 1000, Bytes: 1 << 20, Duration: 90 * time.Second},
+			Bye{SSRC: 1, Code: CloseFinished, Packets: 1000, Bytes: 1 << 20, Duration: 90 * time.Second}},
+		{"reason", Bye{SSRC: 0xdeadbeef, Code: CloseServerBusy, Reason: "2 sessions open"},
+			Bye{SSRC: 0xdeadbeef, Code: CloseServerBusy, Reason: "2 sessions open"}},
+		{"unknown code", Bye{Code: 1 << 40}, Bye{Code: 1 << 40}},
+		{"long reason", Bye{Code: CloseServerError, Reason: strings.Repeat("x", 300)},
+			Bye{Code: CloseServerError, Reason: strings.Repeat("x", maxByeReasonLength)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			buf, err := tc.bye.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if !isBye(buf) {
+				t.Fatalf("isBye(%x) = false", buf)
+			}
+			packets, err := rtcp.Unmarshal(buf)
+			if err != nil {
+				t.Fatalf("rtcp.Unmarshal: %v", err)
+			}
+			last, ok := packets[len(packets)-1].(*rtcp.Goodbye)
+			if !ok || len(last.Sources) != 1 || last.Sources[0] != tc.want.SSRC || last.Reason != tc.want.Reason {
+				t.Fatalf("last packet %v is not the RTCP BYE of %v", packets[len(packets)-1], tc.want)
+			}
+			var got Bye
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if got != tc.want {
+				t.Fatalf("UnmarshalBinary = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestByeInvalid(t *testing.T) {
+	goodbye, err := (&rtcp.Goodbye{Sources: []uint32{1}}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	valid, err := Bye{SSRC: 1, Code: CloseTimeout}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"rtp", testRTPPacket(1, 1, []byte("payload"))},
+		{"goodbye without app", goodbye},
+		{"app without goodbye", valid[:len(valid)-len(goodbye)]},
+		{"truncated", valid[:len(valid)-1]},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var b Bye
+			if err := b.UnmarshalBinary(tc.data); !errors.Is(err, ErrInvalidBye) {
+				t.Fatalf("UnmarshalBinary error = %v, want %v", err, ErrInvalidBye)
+			}
+		})
+	}
+}
+
+func TestIsBye(t *testing.T) {
+	bye, err := Bye{SSRC: 1, Code: CloseFinished}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	feedback, err := (&CCFeedback{SenderSSRC: 1}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"bye", bye, true},
+		{"feedback followed by bye", append(append([]byte{}, feedback...), bye...), true},
+		{"feedback", feedback, false},
+		{"rtp with bye payload", testRTPPacket(1, 1, bye), false},
+		{"hello", udpHello, false},
+		{"truncated compound", append(append([]byte{}, feedback[:len(feedback)-4]...), bye...), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isBye(tc.data); got != tc.want {
+				t.Fatalf("isBye(%x) = %v, want %v", tc.data, got, tc.want)
+			}
+		})
+	}
+}
+
+// BYE messages are protected by SRTCP, so they can not be forged or replayed
+// and are only recognized after they were unprotected.
+func TestByeSRTCP(t *testing.T) {
+	client, server := testSRTPContexts(t)
+	bye := Bye{SSRC: 42, Code: CloseServerShutdown, Reason: "restart", Packets: 7, Bytes: 7000, Duration: time.Second}
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	protected, err := server.Protect(msg)
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	if isBye(protected) {
+		t.Fatal("BYE recognized before it was unprotected")
+	}
+	if _, err := client.Unprotect(msg); !errors.Is(err, ErrSRTPAuthFailed) {
+		t.Fatalf("Unprotect of unprotected BYE error = %v, want %v", err, ErrSRTPAuthFailed)
+	}
+	unprotected, err := client.Unprotect(protected)
+	if err != nil {
+		t.Fatalf("Unprotect: %v", err)
+	}
+	if !isBye(unprotected) {
+		t.Fatal("unprotected BYE not recognized")
+	}
+	var got Bye
+	if err := got.UnmarshalBinary(unprotected); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if got != bye {
+		t.Fatalf("UnmarshalBinary = %+v, want %+v", got, bye)
+	}
+	if _, err := client.Unprotect(protected); !errors.Is(err, ErrSRTPReplayed) {
+		t.Fatalf("Unprotect of replayed BYE error = %v, want %v", err, ErrSRTPReplayed)
+	}
+}
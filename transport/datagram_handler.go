@@ -1,72 +1,279 @@
 package transport
 
 import (
-	"errors"
+	"context"
+	"encoding/binary"
 	"log"
+	"sort"
+	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go"
+	"github.com/pion/rtp"
 )
 
 type DatagramHandler struct {
-	src SrcFactory
+	src          SrcFactory
+	roq          *roqFlow
+	fragmentSize int
+
+	tracer        *QUICTracer
+	rtxSSRC       uint32
+	frameDeadline time.Duration
+	isKeyFrame    KeyFrameDetector
 }
 
 func NewDatagramHandler(src SrcFactory) *DatagramHandler {
 	return &DatagramHandler{
-		src: src,
+		src:        src,
+		isKeyFrame: isH264KeyFrameStart,
+	}
+}
+
+// SetKeyFrameDetector sets the function used to detect key frames, which are
+// retransmitted first. The default detects H.264 key frames.
+func (d *DatagramHandler) SetKeyFrameDetector(isKeyFrame KeyFrameDetector) {
+	d.isKeyFrame = isKeyFrame
+}
+
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier.
+func (d *DatagramHandler) EnableRoQ(flowID uint64) {
+	d.roq = newRoQFlow(flowID)
+}
+
+// EnableFragmentation splits RTP packets into fragments of at most size bytes
+// before sending them as datagrams. The size does not include the RoQ
+// framing. The client has to enable reassembly.
+func (d *DatagramHandler) EnableFragmentation(size int) error {
+	_, err := newFragmenter(size)
+	if err != nil {
+		return err
 	}
+	d.fragmentSize = size
+	return nil
+}
+
+// EnableRetransmissions retransmits RTP packets of the video stream ssrc in
+// QUIC packets which tracer reports lost on the connection of a session.
+// Packets are only retransmitted if they were sent less than deadline ago, a
+// deadline of 0 disables the limit. Packets of key frames are retransmitted
+// first. Retransmissions require plain datagrams without RoQ framing or
+// fragmentation, since the tracer has to parse the RTP header.
+func (d *DatagramHandler) EnableRetransmissions(tracer *QUICTracer, ssrc uint32, deadline time.Duration) {
+	tracer.EnableLossReports()
+	d.tracer = tracer
+	d.rtxSSRC = ssrc
+	d.frameDeadline = deadline
 }
 
-func (d *DatagramHandler) handle(session quic.Session) error {
+func (d *DatagramHandler) handle(ctx context.Context, session quic.Session) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
 	ds := &DatagramSession{
 		sess:        session,
+		roq:         d.roq,
 		feedback:    make(chan []byte, 1024),
-		closeChan:   make(chan error, 1),
+		closeChan:   make(chan struct{}, 1),
 		feedbackErr: make(chan error, 1),
 	}
+	if d.fragmentSize > 0 {
+		// size was validated in EnableFragmentation
+		ds.fragmenter, _ = newFragmenter(d.fragmentSize)
+	}
 
-	go ds.AcceptFeedback()
+	if d.tracer != nil {
+		lost := d.tracer.LostChan(session.RemoteAddr())
+		if lost != nil {
+			ds.history = newRTPPacketHistory(rtxHistorySize)
+			ds.historySSRC = d.rtxSSRC
+			ds.isKeyFrame = d.isKeyFrame
+			go ds.runRetransmissions(lost, d.frameDeadline, ctx.Done())
+		} else {
+			log.Printf("no loss reports for connection to %v, retransmissions disabled\n", session.RemoteAddr())
+		}
+	}
 
-	cancel := d.src.MakeSrc(ds, ds.feedback)
-	defer cancel()
+	go ds.AcceptFeedback(ctx)
+
+	counter := newSessionCounter(ds)
+	stop := d.src.MakeSrc(ctx, counter, ds.feedback)
+	defer stop()
 
-	var err error
+	var bye Bye
 	select {
-	case err = <-ds.closeChan:
-	case err = <-ds.feedbackErr:
+	case <-ds.closeChan:
+		bye = counter.bye(CloseFinished, "")
+	case err := <-ds.feedbackErr:
+		bye = counter.bye(CloseServerError, err.Error())
+	case <-ctx.Done():
+		bye = counter.bye(CloseServerShutdown, "")
 	}
 	log.Println("closing dgram session")
-	if err != nil {
-		log.Println(err)
-		return ds.sess.CloseWithError(1, err.Error())
-	}
-	return ds.sess.CloseWithError(0, "")
+	return closeSession(ds.sess, bye)
 }
 
+// Close is called by the source at the end of the stream.
 func (d *DatagramSession) Close() error {
-	d.closeChan <- errors.New("eos")
+	select {
+	case d.closeChan <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
 type DatagramSession struct {
 	sess        quic.Session
 	feedback    chan []byte
-	closeChan   chan error
+	closeChan   chan struct{}
 	feedbackErr chan error
+	roq         *roqFlow
+	fragmenter  *fragmenter
+
+	lock    sync.Mutex
+	history *rtpPacketHistory
+	// historySSRC is the SSRC of the video stream, whose packets are stored
+	// in the history
+	historySSRC   uint32
+	retransmitted int
+	expired       int
+
+	isKeyFrame KeyFrameDetector
+	// keyFrameTimestamp is the RTP timestamp of the latest key frame
+	keyFrameTimestamp uint32
+	keyFrameSent      bool
 }
 
-func (d *DatagramSession) AcceptFeedback() {
+// AcceptFeedback passes the feedback of the client to the source until the
+// session is closed or ctx is done.
+func (d *DatagramSession) AcceptFeedback(ctx context.Context) {
 	for {
 		msg, err := d.sess.ReceiveMessage()
 		if err != nil {
 			d.feedbackErr <- err
+			return
+		}
+		if d.roq != nil {
+			msg, err = d.roq.unmarshalDatagram(msg)
+			if err != nil {
+				log.Printf("dropping feedback: %v\n", err)
+				continue
+			}
+		}
+		select {
+		case d.feedback <- msg:
+		case <-ctx.Done():
+			return
 		}
-		d.feedback <- msg
 	}
 }
 
 func (d *DatagramSession) Write(b []byte) (int, error) {
-	err := d.sess.SendMessage(b)
-	return len(b), err
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.history != nil && d.isHistoryPacket(b) {
+		packet := &rtp.Packet{}
+		err := packet.Unmarshal(append([]byte{}, b...))
+		if err != nil {
+			return 0, err
+		}
+		d.history.store(packet)
+		if d.isKeyFrame(packet.Payload) {
+			d.keyFrameTimestamp = packet.Timestamp
+			d.keyFrameSent = true
+		}
+	}
+	return d.write(b)
+}
+
+// isHistoryPacket returns true if b is a media packet of the video stream.
+// RTCP packets, audio packets and FEC packets, which share the SSRC of the
+// video stream, are not retransmitted.
+func (d *DatagramSession) isHistoryPacket(b []byte) bool {
+	return isRTP(b) && !isRTCP(b) && binary.BigEndian.Uint32(b[8:12]) == d.historySSRC &&
+		b[1]&0x7F != FECPayloadType
+}
+
+func (d *DatagramSession) write(b []byte) (int, error) {
+	if d.fragmenter == nil {
+		return len(b), d.send(b)
+	}
+	fragments, err := d.fragmenter.fragment(b)
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range fragments {
+		err = d.send(f)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (d *DatagramSession) send(b []byte) error {
+	if d.roq != nil {
+		return d.sess.SendMessage(d.roq.marshalDatagram(b))
+	}
+	return d.sess.SendMessage(b)
+}
+
+// isKeyFramePacket returns true if packet belongs to the latest key frame. The
+// caller must hold the lock.
+func (d *DatagramSession) isKeyFramePacket(packet *rtp.Packet) bool {
+	return d.keyFrameSent && packet.Timestamp == d.keyFrameTimestamp
+}
+
+// runRetransmissions retransmits lost packets until done is closed.
+func (d *DatagramSession) runRetransmissions(lost <-chan []*Packet, deadline time.Duration, done <-chan struct{}) {
+	defer func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		log.Printf("retransmitted %v lost packets, %v expired\n", d.retransmitted, d.expired)
+	}()
+	for {
+		select {
+		case packets := <-lost:
+			err := d.retransmit(packets, deadline)
+			if err != nil {
+				log.Printf("failed to retransmit packets: %v\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// retransmit resends the lost packets which are still in the history and not
+// older than deadline, key frame packets first.
+func (d *DatagramSession) retransmit(packets []*Packet, deadline time.Duration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var resend []*sentRTPPacket
+	for _, p := range packets {
+		sent, ok := d.history.get(p.rtpSeqNr)
+		if !ok || sent.packet.SSRC != p.ssrc {
+			continue
+		}
+		if deadline > 0 && time.Since(sent.sent) > deadline {
+			d.expired++
+			continue
+		}
+		resend = append(resend, sent)
+	}
+	sort.SliceStable(resend, func(i, j int) bool {
+		return d.isKeyFramePacket(resend[i].packet) && !d.isKeyFramePacket(resend[j].packet)
+	})
+	for _, p := range resend {
+		b, err := p.packet.Marshal()
+		if err != nil {
+			return err
+		}
+		_, err = d.write(b)
+		if err != nil {
+			return err
+		}
+		d.retransmitted++
+	}
+	return nil
 }
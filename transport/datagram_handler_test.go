@@ -0,0 +1,43 @@
+package transport
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Only packets of the video stream are stored for retransmissions. A sender
+// report of the video SSRC, whose length field looks like the sequence number
+// of a video packet, must not replace that packet.
+func TestDatagramSessionHistory(t *testing.T) {
+	sess := newTestSession()
+	defer sess.cancel()
+	d := &DatagramSession{
+		sess:        sess,
+		history:     newRTPPacketHistory(rtxHistorySize),
+		historySSRC: 1,
+		isKeyFrame:  isH264KeyFrameStart,
+	}
+
+	video := testRTPPacket(6, 1, []byte("video"))
+	sr := append([]byte{0x80, 0xc8, 0x00, 0x06, 0x00, 0x00, 0x00, 0x01}, make([]byte, 20)...)
+	audio := testRTPPacket(7, 2, []byte("audio"))
+	fec := testRTPPacket(8, 1, []byte("fec"))
+	fec[1] = FECPayloadType
+	for _, b := range [][]byte{video, sr, audio, fec} {
+		if _, err := d.Write(b); err != nil {
+			t.Fatalf("Write(%x): %v", b, err)
+		}
+	}
+	for _, seq := range []uint16{7, 8} {
+		if _, ok := d.history.get(seq); ok {
+			t.Fatalf("packet %v stored in history", seq)
+		}
+	}
+
+	if err := d.retransmit([]*Packet{{rtpSeqNr: 6, ssrc: 1}}, 0); err != nil {
+		t.Fatalf("retransmit: %v", err)
+	}
+	if len(sess.sent) != 5 || !bytes.Equal(sess.sent[4], video) {
+		t.Fatalf("retransmitted %x, want %x", sess.sent[len(sess.sent)-1], video)
+	}
+}
@@ -0,0 +1,416 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidFECGroupSize = errors.New("invalid FEC group size")
+	ErrFECPacketTooShort   = errors.New("FEC packet too short")
+)
+
+// FECPayloadType is the RTP payload type used for FEC packets.
+const FECPayloadType = 127
+
+const (
+	rtpHeaderLen    = 12
+	fecHeaderLen    = 10
+	fecLevelLen     = 4
+	fecLevelLongLen = 8
+	maxFECGroupSize = 48
+	// fecHistorySize is the number of received media packets kept for
+	// recovery.
+	fecHistorySize = 1024
+)
+
+// FECSendWriter protects groups of RTP packets by XOR parity packets as
+// described in RFC 5109 (ULPFEC, protection level 0 only). After groupSize
+// media packets were written, a FEC packet protecting all of them is written
+// to the underlying writer. Groups are closed early if the next packet does
+// not fit into the window of maxFECGroupSize sequence numbers covered by the
+// FEC mask, e.g. after gaps in the sequence numbers. FEC packets use the SSRC
+// of the media stream, the payload type FECPayloadType and a separate
+// sequence number space.
+type FECSendWriter struct {
+	w         io.WriteCloser
+	groupSize int
+	group     [][]byte
+	seqNr     uint16
+
+	mediaBytes uint64
+	fecBytes   uint64
+}
+
+func NewFECSendWriter(w io.WriteCloser, groupSize int) (*FECSendWriter, error) {
+	if groupSize < 1 || groupSize > maxFECGroupSize {
+		return nil, fmt.Errorf("%w: %v, must be between 1 and %v", ErrInvalidFECGroupSize, groupSize, maxFECGroupSize)
+	}
+	return &FECSendWriter{
+		w:         w,
+		groupSize: groupSize,
+	}, nil
+}
+
+func (f *FECSendWriter) Write(b []byte) (int, error) {
+	if len(b) < rtpHeaderLen {
+		return 0, fmt.Errorf("RTP packet too short: %v bytes", len(b))
+	}
+	if !f.fits(b) {
+		// the FEC mask can not cover the packet, protect the group as is
+		err := f.flush()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	atomic.AddUint64(&f.mediaBytes, uint64(len(b)))
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	f.group = append(f.group, packet)
+	if len(f.group) < f.groupSize {
+		return n, nil
+	}
+	return n, f.flush()
+}
+
+// fits returns whether packet can be added to the current group, i.e. it has
+// the SSRC of the group and the sequence numbers of the group including
+// packet span at most maxFECGroupSize.
+func (f *FECSendWriter) fits(packet []byte) bool {
+	if len(f.group) == 0 {
+		return true
+	}
+	if binary.BigEndian.Uint32(packet[8:12]) != binary.BigEndian.Uint32(f.group[0][8:12]) {
+		return false
+	}
+	lo := binary.BigEndian.Uint16(packet[2:4])
+	hi := lo
+	for _, p := range f.group {
+		seqNr := binary.BigEndian.Uint16(p[2:4])
+		if int16(seqNr-lo) < 0 {
+			lo = seqNr
+		}
+		if int16(seqNr-hi) > 0 {
+			hi = seqNr
+		}
+	}
+	return hi-lo < maxFECGroupSize
+}
+
+// flush writes a FEC packet protecting the current group.
+func (f *FECSendWriter) flush() error {
+	if len(f.group) == 0 {
+		return nil
+	}
+	fec := marshalFECPacket(f.group, f.seqNr)
+	f.seqNr++
+	f.group = f.group[:0]
+	_, err := f.w.Write(fec)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&f.fecBytes, uint64(len(fec)))
+	return nil
+}
+
+// Close protects the remaining packets of an incomplete group and closes the
+// underlying writer.
+func (f *FECSendWriter) Close() error {
+	err := f.flush()
+	if err != nil {
+		log.Println(err)
+	}
+	return f.w.Close()
+}
+
+// MediaBitrate returns the share of target which is available for media
+// packets after subtracting the measured protection overhead.
+func (f *FECSendWriter) MediaBitrate(target uint) uint {
+	media := atomic.LoadUint64(&f.mediaBytes)
+	fec := atomic.LoadUint64(&f.fecBytes)
+	if media == 0 || fec == 0 {
+		return target * uint(f.groupSize) / uint(f.groupSize+1)
+	}
+	return uint(float64(target) * float64(media) / float64(media+fec))
+}
+
+// marshalFECPacket creates an RTP packet carrying a FEC header and a level 0
+// header protecting all packets of group. group must not be empty and all
+// packets must share the SSRC and fall into a window of maxFECGroupSize
+// sequence numbers.
+func marshalFECPacket(group [][]byte, seqNr uint16) []byte {
+	base := binary.BigEndian.Uint16(group[0][2:4])
+	long := false
+	protectionLength := 0
+	for _, p := range group {
+		if int16(binary.BigEndian.Uint16(p[2:4])-base) < 0 {
+			base = binary.BigEndian.Uint16(p[2:4])
+		}
+		if len(p)-rtpHeaderLen > protectionLength {
+			protectionLength = len(p) - rtpHeaderLen
+		}
+	}
+	levelLen := fecLevelLen
+	for _, p := range group {
+		if binary.BigEndian.Uint16(p[2:4])-base >= 16 {
+			long = true
+			levelLen = fecLevelLongLen
+		}
+	}
+	last := group[len(group)-1]
+
+	b := make([]byte, rtpHeaderLen+fecHeaderLen+levelLen+protectionLength)
+	b[0] = 0x80
+	b[1] = FECPayloadType
+	binary.BigEndian.PutUint16(b[2:4], seqNr)
+	copy(b[4:12], last[4:12]) // timestamp and SSRC
+
+	fecHeader := b[rtpHeaderLen : rtpHeaderLen+fecHeaderLen]
+	level := b[rtpHeaderLen+fecHeaderLen : rtpHeaderLen+fecHeaderLen+levelLen]
+	payload := b[rtpHeaderLen+fecHeaderLen+levelLen:]
+	var mask uint64
+	var lengthRecovery uint16
+	for _, p := range group {
+		fecHeader[0] ^= p[0]
+		fecHeader[1] ^= p[1]
+		for i := 0; i < 4; i++ {
+			fecHeader[4+i] ^= p[4+i]
+		}
+		lengthRecovery ^= uint16(len(p) - rtpHeaderLen)
+		for i, v := range p[rtpHeaderLen:] {
+			payload[i] ^= v
+		}
+		mask |= 1 << (47 - uint64(binary.BigEndian.Uint16(p[2:4])-base))
+	}
+	// E = 0, L, P/X/CC recovery
+	fecHeader[0] &= 0x3F
+	if long {
+		fecHeader[0] |= 0x40
+	}
+	binary.BigEndian.PutUint16(fecHeader[2:4], base)
+	binary.BigEndian.PutUint16(fecHeader[8:10], lengthRecovery)
+
+	binary.BigEndian.PutUint16(level[0:2], uint16(protectionLength))
+	binary.BigEndian.PutUint16(level[2:4], uint16(mask>>32))
+	if long {
+		binary.BigEndian.PutUint32(level[4:8], uint32(mask))
+	}
+	return b
+}
+
+// fecPacket is a parsed FEC packet.
+type fecPacket struct {
+	ssrc             uint32
+	base             uint16
+	protected        []uint16
+	header           []byte
+	lengthRecovery   uint16
+	protectionLength int
+	payload          []byte
+}
+
+func unmarshalFECPacket(b []byte) (*fecPacket, error) {
+	if len(b) < rtpHeaderLen+fecHeaderLen+fecLevelLen {
+		return nil, fmt.Errorf("%w: %v bytes", ErrFECPacketTooShort, len(b))
+	}
+	fecHeader := b[rtpHeaderLen : rtpHeaderLen+fecHeaderLen]
+	long := fecHeader[0]&0x40 != 0
+	levelLen := fecLevelLen
+	if long {
+		levelLen = fecLevelLongLen
+	}
+	if len(b) < rtpHeaderLen+fecHeaderLen+levelLen {
+		return nil, fmt.Errorf("%w: %v bytes", ErrFECPacketTooShort, len(b))
+	}
+	level := b[rtpHeaderLen+fecHeaderLen : rtpHeaderLen+fecHeaderLen+levelLen]
+	p := &fecPacket{
+		ssrc:             binary.BigEndian.Uint32(b[8:12]),
+		base:             binary.BigEndian.Uint16(fecHeader[2:4]),
+		header:           fecHeader,
+		lengthRecovery:   binary.BigEndian.Uint16(fecHeader[8:10]),
+		protectionLength: int(binary.BigEndian.Uint16(level[0:2])),
+		payload:          b[rtpHeaderLen+fecHeaderLen+levelLen:],
+	}
+	if len(p.payload) != p.protectionLength {
+		return nil, fmt.Errorf("%w: protection length %v, got %v bytes", ErrFECPacketTooShort, p.protectionLength, len(p.payload))
+	}
+	mask := uint64(binary.BigEndian.Uint16(level[2:4])) << 32
+	if long {
+		mask |= uint64(binary.BigEndian.Uint32(level[4:8]))
+	}
+	for i := uint16(0); i < maxFECGroupSize; i++ {
+		if mask&(1<<(47-uint64(i))) != 0 {
+			p.protected = append(p.protected, p.base+i)
+		}
+	}
+	return p, nil
+}
+
+// FECStats holds the statistics of a FECReceiveWriter.
+type FECStats struct {
+	// FECPackets is the number of received FEC packets.
+	FECPackets uint64
+	// Recovered is the number of media packets recovered from FEC packets.
+	Recovered uint64
+}
+
+func (s FECStats) String() string {
+	return fmt.Sprintf("received %v FEC packets, recovered %v media packets", s.FECPackets, s.Recovered)
+}
+
+// FECReceiveWriter removes FEC packets created by a FECSendWriter from the
+// stream of RTP packets and recovers lost media packets before writing them
+// to the underlying writer. Recovered packets are written as soon as they
+// could be recovered, reordering is left to the receiving pipeline.
+type FECReceiveWriter struct {
+	lock    sync.Mutex
+	w       io.Writer
+	history map[uint16][]byte
+	order   []uint16
+	pending []*fecPacket
+
+	fecPackets uint64
+	recovered  uint64
+}
+
+func NewFECReceiveWriter(w io.Writer) *FECReceiveWriter {
+	return &FECReceiveWriter{
+		w:       w,
+		history: make(map[uint16][]byte),
+	}
+}
+
+func (f *FECReceiveWriter) Write(b []byte) (int, error) {
+	if len(b) < rtpHeaderLen {
+		return 0, fmt.Errorf("RTP packet too short: %v bytes", len(b))
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if b[1]&0x7F == FECPayloadType {
+		atomic.AddUint64(&f.fecPackets, 1)
+		p, err := unmarshalFECPacket(b)
+		if err != nil {
+			log.Printf("dropping FEC packet: %v\n", err)
+			return len(b), nil
+		}
+		f.pending = append(f.pending, p)
+		return len(b), f.recover()
+	}
+	seqNr := binary.BigEndian.Uint16(b[2:4])
+	if _, ok := f.history[seqNr]; ok {
+		// already recovered
+		return len(b), nil
+	}
+	f.store(seqNr, b)
+	_, err := f.w.Write(b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), f.recover()
+}
+
+// store keeps a copy of a media packet for recovery, removing the oldest
+// packet if the history is full.
+func (f *FECReceiveWriter) store(seqNr uint16, b []byte) {
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	f.history[seqNr] = packet
+	f.order = append(f.order, seqNr)
+	if len(f.order) > fecHistorySize {
+		delete(f.history, f.order[0])
+		f.order = f.order[1:]
+	}
+}
+
+// recover tries to recover missing packets from all pending FEC packets.
+// FEC packets are removed when all protected packets were received or if they
+// are too old to be useful.
+func (f *FECReceiveWriter) recover() error {
+	recovered := true
+	for recovered {
+		recovered = false
+		var pending []*fecPacket
+		for _, p := range f.pending {
+			var missing []uint16
+			for _, seqNr := range p.protected {
+				if _, ok := f.history[seqNr]; !ok {
+					missing = append(missing, seqNr)
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			if len(missing) > 1 {
+				if len(f.order) > 0 && int16(f.order[len(f.order)-1]-p.base) > fecHistorySize/2 {
+					// protected packets are no longer in the history
+					continue
+				}
+				pending = append(pending, p)
+				continue
+			}
+			packet := f.recoverPacket(p, missing[0])
+			f.store(missing[0], packet)
+			atomic.AddUint64(&f.recovered, 1)
+			recovered = true
+			_, err := f.w.Write(packet)
+			if err != nil {
+				f.pending = pending
+				return err
+			}
+		}
+		f.pending = pending
+	}
+	return nil
+}
+
+// recoverPacket restores the packet with sequence number seqNr from p and the
+// other packets protected by p.
+func (f *FECReceiveWriter) recoverPacket(p *fecPacket, seqNr uint16) []byte {
+	header := make([]byte, 8)
+	copy(header, p.header[:8])
+	length := p.lengthRecovery
+	payload := make([]byte, p.protectionLength)
+	copy(payload, p.payload)
+	for _, s := range p.protected {
+		if s == seqNr {
+			continue
+		}
+		m := f.history[s]
+		header[0] ^= m[0]
+		header[1] ^= m[1]
+		for i := 0; i < 4; i++ {
+			header[4+i] ^= m[4+i]
+		}
+		length ^= uint16(len(m) - rtpHeaderLen)
+		for i, v := range m[rtpHeaderLen:] {
+			payload[i] ^= v
+		}
+	}
+	if int(length) > len(payload) {
+		length = uint16(len(payload))
+	}
+	b := make([]byte, rtpHeaderLen+int(length))
+	b[0] = 0x80 | header[0]&0x3F
+	b[1] = header[1]
+	binary.BigEndian.PutUint16(b[2:4], seqNr)
+	copy(b[4:8], header[4:8])
+	binary.BigEndian.PutUint32(b[8:12], p.ssrc)
+	copy(b[rtpHeaderLen:], payload[:length])
+	return b
+}
+
+func (f *FECReceiveWriter) Stats() FECStats {
+	return FECStats{
+		FECPackets: atomic.LoadUint64(&f.fecPackets),
+		Recovered:  atomic.LoadUint64(&f.recovered),
+	}
+}
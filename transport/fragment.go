@@ -0,0 +1,273 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrFragmentTooShort  = errors.New("fragment too short")
+	ErrInvalidFragment   = errors.New("invalid fragment header")
+	ErrFragmentSizeSmall = errors.New("fragment size too small")
+)
+
+// fragmentHeaderLen is the length of the header prepended to each fragment:
+// a 16 bit packet number, followed by the 8 bit index of the fragment and the
+// 8 bit number of fragments of the packet.
+const fragmentHeaderLen = 4
+
+const maxFragments = 255
+
+// recentPacketWindow is the number of completed or dropped packet numbers the
+// reassembler remembers to discard late fragments of these packets.
+const recentPacketWindow = 1024
+
+// fragmenter splits packets into fragments of at most size bytes including
+// the fragment header. Packets fitting into a single datagram are sent as a
+// single fragment.
+type fragmenter struct {
+	size int
+	next uint16
+}
+
+func newFragmenter(size int) (*fragmenter, error) {
+	if size <= fragmentHeaderLen {
+		return nil, fmt.Errorf("%w: %v, need more than %v bytes", ErrFragmentSizeSmall, size, fragmentHeaderLen)
+	}
+	return &fragmenter{size: size}, nil
+}
+
+func (f *fragmenter) fragment(packet []byte) ([][]byte, error) {
+	payloadSize := f.size - fragmentHeaderLen
+	count := (len(packet) + payloadSize - 1) / payloadSize
+	if count == 0 {
+		count = 1
+	}
+	if count > maxFragments {
+		return nil, fmt.Errorf("packet of %v bytes needs %v fragments, max is %v", len(packet), count, maxFragments)
+	}
+	number := f.next
+	f.next++
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * payloadSize
+		if end > len(packet) {
+			end = len(packet)
+		}
+		payload := packet[i*payloadSize : end]
+		b := make([]byte, fragmentHeaderLen, fragmentHeaderLen+len(payload))
+		binary.BigEndian.PutUint16(b, number)
+		b[2] = byte(i)
+		b[3] = byte(count)
+		fragments = append(fragments, append(b, payload...))
+	}
+	return fragments, nil
+}
+
+// FragmentStats holds the statistics of a reassembler.
+type FragmentStats struct {
+	// Fragments is the number of received fragments.
+	Fragments uint64
+	// Packets is the number of completely reassembled packets.
+	Packets uint64
+	// LostPackets is the number of packets which were dropped because
+	// fragments were missing when the timeout expired.
+	LostPackets uint64
+	// LostFragments is the number of missing fragments of lost packets.
+	LostFragments uint64
+	// LateFragments is the number of fragments which arrived after their
+	// packet was reassembled or dropped.
+	LateFragments uint64
+}
+
+func (s FragmentStats) String() string {
+	return fmt.Sprintf("received %v fragments, reassembled %v packets, lost %v packets (%v fragments missing), discarded %v late fragments", s.Fragments, s.Packets, s.LostPackets, s.LostFragments, s.LateFragments)
+}
+
+// reassembler reassembles packets from fragments and writes complete packets
+// to w. Incomplete packets are dropped after timeout.
+type reassembler struct {
+	lock    sync.Mutex
+	w       io.Writer
+	timeout time.Duration
+	pending map[uint16]*partialPacket
+
+	// recent is a ring of the numbers of the last recentPacketWindow
+	// completed or dropped packets, recentSet holds the same numbers for
+	// lookup. highest is the highest packet number seen so far.
+	recent     []uint16
+	recentNext int
+	recentSet  map[uint16]struct{}
+	highest    uint16
+
+	fragments     uint64
+	packets       uint64
+	lostPackets   uint64
+	lostFragments uint64
+	lateFragments uint64
+}
+
+type partialPacket struct {
+	fragments [][]byte
+	received  int
+	arrival   time.Time
+}
+
+func newReassembler(w io.Writer, timeout time.Duration) *reassembler {
+	return &reassembler{
+		w:         w,
+		timeout:   timeout,
+		pending:   make(map[uint16]*partialPacket),
+		recent:    make([]uint16, 0, recentPacketWindow),
+		recentSet: make(map[uint16]struct{}, recentPacketWindow),
+	}
+}
+
+// finish removes the packet from the pending packets and remembers its number
+// to recognize late fragments. r.lock must be held.
+func (r *reassembler) finish(number uint16) {
+	delete(r.pending, number)
+	if _, ok := r.recentSet[number]; ok {
+		return
+	}
+	if len(r.recent) < recentPacketWindow {
+		r.recent = append(r.recent, number)
+	} else {
+		delete(r.recentSet, r.recent[r.recentNext])
+		r.recent[r.recentNext] = number
+		r.recentNext = (r.recentNext + 1) % recentPacketWindow
+	}
+	r.recentSet[number] = struct{}{}
+}
+
+// isLate returns whether number belongs to a packet which was already
+// completed or dropped. Packet numbers wrap, so a remembered number ahead of
+// the highest number seen belongs to a new packet. r.lock must be held.
+func (r *reassembler) isLate(number uint16) bool {
+	if r.advance(number) {
+		return false
+	}
+	_, ok := r.recentSet[number]
+	return ok
+}
+
+// advance updates the highest packet number seen and returns whether number
+// is the new highest number. r.lock must be held.
+func (r *reassembler) advance(number uint16) bool {
+	if int16(number-r.highest) > 0 {
+		r.highest = number
+		return true
+	}
+	return false
+}
+
+func (r *reassembler) Write(b []byte) (int, error) {
+	if len(b) < fragmentHeaderLen {
+		return 0, fmt.Errorf("%w: %v bytes", ErrFragmentTooShort, len(b))
+	}
+	number := binary.BigEndian.Uint16(b)
+	index, count := int(b[2]), int(b[3])
+	if count == 0 || index >= count {
+		return 0, fmt.Errorf("%w: fragment %v of %v", ErrInvalidFragment, index, count)
+	}
+	atomic.AddUint64(&r.fragments, 1)
+	payload := b[fragmentHeaderLen:]
+	if count == 1 {
+		r.lock.Lock()
+		r.advance(number)
+		r.lock.Unlock()
+		atomic.AddUint64(&r.packets, 1)
+		_, err := r.w.Write(payload)
+		return len(b), err
+	}
+
+	r.lock.Lock()
+	p, ok := r.pending[number]
+	if !ok {
+		if r.isLate(number) {
+			r.lock.Unlock()
+			atomic.AddUint64(&r.lateFragments, 1)
+			log.Printf("dropping late fragment %v of packet %v\n", index, number)
+			return len(b), nil
+		}
+		p = &partialPacket{
+			fragments: make([][]byte, count),
+			arrival:   time.Now(),
+		}
+		r.pending[number] = p
+	}
+	if len(p.fragments) != count {
+		r.lock.Unlock()
+		return 0, fmt.Errorf("%w: fragment count %v of packet %v, expected %v", ErrInvalidFragment, count, number, len(p.fragments))
+	}
+	if p.fragments[index] != nil {
+		r.lock.Unlock()
+		log.Printf("dropping duplicate fragment %v of packet %v\n", index, number)
+		return len(b), nil
+	}
+	buf := make([]byte, len(payload))
+	copy(buf, payload)
+	p.fragments[index] = buf
+	p.received++
+	if p.received < count {
+		r.lock.Unlock()
+		return len(b), nil
+	}
+	r.finish(number)
+	r.lock.Unlock()
+
+	var packet []byte
+	for _, f := range p.fragments {
+		packet = append(packet, f...)
+	}
+	atomic.AddUint64(&r.packets, 1)
+	_, err := r.w.Write(packet)
+	return len(b), err
+}
+
+// dropExpired drops incomplete packets whose first fragment arrived more than
+// timeout ago.
+func (r *reassembler) dropExpired() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for number, p := range r.pending {
+		if time.Since(p.arrival) < r.timeout {
+			continue
+		}
+		missing := len(p.fragments) - p.received
+		log.Printf("dropping packet %v, %v of %v fragments missing\n", number, missing, len(p.fragments))
+		r.finish(number)
+		atomic.AddUint64(&r.lostPackets, 1)
+		atomic.AddUint64(&r.lostFragments, uint64(missing))
+	}
+}
+
+// run periodically drops expired packets until done is closed.
+func (r *reassembler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(r.timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.dropExpired()
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *reassembler) stats() FragmentStats {
+	return FragmentStats{
+		Fragments:     atomic.LoadUint64(&r.fragments),
+		Packets:       atomic.LoadUint64(&r.packets),
+		LostPackets:   atomic.LoadUint64(&r.lostPackets),
+		LostFragments: atomic.LoadUint64(&r.lostFragments),
+		LateFragments: atomic.LoadUint64(&r.lateFragments),
+	}
+}
@@ -0,0 +1,430 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	gccMinBitrate = 100000
+	gccMaxBitrate = 100000000
+
+	// packets sent within gccBurstTime belong to the same packet group
+	gccBurstTime = 5 * 65536 / 1000
+	// sent packets are forgotten after gccHistoryTime
+	gccHistoryTime = 2 * 65536
+
+	gccTrendlineWindow    = 20
+	gccTrendlineSmoothing = 0.9
+	gccTrendlineGain      = 4.0
+
+	gccPacingFactor  = 2.5
+	gccAckedRateTime = 500 * 65536 / 1000
+	gccLossInterval  = 100 * 65536 / 1000
+)
+
+type bandwidthUsage int
+
+const (
+	bwNormal bandwidthUsage = iota
+	bwUnderusing
+	bwOverusing
+)
+
+type rateControlState int
+
+const (
+	rcHold rateControlState = iota
+	rcIncrease
+	rcDecrease
+)
+
+type gccPacketGroup struct {
+	firstSent   uint32
+	lastSent    uint32
+	lastArrival uint32
+	size        int
+}
+
+// GCCController implements CongestionController using Google Congestion
+// Control as described in draft-ietf-rmcat-gcc-02. The target bitrate is the
+// minimum of a delay-based estimate (trendline filter, overuse detector and
+// AIMD rate controller) and a loss-based estimate.
+type GCCController struct {
+	mu   sync.Mutex
+	q    *Queue
+	ssrc uint
+
+	history *sentPacketHistory
+
+	currentGroup *gccPacketGroup
+	prevGroup    *gccPacketGroup
+	trendline    *trendlineEstimator
+	aimd         *aimdRateController
+
+	lossBitrate    float64
+	lastLossUpdate uint32
+	received       int
+	lost           int
+
+	acked []*sentPacket
+	rtt   float64 // ms
+
+	pacer           pacer
+	rateTransmitted rateCounter
+}
+
+func NewGCCController(ssrc uint, bitrate int, q *Queue) CongestionController {
+	initial := float64(bitrate * 1000)
+	return &GCCController{
+		q:           q,
+		ssrc:        ssrc,
+		history:     newSentPacketHistory(ssrc, gccHistoryTime),
+		trendline:   newTrendlineEstimator(),
+		aimd:        newAIMDRateController(initial),
+		lossBitrate: initial,
+	}
+}
+
+func (g *GCCController) OnMediaFrame(now uint32, packet *rtp.Packet) {
+}
+
+func (g *GCCController) OnPacketSent(now uint32, packet *rtp.Packet) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.history.onSent(now, packet)
+	g.pacer.sent(len(packet.Raw))
+	g.rateTransmitted.add(len(packet.Raw))
+}
+
+func (g *GCCController) OnCrossTraffic(now uint32, bytes int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.pacer.sent(bytes)
+	g.rateTransmitted.add(bytes)
+}
+
+func (g *GCCController) OnFeedback(now uint32, feedback []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	res, err := g.history.onFeedback(feedback)
+	if err != nil {
+		log.Printf("gcc: dropping invalid feedback: %v\n", err)
+		return
+	}
+	g.lost += res.lost
+	g.lost -= res.recovered
+	if g.lost < 0 {
+		g.lost = 0
+	}
+	g.received += len(res.acked)
+	for _, p := range res.acked {
+		if !p.hasArrival {
+			continue
+		}
+		g.acked = append(g.acked, p)
+		if sample := rttSample(now, res.reportTimestamp, p); sample > 0 {
+			if g.rtt == 0 {
+				g.rtt = sample
+			} else {
+				g.rtt = 0.9*g.rtt + 0.1*sample
+			}
+		}
+		g.onPacketArrival(p)
+	}
+	g.updateLossBasedBitrate(now)
+	g.aimd.update(g.trendline.state, g.ackedBitrate(), g.rtt, now)
+}
+
+// onPacketArrival groups acknowledged packets and feeds the delay variation
+// between consecutive groups to the trendline estimator.
+func (g *GCCController) onPacketArrival(p *sentPacket) {
+	if g.currentGroup == nil {
+		g.currentGroup = &gccPacketGroup{firstSent: p.sent, lastSent: p.sent, lastArrival: p.arrival, size: p.size}
+		return
+	}
+	if int32(p.sent-g.currentGroup.firstSent) < 0 {
+		// reordered packet from an older group
+		return
+	}
+	if int32(p.sent-g.currentGroup.firstSent) <= gccBurstTime {
+		g.currentGroup.lastSent = p.sent
+		if int32(p.arrival-g.currentGroup.lastArrival) > 0 {
+			g.currentGroup.lastArrival = p.arrival
+		}
+		g.currentGroup.size += p.size
+		return
+	}
+	if g.prevGroup != nil {
+		sendDelta := ntpDiffMs(g.currentGroup.lastSent, g.prevGroup.lastSent)
+		arrivalDelta := ntpDiffMs(g.currentGroup.lastArrival, g.prevGroup.lastArrival)
+		g.trendline.update(sendDelta, arrivalDelta, float64(g.currentGroup.lastArrival)*1000/65536)
+	}
+	g.prevGroup = g.currentGroup
+	g.currentGroup = &gccPacketGroup{firstSent: p.sent, lastSent: p.sent, lastArrival: p.arrival, size: p.size}
+}
+
+// ackedBitrate returns the receive rate of recently acknowledged packets in
+// bit/s.
+func (g *GCCController) ackedBitrate() float64 {
+	if len(g.acked) == 0 {
+		return 0
+	}
+	last := g.acked[len(g.acked)-1].arrival
+	i := 0
+	for i < len(g.acked) && int32(last-g.acked[i].arrival) > gccAckedRateTime {
+		i++
+	}
+	g.acked = g.acked[i:]
+	bytes := 0
+	for _, p := range g.acked {
+		bytes += p.size
+	}
+	return float64(bytes*8) / (float64(gccAckedRateTime) / 65536)
+}
+
+func (g *GCCController) updateLossBasedBitrate(now uint32) {
+	if int32(now-g.lastLossUpdate) < gccLossInterval || g.received+g.lost == 0 {
+		return
+	}
+	g.lastLossUpdate = now
+	loss := float64(g.lost) / float64(g.received+g.lost)
+	switch {
+	case loss > 0.1:
+		g.lossBitrate = g.lossBitrate * (1 - 0.5*loss)
+	case loss < 0.02:
+		g.lossBitrate = 1.05 * g.lossBitrate
+	}
+	g.lossBitrate = math.Max(gccMinBitrate, math.Min(gccMaxBitrate, g.lossBitrate))
+	g.received = 0
+	g.lost = 0
+}
+
+func (g *GCCController) IsOkToTransmit(now uint32) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.pacer.allow(now, gccPacingFactor*g.targetBitrate())
+}
+
+func (g *GCCController) TargetBitrate(now uint32) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return int(g.targetBitrate())
+}
+
+func (g *GCCController) targetBitrate() float64 {
+	return math.Min(g.aimd.rate, g.lossBitrate)
+}
+
+func (g *GCCController) Stats(now uint32) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return fmt.Sprintf(
+		"%.3f %v %v %v %.3f %v %.0f",
+		g.rtt/1000,
+		0,
+		g.history.bytesInFlight,
+		0,
+		g.q.GetDelay(float64(now)/65536),
+		int(g.targetBitrate())/1000,
+		g.rateTransmitted.get(now),
+	)
+}
+
+type trendlineEstimator struct {
+	numDeltas        int
+	firstArrival     float64
+	accumulatedDelay float64
+	smoothedDelay    float64
+	arrivals         []float64
+	smoothedDelays   []float64
+	prevTrend        float64
+
+	threshold           float64
+	lastThresholdUpdate float64
+	overuseTime         float64
+	overuseCounter      int
+	state               bandwidthUsage
+}
+
+func newTrendlineEstimator() *trendlineEstimator {
+	return &trendlineEstimator{
+		firstArrival: -1,
+		threshold:    12.5,
+	}
+}
+
+// update adds the delay variation of a packet group. All values are in ms.
+func (t *trendlineEstimator) update(sendDelta, arrivalDelta, arrival float64) {
+	if t.firstArrival < 0 {
+		t.firstArrival = arrival
+	}
+	t.numDeltas++
+	if t.numDeltas > 1000 {
+		t.numDeltas = 1000
+	}
+	t.accumulatedDelay += arrivalDelta - sendDelta
+	t.smoothedDelay = gccTrendlineSmoothing*t.smoothedDelay + (1-gccTrendlineSmoothing)*t.accumulatedDelay
+
+	t.arrivals = append(t.arrivals, arrival-t.firstArrival)
+	t.smoothedDelays = append(t.smoothedDelays, t.smoothedDelay)
+	if len(t.arrivals) > gccTrendlineWindow {
+		t.arrivals = t.arrivals[1:]
+		t.smoothedDelays = t.smoothedDelays[1:]
+	}
+
+	trend := t.prevTrend
+	if len(t.arrivals) == gccTrendlineWindow {
+		if slope, ok := linearFitSlope(t.arrivals, t.smoothedDelays); ok {
+			trend = slope
+		}
+	}
+	t.detect(trend, sendDelta, arrival)
+	t.prevTrend = trend
+}
+
+func (t *trendlineEstimator) detect(trend, sendDelta, now float64) {
+	if t.numDeltas < 2 {
+		t.state = bwNormal
+		return
+	}
+	modifiedTrend := math.Min(float64(t.numDeltas), 60) * trend * gccTrendlineGain
+	switch {
+	case modifiedTrend > t.threshold:
+		t.overuseTime += sendDelta
+		t.overuseCounter++
+		if t.overuseTime > 10 && t.overuseCounter > 1 && trend >= t.prevTrend {
+			t.overuseTime = 0
+			t.overuseCounter = 0
+			t.state = bwOverusing
+		}
+	case modifiedTrend < -t.threshold:
+		t.overuseTime = 0
+		t.overuseCounter = 0
+		t.state = bwUnderusing
+	default:
+		t.overuseTime = 0
+		t.overuseCounter = 0
+		t.state = bwNormal
+	}
+	t.updateThreshold(modifiedTrend, now)
+}
+
+func (t *trendlineEstimator) updateThreshold(modifiedTrend, now float64) {
+	if t.lastThresholdUpdate == 0 {
+		t.lastThresholdUpdate = now
+	}
+	abs := math.Abs(modifiedTrend)
+	if abs > t.threshold+15 {
+		// ignore spikes, e.g. caused by route changes
+		t.lastThresholdUpdate = now
+		return
+	}
+	k := 0.0087
+	if abs < t.threshold {
+		k = 0.039
+	}
+	dt := math.Min(now-t.lastThresholdUpdate, 100)
+	t.threshold += k * (abs - t.threshold) * dt
+	t.threshold = math.Max(6, math.Min(600, t.threshold))
+	t.lastThresholdUpdate = now
+}
+
+func linearFitSlope(x, y []float64) (float64, bool) {
+	var sumX, sumY float64
+	for i := range x {
+		sumX += x[i]
+		sumY += y[i]
+	}
+	avgX := sumX / float64(len(x))
+	avgY := sumY / float64(len(y))
+	var num, den float64
+	for i := range x {
+		num += (x[i] - avgX) * (y[i] - avgY)
+		den += (x[i] - avgX) * (x[i] - avgX)
+	}
+	if den == 0 {
+		return 0, false
+	}
+	return num / den, true
+}
+
+type aimdRateController struct {
+	state      rateControlState
+	rate       float64
+	avgMaxRate float64 // kbit/s
+	varMaxRate float64
+	lastUpdate uint32
+}
+
+func newAIMDRateController(initial float64) *aimdRateController {
+	return &aimdRateController{
+		state:      rcIncrease,
+		rate:       initial,
+		avgMaxRate: -1,
+		varMaxRate: 0.4,
+	}
+}
+
+func (a *aimdRateController) update(usage bandwidthUsage, ackedRate, rtt float64, now uint32) {
+	if a.lastUpdate == 0 {
+		a.lastUpdate = now
+	}
+	dt := ntpDiffMs(now, a.lastUpdate) / 1000
+	a.lastUpdate = now
+
+	switch usage {
+	case bwOverusing:
+		a.state = rcDecrease
+	case bwUnderusing:
+		a.state = rcHold
+	case bwNormal:
+		if a.state == rcHold {
+			a.state = rcIncrease
+		}
+	}
+
+	switch a.state {
+	case rcIncrease:
+		ackedKbps := ackedRate / 1000
+		if a.avgMaxRate >= 0 && ackedKbps > a.avgMaxRate+3*math.Sqrt(a.varMaxRate*a.avgMaxRate) {
+			// link capacity changed, forget the old estimate
+			a.avgMaxRate = -1
+		}
+		if a.avgMaxRate >= 0 && ackedKbps >= a.avgMaxRate-3*math.Sqrt(a.varMaxRate*a.avgMaxRate) {
+			// close to the last known capacity, increase additively by about one
+			// packet per response time
+			responseTime := rtt + 100
+			a.rate += math.Max(1000, 1200*8*dt*1000/responseTime)
+		} else {
+			a.rate *= math.Pow(1.08, math.Min(dt, 1))
+		}
+		if ackedRate > 0 {
+			a.rate = math.Min(a.rate, 1.5*ackedRate+10000)
+		}
+	case rcDecrease:
+		if ackedRate > 0 {
+			a.rate = 0.85 * ackedRate
+			a.updateMaxRate(ackedRate / 1000)
+		} else {
+			a.rate *= 0.85
+		}
+		a.state = rcHold
+	}
+	a.rate = math.Max(gccMinBitrate, math.Min(gccMaxBitrate, a.rate))
+}
+
+func (a *aimdRateController) updateMaxRate(kbps float64) {
+	if a.avgMaxRate < 0 {
+		a.avgMaxRate = kbps
+	} else {
+		a.avgMaxRate = 0.95*a.avgMaxRate + 0.05*kbps
+	}
+	norm := math.Max(a.avgMaxRate, 1)
+	a.varMaxRate = 0.95*a.varMaxRate + 0.05*(a.avgMaxRate-kbps)*(a.avgMaxRate-kbps)/norm
+	a.varMaxRate = math.Max(0.4, math.Min(2.5, a.varMaxRate))
+}
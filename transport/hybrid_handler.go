@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/pion/rtp"
+)
+
+// HybridHandler sends key frames reliably on a QUIC stream per frame and all
+// other frames as datagrams. For H.264, frames containing IDR slices or
+// parameter sets (SPS/PPS) are key frames. The session has to be created with
+// datagrams enabled.
+type HybridHandler struct {
+	src           SrcFactory
+	frameDeadline time.Duration
+	roq           *roqFlow
+	isKeyFrame    KeyFrameDetector
+}
+
+func NewHybridHandler(src SrcFactory) *HybridHandler {
+	return &HybridHandler{
+		src:        src,
+		isKeyFrame: isH264KeyFrameStart,
+	}
+}
+
+// SetKeyFrameDetector sets the function used to detect key frames. The default
+// detects H.264 key frames.
+func (m *HybridHandler) SetKeyFrameDetector(isKeyFrame KeyFrameDetector) {
+	m.isKeyFrame = isKeyFrame
+}
+
+// SetFrameDeadline sets the deadline for key frames sent on streams, see
+// StreamPerFrameHandler.SetFrameDeadline.
+func (m *HybridHandler) SetFrameDeadline(deadline time.Duration) {
+	m.frameDeadline = deadline
+}
+
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier.
+func (m *HybridHandler) EnableRoQ(flowID uint64) {
+	m.roq = newRoQFlow(flowID)
+}
+
+func (m *HybridHandler) handle(ctx context.Context, sess quic.Session) error {
+	session := &HybridSession{
+		StreamPerFrameSession: &StreamPerFrameSession{
+			streamSession: newStreamSession(sess, m.frameDeadline, m.roq),
+		},
+		isKeyFrame: m.isKeyFrame,
+	}
+	return handleStreamSession(ctx, m.src, session.streamSession, session)
+}
+
+// HybridSession writes key frames using the embedded StreamPerFrameSession and
+// all other packets as datagrams. A frame is treated as key frame from the
+// first packet detected as key frame on.
+type HybridSession struct {
+	*StreamPerFrameSession
+
+	isKeyFrame        KeyFrameDetector
+	keyFrame          bool
+	keyFrameTimestamp uint32
+}
+
+func (m *HybridSession) Write(b []byte) (int, error) {
+	if isRTCP(b) {
+		return len(b), m.sendDatagram(b)
+	}
+	packet := &rtp.Packet{}
+	err := packet.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	if m.keyFrame && packet.Timestamp != m.keyFrameTimestamp {
+		m.keyFrame = false
+		// flush key frames which did not have the marker bit set
+		m.lock.Lock()
+		err = m.flush()
+		m.lock.Unlock()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if !m.keyFrame && m.isKeyFrame(packet.Payload) {
+		m.keyFrame = true
+		m.keyFrameTimestamp = packet.Timestamp
+	}
+	if m.keyFrame {
+		return m.StreamPerFrameSession.Write(b)
+	}
+	return len(b), m.sendDatagram(b)
+}
+
+func (m *HybridSession) sendDatagram(b []byte) error {
+	if m.roq != nil {
+		return m.session.SendMessage(m.roq.marshalDatagram(b))
+	}
+	return m.session.SendMessage(b)
+}
+
+const (
+	h264NALUTypeIDR   = 5
+	h264NALUTypeSPS   = 7
+	h264NALUTypePPS   = 8
+	h264NALUTypeSTAPA = 24
+	h264NALUTypeFUA   = 28
+)
+
+// isH264KeyFramePayload returns true if the RTP payload (RFC 6184) contains an
+// IDR slice, a SPS or a PPS.
+func isH264KeyFramePayload(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	switch t := payload[0] & 0x1F; t {
+	case h264NALUTypeSTAPA:
+		for i := 1; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isH264KeyFrameNALUType(payload[i+2] & 0x1F) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case h264NALUTypeFUA:
+		return len(payload) > 1 && isH264KeyFrameNALUType(payload[1]&0x1F)
+	default:
+		return isH264KeyFrameNALUType(t)
+	}
+}
+
+func isH264KeyFrameNALUType(t byte) bool {
+	return t == h264NALUTypeIDR || t == h264NALUTypeSPS || t == h264NALUTypePPS
+}
+
+// isH264KeyFrameStart returns true if the RTP payload contains the beginning
+// of an IDR slice or parameter set, i.e. it is not a continuation of a
+// fragmented NAL unit.
+func isH264KeyFrameStart(payload []byte) bool {
+	if !isH264KeyFramePayload(payload) {
+		return false
+	}
+	if payload[0]&0x1F == h264NALUTypeFUA {
+		return payload[1]&0x80 != 0
+	}
+	return true
+}
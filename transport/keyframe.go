@@ -0,0 +1,120 @@
+package transport
+
+import "fmt"
+
+// KeyFrameDetector returns true if an RTP payload contains the beginning of a
+// key frame. For H.264 and H.265, parameter sets sent before a key frame are
+// treated as its beginning.
+type KeyFrameDetector func(payload []byte) bool
+
+var keyFrameDetectors = map[string]KeyFrameDetector{
+	"h264": isH264KeyFrameStart,
+	"h265": isH265KeyFrameStart,
+	"vp8":  isVP8KeyFrameStart,
+	"vp9":  isVP9KeyFrameStart,
+	"av1":  isAV1KeyFrameStart,
+}
+
+// GetKeyFrameDetector returns the key frame detector for the payload format of
+// the codec with the given name.
+func GetKeyFrameDetector(codec string) (KeyFrameDetector, error) {
+	d, ok := keyFrameDetectors[codec]
+	if !ok {
+		return nil, fmt.Errorf("no key frame detector for codec: %v", codec)
+	}
+	return d, nil
+}
+
+const (
+	h265NALUTypeIRAPFirst = 16
+	h265NALUTypeIRAPLast  = 23
+	h265NALUTypeVPS       = 32
+	h265NALUTypeSPS       = 33
+	h265NALUTypePPS       = 34
+	h265NALUTypeAP        = 48
+	h265NALUTypeFU        = 49
+)
+
+// isH265KeyFrameStart returns true if the RTP payload (RFC 7798) contains the
+// beginning of an IRAP picture or a parameter set.
+func isH265KeyFrameStart(payload []byte) bool {
+	if len(payload) < 2 {
+		return false
+	}
+	switch t := h265NALUType(payload[0]); t {
+	case h265NALUTypeAP:
+		for i := 2; i+2 < len(payload); {
+			size := int(payload[i])<<8 | int(payload[i+1])
+			if isH265KeyFrameNALUType(h265NALUType(payload[i+2])) {
+				return true
+			}
+			i += 2 + size
+		}
+		return false
+	case h265NALUTypeFU:
+		return len(payload) > 2 && payload[2]&0x80 != 0 && isH265KeyFrameNALUType(payload[2]&0x3F)
+	default:
+		return isH265KeyFrameNALUType(t)
+	}
+}
+
+func h265NALUType(b byte) byte {
+	return (b >> 1) & 0x3F
+}
+
+func isH265KeyFrameNALUType(t byte) bool {
+	return (t >= h265NALUTypeIRAPFirst && t <= h265NALUTypeIRAPLast) ||
+		t == h265NALUTypeVPS || t == h265NALUTypeSPS || t == h265NALUTypePPS
+}
+
+// isVP8KeyFrameStart returns true if the RTP payload (RFC 7741) contains the
+// start of the first partition of a key frame.
+func isVP8KeyFrameStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	// S bit set and partition index 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return false
+	}
+	i := 1
+	if payload[0]&0x80 != 0 { // X: extension
+		if len(payload) < 2 {
+			return false
+		}
+		ext := payload[1]
+		i++
+		if ext&0x80 != 0 { // I: picture ID
+			if len(payload) <= i {
+				return false
+			}
+			if payload[i]&0x80 != 0 {
+				i += 2
+			} else {
+				i++
+			}
+		}
+		if ext&0x40 != 0 { // L: TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // T or K: TID/Y/KEYIDX
+			i++
+		}
+	}
+	// P bit of the VP8 payload header is 0 for key frames
+	return len(payload) > i && payload[i]&0x01 == 0
+}
+
+// isVP9KeyFrameStart returns true if the RTP payload contains the beginning
+// of a frame which is not inter-picture predicted.
+func isVP9KeyFrameStart(payload []byte) bool {
+	// P: inter-picture predicted, B: beginning of frame
+	return len(payload) > 0 && payload[0]&0x40 == 0 && payload[0]&0x08 != 0
+}
+
+// isAV1KeyFrameStart returns true if the RTP payload starts a new coded video
+// sequence, which begins with a key frame.
+func isAV1KeyFrameStart(payload []byte) bool {
+	// Z: continuation of an OBU, N: first packet of a coded video sequence
+	return len(payload) > 0 && payload[0]&0x80 == 0 && payload[0]&0x08 != 0
+}
@@ -0,0 +1,264 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+
+	"github.com/pion/rtp"
+)
+
+// NADA parameters, see RFC 8698, Figure 3
+const (
+	nadaPrio      = 1.0
+	nadaRMin      = 150000
+	nadaRMax      = 5000000
+	nadaXRef      = 10.0 // ms
+	nadaKappa     = 0.5
+	nadaEta       = 2.0
+	nadaTau       = 500.0 // ms
+	nadaDelta     = 100.0 // ms
+	nadaLogWin    = 500.0 // ms
+	nadaQEps      = 10.0  // ms
+	nadaDFilt     = 120.0 // ms
+	nadaGammaMax  = 0.5
+	nadaQBound    = 50.0 // ms
+	nadaMultiLoss = 7.0
+	nadaQTh       = 50.0 // ms
+	nadaLambda    = 0.5
+	nadaPLRRef    = 0.01
+	nadaPMRRef    = 0.01
+	nadaDLoss     = 10.0 // ms
+	nadaDMark     = 2.0  // ms
+	nadaFPS       = 30.0
+	nadaBetaV     = 0.1
+	nadaBetaS     = 0.1
+	nadaAlpha     = 0.1
+
+	// window size of the minimum filter applied to queuing delay samples
+	nadaMinFilterSize = 15
+	nadaHistoryTime   = 2 * 65536
+)
+
+// NADAController implements CongestionController using the Network-Assisted
+// Dynamic Adaptation algorithm described in RFC 8698. The composite congestion
+// signal is calculated at the sender from the per-packet arrival times, loss
+// and ECN marking reported in RFC 8888 feedback.
+type NADAController struct {
+	mu   sync.Mutex
+	q    *Queue
+	ssrc uint
+
+	history *sentPacketHistory
+
+	baseDelay    float64
+	hasBaseDelay bool
+	queueDelays  []float64
+	queueDelay   float64
+
+	received int
+	lost     int
+	marked   int
+	pLoss    float64
+	pMark    float64
+	lastLoss uint32
+	hasLoss  bool
+
+	acked []*sentPacket
+	rtt   float64 // ms
+
+	xPrev      float64
+	rRef       float64
+	rVin       float64
+	rSend      float64
+	rampUp     bool
+	lastUpdate uint32
+
+	pacer           pacer
+	rateTransmitted rateCounter
+}
+
+func NewNADAController(ssrc uint, bitrate int, q *Queue) CongestionController {
+	initial := math.Max(nadaRMin, math.Min(nadaRMax, float64(bitrate*1000)))
+	return &NADAController{
+		q:       q,
+		ssrc:    ssrc,
+		history: newSentPacketHistory(ssrc, nadaHistoryTime),
+		rRef:    initial,
+		rVin:    initial,
+		rSend:   initial,
+	}
+}
+
+func (n *NADAController) OnMediaFrame(now uint32, packet *rtp.Packet) {
+}
+
+func (n *NADAController) OnPacketSent(now uint32, packet *rtp.Packet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.history.onSent(now, packet)
+	n.pacer.sent(len(packet.Raw))
+	n.rateTransmitted.add(len(packet.Raw))
+}
+
+func (n *NADAController) OnCrossTraffic(now uint32, bytes int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pacer.sent(bytes)
+	n.rateTransmitted.add(bytes)
+}
+
+func (n *NADAController) OnFeedback(now uint32, feedback []byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	res, err := n.history.onFeedback(feedback)
+	if err != nil {
+		log.Printf("nada: dropping invalid feedback: %v\n", err)
+		return
+	}
+	n.lost += res.lost
+	n.lost -= res.recovered
+	if n.lost < 0 {
+		n.lost = 0
+	}
+	if res.lost > 0 {
+		n.lastLoss = now
+		n.hasLoss = true
+	}
+	n.received += len(res.acked)
+	for _, p := range res.acked {
+		// ECN-CE is signaled as 0b11
+		if p.ecn == 0x3 {
+			n.marked++
+		}
+		if !p.hasArrival {
+			continue
+		}
+		n.acked = append(n.acked, p)
+		if sample := rttSample(now, res.reportTimestamp, p); sample > 0 {
+			if n.rtt == 0 {
+				n.rtt = sample
+			} else {
+				n.rtt = 0.9*n.rtt + 0.1*sample
+			}
+		}
+		n.onDelaySample(ntpDiffMs(p.arrival, p.sent))
+	}
+	if n.lastUpdate == 0 {
+		n.lastUpdate = now
+	}
+	if delta := ntpDiffMs(now, n.lastUpdate); delta >= nadaDelta {
+		n.updateReferenceRate(now, delta)
+		n.lastUpdate = now
+	}
+}
+
+// onDelaySample updates the queuing delay estimate with a one-way delay
+// sample. Sender and receiver clocks are not synchronized, so the queuing
+// delay is measured relative to the smallest delay seen so far.
+func (n *NADAController) onDelaySample(forwardDelay float64) {
+	if !n.hasBaseDelay || forwardDelay < n.baseDelay {
+		n.baseDelay = forwardDelay
+		n.hasBaseDelay = true
+	}
+	n.queueDelays = append(n.queueDelays, forwardDelay-n.baseDelay)
+	if len(n.queueDelays) > nadaMinFilterSize {
+		n.queueDelays = n.queueDelays[1:]
+	}
+	n.queueDelay = n.queueDelays[0]
+	for _, d := range n.queueDelays {
+		n.queueDelay = math.Min(n.queueDelay, d)
+	}
+}
+
+// receiveRate returns the rate of packets acknowledged within the last
+// nadaLogWin in bit/s.
+func (n *NADAController) receiveRate() float64 {
+	if len(n.acked) == 0 {
+		return 0
+	}
+	last := n.acked[len(n.acked)-1].arrival
+	i := 0
+	for i < len(n.acked) && ntpDiffMs(last, n.acked[i].arrival) > nadaLogWin {
+		i++
+	}
+	n.acked = n.acked[i:]
+	bytes := 0
+	for _, p := range n.acked {
+		bytes += p.size
+	}
+	return float64(bytes*8) / (nadaLogWin / 1000)
+}
+
+func (n *NADAController) updateReferenceRate(now uint32, delta float64) {
+	if total := n.received + n.lost; total > 0 {
+		n.pLoss = nadaAlpha*float64(n.lost)/float64(total) + (1-nadaAlpha)*n.pLoss
+	}
+	if n.received > 0 {
+		n.pMark = nadaAlpha*float64(n.marked)/float64(n.received) + (1-nadaAlpha)*n.pMark
+	}
+	n.received, n.lost, n.marked = 0, 0, 0
+
+	recentLoss := n.hasLoss && ntpDiffMs(now, n.lastLoss) < nadaMultiLoss*nadaDelta
+
+	dTilde := n.queueDelay
+	if recentLoss && dTilde > nadaQTh {
+		// warp the delay signal to avoid reacting to both, delay and loss
+		dTilde = nadaQTh * math.Exp(-nadaLambda*math.Pow((n.queueDelay-nadaQTh)/nadaQTh, 4))
+	}
+	xCurr := dTilde +
+		math.Pow(n.pMark/nadaPMRRef, 2)*nadaDMark +
+		math.Pow(n.pLoss/nadaPLRRef, 2)*nadaDLoss
+
+	rRecv := n.receiveRate()
+	n.rampUp = !(n.hasLoss && ntpDiffMs(now, n.lastLoss) < nadaLogWin) && n.pMark == 0 && n.queueDelay < nadaQEps
+	if n.rampUp {
+		gamma := math.Min(nadaGammaMax, nadaQBound/(n.rtt+nadaDelta+nadaDFilt))
+		n.rRef = math.Max(n.rRef, (1+gamma)*rRecv)
+	} else {
+		delta = math.Min(delta, 2*nadaTau)
+		xOffset := xCurr - nadaPrio*nadaXRef*nadaRMax/n.rRef
+		xDiff := xCurr - n.xPrev
+		n.rRef = n.rRef -
+			nadaKappa*(delta/nadaTau)*(xOffset/nadaTau)*n.rRef -
+			nadaKappa*nadaEta*(xDiff/nadaTau)*n.rRef
+	}
+	n.rRef = math.Max(nadaRMin, math.Min(nadaRMax, n.rRef))
+	n.xPrev = xCurr
+}
+
+func (n *NADAController) IsOkToTransmit(now uint32) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	// rate shaping buffer, see RFC 8698, Section 5.2.2
+	bufferLen := float64(n.q.BytesInQueue())
+	n.rVin = math.Max(nadaRMin, n.rRef-nadaBetaV*8*bufferLen*nadaFPS)
+	n.rSend = math.Min(nadaRMax, n.rRef+nadaBetaS*8*bufferLen*nadaFPS)
+	return n.pacer.allow(now, n.rSend)
+}
+
+func (n *NADAController) TargetBitrate(now uint32) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return int(n.rVin)
+}
+
+func (n *NADAController) Stats(now uint32) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	rampUp := 0
+	if n.rampUp {
+		rampUp = 1
+	}
+	return fmt.Sprintf(
+		"%.3f %v %v %v %.3f %v %.0f",
+		n.rtt/1000,
+		0,
+		n.history.bytesInFlight,
+		rampUp,
+		n.queueDelay/1000,
+		int(n.rVin)/1000,
+		n.rateTransmitted.get(now),
+	)
+}
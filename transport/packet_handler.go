@@ -1,63 +1,579 @@
 package transport
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// DefaultUDPIdleTimeout is the time after which UDP sessions are closed
+	// if no packet was received from the peer.
+	DefaultUDPIdleTimeout = 10 * time.Second
+	// MinUDPIdleTimeout is the shortest idle timeout, which still lets some
+	// keepalives of an idle client get lost.
+	MinUDPIdleTimeout = 3 * udpKeepaliveInterval
+)
+
+var ErrUDPIdleTimeout = errors.New("udp idle timeout too short")
+
+// Control messages of the udp handler. They are sent unprotected next to the
+// RTP and RTCP packets, from which they differ by not starting with RTP
+// version 2. Sessions are ended by BYE messages in both directions, which are
+// RTCP packets protected by SRTCP like all other RTCP packets. Only the BYE
+// messages rejecting a hello are sent unprotected, since there are no keys
+// before the welcome.
+var (
+	// udpHello starts a session, it is repeated until the server answers.
+	// It is followed by the random nonce of the client.
+	udpHello = []byte("hello")
+	// udpWelcome accepts a session. It is followed by the random cookie of
+	// the server, which is also the nonce of the server. The SRTP keys of a
+	// session are derived from both nonces.
+	udpWelcome = []byte("welcome")
+	// udpStart echoes the cookie of the welcome message. The server only
+	// starts streaming after the client proved that it receives packets at
+	// its address, so spoofed hello messages can not direct a stream to
+	// another host. It is repeated until the first packet of the stream
+	// arrives.
+	udpStart = []byte("start")
+	// udpKeepalive is sent by clients to keep idle sessions open
+	udpKeepalive = []byte("keepalive")
+)
+
+// udpHandshakeMessage returns the control message msg followed by nonce.
+func udpHandshakeMessage(msg, nonce []byte) []byte {
+	b := make([]byte, 0, len(msg)+len(nonce))
+	b = append(b, msg...)
+	return append(b, nonce...)
+}
+
+// parseUDPHandshakeMessage returns the nonce of b if b is the control message
+// msg followed by a nonce.
+func parseUDPHandshakeMessage(b, msg []byte) ([]byte, bool) {
+	if len(b) != len(msg)+srtpNonceLength || !bytes.HasPrefix(b, msg) {
+		return nil, false
+	}
+	return b[len(msg):], true
+}
+
+// UDPPacketHandler serves RTP over UDP. Sessions are started by a handshake
+// and kept in a session table until the stream ends, the client says bye or
+// no packet was received from the client for the idle timeout.
 type UDPPacketHandler struct {
 	src        SrcFactory
 	sessions   map[string]*UDPPacketSession
 	sessionMux sync.Mutex
+
+	// maxSessions is the maximum number of concurrent sessions, 0 means no
+	// limit
+	maxSessions int
+	idleTimeout time.Duration
+	sessionLog  *log.Logger
+	start       time.Time
+
+	// srtpKey is the pre-shared key from which the SRTP keys of each
+	// session are derived
+	srtpKey      []byte
+	srtpStatsLog io.Writer
+
+	// closing is set by shutdown, drained is closed when the last session
+	// ended afterwards
+	closing bool
+	drained chan struct{}
 }
 
 func NewUDPPacketHandler(src SrcFactory) *UDPPacketHandler {
 	return &UDPPacketHandler{
-		src:      src,
-		sessions: make(map[string]*UDPPacketSession),
+		src:         src,
+		sessions:    make(map[string]*UDPPacketSession),
+		idleTimeout: DefaultUDPIdleTimeout,
+		start:       time.Now(),
 	}
 }
 
-func (h *UDPPacketHandler) handle(conn net.PacketConn, addr net.Addr, buf []byte) error {
+// SetMaxSessions limits the number of concurrent sessions, further clients
+// are rejected. 0 disables the limit.
+func (h *UDPPacketHandler) SetMaxSessions(n int) {
+	h.maxSessions = n
+}
+
+// SetIdleTimeout sets the time after which sessions are closed if no packet
+// was received from the client. It must be at least MinUDPIdleTimeout.
+func (h *UDPPacketHandler) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < MinUDPIdleTimeout {
+		return fmt.Errorf("%w: got %v, expected at least %v", ErrUDPIdleTimeout, timeout, MinUDPIdleTimeout)
+	}
+	h.idleTimeout = timeout
+	return nil
+}
+
+// SetSessionLogger logs the statistics of each closed session to w.
+func (h *UDPPacketHandler) SetSessionLogger(w io.Writer) {
+	h.sessionLog = log.New(w, "", 0)
+}
+
+// EnableSRTP protects the packets of all sessions by SRTP and SRTCP. Each
+// session uses its own SRTPContext, whose keys are derived from the
+// pre-shared key psk and the nonces of the handshake. If statsLogger is not
+// nil, the SRTP statistics of each session are logged to it.
+func (h *UDPPacketHandler) EnableSRTP(psk []byte, statsLogger io.Writer) error {
+	if len(psk) < MinSRTPPreSharedKeyLength {
+		return fmt.Errorf("%w: got %v bytes of pre-shared key, expected at least %v", ErrInvalidSRTPKey, len(psk), MinSRTPPreSharedKeyLength)
+	}
+	h.srtpKey = psk
+	h.srtpStatsLog = statsLogger
+	return nil
+}
+
+// Sessions returns the statistics of all open sessions.
+func (h *UDPPacketHandler) Sessions() []UDPSessionStats {
 	h.sessionMux.Lock()
 	defer h.sessionMux.Unlock()
-	ps, ok := h.sessions[addr.String()]
+	stats := make([]UDPSessionStats, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		stats = append(stats, s.Stats())
+	}
+	return stats
+}
 
+func (h *UDPPacketHandler) handle(conn net.PacketConn, addr net.Addr, buf []byte) error {
+	h.sessionMux.Lock()
+	ps, ok := h.sessions[addr.String()]
+	if ok {
+		h.sessionMux.Unlock()
+		ps.receive(buf)
+		return nil
+	}
+	clientNonce, ok := parseUDPHandshakeMessage(buf, udpHello)
 	if !ok {
-		ps = &UDPPacketSession{
-			conn:     conn,
-			addr:     addr,
-			feedback: make(chan []byte, 1024),
-		}
-		cancel := h.src.MakeSrc(ps, ps.feedback) // nil: QUIC Feedback not implemented for UDP
-		ps.cancelFn = cancel
-		h.sessions[addr.String()] = ps
+		h.sessionMux.Unlock()
+		log.Printf("dropping packet of unknown session %v\n", addr)
 		return nil
 	}
+	if h.closing {
+		h.sessionMux.Unlock()
+		log.Printf("rejecting session %v, shutting down\n", addr)
+		return writeBye(conn, addr, Bye{Code: CloseServerShutdown})
+	}
+	if h.maxSessions > 0 && len(h.sessions) >= h.maxSessions {
+		h.sessionMux.Unlock()
+		log.Printf("rejecting session %v, %v sessions open\n", addr, h.maxSessions)
+		return writeBye(conn, addr, Bye{Code: CloseServerBusy, Reason: fmt.Sprintf("%v sessions open", h.maxSessions)})
+	}
+	ps, err := h.newSession(conn, addr, clientNonce)
+	if err != nil {
+		h.sessionMux.Unlock()
+		return err
+	}
+	h.sessions[addr.String()] = ps
+	h.sessionMux.Unlock()
 
-	ps.AcceptFeedback(buf)
+	log.Printf("welcoming udp session %v\n", addr)
+	go ps.watchIdle(h.idleTimeout)
+	_, err = conn.WriteTo(ps.welcome, addr)
+	if err != nil {
+		ps.teardown(CloseServerError, err.Error())
+		return err
+	}
 	return nil
 }
 
+func (h *UDPPacketHandler) newSession(conn net.PacketConn, addr net.Addr, clientNonce []byte) (*UDPPacketSession, error) {
+	serverNonce, err := newSRTPNonce()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ps := &UDPPacketSession{
+		handler:   h,
+		conn:      conn,
+		addr:      addr,
+		cookie:    serverNonce,
+		welcome:   udpHandshakeMessage(udpWelcome, serverNonce),
+		feedback:  make(chan []byte, 1024),
+		ctx:       ctx,
+		cancelCtx: cancel,
+		start:     time.Now(),
+	}
+	ps.lastReceived = ps.start.UnixNano()
+	if h.srtpKey != nil {
+		srtp, err := NewSRTPSessionContext(h.srtpKey, clientNonce, serverNonce, false)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		if h.srtpStatsLog != nil {
+			srtp.SetStatsLogger(h.srtpStatsLog)
+		}
+		go srtp.Run(ctx.Done())
+		ps.srtp = srtp
+	}
+	return ps, nil
+}
+
+// remove removes s from the session table and logs its statistics.
+func (h *UDPPacketHandler) remove(s *UDPPacketSession) {
+	h.sessionMux.Lock()
+	if h.sessions[s.addr.String()] == s {
+		delete(h.sessions, s.addr.String())
+	}
+	open := len(h.sessions)
+	if h.closing && open == 0 {
+		h.closeDrained()
+	}
+	h.sessionMux.Unlock()
+
+	stats := s.Stats()
+	log.Printf("%v, %v sessions open\n", stats, open)
+	if h.sessionLog != nil {
+		h.sessionLog.Println(stats.logLine(h.start))
+	}
+}
+
+// shutdown rejects new sessions and waits until all sessions ended. Sessions
+// whose client did not echo the cookie yet are closed right away, the
+// remaining sessions are closed when ctx is done.
+func (h *UDPPacketHandler) shutdown(ctx context.Context) error {
+	h.sessionMux.Lock()
+	h.closing = true
+	if h.drained == nil {
+		h.drained = make(chan struct{})
+	}
+	if len(h.sessions) == 0 {
+		h.closeDrained()
+	}
+	drained := h.drained
+	var pending []*UDPPacketSession
+	for _, s := range h.sessions {
+		if !s.isStarted() {
+			pending = append(pending, s)
+		}
+	}
+	h.sessionMux.Unlock()
+	for _, s := range pending {
+		s.teardown(CloseServerShutdown, "")
+	}
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+	h.sessionMux.Lock()
+	sessions := make([]*UDPPacketSession, 0, len(h.sessions))
+	for _, s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.sessionMux.Unlock()
+	for _, s := range sessions {
+		s.teardown(CloseServerShutdown, "")
+	}
+	return ctx.Err()
+}
+
+// closeDrained closes the drained channel once. The caller must hold the
+// session lock.
+func (h *UDPPacketHandler) closeDrained() {
+	select {
+	case <-h.drained:
+	default:
+		close(h.drained)
+	}
+}
+
+// UDPSessionStats holds the number of packets and bytes sent to and received
+// from the client of a session.
+type UDPSessionStats struct {
+	Addr            string
+	Duration        time.Duration
+	PacketsSent     uint64
+	BytesSent       uint64
+	PacketsReceived uint64
+	BytesReceived   uint64
+	// Reason is the close code and reason of the BYE message closing the
+	// session, empty while the session is open.
+	Reason string
+}
+
+func (s UDPSessionStats) String() string {
+	return fmt.Sprintf("udp session %v: sent %v packets (%v bytes), received %v packets (%v bytes) in %v, closed: %v",
+		s.Addr, s.PacketsSent, s.BytesSent, s.PacketsReceived, s.BytesReceived, s.Duration, s.Reason)
+}
+
+// logLine formats s as a line of a session log file: the time in
+// milliseconds since start, the address of the client, the duration of the
+// session in milliseconds, the number of sent packets and bytes, the number of
+// received packets and bytes and the reason for closing the session.
+func (s UDPSessionStats) logLine(start time.Time) string {
+	return fmt.Sprintf("%v %v %v %v %v %v %v %v", time.Since(start).Milliseconds(), s.Addr, s.Duration.Milliseconds(),
+		s.PacketsSent, s.BytesSent, s.PacketsReceived, s.BytesReceived, s.Reason)
+}
+
 type UDPPacketSession struct {
-	conn     net.PacketConn
-	addr     net.Addr
+	handler *UDPPacketHandler
+	conn    net.PacketConn
+	addr    net.Addr
+	// cookie must be echoed by the client to start the stream
+	cookie []byte
+	// welcome is the welcome message of the session, which is repeated if
+	// the client repeats its hello
+	welcome  []byte
 	feedback chan []byte
+	srtp     *SRTPContext
+	start    time.Time
+
+	lock sync.Mutex
+	// started is set when the client echoed the cookie
+	started  bool
 	cancelFn func()
+	// reason is the reason for closing the session, empty while the session
+	// is open
+	reason string
+	// ctx is cancelled when the session is closed
+	ctx       context.Context
+	cancelCtx context.CancelFunc
+	once      sync.Once
+
+	// lastReceived is the time of the last packet from the client in
+	// nanoseconds since the epoch
+	lastReceived int64
+	// ssrc is the SSRC of the first RTP packet sent to the client
+	ssrc            uint32
+	packetsSent     uint64
+	bytesSent       uint64
+	packetsReceived uint64
+	bytesReceived   uint64
 }
 
+// run starts the source of the session once the client echoed the cookie.
+// Repeated start messages are ignored.
+func (s *UDPPacketSession) run(cookie []byte, src SrcFactory) {
+	if !hmac.Equal(cookie, s.cookie) {
+		log.Printf("dropping start of %v with invalid cookie\n", s.addr)
+		return
+	}
+	s.lock.Lock()
+	if s.started || len(s.reason) > 0 {
+		s.lock.Unlock()
+		return
+	}
+	s.started = true
+	s.lock.Unlock()
+
+	log.Printf("accepted udp session %v\n", s.addr)
+	cancel := src.MakeSrc(s.ctx, s, s.feedback)
+	s.lock.Lock()
+	if len(s.reason) > 0 {
+		// closed while the source was created
+		s.lock.Unlock()
+		cancel()
+		return
+	}
+	s.cancelFn = cancel
+	s.lock.Unlock()
+}
+
+func (s *UDPPacketSession) isStarted() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.started
+}
+
+func (s *UDPPacketSession) watchIdle(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastReceived)))
+			if idle >= timeout {
+				log.Printf("udp session %v idle for %v\n", s.addr, idle)
+				s.teardown(CloseTimeout, fmt.Sprintf("no packet received for %v", idle))
+				return
+			}
+			timer.Reset(timeout - idle)
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// receive handles a packet of the client.
+func (s *UDPPacketSession) receive(msg []byte) {
+	atomic.StoreInt64(&s.lastReceived, time.Now().UnixNano())
+	atomic.AddUint64(&s.packetsReceived, 1)
+	atomic.AddUint64(&s.bytesReceived, uint64(len(msg)))
+	switch {
+	case bytes.HasPrefix(msg, udpHello):
+		// the welcome message was lost
+		_, err := s.conn.WriteTo(s.welcome, s.addr)
+		if err != nil {
+			log.Printf("could not welcome %v: %v\n", s.addr, err)
+		}
+	case bytes.HasPrefix(msg, udpStart):
+		cookie, ok := parseUDPHandshakeMessage(msg, udpStart)
+		if !ok {
+			log.Printf("dropping invalid start of %v\n", s.addr)
+			return
+		}
+		s.run(cookie, s.handler.src)
+	case bytes.Equal(msg, udpKeepalive):
+	default:
+		if !s.isStarted() {
+			log.Printf("dropping packet of %v before start\n", s.addr)
+			return
+		}
+		s.AcceptFeedback(msg)
+	}
+}
+
+// teardown closes the session once: the client gets a BYE message unless it
+// closed the session itself or never echoed the cookie, the session is
+// removed from the session table and its source is stopped. The source is
+// stopped outside of once, because it may close the session again.
+func (s *UDPPacketSession) teardown(code CloseCode, reason string) {
+	var cancel func()
+	closed := false
+	started := false
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.reason = Bye{Code: code, Reason: reason}.reason()
+		cancel = s.cancelFn
+		started = s.started
+		s.lock.Unlock()
+		s.cancelCtx()
+		closed = true
+	})
+	if !closed {
+		return
+	}
+	if code != CloseClientBye && started {
+		stats := s.Stats()
+		err := s.writeBye(Bye{
+			SSRC:     atomic.LoadUint32(&s.ssrc),
+			Code:     code,
+			Reason:   reason,
+			Packets:  stats.PacketsSent,
+			Bytes:    stats.BytesSent,
+			Duration: stats.Duration,
+		})
+		if err != nil {
+			log.Printf("could not send bye to %v: %v\n", s.addr, err)
+		}
+	}
+	if s.srtp != nil {
+		log.Println(s.srtp.Stats())
+	}
+	s.handler.remove(s)
+	if cancel != nil {
+		cancel()
+	}
+}
+
+// Stats returns the statistics of the session.
+func (s *UDPPacketSession) Stats() UDPSessionStats {
+	s.lock.Lock()
+	reason := s.reason
+	s.lock.Unlock()
+	return UDPSessionStats{
+		Addr:            s.addr.String(),
+		Duration:        time.Since(s.start),
+		PacketsSent:     atomic.LoadUint64(&s.packetsSent),
+		BytesSent:       atomic.LoadUint64(&s.bytesSent),
+		PacketsReceived: atomic.LoadUint64(&s.packetsReceived),
+		BytesReceived:   atomic.LoadUint64(&s.bytesReceived),
+		Reason:          reason,
+	}
+}
+
+// Close is called by the source at the end of the stream. It tells the
+// client and closes the session.
 func (s *UDPPacketSession) Close() error {
 	log.Println("closing udp session")
-	_, err := s.conn.WriteTo([]byte("eos"), s.addr)
-	s.cancelFn()
+	s.teardown(CloseFinished, "")
+	return nil
+}
+
+// writeBye sends bye unprotected. It is only used to reject sessions, which
+// have no keys yet.
+func writeBye(conn net.PacketConn, addr net.Addr, bye Bye) error {
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(msg, addr)
+	return err
+}
+
+// writeBye sends bye to the client of s, protected by SRTCP if SRTP is
+// enabled.
+func (s *UDPPacketSession) writeBye(bye Bye) error {
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if s.srtp != nil {
+		msg, err = s.srtp.Protect(msg)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = s.conn.WriteTo(msg, s.addr)
 	return err
 }
 
+// AcceptFeedback unprotects a packet of the client and passes it to the
+// source, unless it is the BYE message of the client, which closes the
+// session.
 func (s *UDPPacketSession) AcceptFeedback(msg []byte) {
-	s.feedback <- msg
+	if s.srtp != nil {
+		var err error
+		msg, err = s.srtp.Unprotect(msg)
+		if err != nil {
+			log.Printf("dropping feedback: %v\n", err)
+			return
+		}
+	}
+	if isBye(msg) {
+		bye := Bye{}
+		err := bye.UnmarshalBinary(msg)
+		if err != nil {
+			log.Printf("dropping bye: %v\n", err)
+			return
+		}
+		s.teardown(CloseClientBye, bye.Reason)
+		return
+	}
+	select {
+	case s.feedback <- msg:
+	case <-s.ctx.Done():
+	}
 }
 
 func (s *UDPPacketSession) Write(p []byte) (int, error) {
-	return s.conn.WriteTo(p, s.addr)
+	b := p
+	if s.srtp != nil {
+		var err error
+		b, err = s.srtp.Protect(p)
+		if err != nil {
+			return 0, err
+		}
+	}
+	_, err := s.conn.WriteTo(b, s.addr)
+	if err != nil {
+		return 0, err
+	}
+	recordSSRC(&s.ssrc, p)
+	atomic.AddUint64(&s.packetsSent, 1)
+	atomic.AddUint64(&s.bytesSent, uint64(len(b)))
+	return len(p), nil
 }
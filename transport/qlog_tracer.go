@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/mengelbart/cgo-streamer/gst"
@@ -14,34 +15,92 @@ import (
 
 type QUICTracer struct {
 	ack chan []*Packet
+
+	// lost maps the remote address of each traced connection to the channel
+	// receiving its losses, it is nil if losses are not reported.
+	lock sync.Mutex
+	lost map[string]chan []*Packet
 }
 
 func NewTracer(getLogWriter func(p logging.Perspective, connectionID []byte) io.WriteCloser) *QUICTracer {
-	return &QUICTracer{
-		ack: make(chan []*Packet, 1024),
-	}
+	return &QUICTracer{}
 }
 
+// GetACKChan returns a channel receiving the RTP packets of acknowledged QUIC
+// packets. Acknowledgments are only reported if the channel was requested
+// before connections are traced.
 func (q *QUICTracer) GetACKChan() chan []*Packet {
+	if q.ack == nil {
+		q.ack = make(chan []*Packet, 1024)
+	}
 	return q.ack
 }
 
+// EnableLossReports reports the RTP packets of QUIC packets declared lost on
+// a channel per connection, which is returned by LostChan. Losses are only
+// reported for connections traced after the call.
+func (q *QUICTracer) EnableLossReports() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.lost == nil {
+		q.lost = make(map[string]chan []*Packet)
+	}
+}
+
+// LostChan returns the channel receiving the RTP packets of QUIC packets
+// declared lost on the connection to remote. It returns nil if loss reports
+// are disabled or the connection is not traced.
+func (q *QUICTracer) LostChan(remote net.Addr) <-chan []*Packet {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.lost[remote.String()]
+}
+
+// addConnection creates the loss channel of the connection to remote, if
+// losses are reported.
+func (q *QUICTracer) addConnection(remote string) chan []*Packet {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.lost == nil {
+		return nil
+	}
+	lost := make(chan []*Packet, 1024)
+	q.lost[remote] = lost
+	return lost
+}
+
+// removeConnection forgets the loss channel of a closed connection unless a
+// new connection from the same address replaced it.
+func (q *QUICTracer) removeConnection(remote string, lost chan []*Packet) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.lost[remote] == lost {
+		delete(q.lost, remote)
+	}
+}
+
 func (q *QUICTracer) TracerForConnection(p logging.Perspective, odcid logging.ConnectionID) logging.ConnectionTracer {
 	ct := &ConnectionTracer{
+		tracer:  q,
 		ack:     q.ack,
 		packets: make(map[int64][]*Packet),
 	}
 	return ct
 }
 
-func (q QUICTracer) SentPacket(addr net.Addr, header *logging.Header, count logging.ByteCount, frames []logging.Frame) {
+func (q *QUICTracer) SentPacket(addr net.Addr, header *logging.Header, count logging.ByteCount, frames []logging.Frame) {
 }
 
-func (q QUICTracer) DroppedPacket(addr net.Addr, packetType logging.PacketType, count logging.ByteCount, reason logging.PacketDropReason) {
+func (q *QUICTracer) DroppedPacket(addr net.Addr, packetType logging.PacketType, count logging.ByteCount, reason logging.PacketDropReason) {
 }
 
 type ConnectionTracer struct {
-	ack chan []*Packet
+	tracer *QUICTracer
+	ack    chan []*Packet
+	// lost receives the losses of this connection, it is created when the
+	// connection starts.
+	lost   chan []*Packet
+	remote string
 
 	packets      map[int64][]*Packet
 	lastRTTStats *logging.RTTStats
@@ -52,17 +111,26 @@ func (c *ConnectionTracer) SentPacket(hdr *logging.ExtendedHeader, size logging.
 	for _, f := range frames {
 		switch v := f.(type) {
 		case *logging.DatagramFrame:
+			// sender reports share the datagrams with the media
+			if isRTCP(v.Data) {
+				continue
+			}
 			var r rtp.Packet
 			err := r.Unmarshal(v.Data)
 			if err != nil {
 				log.Printf("failed to parse data as rtcp Header: %v\n", err)
 				continue
 			}
+			// FEC packets use a separate sequence number space
+			if r.PayloadType == FECPayloadType {
+				continue
+			}
 			//log.Printf("%v: sent packet: %v\n", now, r.SequenceNumber)
 
 			c.packets[int64(hdr.PacketNumber)] = append(c.packets[int64(hdr.PacketNumber)], &Packet{
 				quicPacketNr: int64(hdr.PacketNumber),
 				rtpSeqNr:     r.SequenceNumber,
+				ssrc:         r.SSRC,
 			})
 		}
 	}
@@ -86,7 +154,7 @@ func (c *ConnectionTracer) ReceivedPacket(hdr *logging.ExtendedHeader, size logg
 					delete(c.packets, int64(i))
 				}
 			}
-			if len(acks) > 0 {
+			if len(acks) > 0 && c.ack != nil {
 				c.ack <- acks
 			}
 		}
@@ -102,7 +170,9 @@ func (c ConnectionTracer) ReceivedVersionNegotiationPacket(header *logging.Heade
 func (c ConnectionTracer) ReceivedRetry(header *logging.Header) {
 }
 
-func (c ConnectionTracer) StartedConnection(local, remote net.Addr, version logging.VersionNumber, srcConnID, destConnID logging.ConnectionID) {
+func (c *ConnectionTracer) StartedConnection(local, remote net.Addr, version logging.VersionNumber, srcConnID, destConnID logging.ConnectionID) {
+	c.remote = remote.String()
+	c.lost = c.tracer.addConnection(c.remote)
 }
 
 func (c ConnectionTracer) ClosedConnection(reason logging.CloseReason) {
@@ -126,7 +196,21 @@ func (c *ConnectionTracer) UpdatedMetrics(rttStats *logging.RTTStats, cwnd, byte
 	}
 }
 
-func (c ConnectionTracer) LostPacket(level logging.EncryptionLevel, number logging.PacketNumber, reason logging.PacketLossReason) {
+func (c *ConnectionTracer) LostPacket(level logging.EncryptionLevel, number logging.PacketNumber, reason logging.PacketLossReason) {
+	packets, ok := c.packets[int64(number)]
+	if !ok {
+		return
+	}
+	delete(c.packets, int64(number))
+	if c.lost == nil {
+		return
+	}
+	// don't block the connection if nobody handles losses
+	select {
+	case c.lost <- packets:
+	default:
+		log.Printf("dropping loss report of packet %v\n", number)
+	}
 }
 
 func (c ConnectionTracer) UpdatedCongestionState(state logging.CongestionState) {
@@ -156,7 +240,10 @@ func (c ConnectionTracer) LossTimerExpired(timerType logging.TimerType, level lo
 func (c ConnectionTracer) LossTimerCanceled() {
 }
 
-func (c ConnectionTracer) Close() {
+func (c *ConnectionTracer) Close() {
+	if c.lost != nil {
+		c.tracer.removeConnection(c.remote, c.lost)
+	}
 }
 
 func (c ConnectionTracer) Debug(name, msg string) {
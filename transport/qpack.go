@@ -0,0 +1,411 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var (
+	ErrQPACKTruncated      = errors.New("truncated QPACK field section")
+	ErrQPACKDynamicTable   = errors.New("QPACK dynamic table references are not supported")
+	ErrQPACKInvalidIndex   = errors.New("invalid QPACK static table index")
+	ErrQPACKInvalidHuffman = errors.New("invalid Huffman encoded string")
+)
+
+// headerField is a field line of an HTTP/3 field section.
+type headerField struct {
+	name  string
+	value string
+}
+
+// encodeQPACK encodes a field section (RFC 9204) without using the dynamic
+// table. Fields found in the static table are encoded as indexed field lines,
+// all other fields as literals without Huffman encoding.
+func encodeQPACK(fields []headerField) []byte {
+	// Required Insert Count and Base are 0 without dynamic table
+	b := []byte{0, 0}
+	for _, f := range fields {
+		if i, ok := qpackStaticIndex(f.name, f.value); ok {
+			// indexed field line referencing the static table
+			b = appendQPACKInt(b, 0xC0, 6, uint64(i))
+			continue
+		}
+		// literal field line with literal name
+		b = appendQPACKInt(b, 0x20, 3, uint64(len(f.name)))
+		b = append(b, f.name...)
+		b = appendQPACKInt(b, 0x00, 7, uint64(len(f.value)))
+		b = append(b, f.value...)
+	}
+	return b
+}
+
+// decodeQPACK decodes a field section which does not reference the dynamic
+// table. Encoders do not use the dynamic table as long as the decoder
+// announces a table capacity of 0.
+func decodeQPACK(b []byte) ([]headerField, error) {
+	ric, n, err := parseQPACKInt(b, 8)
+	if err != nil {
+		return nil, err
+	}
+	if ric != 0 {
+		return nil, ErrQPACKDynamicTable
+	}
+	b = b[n:]
+	_, n, err = parseQPACKInt(b, 7)
+	if err != nil {
+		return nil, err
+	}
+	b = b[n:]
+	var fields []headerField
+	for len(b) > 0 {
+		var f headerField
+		switch {
+		case b[0]&0x80 != 0:
+			// indexed field line
+			if b[0]&0x40 == 0 {
+				return nil, ErrQPACKDynamicTable
+			}
+			f, n, err = parseQPACKStaticField(b, 6)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		case b[0]&0x40 != 0:
+			// literal field line with name reference
+			if b[0]&0x10 == 0 {
+				return nil, ErrQPACKDynamicTable
+			}
+			f, n, err = parseQPACKStaticField(b, 4)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			f.value, n, err = parseQPACKString(b, 7)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		case b[0]&0x20 != 0:
+			// literal field line with literal name
+			f.name, n, err = parseQPACKString(b, 3)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+			f.value, n, err = parseQPACKString(b, 7)
+			if err != nil {
+				return nil, err
+			}
+			b = b[n:]
+		default:
+			// field lines with post-base index
+			return nil, ErrQPACKDynamicTable
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func qpackStaticIndex(name, value string) (int, bool) {
+	for i, f := range qpackStaticTable {
+		if f.name == name && f.value == value {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// parseQPACKStaticField returns the static table entry referenced by the
+// prefix integer at the beginning of b.
+func parseQPACKStaticField(b []byte, prefix uint) (headerField, int, error) {
+	i, n, err := parseQPACKInt(b, prefix)
+	if err != nil {
+		return headerField{}, 0, err
+	}
+	if i >= uint64(len(qpackStaticTable)) {
+		return headerField{}, 0, fmt.Errorf("%w: %v", ErrQPACKInvalidIndex, i)
+	}
+	return qpackStaticTable[i], n, nil
+}
+
+// appendQPACKInt appends v as prefix integer (RFC 7541, Section 5.1) using
+// the lowest prefix bits of the first byte, the other bits are set to flags.
+func appendQPACKInt(b []byte, flags byte, prefix uint, v uint64) []byte {
+	max := uint64(1)<<prefix - 1
+	if v < max {
+		return append(b, flags|byte(v))
+	}
+	b = append(b, flags|byte(max))
+	v -= max
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+// parseQPACKInt parses a prefix integer from the lowest prefix bits of the
+// first byte of b and returns the value and the number of bytes read.
+func parseQPACKInt(b []byte, prefix uint) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrQPACKTruncated
+	}
+	max := uint64(1)<<prefix - 1
+	v := uint64(b[0]) & max
+	if v < max {
+		return v, 1, nil
+	}
+	for i, shift := 1, uint(0); i < len(b) && shift < 63; i, shift = i+1, shift+7 {
+		v += uint64(b[i]&0x7F) << shift
+		if b[i]&0x80 == 0 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, ErrQPACKTruncated
+}
+
+// parseQPACKString parses a string literal whose length is encoded as prefix
+// integer of prefix bits. The bit before the prefix is the Huffman flag.
+func parseQPACKString(b []byte, prefix uint) (string, int, error) {
+	if len(b) == 0 {
+		return "", 0, ErrQPACKTruncated
+	}
+	huffman := b[0]&(1<<prefix) != 0
+	length, n, err := parseQPACKInt(b, prefix)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(b)-n) < length {
+		return "", 0, ErrQPACKTruncated
+	}
+	s := b[n : n+int(length)]
+	if !huffman {
+		return string(s), n + int(length), nil
+	}
+	d, err := huffmanDecode(s)
+	if err != nil {
+		return "", 0, err
+	}
+	return string(d), n + int(length), nil
+}
+
+// huffmanNode is a node of the decoding tree of the Huffman code.
+type huffmanNode struct {
+	children [2]*huffmanNode
+	symbol   byte
+	leaf     bool
+}
+
+var (
+	huffmanTreeOnce sync.Once
+	huffmanTree     *huffmanNode
+)
+
+func buildHuffmanTree() {
+	huffmanTree = &huffmanNode{}
+	for sym, code := range huffmanCodes {
+		n := huffmanTree
+		for i := int(huffmanCodeLen[sym]) - 1; i >= 0; i-- {
+			bit := (code >> uint(i)) & 1
+			if n.children[bit] == nil {
+				n.children[bit] = &huffmanNode{}
+			}
+			n = n.children[bit]
+		}
+		n.symbol = byte(sym)
+		n.leaf = true
+	}
+}
+
+// huffmanDecode decodes a string encoded with the Huffman code of HPACK
+// (RFC 7541, Section 5.2).
+func huffmanDecode(b []byte) ([]byte, error) {
+	huffmanTreeOnce.Do(buildHuffmanTree)
+	var out []byte
+	n := huffmanTree
+	// the string is padded with at most 7 one bits, the beginning of EOS
+	pending := 0
+	ones := true
+	for _, v := range b {
+		for i := 7; i >= 0; i-- {
+			bit := (v >> uint(i)) & 1
+			n = n.children[bit]
+			if n == nil {
+				return nil, ErrQPACKInvalidHuffman
+			}
+			if n.leaf {
+				out = append(out, n.symbol)
+				n = huffmanTree
+				pending = 0
+				ones = true
+				continue
+			}
+			pending++
+			ones = ones && bit == 1
+		}
+	}
+	if pending > 7 || !ones {
+		return nil, ErrQPACKInvalidHuffman
+	}
+	return out, nil
+}
+
+// qpackStaticTable is the QPACK static table (RFC 9204, Appendix A).
+var qpackStaticTable = [...]headerField{
+	{":authority", ""},
+	{":path", "/"},
+	{"age", "0"},
+	{"content-disposition", ""},
+	{"content-length", "0"},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"referer", ""},
+	{"set-cookie", ""},
+	{":method", "CONNECT"},
+	{":method", "DELETE"},
+	{":method", "GET"},
+	{":method", "HEAD"},
+	{":method", "OPTIONS"},
+	{":method", "POST"},
+	{":method", "PUT"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "103"},
+	{":status", "200"},
+	{":status", "304"},
+	{":status", "404"},
+	{":status", "503"},
+	{"accept", "*/*"},
+	{"accept", "application/dns-message"},
+	{"accept-encoding", "gzip, deflate, br"},
+	{"accept-ranges", "bytes"},
+	{"access-control-allow-headers", "cache-control"},
+	{"access-control-allow-headers", "content-type"},
+	{"access-control-allow-origin", "*"},
+	{"cache-control", "max-age=0"},
+	{"cache-control", "max-age=2592000"},
+	{"cache-control", "max-age=604800"},
+	{"cache-control", "no-cache"},
+	{"cache-control", "no-store"},
+	{"cache-control", "public, max-age=31536000"},
+	{"content-encoding", "br"},
+	{"content-encoding", "gzip"},
+	{"content-type", "application/dns-message"},
+	{"content-type", "application/javascript"},
+	{"content-type", "application/json"},
+	{"content-type", "application/x-www-form-urlencoded"},
+	{"content-type", "image/gif"},
+	{"content-type", "image/jpeg"},
+	{"content-type", "image/png"},
+	{"content-type", "text/css"},
+	{"content-type", "text/html; charset=utf-8"},
+	{"content-type", "text/plain"},
+	{"content-type", "text/plain;charset=utf-8"},
+	{"range", "bytes=0-"},
+	{"strict-transport-security", "max-age=31536000"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains"},
+	{"strict-transport-security", "max-age=31536000; includesubdomains; preload"},
+	{"vary", "accept-encoding"},
+	{"vary", "origin"},
+	{"x-content-type-options", "nosniff"},
+	{"x-xss-protection", "1; mode=block"},
+	{":status", "100"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "302"},
+	{":status", "400"},
+	{":status", "403"},
+	{":status", "421"},
+	{":status", "425"},
+	{":status", "500"},
+	{"accept-language", ""},
+	{"access-control-allow-credentials", "FALSE"},
+	{"access-control-allow-credentials", "TRUE"},
+	{"access-control-allow-headers", "*"},
+	{"access-control-allow-methods", "get"},
+	{"access-control-allow-methods", "get, post, options"},
+	{"access-control-allow-methods", "options"},
+	{"access-control-expose-headers", "content-length"},
+	{"access-control-request-headers", "content-type"},
+	{"access-control-request-method", "get"},
+	{"access-control-request-method", "post"},
+	{"alt-svc", "clear"},
+	{"authorization", ""},
+	{"content-security-policy", "script-src 'none'; object-src 'none'; base-uri 'none'"},
+	{"early-data", "1"},
+	{"expect-ct", ""},
+	{"forwarded", ""},
+	{"if-range", ""},
+	{"origin", ""},
+	{"purpose", "prefetch"},
+	{"server", ""},
+	{"timing-allow-origin", "*"},
+	{"upgrade-insecure-requests", "1"},
+	{"user-agent", ""},
+	{"x-forwarded-for", ""},
+	{"x-frame-options", "deny"},
+	{"x-frame-options", "sameorigin"},
+}
+
+// huffmanCodes and huffmanCodeLen are the codes and code lengths in bits of
+// the Huffman code of HPACK (RFC 7541, Appendix B) for all symbols except EOS.
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
@@ -7,31 +7,133 @@ import (
 type RTPQueueItem struct {
 	Packet    *rtp.Packet
 	Timestamp float64
+	// TemporalLayer is the temporal layer of the packet, 0 is the base
+	// layer
+	TemporalLayer int
 }
 
 type Queue struct {
 	q []*RTPQueueItem
+
+	// droppedLayer is the lowest temporal layer of which packets were
+	// dropped or -1. Packets of higher layers may reference the dropped
+	// frames and are dropped as well until a frame of the dropped layer or
+	// below is pushed.
+	droppedLayer int
+	// droppedTS is the timestamp of the last dropped frame, remaining
+	// packets of the frame are dropped as well
+	droppedTS uint32
+	dropped   int
+
+	// droppedSeqNrs are the sequence numbers of dropped packets which were
+	// not yet accounted for in seqNrOffset. Sequence numbers of popped
+	// packets are reduced by seqNrOffset to close the gaps of dropped
+	// packets, so the receiver does not consider them lost.
+	droppedSeqNrs []uint16
+	seqNrOffset   uint16
 }
 
 func NewQueue() *Queue {
 	return &Queue{
-		make([]*RTPQueueItem, 0),
+		q:            make([]*RTPQueueItem, 0),
+		droppedLayer: -1,
 	}
 }
 
+// Push adds p to the queue, unless it belongs to a frame referencing a
+// dropped frame.
 func (q *Queue) Push(p *RTPQueueItem) {
+	q.push(p)
+}
+
+// push adds p to the queue and returns false if p was dropped.
+func (q *Queue) push(p *RTPQueueItem) bool {
+	if q.droppedLayer >= 0 {
+		if p.TemporalLayer > q.droppedLayer || p.Packet.Timestamp == q.droppedTS {
+			q.dropped++
+			q.droppedSeqNrs = append(q.droppedSeqNrs, p.Packet.SequenceNumber)
+			return false
+		}
+		q.droppedLayer = -1
+	}
 	q.q = append(q.q, p)
+	return true
+}
+
+// DropEnhancementLayers drops packets of the highest temporal layer in the
+// queue, as long as the queue delay at time now exceeds maxDelay and packets
+// of layers above the base layer are queued. It returns the number of dropped
+// packets. All times are in seconds.
+func (q *Queue) DropEnhancementLayers(now, maxDelay float64) int {
+	dropped := 0
+	for q.GetDelay(now) > maxDelay {
+		highest := 0
+		for _, p := range q.q {
+			if p.TemporalLayer > highest {
+				highest = p.TemporalLayer
+			}
+		}
+		if highest == 0 {
+			break
+		}
+		kept := q.q[:0]
+		for _, p := range q.q {
+			if p.TemporalLayer == highest {
+				dropped++
+				q.droppedTS = p.Packet.Timestamp
+				q.droppedSeqNrs = append(q.droppedSeqNrs, p.Packet.SequenceNumber)
+				continue
+			}
+			kept = append(kept, p)
+		}
+		q.q = kept
+		if q.droppedLayer < 0 || highest < q.droppedLayer {
+			q.droppedLayer = highest
+		}
+	}
+	q.dropped += dropped
+	return dropped
+}
+
+// Dropped returns the number of packets dropped from enhancement layers.
+func (q *Queue) Dropped() int {
+	return q.dropped
 }
 
+// Pop removes the next packet from the queue and rewrites its sequence number
+// to follow the previously popped packet if packets were dropped in between.
 func (q *Queue) Pop() *RTPQueueItem {
 	if len(q.q) <= 0 {
 		return nil
 	}
 	p := q.q[0]
 	q.q = q.q[1:]
+	p.Packet.SequenceNumber = q.outgoingSeqNr(p.Packet.SequenceNumber, true)
 	return p
 }
 
+// outgoingSeqNr returns the sequence number of a packet with sequence number
+// seqNr after removing the gaps of dropped packets sent before it. If pop is
+// set, the dropped packets before seqNr are added to the offset.
+func (q *Queue) outgoingSeqNr(seqNr uint16, pop bool) uint16 {
+	offset := q.seqNrOffset
+	remaining := q.droppedSeqNrs[:0]
+	for _, d := range q.droppedSeqNrs {
+		if int16(d-seqNr) < 0 {
+			offset++
+			continue
+		}
+		if pop {
+			remaining = append(remaining, d)
+		}
+	}
+	if pop {
+		q.droppedSeqNrs = remaining
+		q.seqNrOffset = offset
+	}
+	return seqNr - offset
+}
+
 func (q *Queue) Len() int {
 	return len(q.q)
 }
@@ -51,7 +153,7 @@ func (q *Queue) SeqNrOfNextRTP() int {
 	if len(q.q) <= 0 {
 		return 0
 	}
-	return int(q.q[0].Packet.SequenceNumber)
+	return int(q.outgoingSeqNr(q.q[0].Packet.SequenceNumber, false))
 }
 
 func (q *Queue) BytesInQueue() int {
@@ -10,7 +10,10 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"os"
+	"sync/atomic"
+	"time"
 
 	"github.com/mengelbart/cgo-streamer/util"
 
@@ -20,13 +23,43 @@ import (
 	"github.com/lucas-clemente/quic-go"
 )
 
+// QUICMode selects how media is received by a QUICClient and has to match
+// the handler used by the server.
+type QUICMode string
+
+const (
+	DatagramMode        QUICMode = "datagram"
+	StreamPerFrameMode  QUICMode = "streamperframe"
+	StreamPerPacketMode QUICMode = "streamperpacket"
+	HybridMode          QUICMode = "hybrid"
+	SingleStreamMode    QUICMode = "singlestream"
+)
+
+// fragmentTimeout is the time the datagram client waits for missing fragments
+// before dropping a packet.
+const fragmentTimeout = 100 * time.Millisecond
+
+// hybridMaxWait is the time the hybrid client waits for missing packets
+// before skipping them.
+const hybridMaxWait = 100 * time.Millisecond
+
 type QUICClient struct {
-	addr      string
-	config    *quic.Config
-	session   quic.Session
-	writer    io.Writer
-	closeChan chan struct{}
-	dgram     bool
+	addr    string
+	config  *quic.Config
+	session quic.Session
+	writer  io.Writer
+	mode    QUICMode
+	dgram   bool
+
+	frameDeadline time.Duration
+	frames        uint64
+	expiredFrames uint64
+
+	roq *roqFlow
+	bye byeReceiver
+
+	reassemble  bool
+	reassembler *reassembler
 }
 
 var tlsConf = &tls.Config{
@@ -34,16 +67,16 @@ var tlsConf = &tls.Config{
 	NextProtos:         []string{"quic-realtime"},
 }
 
-func NewQUICClient(addr string, w io.Writer, dgram bool, qlogFile string) *QUICClient {
+func NewQUICClient(addr string, w io.Writer, mode QUICMode, qlogFile string) *QUICClient {
 	qc := &QUICClient{
-		dgram: dgram,
+		mode:  mode,
+		dgram: mode == DatagramMode,
 		addr:  addr,
 		config: &quic.Config{
 			MaxIncomingStreams:    maxStreamCount,
 			MaxIncomingUniStreams: maxStreamCount,
 		},
-		writer:    w,
-		closeChan: make(chan struct{}, 1),
+		writer: w,
 	}
 	if len(qlogFile) > 0 {
 		qc.config.Tracer = qlog.NewTracer(func(_ logging.Perspective, connID []byte) io.WriteCloser {
@@ -65,27 +98,109 @@ func (f FeedbackWriter) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
-func (c *QUICClient) CloseChan() chan struct{} {
-	return c.closeChan
+// SetFrameDeadline sets the maximum time to receive a frame on a stream after
+// the stream was accepted. Streams are cancelled when the deadline expires. A
+// deadline of 0 disables cancellation.
+func (c *QUICClient) SetFrameDeadline(deadline time.Duration) {
+	c.frameDeadline = deadline
+}
+
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier. The
+// server has to use the same flow identifier.
+func (c *QUICClient) EnableRoQ(flowID uint64) {
+	c.roq = newRoQFlow(flowID)
+}
+
+// EnableReassembly reassembles datagrams fragmented by a DatagramHandler with
+// fragmentation enabled. Only used in DatagramMode.
+func (c *QUICClient) EnableReassembly() {
+	c.reassemble = true
+}
+
+// FragmentStats returns the fragment statistics of the datagram client. The
+// statistics are empty if reassembly is not enabled.
+func (c *QUICClient) FragmentStats() FragmentStats {
+	if c.reassembler == nil {
+		return FragmentStats{}
+	}
+	return c.reassembler.stats()
+}
+
+// FrameStats returns the number of frames received on streams and the number
+// of frames which expired before they were complete.
+func (c *QUICClient) FrameStats() (uint64, uint64) {
+	return atomic.LoadUint64(&c.frames), atomic.LoadUint64(&c.expiredFrames)
+}
+
+// closeOnDone closes session when ctx is done or the returned function is
+// called at the end of the run. The returned function blocks until the
+// session was closed.
+func closeOnDone(ctx context.Context, session quic.Session) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		err := session.CloseWithError(quic.ErrorCode(CloseClientBye), "")
+		if err != nil {
+			log.Printf("could not close session: %v\n", err)
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// result returns the result of a run which ended with err: ctx.Err() if the
+// client was closed and the result of the BYE message otherwise.
+func (c *QUICClient) result(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return c.bye.result(err)
 }
 
-func (c *QUICClient) RunFeedbackSender() (io.Writer, chan<- struct{}, error) {
+// RunFeedbackSender returns a writer for feedback, which is sent to the
+// server until ctx is done.
+func (c *QUICClient) RunFeedbackSender(ctx context.Context) (io.Writer, error) {
 	fbw := FeedbackWriter(make(chan []byte, 1024))
-	done := make(chan struct{}, 1)
 	var fbSender func([]byte) error
 	var fbStream quic.SendStream
 	if c.dgram {
 		fbSender = func(fb []byte) error {
-			if c.session != nil {
-				return c.session.SendMessage(fb)
+			if c.session == nil {
+				return errors.New("no active session")
+			}
+			if c.roq != nil {
+				return c.session.SendMessage(c.roq.marshalDatagram(fb))
 			}
-			return errors.New("no active session")
+			return c.session.SendMessage(fb)
+		}
+	} else if c.roq != nil {
+		fbSender = func(fb []byte) error {
+			if fbStream == nil {
+				var err error
+				fbStream, err = c.session.OpenUniStreamSync(ctx)
+				if err != nil {
+					return err
+				}
+				_, err = fbStream.Write(c.roq.marshalStreamHeader())
+				if err != nil {
+					return err
+				}
+			}
+			_, err := fbStream.Write(c.roq.marshalPackets([][]byte{fb}))
+			return err
 		}
 	} else {
 		fbSender = func(fb []byte) error {
 			if fbStream == nil {
 				var err error
-				fbStream, err = c.session.OpenUniStreamSync(context.Background())
+				fbStream, err = c.session.OpenUniStreamSync(ctx)
 				if err != nil {
 					return err
 				}
@@ -107,28 +222,35 @@ func (c *QUICClient) RunFeedbackSender() (io.Writer, chan<- struct{}, error) {
 				if err != nil {
 					log.Println(err)
 				}
-			case <-done:
+			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	return fbw, done, nil
+	return fbw, nil
 }
 
-func (c *QUICClient) Run() error {
-	if c.dgram {
-		return c.RunDgram()
+// Run receives the stream until the server ends the session or ctx is done.
+// The session is closed when ctx is done and ctx.Err() is returned.
+func (c *QUICClient) Run(ctx context.Context) error {
+	switch c.mode {
+	case StreamPerFrameMode, StreamPerPacketMode, SingleStreamMode:
+		return c.RunStreamPerFrame(ctx)
+	case HybridMode:
+		return c.RunHybrid(ctx)
+	default:
+		return c.RunDgram(ctx)
 	}
-	return c.RunStreamPerFrame()
 }
 
 const maxFlowControlWindow = uint64(1 << 60)
 
-func (c *QUICClient) RunStreamPerFrame() error {
+func (c *QUICClient) RunStreamPerFrame(ctx context.Context) error {
 	log.Println("running streamperframe client")
 	c.config.MaxReceiveStreamFlowControlWindow = maxFlowControlWindow
 	c.config.MaxReceiveConnectionFlowControlWindow = maxFlowControlWindow
-	session, err := quic.DialAddr(
+	session, err := quic.DialAddrContext(
+		ctx,
 		c.addr,
 		tlsConf,
 		c.config,
@@ -137,10 +259,12 @@ func (c *QUICClient) RunStreamPerFrame() error {
 		return err
 	}
 	c.session = session
+	defer closeOnDone(ctx, session)()
+	go c.bye.run(session)
 
-	stream, err := session.OpenStreamSync(context.Background())
+	stream, err := session.OpenStreamSync(ctx)
 	if err != nil {
-		return err
+		return c.result(ctx, err)
 	}
 
 	_, err = stream.Write([]byte("hello"))
@@ -148,39 +272,203 @@ func (c *QUICClient) RunStreamPerFrame() error {
 		return err
 	}
 
+	defer func() {
+		frames, expired := c.FrameStats()
+		log.Printf("received %v frames, %v expired\n", frames, expired)
+	}()
 	for {
-		select {
-		case <-c.closeChan:
+		stream, err := session.AcceptStream(ctx)
+		if err != nil {
+			return c.result(ctx, err)
+		}
+		if c.mode == SingleStreamMode {
+			// all packets are sent on this stream, read until it is closed
+			err = c.readStream(stream, c.writer)
+			if err != nil {
+				return c.result(ctx, err)
+			}
+			continue
+		}
+		atomic.AddUint64(&c.frames, 1)
+		if c.frameDeadline > 0 {
+			err = stream.SetReadDeadline(time.Now().Add(c.frameDeadline))
+			if err != nil {
+				return err
+			}
+		}
+		if c.mode == StreamPerFrameMode || c.roq != nil {
+			err = c.readStream(stream, c.writer)
+		} else {
+			err = c.readPacket(stream)
+		}
+		if err != nil && c.frameExpired(stream, err) {
+			continue
+		}
+		if err != nil {
+			return c.result(ctx, err)
+		}
+	}
+}
+
+// frameExpired checks if err was caused by an expired frame, either because
+// the read deadline was exceeded or because the sender cancelled the stream.
+// Streams exceeding the read deadline are cancelled.
+func (c *QUICClient) frameExpired(stream quic.Stream, err error) bool {
+	if nErr, ok := err.(net.Error); ok && nErr.Timeout() && c.frameDeadline > 0 {
+		stream.CancelRead(FrameExpiredErrorCode)
+		atomic.AddUint64(&c.expiredFrames, 1)
+		return true
+	}
+	if sErr, ok := err.(quic.StreamError); ok && sErr.Canceled() && sErr.ErrorCode() == FrameExpiredErrorCode {
+		atomic.AddUint64(&c.expiredFrames, 1)
+		return true
+	}
+	return false
+}
+
+// readPacket reads a stream containing a single RTP packet.
+func (c *QUICClient) readPacket(stream io.Reader) error {
+	bs, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(c.writer, bytes.NewReader(bs))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// readStream reads a stream containing one or more framed RTP packets and
+// writes the packets to w.
+func (c *QUICClient) readStream(stream io.Reader, w io.Writer) error {
+	if c.roq != nil {
+		return readRoQStream(c.roq, stream, w)
+	}
+	return readFrame(stream, w)
+}
+
+// unmarshalDatagram removes the RoQ framing from b if RoQ is enabled.
+func (c *QUICClient) unmarshalDatagram(b []byte) ([]byte, error) {
+	if c.roq == nil {
+		return b, nil
+	}
+	return c.roq.unmarshalDatagram(b)
+}
+
+// readFrame reads a stream containing length prefixed RTP packets of a
+// single frame and writes the packets to w.
+func readFrame(stream io.Reader, w io.Writer) error {
+	var size uint16
+	for {
+		err := binary.Read(stream, binary.BigEndian, &size)
+		if err == io.EOF {
 			return nil
-		default:
 		}
-		stream, err := session.AcceptStream(context.Background())
 		if err != nil {
-			// TODO: Figure out correct error handling
-			if err.Error() == "Application error 0x1: eos" {
-				return nil
-			}
 			return err
 		}
-		bs, err := ioutil.ReadAll(stream)
+		packet := make([]byte, size)
+		_, err = io.ReadFull(stream, packet)
 		if err != nil {
-			// TODO: Figure out correct error handling
-			if err.Error() == "Application error 0x1: eos" {
-				return nil
-			}
 			return err
 		}
-		_, err = io.Copy(c.writer, bytes.NewReader(bs))
-		if err != nil && err != io.EOF {
+		_, err = w.Write(packet)
+		if err != nil {
 			return err
 		}
 	}
 }
 
-func (c *QUICClient) RunDgram() error {
+// RunHybrid receives key frames on streams and all other packets as datagrams
+// and merges both in sequence number order.
+func (c *QUICClient) RunHybrid(ctx context.Context) error {
+	log.Println("running hybrid client")
+	c.config.EnableDatagrams = true
+	c.config.MaxReceiveStreamFlowControlWindow = maxFlowControlWindow
+	c.config.MaxReceiveConnectionFlowControlWindow = maxFlowControlWindow
+	session, err := quic.DialAddrContext(
+		ctx,
+		c.addr,
+		tlsConf,
+		c.config,
+	)
+	if err != nil {
+		return err
+	}
+	c.session = session
+	defer closeOnDone(ctx, session)()
+	go c.bye.run(session)
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return c.result(ctx, err)
+	}
+	_, err = stream.Write([]byte("hello"))
+	if err != nil {
+		return err
+	}
+
+	merger := newRTPMerger(c.writer, hybridMaxWait)
+	done := make(chan struct{})
+	defer close(done)
+	go merger.run(done)
+
+	errs := make(chan error, 2)
+	go func() {
+		for {
+			bs, err := session.ReceiveMessage()
+			if err != nil {
+				errs <- err
+				return
+			}
+			bs, err = c.unmarshalDatagram(bs)
+			if err != nil {
+				log.Printf("dropping datagram: %v\n", err)
+				continue
+			}
+			_, err = merger.Write(bs)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for {
+			stream, err := session.AcceptStream(ctx)
+			if err != nil {
+				errs <- err
+				return
+			}
+			atomic.AddUint64(&c.frames, 1)
+			if c.frameDeadline > 0 {
+				err = stream.SetReadDeadline(time.Now().Add(c.frameDeadline))
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			err = c.readStream(stream, merger)
+			if err != nil && !c.frameExpired(stream, err) {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		frames, expired := c.FrameStats()
+		log.Printf("received %v key frames, %v expired, %v packets dropped\n", frames, expired, atomic.LoadUint64(&merger.dropped))
+	}()
+	return c.result(ctx, <-errs)
+}
+
+func (c *QUICClient) RunDgram(ctx context.Context) error {
 	log.Println("running dgram client")
 	c.config.EnableDatagrams = true
-	session, err := quic.DialAddr(
+	session, err := quic.DialAddrContext(
+		ctx,
 		c.addr,
 		tlsConf,
 		c.config,
@@ -189,22 +477,40 @@ func (c *QUICClient) RunDgram() error {
 		return err
 	}
 	c.session = session
+	defer closeOnDone(ctx, session)()
+	go c.bye.run(session)
+
+	var w io.Writer = c.writer
+	if c.reassemble {
+		c.reassembler = newReassembler(c.writer, fragmentTimeout)
+		done := make(chan struct{})
+		defer close(done)
+		go c.reassembler.run(done)
+		w = c.reassembler
+		defer func() {
+			log.Println(c.FragmentStats())
+		}()
+	}
 
 	for {
-		select {
-		case <-c.closeChan:
-			return nil
-		default:
-		}
 		bs, err := c.session.ReceiveMessage()
 		if err != nil {
-			// TODO: Figure out correct error handling
-			if err.Error() == "Application error 0x1: eos" {
-				return nil
+			return c.result(ctx, err)
+		}
+		bs, err = c.unmarshalDatagram(bs)
+		if err != nil {
+			log.Printf("dropping datagram: %v\n", err)
+			continue
+		}
+		if c.reassemble {
+			_, err = w.Write(bs)
+			if errors.Is(err, ErrFragmentTooShort) || errors.Is(err, ErrInvalidFragment) {
+				log.Printf("dropping datagram: %v\n", err)
+				continue
 			}
-			return err
+		} else {
+			_, err = io.Copy(w, bytes.NewReader(bs))
 		}
-		_, err = io.Copy(c.writer, bytes.NewReader(bs))
 		if err != nil && err != io.EOF {
 			return err
 		}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
@@ -18,14 +19,17 @@ import (
 const maxControlWindowSize = uint64(1 << 60)
 const maxStreamCount = int64(1 << 60)
 
+// SessionHandler serves QUIC sessions. The context passed to handle is
+// cancelled when the server closes all sessions, e.g. because Shutdown did
+// not finish in time.
 type SessionHandler interface {
-	handle(session quic.Session) error
+	handle(ctx context.Context, session quic.Session) error
 }
 
 type defaultSessionHandler string
 
-func (d defaultSessionHandler) handle(session quic.Session) error {
-	return session.CloseWithError(0, string(d))
+func (d defaultSessionHandler) handle(ctx context.Context, session quic.Session) error {
+	return closeSession(session, Bye{Code: CloseServerError, Reason: string(d)})
 }
 
 type QUICServer struct {
@@ -33,6 +37,10 @@ type QUICServer struct {
 	addr       string
 	tlsConfig  *tls.Config
 	quicConfig *quic.Config
+
+	webTransportPath string
+
+	lifecycle lifecycle
 }
 
 func NewQUICServer(addr string, tlsc *tls.Config, options ...func(*QUICServer)) (*QUICServer, error) {
@@ -47,6 +55,13 @@ func NewQUICServer(addr string, tlsc *tls.Config, options ...func(*QUICServer))
 	for _, option := range options {
 		option(s)
 	}
+	if s.tlsConfig == nil && len(s.webTransportPath) > 0 {
+		config, err := generateWebTransportTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		s.tlsConfig = config
+	}
 	if s.tlsConfig == nil {
 		config, err := generateTLSConfig()
 		if err != nil {
@@ -78,7 +93,24 @@ func SetDatagramEnabled(enabled bool) func(*QUICServer) {
 	}
 }
 
-func (s *QUICServer) Run() error {
+// CertificateHash returns the SHA-256 hash of the server certificate, which
+// browsers use to verify the self-signed WebTransport certificate.
+func (s *QUICServer) CertificateHash() []byte {
+	if len(s.tlsConfig.Certificates) == 0 || len(s.tlsConfig.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+	hash := sha256.Sum256(s.tlsConfig.Certificates[0].Certificate[0])
+	return hash[:]
+}
+
+// Run accepts sessions until ctx is done or Shutdown is called. Run returns
+// after all sessions ended, cancelling ctx closes all sessions right away.
+func (s *QUICServer) Run(ctx context.Context) error {
+	acceptCtx, sessionCtx, err := s.lifecycle.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.lifecycle.end()
 	listener, err := quic.ListenAddr(
 		s.addr,
 		s.tlsConfig,
@@ -87,37 +119,66 @@ func (s *QUICServer) Run() error {
 	if err != nil {
 		return err
 	}
-	return s.accept(listener)
+	// closing the listener closes all of its sessions, so it is closed after
+	// the sessions ended
+	defer listener.Close()
+	err = s.accept(acceptCtx, sessionCtx, listener)
+	return s.lifecycle.wait(ctx, err)
+}
+
+// Shutdown stops accepting sessions and waits until all sessions ended. If
+// ctx expires first, the remaining sessions are closed and ctx.Err() is
+// returned. Run returns ErrServerClosed afterwards.
+func (s *QUICServer) Shutdown(ctx context.Context) error {
+	return s.lifecycle.shutdown(ctx)
 }
 
-func (s *QUICServer) accept(listener quic.Listener) error {
+func (s *QUICServer) accept(ctx, sessionCtx context.Context, listener quic.Listener) error {
 	for {
-		sess, err := listener.Accept(context.Background())
+		sess, err := listener.Accept(ctx)
 		if err != nil {
 			return err
 		}
 		log.Printf("session accepted: %s", sess.RemoteAddr().String())
+		s.lifecycle.sessions.Add(1)
 		go func() {
-			var err error
-			defer func() {
-				if err != nil {
-					log.Printf("closing session with error: %v\n", err)
-					err = sess.CloseWithError(1, err.Error())
-					log.Printf("error while closing session: %v\n", err)
-					return
-				}
-				err := sess.CloseWithError(0, "bye")
-				if err != nil {
-					log.Printf("error while closing session: %v\n", err)
-					return
-				}
-				log.Println("closed session")
-			}()
-			err = s.handle(sess)
+			defer s.lifecycle.sessions.Done()
+			s.serve(sessionCtx, sess)
 		}()
 	}
 }
 
+func (s *QUICServer) serve(ctx context.Context, sess quic.Session) {
+	if len(s.webTransportPath) > 0 {
+		wt, err := acceptWebTransportSession(sess, s.webTransportPath)
+		if err != nil {
+			log.Printf("could not accept WebTransport session: %v\n", err)
+			err = sess.CloseWithError(h3RequestRejected, err.Error())
+			if err != nil {
+				log.Printf("error while closing session: %v\n", err)
+			}
+			return
+		}
+		sess = wt
+	}
+	var err error
+	defer func() {
+		if err != nil {
+			log.Printf("closing session with error: %v\n", err)
+			err = sess.CloseWithError(quic.ErrorCode(CloseServerError), err.Error())
+			log.Printf("error while closing session: %v\n", err)
+			return
+		}
+		err := sess.CloseWithError(quic.ErrorCode(CloseFinished), "")
+		if err != nil {
+			log.Printf("error while closing session: %v\n", err)
+			return
+		}
+		log.Println("closed session")
+	}()
+	err = s.handle(ctx, sess)
+}
+
 func generateTLSConfig() (*tls.Config, error) {
 	key, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -0,0 +1,313 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// receiverReportInterval is the interval in which RTCP Receiver Reports are
+// sent.
+const receiverReportInterval = time.Second
+
+// ReceptionStats holds the statistics of a report block (RFC 3550) of a
+// single RTP stream.
+type ReceptionStats struct {
+	SSRC uint32
+	// FractionLost is the fraction of packets lost since the previous report.
+	FractionLost float64
+	// TotalLost is the cumulative number of lost packets.
+	TotalLost uint32
+	// Jitter is the interarrival jitter.
+	Jitter time.Duration
+	// RTT is the round trip time calculated from LSR and DLSR, it is only
+	// known to the sender of the media.
+	RTT time.Duration
+}
+
+func (s ReceptionStats) String() string {
+	return fmt.Sprintf("ssrc %v: fraction lost %.3f, total lost %v, jitter %v, rtt %v", s.SSRC, s.FractionLost, s.TotalLost, s.Jitter, s.RTT)
+}
+
+// logLine formats s as a line of a report log file: the time in milliseconds
+// since start, the SSRC, the fraction lost, the cumulative number of lost
+// packets, the jitter and the RTT in milliseconds.
+func (s ReceptionStats) logLine(start time.Time) string {
+	return fmt.Sprintf("%v %v %.3f %v %.3f %.3f", time.Since(start).Milliseconds(), s.SSRC, s.FractionLost, s.TotalLost,
+		float64(s.Jitter)/float64(time.Millisecond), float64(s.RTT)/float64(time.Millisecond))
+}
+
+// receptionStream keeps the reception statistics of a single RTP stream as
+// described in RFC 3550, Appendix A.
+type receptionStream struct {
+	clockRate uint32
+
+	baseSeq  uint16
+	maxSeq   uint16
+	cycles   uint32
+	received uint32
+
+	expectedPrior uint32
+	receivedPrior uint32
+
+	// jitter and transit are in units of the RTP clock
+	jitter     float64
+	transit    float64
+	hasTransit bool
+
+	// lastSR is the middle 32 bits of the NTP timestamp of the latest Sender
+	// Report, lastSRTime the time it was received
+	lastSR     uint32
+	lastSRTime time.Time
+}
+
+func (s *receptionStream) update(header *rtp.Header, arrival time.Time) {
+	if s.received == 0 {
+		s.baseSeq = header.SequenceNumber
+		s.maxSeq = header.SequenceNumber
+	} else if delta := header.SequenceNumber - s.maxSeq; delta > 0 && delta < 1<<15 {
+		if header.SequenceNumber < s.maxSeq {
+			// sequence number wrapped
+			s.cycles += 1 << 16
+		}
+		s.maxSeq = header.SequenceNumber
+	}
+	s.received++
+
+	transit := float64(arrival.UnixNano())*float64(s.clockRate)/1e9 - float64(header.Timestamp)
+	if s.hasTransit {
+		d := transit - s.transit
+		if d < 0 {
+			d = -d
+		}
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.transit = transit
+	s.hasTransit = true
+}
+
+// report creates a report block and starts a new report interval.
+func (s *receptionStream) report(ssrc uint32, now time.Time) rtcp.ReceptionReport {
+	extendedMax := s.cycles + uint32(s.maxSeq)
+	expected := extendedMax - uint32(s.baseSeq) + 1
+	lost := int64(expected) - int64(s.received)
+	if lost < 0 {
+		lost = 0
+	}
+	expectedInterval := expected - s.expectedPrior
+	receivedInterval := s.received - s.receivedPrior
+	s.expectedPrior = expected
+	s.receivedPrior = s.received
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+	var delay uint32
+	if s.lastSR != 0 {
+		delay = uint32(now.Sub(s.lastSRTime).Seconds() * 65536)
+	}
+	return rtcp.ReceptionReport{
+		SSRC:               ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost),
+		LastSequenceNumber: extendedMax,
+		Jitter:             uint32(s.jitter),
+		LastSenderReport:   s.lastSR,
+		Delay:              delay,
+	}
+}
+
+// receptionStats converts a report block to statistics of a stream with the
+// given clock rate.
+func receptionStats(r rtcp.ReceptionReport, clockRate uint32) ReceptionStats {
+	stats := ReceptionStats{
+		SSRC:         r.SSRC,
+		FractionLost: float64(r.FractionLost) / 256,
+		TotalLost:    r.TotalLost,
+	}
+	if clockRate > 0 {
+		stats.Jitter = time.Duration(float64(r.Jitter) / float64(clockRate) * float64(time.Second))
+	}
+	return stats
+}
+
+// ReceiverReportWriter keeps reception statistics of all received RTP streams
+// and sends RTCP Receiver Reports (RFC 3550) using the feedback writer. RTCP
+// packets multiplexed with the RTP packets are not written to the underlying
+// writer, Sender Reports are recorded for the LSR and DLSR fields of the
+// reports and passed to the Sender Report handler. Only packets with a
+// payload type of known clock rate are included in the statistics.
+type ReceiverReportWriter struct {
+	lock       sync.Mutex
+	w          io.Writer
+	ssrc       uint32
+	clockRates map[uint8]uint32
+	streams    map[uint32]*receptionStream
+	feedback   io.Writer
+	onSR       func(*rtcp.SenderReport)
+	logger     *log.Logger
+	start      time.Time
+}
+
+// NewReceiverReportWriter creates a ReceiverReportWriter using clockRates to
+// map payload types to RTP clock rates in Hz.
+func NewReceiverReportWriter(w io.Writer, clockRates map[uint8]uint32) *ReceiverReportWriter {
+	return &ReceiverReportWriter{
+		w:          w,
+		ssrc:       rand.Uint32(),
+		clockRates: clockRates,
+		streams:    make(map[uint32]*receptionStream),
+		start:      time.Now(),
+	}
+}
+
+// SetFeedbackWriter sets the writer used to send reports to the sender. No
+// reports are sent before a writer is set.
+func (r *ReceiverReportWriter) SetFeedbackWriter(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.feedback = w
+}
+
+// SetSenderReportHandler sets a function called with every received Sender
+// Report.
+func (r *ReceiverReportWriter) SetSenderReportHandler(handler func(*rtcp.SenderReport)) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onSR = handler
+}
+
+// SetReportLogger logs the statistics of every sent report block to w.
+func (r *ReceiverReportWriter) SetReportLogger(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.logger = log.New(w, "", 0)
+}
+
+func (r *ReceiverReportWriter) Write(b []byte) (int, error) {
+	if isRTCP(b) {
+		return len(b), r.handleRTCP(b)
+	}
+	var header rtp.Header
+	err := header.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	r.lock.Lock()
+	if clockRate, ok := r.clockRates[header.PayloadType]; ok {
+		r.stream(header.SSRC, clockRate).update(&header, time.Now())
+	}
+	r.lock.Unlock()
+	return r.w.Write(b)
+}
+
+// stream returns the statistics of ssrc. The caller must hold the lock.
+func (r *ReceiverReportWriter) stream(ssrc uint32, clockRate uint32) *receptionStream {
+	s, ok := r.streams[ssrc]
+	if !ok {
+		s = &receptionStream{}
+		r.streams[ssrc] = s
+	}
+	if clockRate > 0 {
+		s.clockRate = clockRate
+	}
+	return s
+}
+
+func (r *ReceiverReportWriter) handleRTCP(b []byte) error {
+	packets, err := rtcp.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	r.lock.Lock()
+	onSR := r.onSR
+	var reports []*rtcp.SenderReport
+	for _, p := range packets {
+		sr, ok := p.(*rtcp.SenderReport)
+		if !ok {
+			continue
+		}
+		s := r.stream(sr.SSRC, 0)
+		s.lastSR = uint32(sr.NTPTime >> 16)
+		s.lastSRTime = now
+		reports = append(reports, sr)
+	}
+	r.lock.Unlock()
+	if onSR != nil {
+		for _, sr := range reports {
+			onSR(sr)
+		}
+	}
+	return nil
+}
+
+// Run sends Receiver Reports until done is closed.
+func (r *ReceiverReportWriter) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(receiverReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := r.sendReport()
+			if err != nil {
+				log.Printf("failed to send receiver report: %v\n", err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+func (r *ReceiverReportWriter) sendReport() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.feedback == nil {
+		return nil
+	}
+	now := time.Now()
+	rr := &rtcp.ReceiverReport{
+		SSRC: r.ssrc,
+	}
+	for ssrc, s := range r.streams {
+		if s.received == 0 {
+			continue
+		}
+		report := s.report(ssrc, now)
+		rr.Reports = append(rr.Reports, report)
+		if r.logger != nil {
+			r.logger.Println(receptionStats(report, s.clockRate).logLine(r.start))
+		}
+	}
+	if len(rr.Reports) == 0 {
+		return nil
+	}
+	b, err := rr.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = r.feedback.Write(b)
+	return err
+}
+
+// Stats returns the statistics of all received streams since the last report.
+func (r *ReceiverReportWriter) Stats() []ReceptionStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var stats []ReceptionStats
+	for ssrc, s := range r.streams {
+		if s.received == 0 {
+			continue
+		}
+		// work on a copy to keep the report interval
+		c := *s
+		stats = append(stats, receptionStats(c.report(ssrc, time.Now()), s.clockRate))
+	}
+	return stats
+}
@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	ErrVarintTooShort    = errors.New("varint too short")
+	ErrRoQUnknownFlow    = errors.New("unknown RoQ flow identifier")
+	ErrRoQPacketTooLarge = errors.New("RoQ packet too large")
+)
+
+const maxVarint = 1<<62 - 1
+
+// maxRoQPacketSize is the largest packet accepted on RoQ streams. The length
+// prefix is read from the peer, so it is checked before allocating the
+// packet. RTP and RTCP packets carried in UDP datagrams are never larger.
+const maxRoQPacketSize = 0xFFFF
+
+// MaxRoQFlowID is the largest flow identifier that fits into a varint.
+const MaxRoQFlowID = maxVarint
+
+// appendVarint appends v encoded as QUIC variable-length integer (RFC 9000,
+// Section 16) to b.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	case v <= maxVarint:
+		return append(b, byte(v>>56)|0xC0, byte(v>>48), byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		panic(fmt.Sprintf("%v does not fit into a varint", v))
+	}
+}
+
+// parseVarint parses a QUIC variable-length integer from the beginning of b
+// and returns the value and the number of bytes read.
+func parseVarint(b []byte) (uint64, int, error) {
+	if len(b) == 0 {
+		return 0, 0, ErrVarintTooShort
+	}
+	n := 1 << (b[0] >> 6)
+	if len(b) < n {
+		return 0, 0, fmt.Errorf("%w: need %v bytes, got %v", ErrVarintTooShort, n, len(b))
+	}
+	v := uint64(b[0] & 0x3F)
+	for i := 1; i < n; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, n, nil
+}
+
+// readVarint reads a QUIC variable-length integer from r.
+func readVarint(r io.ByteReader) (uint64, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	n := 1 << (first >> 6)
+	v := uint64(first & 0x3F)
+	for i := 1; i < n; i++ {
+		b, err := r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// roqFlow implements the framing of RTP over QUIC
+// (draft-ietf-avtcore-rtp-over-quic) for a single flow. Datagrams start with
+// the flow identifier, streams start with the flow identifier followed by
+// RTP or RTCP packets, each prefixed by its length. Both encoded as varint.
+// RTP and RTCP share the flow and are demultiplexed as in RFC 5761.
+type roqFlow struct {
+	id uint64
+}
+
+func newRoQFlow(id uint64) *roqFlow {
+	return &roqFlow{id: id}
+}
+
+func (f *roqFlow) marshalDatagram(packet []byte) []byte {
+	b := make([]byte, 0, 8+len(packet))
+	b = appendVarint(b, f.id)
+	return append(b, packet...)
+}
+
+func (f *roqFlow) unmarshalDatagram(b []byte) ([]byte, error) {
+	id, n, err := parseVarint(b)
+	if err != nil {
+		return nil, err
+	}
+	if id != f.id {
+		return nil, fmt.Errorf("%w: %v", ErrRoQUnknownFlow, id)
+	}
+	return b[n:], nil
+}
+
+// marshalStreamHeader returns the flow identifier sent at the beginning of a
+// stream.
+func (f *roqFlow) marshalStreamHeader() []byte {
+	return appendVarint(nil, f.id)
+}
+
+// marshalPackets prefixes each packet by its length.
+func (f *roqFlow) marshalPackets(packets [][]byte) []byte {
+	var b []byte
+	for _, p := range packets {
+		b = appendVarint(b, uint64(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+// marshalStream returns a complete stream carrying packets.
+func (f *roqFlow) marshalStream(packets [][]byte) []byte {
+	return append(f.marshalStreamHeader(), f.marshalPackets(packets)...)
+}
+
+// roqStreamReader reads packets from a RoQ stream.
+type roqStreamReader struct {
+	flow   *roqFlow
+	r      *bufio.Reader
+	header bool
+}
+
+func (f *roqFlow) newStreamReader(r io.Reader) *roqStreamReader {
+	return &roqStreamReader{
+		flow: f,
+		r:    bufio.NewReader(r),
+	}
+}
+
+// next returns the next packet of the stream or io.EOF at the end of the
+// stream.
+func (s *roqStreamReader) next() ([]byte, error) {
+	if !s.header {
+		id, err := readVarint(s.r)
+		if err != nil {
+			return nil, err
+		}
+		if id != s.flow.id {
+			return nil, fmt.Errorf("%w: %v", ErrRoQUnknownFlow, id)
+		}
+		s.header = true
+	}
+	length, err := readVarint(s.r)
+	if err != nil {
+		return nil, err
+	}
+	if length > maxRoQPacketSize {
+		return nil, fmt.Errorf("%w: %v bytes, expected at most %v", ErrRoQPacketTooLarge, length, maxRoQPacketSize)
+	}
+	packet := make([]byte, length)
+	_, err = io.ReadFull(s.r, packet)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return packet, err
+}
+
+// isRTCP distinguishes RTCP from RTP packets sharing a flow (RFC 5761).
+func isRTCP(packet []byte) bool {
+	return len(packet) > 1 && packet[1] >= 192 && packet[1] <= 223
+}
+
+// readRoQStream writes all RTP and RTCP packets of a RoQ stream to w.
+func readRoQStream(flow *roqFlow, stream io.Reader, w io.Writer) error {
+	r := flow.newStreamReader(stream)
+	for {
+		packet, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(packet)
+		if err != nil {
+			return err
+		}
+	}
+}
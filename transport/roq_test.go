@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRoQStreamRoundTrip(t *testing.T) {
+	flow := newRoQFlow(300)
+	packets := [][]byte{
+		testRTPPacket(1, 1, []byte("frame")),
+		{0x80, 0xc8, 0x00, 0x00},
+		bytes.Repeat([]byte{0x80}, maxRoQPacketSize),
+	}
+	r := flow.newStreamReader(bytes.NewReader(flow.marshalStream(packets)))
+	for i, want := range packets {
+		packet, err := r.next()
+		if err != nil {
+			t.Fatalf("next packet %v: %v", i, err)
+		}
+		if !reflect.DeepEqual(packet, want) {
+			t.Fatalf("packet %v = %x, want %x", i, packet, want)
+		}
+	}
+	if _, err := r.next(); err != io.EOF {
+		t.Fatalf("next at end of stream error = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestRoQStreamInvalid(t *testing.T) {
+	flow := newRoQFlow(1)
+	for _, tc := range []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"unknown flow", appendVarint(nil, 2), ErrRoQUnknownFlow},
+		{"truncated length", []byte{0x01, 0x40}, io.ErrUnexpectedEOF},
+		{"truncated packet", []byte{0x01, 0x04, 0x80, 0x60}, io.ErrUnexpectedEOF},
+		// the length is checked before allocating the packet
+		{"too large", appendVarint([]byte{0x01}, maxRoQPacketSize+1), ErrRoQPacketTooLarge},
+		{"max varint", appendVarint([]byte{0x01}, maxVarint), ErrRoQPacketTooLarge},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := flow.newStreamReader(bytes.NewReader(tc.data))
+			if _, err := r.next(); !errors.Is(err, tc.err) {
+				t.Fatalf("next error = %v, want %v", err, tc.err)
+			}
+		})
+	}
+}
+
+// packetList records copies of all packets written to it.
+type packetList [][]byte
+
+func (l *packetList) Write(b []byte) (int, error) {
+	*l = append(*l, append([]byte{}, b...))
+	return len(b), nil
+}
+
+// RTCP packets share the flow of the media and are passed on like RTP packets.
+func TestReadRoQStreamRTCP(t *testing.T) {
+	flow := newRoQFlow(1)
+	packets := [][]byte{
+		testRTPPacket(1, 1, []byte("frame")),
+		{0x80, 0xc8, 0x00, 0x00},
+		testRTPPacket(2, 1, []byte("frame")),
+	}
+	var got packetList
+	if err := readRoQStream(flow, bytes.NewReader(flow.marshalStream(packets)), &got); err != nil {
+		t.Fatalf("readRoQStream: %v", err)
+	}
+	if !reflect.DeepEqual([][]byte(got), packets) {
+		t.Fatalf("written packets %x, want %x", got, packets)
+	}
+}
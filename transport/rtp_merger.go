@@ -0,0 +1,139 @@
+package transport
+
+import (
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// rtpMerger merges RTP packets received on multiple paths and writes them to
+// w in sequence number order. Packets following a gap are held back until the
+// gap is filled or the oldest held back packet waited longer than maxWait.
+// Packets arriving after a gap was skipped are dropped. The first packets are
+// held back for maxWait as well, since packets with lower sequence numbers
+// may still arrive on another path. RTCP packets have no sequence number and
+// are written to w immediately.
+type rtpMerger struct {
+	lock    sync.Mutex
+	w       io.Writer
+	maxWait time.Duration
+
+	started bool
+	next    uint16
+	pending map[uint16]*pendingPacket
+	dropped uint64
+}
+
+type pendingPacket struct {
+	buf     []byte
+	arrival time.Time
+}
+
+func newRTPMerger(w io.Writer, maxWait time.Duration) *rtpMerger {
+	return &rtpMerger{
+		w:       w,
+		maxWait: maxWait,
+		pending: make(map[uint16]*pendingPacket),
+	}
+}
+
+func (m *rtpMerger) Write(b []byte) (int, error) {
+	if isRTCP(b) {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		return m.w.Write(b)
+	}
+	var header rtp.Header
+	err := header.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.started && int16(header.SequenceNumber-m.next) < 0 {
+		atomic.AddUint64(&m.dropped, 1)
+		log.Printf("dropping late packet %v, expected %v\n", header.SequenceNumber, m.next)
+		return len(b), nil
+	}
+	buf := make([]byte, len(b))
+	copy(buf, b)
+	m.pending[header.SequenceNumber] = &pendingPacket{
+		buf:     buf,
+		arrival: time.Now(),
+	}
+	if !m.started {
+		return len(b), nil
+	}
+	return len(b), m.drain()
+}
+
+// drain writes all packets which are in order.
+func (m *rtpMerger) drain() error {
+	for {
+		p, ok := m.pending[m.next]
+		if !ok {
+			return nil
+		}
+		delete(m.pending, m.next)
+		m.next++
+		_, err := m.w.Write(p.buf)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// flushExpired skips missing packets if a held back packet waited for longer
+// than maxWait.
+func (m *rtpMerger) flushExpired() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for len(m.pending) > 0 {
+		var oldest time.Time
+		first := true
+		var lowest uint16
+		for seq, p := range m.pending {
+			if first || p.arrival.Before(oldest) {
+				oldest = p.arrival
+			}
+			if first || int16(seq-lowest) < 0 {
+				lowest = seq
+			}
+			first = false
+		}
+		if time.Since(oldest) < m.maxWait {
+			return nil
+		}
+		if m.started {
+			log.Printf("skipping missing packets %v to %v\n", m.next, lowest-1)
+		}
+		m.started = true
+		m.next = lowest
+		err := m.drain()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run periodically flushes expired packets until done is closed.
+func (m *rtpMerger) run(done <-chan struct{}) {
+	ticker := time.NewTicker(m.maxWait / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := m.flushExpired()
+			if err != nil {
+				log.Println(err)
+			}
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"encoding/binary"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// packetRecorder records the sequence numbers of the RTP packets written to
+// it.
+type packetRecorder struct {
+	lock sync.Mutex
+	seqs []uint16
+}
+
+func (r *packetRecorder) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.seqs = append(r.seqs, binary.BigEndian.Uint16(b[2:4]))
+	return len(b), nil
+}
+
+func (r *packetRecorder) written() []uint16 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]uint16{}, r.seqs...)
+}
+
+// The hybrid client passes all received datagrams and packets of key frame
+// streams to a merger, Sender Reports sent in between must neither be ordered
+// as RTP packets nor be held back.
+func TestRTPMergerSenderReport(t *testing.T) {
+	const maxWait = 20 * time.Millisecond
+	recorder := &packetRecorder{}
+	rr := NewReceiverReportWriter(recorder, map[uint8]uint32{96: 90000})
+	reports := make(chan *rtcp.SenderReport, 1)
+	rr.SetSenderReportHandler(func(sr *rtcp.SenderReport) {
+		reports <- sr
+	})
+	m := newRTPMerger(rr, maxWait)
+
+	write := func(b []byte) {
+		t.Helper()
+		if _, err := m.Write(b); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+	}
+	write(testRTPPacket(1, 1, []byte("key frame")))
+	write(testRTPPacket(2, 1, []byte("key frame")))
+	time.Sleep(maxWait)
+	if err := m.flushExpired(); err != nil {
+		t.Fatalf("flushExpired: %v", err)
+	}
+
+	sr, err := (&rtcp.SenderReport{SSRC: 1, NTPTime: 1 << 32, RTPTime: 180}).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	write(sr)
+	select {
+	case got := <-reports:
+		if got.SSRC != 1 || got.RTPTime != 180 {
+			t.Fatalf("Sender Report = %v, want SSRC 1 and RTP time 180", got)
+		}
+	default:
+		t.Fatal("Sender Report was not passed to the writer")
+	}
+
+	write(testRTPPacket(4, 1, []byte("datagram")))
+	write(testRTPPacket(3, 1, []byte("datagram")))
+	if got, want := recorder.written(), []uint16{1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("written packets %v, want %v", got, want)
+	}
+	if m.dropped != 0 {
+		t.Fatalf("dropped %v packets, want 0", m.dropped)
+	}
+}
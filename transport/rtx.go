@@ -0,0 +1,337 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// RTXPayloadType is the RTP payload type used for retransmissions.
+const RTXPayloadType = 126
+
+const (
+	// rtxHistorySize is the number of sent packets kept for retransmission.
+	rtxHistorySize = 1024
+	// maxNACKGap is the largest gap of sequence numbers which is reported
+	// as lost. Larger gaps are considered a restart of the stream.
+	maxNACKGap = 256
+)
+
+// RTXSendWriter keeps a history of sent RTP packets and retransmits packets
+// requested by RTCP Generic NACKs (RFC 4585) in the RTX payload format
+// (RFC 4588). Packets are only retransmitted if they were sent less than
+// maxAge ago, older packets would arrive too late to be played out. FEC
+// packets are not retransmitted.
+type RTXSendWriter struct {
+	lock    sync.Mutex
+	w       io.WriteCloser
+	ssrc    uint32
+	seqNr   uint16
+	maxAge  time.Duration
+	history *rtpPacketHistory
+
+	retransmitted uint64
+	expired       uint64
+}
+
+type sentRTPPacket struct {
+	packet *rtp.Packet
+	sent   time.Time
+}
+
+// rtpPacketHistory keeps the most recently sent RTP packets of a stream by
+// sequence number.
+type rtpPacketHistory struct {
+	size    int
+	packets map[uint16]*sentRTPPacket
+	order   []uint16
+}
+
+func newRTPPacketHistory(size int) *rtpPacketHistory {
+	return &rtpPacketHistory{
+		size:    size,
+		packets: make(map[uint16]*sentRTPPacket),
+	}
+}
+
+// store adds packet to the history, removing the oldest packet if the history
+// is full.
+func (h *rtpPacketHistory) store(packet *rtp.Packet) {
+	if _, ok := h.packets[packet.SequenceNumber]; !ok {
+		h.order = append(h.order, packet.SequenceNumber)
+	}
+	h.packets[packet.SequenceNumber] = &sentRTPPacket{
+		packet: packet,
+		sent:   time.Now(),
+	}
+	if len(h.order) > h.size {
+		delete(h.packets, h.order[0])
+		h.order = h.order[1:]
+	}
+}
+
+func (h *rtpPacketHistory) get(seqNr uint16) (*sentRTPPacket, bool) {
+	p, ok := h.packets[seqNr]
+	return p, ok
+}
+
+// NewRTXSendWriter creates a RTXSendWriter retransmitting packets with the
+// given RTX SSRC.
+func NewRTXSendWriter(w io.WriteCloser, ssrc uint32, maxAge time.Duration) *RTXSendWriter {
+	return &RTXSendWriter{
+		w:       w,
+		ssrc:    ssrc,
+		maxAge:  maxAge,
+		history: newRTPPacketHistory(rtxHistorySize),
+	}
+}
+
+func (r *RTXSendWriter) Write(b []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(b) > 1 && b[1]&0x7F != FECPayloadType {
+		packet := &rtp.Packet{}
+		err := packet.Unmarshal(append([]byte{}, b...))
+		if err != nil {
+			return 0, err
+		}
+		r.history.store(packet)
+	}
+	return r.w.Write(b)
+}
+
+func (r *RTXSendWriter) Close() error {
+	log.Printf("retransmitted %v packets, %v requested packets expired\n", atomic.LoadUint64(&r.retransmitted), atomic.LoadUint64(&r.expired))
+	return r.w.Close()
+}
+
+// FilterFeedback handles all NACKs received on fb and forwards all other
+// feedback to the returned channel until fb is closed or ctx is done.
+func (r *RTXSendWriter) FilterFeedback(ctx context.Context, fb <-chan []byte) <-chan []byte {
+	return filterFeedback(ctx, fb, func(msg []byte) bool {
+		if !isNACK(msg) {
+			return false
+		}
+		err := r.handleNACK(msg)
+		if err != nil {
+			log.Printf("failed to handle NACK: %v\n", err)
+		}
+		return true
+	})
+}
+
+func (r *RTXSendWriter) handleNACK(b []byte) error {
+	nack := &rtcp.TransportLayerNack{}
+	err := nack.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, pair := range nack.Nacks {
+		for _, seqNr := range pair.PacketList() {
+			err = r.retransmit(seqNr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RTXSendWriter) retransmit(seqNr uint16) error {
+	p, ok := r.history.get(seqNr)
+	if !ok {
+		log.Printf("NACKed packet %v not in history\n", seqNr)
+		return nil
+	}
+	if time.Since(p.sent) > r.maxAge {
+		atomic.AddUint64(&r.expired, 1)
+		return nil
+	}
+	payload := make([]byte, 2+len(p.packet.Payload))
+	binary.BigEndian.PutUint16(payload, seqNr)
+	copy(payload[2:], p.packet.Payload)
+	rtx := &rtp.Packet{
+		Header:  p.packet.Header,
+		Payload: payload,
+	}
+	rtx.SSRC = r.ssrc
+	rtx.PayloadType = RTXPayloadType
+	rtx.SequenceNumber = r.seqNr
+	r.seqNr++
+	b, err := rtx.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(b)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.retransmitted, 1)
+	return nil
+}
+
+// isNACK checks if b is a RTCP Generic NACK packet.
+func isNACK(b []byte) bool {
+	if len(b) < 12 {
+		return false
+	}
+	var h rtcp.Header
+	if err := h.Unmarshal(b); err != nil {
+		return false
+	}
+	return h.Type == rtcp.TypeTransportSpecificFeedback &&
+		h.Count == rtcp.FormatTLN &&
+		(int(h.Length)+1)*4 == len(b)
+}
+
+// RTXStats holds the statistics of a RTXReceiveWriter.
+type RTXStats struct {
+	// NACKed is the number of packets requested by NACKs.
+	NACKed uint64
+	// Retransmitted is the number of received retransmissions.
+	Retransmitted uint64
+}
+
+func (s RTXStats) String() string {
+	return fmt.Sprintf("requested %v packets, received %v retransmissions", s.NACKed, s.Retransmitted)
+}
+
+// RTXReceiveWriter detects lost RTP packets by gaps in sequence numbers and
+// requests them from the sender by RTCP Generic NACKs. Retransmissions in the
+// RTX payload format are restored to the original packets before they are
+// written to the underlying writer.
+type RTXReceiveWriter struct {
+	lock      sync.Mutex
+	w         io.Writer
+	nackw     io.Writer
+	started   bool
+	highest   uint16
+	mediaSSRC uint32
+	mediaPT   uint8
+
+	nacked        uint64
+	retransmitted uint64
+}
+
+func NewRTXReceiveWriter(w io.Writer) *RTXReceiveWriter {
+	return &RTXReceiveWriter{
+		w: w,
+	}
+}
+
+// SetNACKWriter sets the writer used to send NACKs to the sender. Losses are
+// not reported before a writer is set.
+func (r *RTXReceiveWriter) SetNACKWriter(w io.Writer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nackw = w
+}
+
+func (r *RTXReceiveWriter) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	err := packet.Unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	switch packet.PayloadType {
+	case FECPayloadType:
+		return r.w.Write(b)
+	case RTXPayloadType:
+		return len(b), r.writeRetransmission(packet)
+	}
+
+	r.lock.Lock()
+	r.mediaSSRC = packet.SSRC
+	r.mediaPT = packet.PayloadType
+	var missing []uint16
+	if !r.started {
+		r.started = true
+		r.highest = packet.SequenceNumber
+	} else if diff := int16(packet.SequenceNumber - r.highest); diff > 0 {
+		if diff > 1 && diff <= maxNACKGap {
+			for s := r.highest + 1; s != packet.SequenceNumber; s++ {
+				missing = append(missing, s)
+			}
+		}
+		r.highest = packet.SequenceNumber
+	}
+	err = r.sendNACK(missing)
+	r.lock.Unlock()
+	if err != nil {
+		log.Printf("failed to send NACK: %v\n", err)
+	}
+	return r.w.Write(b)
+}
+
+func (r *RTXReceiveWriter) writeRetransmission(rtx *rtp.Packet) error {
+	if len(rtx.Payload) < 2 {
+		return fmt.Errorf("retransmission too short: %v bytes", len(rtx.Payload))
+	}
+	atomic.AddUint64(&r.retransmitted, 1)
+	packet := &rtp.Packet{
+		Header:  rtx.Header,
+		Payload: rtx.Payload[2:],
+	}
+	r.lock.Lock()
+	packet.SSRC = r.mediaSSRC
+	packet.PayloadType = r.mediaPT
+	r.lock.Unlock()
+	packet.SequenceNumber = binary.BigEndian.Uint16(rtx.Payload)
+	b, err := packet.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = r.w.Write(b)
+	return err
+}
+
+// sendNACK requests the missing packets. The caller must hold the lock.
+func (r *RTXReceiveWriter) sendNACK(missing []uint16) error {
+	if len(missing) == 0 || r.nackw == nil {
+		return nil
+	}
+	nack := &rtcp.TransportLayerNack{
+		MediaSSRC: r.mediaSSRC,
+		Nacks:     nackPairs(missing),
+	}
+	b, err := nack.Marshal()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.nacked, uint64(len(missing)))
+	_, err = r.nackw.Write(b)
+	return err
+}
+
+// nackPairs encodes ascending sequence numbers as NACK pairs.
+func nackPairs(seqNrs []uint16) []rtcp.NackPair {
+	var pairs []rtcp.NackPair
+	for _, s := range seqNrs {
+		if len(pairs) > 0 {
+			last := &pairs[len(pairs)-1]
+			if d := s - last.PacketID; d > 0 && d <= 16 {
+				last.LostPackets |= rtcp.PacketBitmap(1 << (d - 1))
+				continue
+			}
+		}
+		pairs = append(pairs, rtcp.NackPair{PacketID: s})
+	}
+	return pairs
+}
+
+func (r *RTXReceiveWriter) Stats() RTXStats {
+	return RTXStats{
+		NACKed:        atomic.LoadUint64(&r.nacked),
+		Retransmitted: atomic.LoadUint64(&r.retransmitted),
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -70,287 +71,58 @@ func rttReceiveTime(p *Packet, ts uint32) uint32 {
 	return minMax(p.sentTimestamp, ts, uint32(int64(p.sentTimestamp)+int64(rttNTP)/2))
 }
 
-func (s *ScreamSendWriter) SetReceiveTimeInferFn(fn InferReceiveTimeFnFactory) {
-	s.inferReceiveTime = fn.getInferReceiveTimeFn()
+// ScreamController implements CongestionController using the SCReAM
+// implementation wrapped by scream-go.
+type ScreamController struct {
+	tx   *scream.Tx
+	ssrc uint
 }
 
-func (s *ScreamSendWriter) SetKeyFrameRequester(requestKeyFrame func()) {
-	s.requestKeyFrame = requestKeyFrame
-}
-
-type ScreamSendWriter struct {
-	w               io.WriteCloser
-	q               *Queue
-	screamTx        *scream.Tx
-	screamRx        *scream.Rx
-	ssrc            uint
-	packet          chan *rtp.Packet
-	feedback        <-chan []byte
-	ack             <-chan []*Packet
-	done            chan struct{}
-	screamLogWriter io.Writer
-	requestKeyFrame func()
-
-	inferReceiveTime InferReceiveTime
-}
-
-type Feedback struct {
-	fb    []byte
-	seqNr uint16
-	ts    uint32
-}
-
-func (s *ScreamSendWriter) Close() error {
-	close(s.done)
-	return nil
-}
-
-func NewScreamWriter(ssrc uint, bitrate int, w io.WriteCloser, fb <-chan []byte, screamLogWriter io.Writer) *ScreamSendWriter {
-	queue := NewQueue()
-	screamTx := scream.NewTx()
-	screamTx.RegisterNewStream(queue, ssrc, 1, 1000, float64(bitrate*1000), 2048000000)
-	screamRx := scream.NewRx(ssrc)
-
-	return &ScreamSendWriter{
-		w:                w,
-		q:                queue,
-		screamTx:         screamTx,
-		screamRx:         screamRx,
-		ssrc:             ssrc,
-		packet:           make(chan *rtp.Packet, 1024),
-		done:             make(chan struct{}, 1),
-		feedback:         fb,
-		screamLogWriter:  screamLogWriter,
-		inferReceiveTime: staticReceiveTime,
+func NewScreamController(ssrc uint, bitrate int, q *Queue) CongestionController {
+	tx := scream.NewTx()
+	tx.RegisterNewStream(q, ssrc, 1, 1000, float64(bitrate*1000), 2048000000)
+	return &ScreamController{
+		tx:   tx,
+		ssrc: ssrc,
 	}
 }
 
-func (s *ScreamSendWriter) Write(b []byte) (int, error) {
-	packet := &rtp.Packet{}
-	err := packet.Unmarshal(b)
-	if err != nil {
-		return 0, err
-	}
-	s.packet <- packet
-	return len(b), nil
+func (s *ScreamController) OnMediaFrame(now uint32, packet *rtp.Packet) {
+	s.tx.NewMediaFrame(uint(now), s.ssrc, len(packet.Raw))
 }
 
-func (s ScreamSendWriter) RunBitrate(setBitrate func(uint)) {
-	ticker := time.NewTicker(20 * time.Millisecond)
-	var lastBitrate uint
-	screamLogger := log.New(s.screamLogWriter, "", 0)
-	start := time.Now()
-	//screamLogger.Printf("len(queue) cwnd bytesInFlightLog fastStart queueDelay targetBitrate rateTransmitted")
-	for {
-		select {
-		case <-ticker.C:
-			stats := s.screamTx.GetStatistics(uint(gst.GetTimeInNTP() / 65536.0))
-			statSlice := strings.Split(stats, ",")
-			screamLogger.Printf("%v %v %v %v %v %v %v %v %v", time.Since(start).Milliseconds(), s.q.Len(), statSlice[3], statSlice[4], statSlice[5], statSlice[7], statSlice[8], statSlice[9], statSlice[11])
-			kbps := s.screamTx.GetTargetBitrate(s.ssrc) / 1000
-			//log.Printf("got scream bitrate: %v\n", kbps)
-			if kbps <= 0 {
-				//log.Printf("skipping setBitrate to %v\n", kbps)
-				if s.requestKeyFrame != nil {
-					//log.Printf("requesting new key frame")
-					s.requestKeyFrame()
-				}
-				continue
-			}
-			if lastBitrate != uint(kbps) {
-				lastBitrate = uint(kbps)
-				setBitrate(lastBitrate)
-				fmt.Printf("%v, SET BITRATE to %v\n", time.Since(start).Seconds(), lastBitrate)
-			}
-		case <-s.done:
-			log.Println("leaving RunBitrate")
-			return
-		}
-
-	}
+func (s *ScreamController) OnPacketSent(now uint32, packet *rtp.Packet) {
+	s.tx.AddTransmitted(
+		uint(now),
+		uint(packet.SSRC),
+		len(packet.Raw),
+		uint(packet.SequenceNumber),
+		packet.Marker,
+	)
 }
 
-func (s *ScreamSendWriter) RunReceiveFeedback() {
-	gst.InitT0()
-	for {
-		//fmt.Printf("len(q)=%v, delay: %v\n", s.q.Len(), s.q.GetDelay(float64(gst.GetTimeInNTP())/65536))
-		select {
-		case packet := <-s.packet:
-			now := gst.GetTimeInNTP()
-			s.q.Push(&RTPQueueItem{
-				Packet:    packet,
-				Timestamp: float64(now) / 65536.0,
-			})
-			s.screamTx.NewMediaFrame(uint(now), s.ssrc, len(packet.Raw))
-
-		case fb := <-s.feedback:
-			s.screamTx.IncomingStandardizedFeedback(uint(gst.GetTimeInNTP()), fb)
-
-		case <-s.done:
-			if s.q.Len() <= 0 {
-				log.Println("done, closing ScreamSendWriter")
-				err := s.w.Close()
-				if err != nil {
-					log.Println(err)
-				}
-				return
-			}
-		default:
-		}
-
-		dT := s.screamTx.IsOkToTransmit(uint(gst.GetTimeInNTP()), s.ssrc)
-		if dT != 0 {
-			//if dT > 0 {
-			//fmt.Printf("not ok to transmit: s.q.Len()=%v, dT:=%v\n", s.q.Len(), dT)
-			//}
-			continue
-		}
-		item := s.q.Pop()
-		if item == nil {
-			continue
-		}
-		bs, err := item.Packet.Marshal()
-		if err != nil {
-			log.Println(err)
-		}
-		_, err = s.w.Write(bs)
-		if err != nil {
-			log.Println(err)
-		}
-		//log.Printf("packet of %v bytes written from scream queue, len(queue)=%v", n, s.q.Len())
-		now := gst.GetTimeInNTP()
-		dT = s.screamTx.AddTransmitted(
-			uint(now),
-			uint(item.Packet.SSRC),
-			len(item.Packet.Raw),
-			uint(item.Packet.SequenceNumber),
-			item.Packet.Marker,
-		)
-		//log.Printf("%v: sent %v, got dT=%v\n", now, item.Packet.SequenceNumber, dT)
-		//log.Printf("transmitted seq nr: %v\n", item.Packet.SequenceNumber)
-	}
+func (s *ScreamController) OnFeedback(now uint32, feedback []byte) {
+	s.tx.IncomingStandardizedFeedback(uint(now), feedback)
 }
 
-type Packet struct {
-	sentTimestamp     uint32
-	inferredTimestamp uint32
-	rtpSeqNr          uint16
-	size              int
-
-	quicPacketNr int64
-	ackTimestamp uint32
-	smoothedRTT  float64
+func (s *ScreamController) IsOkToTransmit(now uint32) bool {
+	return s.tx.IsOkToTransmit(uint(now), s.ssrc) == 0
 }
 
-func (s *ScreamSendWriter) RunInferFeedback(ackChan <-chan []*Packet) {
-
-	sentPackets := make(map[uint16]*Packet) // rtp sequencenumber -> packet
-	var nextReceiveCall []*Packet
-	var lastSeenSmoothedRTT float64
-
-	gst.InitT0()
-	for {
-		//fmt.Printf("len(q)=%v, delay: %v\n", s.q.Len(), s.q.GetDelay(float64(gst.GetTimeInNTP())/65536))
-		select {
-		case packet := <-s.packet:
-			now := gst.GetTimeInNTP()
-			s.q.Push(&RTPQueueItem{
-				Packet:    packet,
-				Timestamp: float64(now) / 65536.0,
-			})
-			s.screamTx.NewMediaFrame(uint(now), s.ssrc, len(packet.Raw))
-
-		case ack := <-ackChan:
-			for _, n := range ack {
-				sentPackets[n.rtpSeqNr].ackTimestamp = n.ackTimestamp
-				sentPackets[n.rtpSeqNr].smoothedRTT = n.smoothedRTT
-				lastSeenSmoothedRTT = n.smoothedRTT
-				nextReceiveCall = append(nextReceiveCall, sentPackets[n.rtpSeqNr])
-			}
-
-		case fb := <-s.feedback:
-			ts := binary.BigEndian.Uint32(fb[0:4])
-			snr := binary.BigEndian.Uint16(fb[4:6])
-			//log.Printf("TIMESTAMP: %v\n", ts)
-
-			if p, ok := sentPackets[snr]; ok {
-				p.ackTimestamp = ts
-				p.smoothedRTT = lastSeenSmoothedRTT
-				nextReceiveCall = append(nextReceiveCall, p)
-			}
-			for _, p := range nextReceiveCall {
-				p.inferredTimestamp = s.inferReceiveTime(p, ts)
-				//log.Printf("seqNr: %v, sent at %v, got inferred Timestamp: %v, diff:=%v\n", p.rtpSeqNr, p.sentTimestamp, p.inferredTimestamp, p.inferredTimestamp-p.sentTimestamp)
-				s.screamRx.Receive(uint(p.inferredTimestamp), nil, 1, p.size, int(p.rtpSeqNr), 0)
-			}
-			nextReceiveCall = []*Packet{}
-			if ok, feedback := s.screamRx.CreateStandardizedFeedback(
-				uint(ts),
-				true,
-			); ok {
-				fbts := binary.BigEndian.Uint32(feedback[len(feedback)-4:])
-				if fbts != ts {
-					panic(fmt.Sprintf("feedback has wrong ts: %v: %v\n", fbts, feedback))
-				}
-				c := make([]byte, len(feedback))
-				copy(c, feedback)
-				s.screamTx.IncomingStandardizedFeedback(uint(gst.GetTimeInNTP()), c)
-			}
-
-		case <-s.done:
-			if s.q.Len() <= 0 {
-				log.Println("done, closing ScreamSendWriter")
-				err := s.w.Close()
-				if err != nil {
-					log.Println(err)
-				}
-				return
-			}
-		default:
-		}
+func (s *ScreamController) TargetBitrate(now uint32) int {
+	return int(s.tx.GetTargetBitrate(s.ssrc))
+}
 
-		dT := s.screamTx.IsOkToTransmit(uint(gst.GetTimeInNTP()), s.ssrc)
-		if dT != 0 {
-			//if dT > 0 {
-			//fmt.Printf("not ok to transmit: s.q.Len()=%v, dT:=%v\n", s.q.Len(), dT)
-			//}
-			continue
-		}
-		item := s.q.Pop()
-		if item == nil {
-			continue
-		}
-		bs, err := item.Packet.Marshal()
-		if err != nil {
-			log.Println(err)
-		}
-		_, err = s.w.Write(bs)
-		if err != nil {
-			log.Println(err)
-		}
-		//log.Printf("packet of %v bytes written from scream queue, len(queue)=%v", n, s.q.Len())
-		now := gst.GetTimeInNTP()
-		dT = s.screamTx.AddTransmitted(
-			uint(now),
-			uint(item.Packet.SSRC),
-			len(item.Packet.Raw),
-			uint(item.Packet.SequenceNumber),
-			item.Packet.Marker,
-		)
-		sentPackets[item.Packet.SequenceNumber] = &Packet{
-			sentTimestamp: now,
-			size:          len(item.Packet.Raw),
-			rtpSeqNr:      item.Packet.SequenceNumber,
-		}
-		//log.Printf("%v: sent %v, got dT=%v\n", now, item.Packet.SequenceNumber, dT)
-	}
+func (s *ScreamController) Stats(now uint32) string {
+	stats := s.tx.GetStatistics(uint(now / 65536))
+	statSlice := strings.Split(stats, ",")
+	return fmt.Sprintf("%v %v %v %v %v %v %v", statSlice[3], statSlice[4], statSlice[5], statSlice[7], statSlice[8], statSlice[9], statSlice[11])
 }
 
 type ScreamReadWriter struct {
 	w                     io.Writer
 	screamRx              *scream.Rx
 	packetChan            chan *rtp.Packet
-	CloseChan             chan struct{}
 	feedbackFrequency     time.Duration
 	sendImmediateFeedback bool
 }
@@ -360,7 +132,6 @@ func NewScreamReadWriter(w io.Writer, feedbackFrequency time.Duration, sendImmed
 		w:                     w,
 		screamRx:              scream.NewRx(1),
 		packetChan:            make(chan *rtp.Packet, 1024),
-		CloseChan:             make(chan struct{}, 1),
 		feedbackFrequency:     feedbackFrequency,
 		sendImmediateFeedback: sendImmediateFeedback,
 	}
@@ -376,7 +147,9 @@ func (s *ScreamReadWriter) Write(b []byte) (int, error) {
 	return s.w.Write(b)
 }
 
-func (s *ScreamReadWriter) RunFullFeedback(fbw io.Writer) {
+// RunFullFeedback writes RFC 8888 feedback for the received packets to fbw
+// until ctx is done.
+func (s *ScreamReadWriter) RunFullFeedback(ctx context.Context, fbw io.Writer) {
 	gst.InitT0()
 	ticker := time.NewTicker(s.feedbackFrequency)
 	defer ticker.Stop()
@@ -423,13 +196,15 @@ func (s *ScreamReadWriter) RunFullFeedback(fbw io.Writer) {
 					log.Println(err)
 				}
 			}
-		case <-s.CloseChan:
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-func (s *ScreamReadWriter) RunMinimalFeedback(fbw io.Writer) {
+// RunMinimalFeedback writes the sequence number and receive time of the last
+// received packet to fbw until ctx is done.
+func (s *ScreamReadWriter) RunMinimalFeedback(ctx context.Context, fbw io.Writer) {
 	gst.InitT0()
 	ticker := time.NewTicker(s.feedbackFrequency)
 	defer ticker.Stop()
@@ -446,7 +221,7 @@ func (s *ScreamReadWriter) RunMinimalFeedback(fbw io.Writer) {
 			if err != nil {
 				log.Println(err)
 			}
-		case <-s.CloseChan:
+		case <-ctx.Done():
 			return
 		}
 	}
@@ -0,0 +1,286 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+// senderReportInterval is the interval in which RTCP Sender Reports are sent.
+const senderReportInterval = time.Second
+
+// ntpEpochOffset is the number of seconds from the NTP epoch (1900) to the
+// Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+// toNTP converts t to a 64 bit NTP timestamp.
+func toNTP(t time.Time) uint64 {
+	nanos := uint64(t.UnixNano())
+	seconds := nanos/1e9 + ntpEpochOffset
+	fraction := (nanos % 1e9 << 32) / 1e9
+	return seconds<<32 | fraction
+}
+
+// fromNTP converts a 64 bit NTP timestamp to a time.
+func fromNTP(ntp uint64) time.Time {
+	seconds := int64(ntp>>32) - ntpEpochOffset
+	nanos := int64((ntp & 0xFFFFFFFF) * 1e9 >> 32)
+	return time.Unix(seconds, nanos)
+}
+
+type senderStream struct {
+	clockRate uint32
+	// timestamp is the RTP timestamp of the latest packet at wall clock time
+	// at, which is the time the packet left the pipeline if the stream is
+	// captured or the time it was sent otherwise.
+	timestamp uint32
+	at        time.Time
+	captured  bool
+	packets   uint32
+	octets    uint32
+
+	// stats is the reception statistics of the latest Receiver Report
+	stats ReceptionStats
+}
+
+// SenderReportWriter sends RTCP Sender Reports (RFC 3550) for all RTP streams
+// written to it, multiplexed with the RTP packets (RFC 5761), and keeps the
+// statistics of the Receiver Reports received as feedback. Writes are
+// serialized, so multiple pipelines can share the writer. Only packets with
+// a payload type of known clock rate are reported. The RTP timestamp of a
+// report is extrapolated from the latest packet of the stream. RTP timestamps
+// are mapped to the time packets left the pipeline if the stream passes a
+// writer returned by Capture and to the time packets are sent otherwise.
+type SenderReportWriter struct {
+	lock       sync.Mutex
+	w          io.WriteCloser
+	clockRates map[uint8]uint32
+	streams    map[uint32]*senderStream
+	done       chan struct{}
+	closed     bool
+	logger     *log.Logger
+	start      time.Time
+}
+
+// NewSenderReportWriter creates a SenderReportWriter using clockRates to map
+// payload types to RTP clock rates in Hz.
+func NewSenderReportWriter(w io.WriteCloser, clockRates map[uint8]uint32) *SenderReportWriter {
+	return &SenderReportWriter{
+		w:          w,
+		clockRates: clockRates,
+		streams:    make(map[uint32]*senderStream),
+		done:       make(chan struct{}),
+		start:      time.Now(),
+	}
+}
+
+// SetReportLogger logs the statistics of every received report block to w.
+func (s *SenderReportWriter) SetReportLogger(w io.Writer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.logger = log.New(w, "", 0)
+}
+
+func (s *SenderReportWriter) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	var header rtp.Header
+	if err := header.Unmarshal(b); err == nil {
+		if stream := s.stream(&header); stream != nil {
+			if !stream.captured {
+				stream.timestamp = header.Timestamp
+				stream.at = time.Now()
+			}
+			stream.packets++
+			stream.octets += uint32(len(b) - header.PayloadOffset)
+		}
+	}
+	return s.w.Write(b)
+}
+
+// stream returns the stream of the packet with header or nil if the clock
+// rate of the payload type is unknown. s.lock must be held.
+func (s *SenderReportWriter) stream(header *rtp.Header) *senderStream {
+	clockRate, ok := s.clockRates[header.PayloadType]
+	if !ok {
+		return nil
+	}
+	stream, ok := s.streams[header.SSRC]
+	if !ok {
+		stream = &senderStream{clockRate: clockRate}
+		s.streams[header.SSRC] = stream
+	}
+	return stream
+}
+
+// Capture returns a writer which passes packets to w and maps their RTP
+// timestamps to the current time. It belongs at the output of a pipeline
+// whose packets are queued before they reach s, e.g. by a CCSendWriter, so
+// that the queueing delay does not skew the reports.
+func (s *SenderReportWriter) Capture(w io.WriteCloser) io.WriteCloser {
+	return &captureWriter{sr: s, w: w}
+}
+
+func (s *SenderReportWriter) capture(b []byte) {
+	var header rtp.Header
+	if err := header.Unmarshal(b); err != nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stream := s.stream(&header); stream != nil {
+		stream.timestamp = header.Timestamp
+		stream.at = time.Now()
+		stream.captured = true
+	}
+}
+
+type captureWriter struct {
+	sr *SenderReportWriter
+	w  io.WriteCloser
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	c.sr.capture(b)
+	return c.w.Write(b)
+}
+
+func (c *captureWriter) Close() error {
+	return c.w.Close()
+}
+
+// Close stops sending reports and closes the underlying writer.
+func (s *SenderReportWriter) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for ssrc, stream := range s.streams {
+		log.Printf("sent %v packets of stream %v, last report: %v\n", stream.packets, ssrc, stream.stats)
+	}
+	return s.w.Close()
+}
+
+// Run sends Sender Reports until the writer is closed or ctx is done.
+func (s *SenderReportWriter) Run(ctx context.Context) {
+	ticker := time.NewTicker(senderReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.sendReports()
+			if err != nil {
+				log.Printf("failed to send sender report: %v\n", err)
+			}
+		case <-s.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// FilterFeedback handles all Receiver Reports received on fb and forwards all
+// other feedback to the returned channel until fb is closed or ctx is done.
+func (s *SenderReportWriter) FilterFeedback(ctx context.Context, fb <-chan []byte) <-chan []byte {
+	return filterFeedback(ctx, fb, func(msg []byte) bool {
+		if !isReceiverReport(msg) {
+			return false
+		}
+		err := s.handleReceiverReport(msg, time.Now())
+		if err != nil {
+			log.Printf("failed to handle receiver report: %v\n", err)
+		}
+		return true
+	})
+}
+
+func (s *SenderReportWriter) handleReceiverReport(b []byte, now time.Time) error {
+	rr := &rtcp.ReceiverReport{}
+	err := rr.Unmarshal(b)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, r := range rr.Reports {
+		stream, ok := s.streams[r.SSRC]
+		if !ok {
+			continue
+		}
+		stats := receptionStats(r, stream.clockRate)
+		if r.LastSenderReport != 0 {
+			rtt := uint32(toNTP(now)>>16) - r.LastSenderReport - r.Delay
+			stats.RTT = time.Duration(float64(rtt) / 65536 * float64(time.Second))
+		}
+		stream.stats = stats
+		if s.logger != nil {
+			s.logger.Println(stats.logLine(s.start))
+		}
+	}
+	return nil
+}
+
+// Stats returns the statistics of the latest Receiver Report of each stream.
+func (s *SenderReportWriter) Stats() []ReceptionStats {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var stats []ReceptionStats
+	for ssrc, stream := range s.streams {
+		st := stream.stats
+		st.SSRC = ssrc
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+func (s *SenderReportWriter) sendReports() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	now := time.Now()
+	for ssrc, stream := range s.streams {
+		elapsed := now.Sub(stream.at)
+		sr := &rtcp.SenderReport{
+			SSRC:        ssrc,
+			NTPTime:     toNTP(now),
+			RTPTime:     stream.timestamp + uint32(elapsed.Seconds()*float64(stream.clockRate)),
+			PacketCount: stream.packets,
+			OctetCount:  stream.octets,
+		}
+		b, err := sr.Marshal()
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isReceiverReport checks if b is a RTCP Receiver Report.
+func isReceiverReport(b []byte) bool {
+	if !isRTCP(b) {
+		return false
+	}
+	var h rtcp.Header
+	if err := h.Unmarshal(b); err != nil {
+		return false
+	}
+	return h.Type == rtcp.TypeReceiverReport
+}
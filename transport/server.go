@@ -0,0 +1,105 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+var (
+	// ErrServerClosed is returned by Run after Shutdown was called.
+	ErrServerClosed = errors.New("server closed")
+	// ErrServerRunning is returned by Run if the server is already running.
+	ErrServerRunning = errors.New("server already running")
+)
+
+// lifecycle implements Run and Shutdown of the servers. Run stops accepting
+// sessions when the accept context is done and waits for the goroutines
+// serving sessions, which stop when the session context is done. Shutdown
+// only stops accepting sessions and cancels the session context when its own
+// context expires.
+type lifecycle struct {
+	lock    sync.Mutex
+	closed  bool
+	running bool
+	stop    context.CancelFunc
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// sessions are the goroutines serving sessions
+	sessions sync.WaitGroup
+}
+
+// start returns the accept and session contexts of a run derived from ctx.
+func (l *lifecycle) start(ctx context.Context) (context.Context, context.Context, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closed {
+		return nil, nil, ErrServerClosed
+	}
+	if l.running {
+		return nil, nil, ErrServerRunning
+	}
+	l.running = true
+	sessionCtx, cancel := context.WithCancel(ctx)
+	acceptCtx, stop := context.WithCancel(sessionCtx)
+	l.cancel = cancel
+	l.stop = stop
+	l.done = make(chan struct{})
+	return acceptCtx, sessionCtx, nil
+}
+
+// wait waits for all sessions after the server stopped accepting sessions
+// because of err and returns the result of the run. Sessions are cancelled
+// right away unless the server is shut down.
+func (l *lifecycle) wait(ctx context.Context, err error) error {
+	l.lock.Lock()
+	closed := l.closed
+	l.lock.Unlock()
+	if !closed {
+		l.cancel()
+	}
+	l.sessions.Wait()
+	if closed {
+		return ErrServerClosed
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// end releases the contexts of the run and unblocks Shutdown.
+func (l *lifecycle) end() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.stop()
+	l.cancel()
+	l.running = false
+	close(l.done)
+}
+
+// shutdown stops accepting sessions and waits until the run ended. If ctx
+// expires first, the sessions are cancelled and ctx.Err() is returned after
+// the run ended.
+func (l *lifecycle) shutdown(ctx context.Context) error {
+	l.lock.Lock()
+	l.closed = true
+	if !l.running {
+		l.lock.Unlock()
+		return nil
+	}
+	l.stop()
+	cancel := l.cancel
+	done := l.done
+	l.lock.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		cancel()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,148 @@
+package transport
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// minKeyFrameRequestInterval limits how often a SimulcastSelector requests
+// key frames while waiting for a layer switch.
+const minKeyFrameRequestInterval = time.Second
+
+// SimulcastLayer is an encoding of a simulcast source.
+type SimulcastLayer struct {
+	SSRC uint32
+	// Bitrate is the bitrate of the layer in kbit/s.
+	Bitrate uint
+}
+
+// SimulcastSelector forwards the packets of one layer of a simulcast source
+// to the underlying writer. The layer is selected by the target bitrate of the
+// session, switches take effect at the start of the next key frame of the new
+// layer. Forwarded packets are rewritten to a single SSRC and continuous
+// sequence numbers, timestamps are kept, since all layers use the same
+// timestamp offset.
+type SimulcastSelector struct {
+	lock   sync.Mutex
+	w      io.WriteCloser
+	ssrc   uint32
+	layers []SimulcastLayer
+	seqNr  uint16
+
+	current int
+	target  int
+
+	requestKeyFrame  func()
+	lastKeyFrameTime time.Time
+	isKeyFrame       KeyFrameDetector
+}
+
+// NewSimulcastSelector creates a selector writing packets with the given SSRC
+// to w. layers must be ordered by ascending bitrate. The lowest layer is
+// selected until a target bitrate is set.
+func NewSimulcastSelector(w io.WriteCloser, ssrc uint32, layers []SimulcastLayer) *SimulcastSelector {
+	return &SimulcastSelector{
+		w:          w,
+		ssrc:       ssrc,
+		layers:     layers,
+		current:    -1,
+		isKeyFrame: isH264KeyFrameStart,
+	}
+}
+
+// SetKeyFrameDetector sets the function used to detect the key frames at which
+// layers are switched. The default detects H.264 key frames.
+func (s *SimulcastSelector) SetKeyFrameDetector(isKeyFrame KeyFrameDetector) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.isKeyFrame = isKeyFrame
+}
+
+// SetKeyFrameRequester sets the function used to request key frames when the
+// selected layer changes.
+func (s *SimulcastSelector) SetKeyFrameRequester(requestKeyFrame func()) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.requestKeyFrame = requestKeyFrame
+}
+
+// SetTargetBitrate selects the highest layer which does not exceed bitrate in
+// kbit/s, or the lowest layer if all layers exceed bitrate.
+func (s *SimulcastSelector) SetTargetBitrate(bitrate uint) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	target := 0
+	for i, l := range s.layers {
+		if l.Bitrate <= bitrate {
+			target = i
+		}
+	}
+	if target == s.target {
+		return
+	}
+	log.Printf("switching simulcast layer from %v to %v at %v kbit/s\n", s.target, target, bitrate)
+	s.target = target
+	s.requestKeyFrameLocked()
+}
+
+func (s *SimulcastSelector) requestKeyFrameLocked() {
+	if s.requestKeyFrame == nil || time.Since(s.lastKeyFrameTime) < minKeyFrameRequestInterval {
+		return
+	}
+	s.lastKeyFrameTime = time.Now()
+	go s.requestKeyFrame()
+}
+
+func (s *SimulcastSelector) Write(b []byte) (int, error) {
+	packet := &rtp.Packet{}
+	err := packet.Unmarshal(append([]byte{}, b...))
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	layer := s.layer(packet.SSRC)
+	if layer < 0 {
+		s.lock.Unlock()
+		log.Printf("dropping packet of unknown simulcast layer %v\n", packet.SSRC)
+		return len(b), nil
+	}
+	if layer == s.target && layer != s.current && s.isKeyFrame(packet.Payload) {
+		s.current = layer
+	}
+	if layer != s.current {
+		if s.current != s.target {
+			s.requestKeyFrameLocked()
+		}
+		s.lock.Unlock()
+		return len(b), nil
+	}
+	packet.SSRC = s.ssrc
+	packet.SequenceNumber = s.seqNr
+	s.seqNr++
+	s.lock.Unlock()
+
+	out, err := packet.Marshal()
+	if err != nil {
+		return 0, err
+	}
+	_, err = s.w.Write(out)
+	return len(b), err
+}
+
+func (s *SimulcastSelector) Close() error {
+	return s.w.Close()
+}
+
+// layer returns the index of the layer with the given SSRC or -1.
+func (s *SimulcastSelector) layer(ssrc uint32) int {
+	for i, l := range s.layers {
+		if l.SSRC == ssrc {
+			return i
+		}
+	}
+	return -1
+}
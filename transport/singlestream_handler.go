@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// SingleStreamHandler sends all RTP packets of a session on a single
+// bidirectional QUIC stream. Packets are framed as in RFC 4571 by prefixing
+// each packet by its length as a 16 bit unsigned integer, or using RoQ
+// framing if enabled.
+type SingleStreamHandler struct {
+	src SrcFactory
+	roq *roqFlow
+}
+
+func NewSingleStreamHandler(src SrcFactory) *SingleStreamHandler {
+	return &SingleStreamHandler{
+		src: src,
+	}
+}
+
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier.
+func (m *SingleStreamHandler) EnableRoQ(flowID uint64) {
+	m.roq = newRoQFlow(flowID)
+}
+
+func (m *SingleStreamHandler) handle(ctx context.Context, sess quic.Session) error {
+	session := &SingleStreamSession{
+		streamSession: newStreamSession(sess, 0, m.roq),
+	}
+	return handleStreamSession(ctx, m.src, session.streamSession, session)
+}
+
+type SingleStreamSession struct {
+	*streamSession
+
+	lock   sync.Mutex
+	stream quic.Stream
+}
+
+func (m *SingleStreamSession) Write(b []byte) (int, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stream == nil {
+		stream, err := m.session.OpenStreamSync(context.Background())
+		if err != nil {
+			log.Println("could not open stream, closing session")
+			m.fail(err)
+			return 0, err
+		}
+		m.stream = stream
+		if m.roq != nil {
+			_, err = m.stream.Write(m.roq.marshalStreamHeader())
+			if err != nil {
+				log.Printf("could not write to stream, closing session: %v\n", err)
+				m.fail(err)
+				return 0, err
+			}
+		}
+	}
+	var frame []byte
+	if m.roq != nil {
+		frame = m.roq.marshalPackets([][]byte{b})
+	} else {
+		frame = marshalLengthPrefixed([][]byte{b})
+	}
+	_, err := m.stream.Write(frame)
+	if err != nil {
+		log.Printf("could not write to stream, closing session: %v\n", err)
+		m.fail(err)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (m *SingleStreamSession) Close() error {
+	m.lock.Lock()
+	if m.stream != nil {
+		err := m.stream.Close()
+		if err != nil {
+			log.Printf("could not Close stream: %v", err)
+		}
+	}
+	m.lock.Unlock()
+	return m.streamSession.Close()
+}
@@ -1,7 +1,61 @@
 package transport
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
+// SrcFactory creates the source of a session. The source writes to writer
+// and reads feedback of the client from feedback. ctx is cancelled when the
+// session ended, all goroutines of the source should return then. The
+// returned function stops the source.
 type SrcFactory interface {
-	MakeSrc(writer io.WriteCloser, feedback <-chan []byte) func()
+	MakeSrc(ctx context.Context, writer io.WriteCloser, feedback <-chan []byte) func()
+}
+
+// sessionFeedback passes the feedback of a session to its source until ctx
+// is done, so that readers do not block when the source stopped reading
+// feedback.
+type sessionFeedback struct {
+	ctx      context.Context
+	feedback chan<- []byte
+}
+
+func (f sessionFeedback) Write(b []byte) (int, error) {
+	select {
+	case f.feedback <- b:
+		return len(b), nil
+	case <-f.ctx.Done():
+		return 0, f.ctx.Err()
+	}
+}
+
+// filterFeedback passes all feedback received on fb to handle and forwards
+// the feedback not handled to the returned channel. The returned channel is
+// closed when fb is closed, the goroutine forwarding feedback returns when ctx
+// is done.
+func filterFeedback(ctx context.Context, fb <-chan []byte, handle func([]byte) bool) <-chan []byte {
+	out := make(chan []byte, cap(fb))
+	go func() {
+		for {
+			select {
+			case msg, ok := <-fb:
+				if !ok {
+					close(out)
+					return
+				}
+				if handle(msg) {
+					continue
+				}
+				select {
+				case out <- msg:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
 }
@@ -0,0 +1,574 @@
+package transport
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	srtpMasterKeyLength  = 16
+	srtpMasterSaltLength = 14
+	srtpAuthKeyLength    = 20
+	srtpAuthTagLength    = 10
+	srtcpIndexLength     = 4
+	srtcpEncryptedFlag   = 1 << 31
+	srtcpMaxIndex        = 1<<31 - 1
+	srtpReplayWindowSize = 64
+
+	// SRTPKeyingMaterialLength is the length of the keying material of an
+	// SRTPContext. It holds the client master key, the server master key,
+	// the client master salt and the server master salt in this order, as
+	// exported by DTLS-SRTP (RFC 5764).
+	SRTPKeyingMaterialLength = 2 * (srtpMasterKeyLength + srtpMasterSaltLength)
+
+	// MinSRTPPreSharedKeyLength is the minimum length of the pre-shared key
+	// from which the keying material of each session is derived.
+	MinSRTPPreSharedKeyLength = 16
+
+	// srtpNonceLength is the length of the random nonces of client and
+	// server exchanged in the handshake of a session
+	srtpNonceLength = 16
+)
+
+// srtpKeyInfo binds the keying material derived from a pre-shared key to
+// its use for SRTP sessions of this streamer.
+var srtpKeyInfo = []byte("cgo-streamer srtp keying material")
+
+// labels of the SRTP key derivation (RFC 3711, Section 4.3.2)
+const (
+	srtpLabelRTPEncryption  = 0x00
+	srtpLabelRTPAuth        = 0x01
+	srtpLabelRTPSalt        = 0x02
+	srtpLabelRTCPEncryption = 0x03
+	srtpLabelRTCPAuth       = 0x04
+	srtpLabelRTCPSalt       = 0x05
+)
+
+var (
+	ErrInvalidSRTPKey      = errors.New("invalid SRTP keying material")
+	ErrSRTPPacketTooShort  = errors.New("SRTP packet too short")
+	ErrSRTPAuthFailed      = errors.New("SRTP authentication failed")
+	ErrSRTPReplayed        = errors.New("SRTP packet replayed")
+	ErrSRTCPIndexExhausted = errors.New("SRTCP index exhausted")
+)
+
+// SRTPStats holds the number of protected and unprotected packets of an
+// SRTPContext, the bytes added by the protection and the time spent on
+// cryptographic operations.
+type SRTPStats struct {
+	Protected   uint64
+	Unprotected uint64
+	// Bytes is the number of protected bytes before protection.
+	Bytes uint64
+	// Overhead is the number of bytes added by authentication tags and
+	// SRTCP indices.
+	Overhead uint64
+	// ProtectTime is the time spent protecting packets.
+	ProtectTime time.Duration
+	// UnprotectTime is the time spent authenticating and decrypting packets.
+	UnprotectTime time.Duration
+	// Dropped is the number of received packets which failed authentication
+	// or replay protection.
+	Dropped uint64
+}
+
+func (s SRTPStats) String() string {
+	return fmt.Sprintf("srtp: protected %v packets (%v bytes, %v bytes overhead) in %v, unprotected %v packets in %v, dropped %v", s.Protected, s.Bytes, s.Overhead, s.ProtectTime, s.Unprotected, s.UnprotectTime, s.Dropped)
+}
+
+// logLine formats s as a line of an SRTP log file: the time in milliseconds
+// since start, the number of protected packets, protected bytes, overhead
+// bytes, the protection time in microseconds, the number of unprotected
+// packets, the unprotection time in microseconds and the number of dropped
+// packets.
+func (s SRTPStats) logLine(start time.Time) string {
+	return fmt.Sprintf("%v %v %v %v %v %v %v %v", time.Since(start).Milliseconds(), s.Protected, s.Bytes, s.Overhead,
+		s.ProtectTime.Microseconds(), s.Unprotected, s.UnprotectTime.Microseconds(), s.Dropped)
+}
+
+func (s SRTPStats) sub(o SRTPStats) SRTPStats {
+	return SRTPStats{
+		Protected:     s.Protected - o.Protected,
+		Unprotected:   s.Unprotected - o.Unprotected,
+		Bytes:         s.Bytes - o.Bytes,
+		Overhead:      s.Overhead - o.Overhead,
+		ProtectTime:   s.ProtectTime - o.ProtectTime,
+		UnprotectTime: s.UnprotectTime - o.UnprotectTime,
+		Dropped:       s.Dropped - o.Dropped,
+	}
+}
+
+// srtpSessionKeys are the session keys of one direction derived from a master
+// key and salt.
+type srtpSessionKeys struct {
+	rtpBlock  cipher.Block
+	rtpSalt   []byte
+	rtpAuth   hash.Hash
+	rtcpBlock cipher.Block
+	rtcpSalt  []byte
+	rtcpAuth  hash.Hash
+}
+
+func newSRTPSessionKeys(masterKey, masterSalt []byte) (*srtpSessionKeys, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	derive := func(label byte, length int) []byte {
+		// x = key_id XOR master_salt with key_id = label || r and r = 0
+		// because no key derivation rate is used
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, masterSalt)
+		iv[7] ^= label
+		out := make([]byte, length)
+		cipher.NewCTR(block, iv).XORKeyStream(out, out)
+		return out
+	}
+	rtpBlock, err := aes.NewCipher(derive(srtpLabelRTPEncryption, srtpMasterKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	rtcpBlock, err := aes.NewCipher(derive(srtpLabelRTCPEncryption, srtpMasterKeyLength))
+	if err != nil {
+		return nil, err
+	}
+	return &srtpSessionKeys{
+		rtpBlock:  rtpBlock,
+		rtpSalt:   derive(srtpLabelRTPSalt, srtpMasterSaltLength),
+		rtpAuth:   hmac.New(sha1.New, derive(srtpLabelRTPAuth, srtpAuthKeyLength)),
+		rtcpBlock: rtcpBlock,
+		rtcpSalt:  derive(srtpLabelRTCPSalt, srtpMasterSaltLength),
+		rtcpAuth:  hmac.New(sha1.New, derive(srtpLabelRTCPAuth, srtpAuthKeyLength)),
+	}, nil
+}
+
+// srtpIV creates the counter mode IV of a packet (RFC 3711, Section 4.1.1).
+func srtpIV(salt []byte, ssrc uint32, index uint64) []byte {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, salt)
+	var s [4]byte
+	binary.BigEndian.PutUint32(s[:], ssrc)
+	for i := range s {
+		iv[4+i] ^= s[i]
+	}
+	var idx [8]byte
+	binary.BigEndian.PutUint64(idx[:], index<<16)
+	for i := range idx {
+		iv[8+i] ^= idx[i]
+	}
+	return iv
+}
+
+func srtpAuthTag(mac hash.Hash, parts ...[]byte) []byte {
+	mac.Reset()
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return mac.Sum(nil)[:srtpAuthTagLength]
+}
+
+// srtpReplayWindow detects replayed packets by their index (RFC 3711,
+// Section 3.3.2).
+type srtpReplayWindow struct {
+	started bool
+	max     uint64
+	mask    uint64
+}
+
+func (w *srtpReplayWindow) check(index uint64) bool {
+	if !w.started || index > w.max {
+		return true
+	}
+	diff := w.max - index
+	return diff < srtpReplayWindowSize && w.mask&(1<<diff) == 0
+}
+
+func (w *srtpReplayWindow) accept(index uint64) {
+	switch {
+	case !w.started:
+		w.started = true
+		w.max = index
+		w.mask = 1
+	case index > w.max:
+		if shift := index - w.max; shift < srtpReplayWindowSize {
+			w.mask = w.mask<<shift | 1
+		} else {
+			w.mask = 1
+		}
+		w.max = index
+	default:
+		w.mask |= 1 << (w.max - index)
+	}
+}
+
+// srtpSendStream is the rollover counter of a sent RTP stream.
+type srtpSendStream struct {
+	started bool
+	roc     uint32
+	lastSeq uint16
+}
+
+func (s *srtpSendStream) index(seq uint16) uint64 {
+	if s.started && seq < s.lastSeq && s.lastSeq-seq > 1<<15 {
+		s.roc++
+	}
+	s.started = true
+	s.lastSeq = seq
+	return uint64(s.roc)<<16 | uint64(seq)
+}
+
+// srtpReceiveStream keeps the rollover counter and the replay window of a
+// received RTP stream.
+type srtpReceiveStream struct {
+	started bool
+	roc     uint32
+	lastSeq uint16
+	replay  srtpReplayWindow
+}
+
+// estimate guesses the rollover counter of seq (RFC 3711, Appendix A).
+func (s *srtpReceiveStream) estimate(seq uint16) uint32 {
+	if !s.started {
+		return 0
+	}
+	if s.lastSeq < 1<<15 {
+		if int(seq)-int(s.lastSeq) > 1<<15 {
+			return s.roc - 1
+		}
+	} else if int(s.lastSeq)-1<<15 > int(seq) {
+		return s.roc + 1
+	}
+	return s.roc
+}
+
+func (s *srtpReceiveStream) update(roc uint32, seq uint16) {
+	index := uint64(roc)<<16 | uint64(seq)
+	if !s.started || index > uint64(s.roc)<<16|uint64(s.lastSeq) {
+		s.started = true
+		s.roc = roc
+		s.lastSeq = seq
+	}
+	s.replay.accept(index)
+}
+
+// SRTPContext protects RTP packets by SRTP and RTCP packets by SRTCP (RFC
+// 3711) using the AES_CM_128_HMAC_SHA1_80 protection profile. Outgoing
+// packets are protected with the keys of the local endpoint, incoming packets
+// are authenticated and decrypted with the keys of the remote endpoint.
+// Packets which are neither RTP nor RTCP, such as the control messages of
+// the UDP handler, are passed through unchanged. The SSRC of each stream
+// must be unique per direction, since the SRTP index of a stream is derived
+// from its SSRC and sequence number.
+type SRTPContext struct {
+	lock   sync.Mutex
+	local  *srtpSessionKeys
+	remote *srtpSessionKeys
+
+	sendStreams    map[uint32]*srtpSendStream
+	receiveStreams map[uint32]*srtpReceiveStream
+	rtcpIndex      map[uint32]uint32
+	rtcpReplay     map[uint32]*srtpReplayWindow
+
+	stats  SRTPStats
+	logger *log.Logger
+	start  time.Time
+}
+
+// NewSRTPContext creates an SRTPContext from keyingMaterial of length
+// SRTPKeyingMaterialLength. isClient selects which of the keys are used for
+// outgoing packets.
+func NewSRTPContext(keyingMaterial []byte, isClient bool) (*SRTPContext, error) {
+	if len(keyingMaterial) != SRTPKeyingMaterialLength {
+		return nil, fmt.Errorf("%w: got %v bytes, expected %v", ErrInvalidSRTPKey, len(keyingMaterial), SRTPKeyingMaterialLength)
+	}
+	clientKey := keyingMaterial[:srtpMasterKeyLength]
+	serverKey := keyingMaterial[srtpMasterKeyLength : 2*srtpMasterKeyLength]
+	clientSalt := keyingMaterial[2*srtpMasterKeyLength : 2*srtpMasterKeyLength+srtpMasterSaltLength]
+	serverSalt := keyingMaterial[2*srtpMasterKeyLength+srtpMasterSaltLength:]
+	client, err := newSRTPSessionKeys(clientKey, clientSalt)
+	if err != nil {
+		return nil, err
+	}
+	server, err := newSRTPSessionKeys(serverKey, serverSalt)
+	if err != nil {
+		return nil, err
+	}
+	c := &SRTPContext{
+		local:          server,
+		remote:         client,
+		sendStreams:    make(map[uint32]*srtpSendStream),
+		receiveStreams: make(map[uint32]*srtpReceiveStream),
+		rtcpIndex:      make(map[uint32]uint32),
+		rtcpReplay:     make(map[uint32]*srtpReplayWindow),
+		start:          time.Now(),
+	}
+	if isClient {
+		c.local, c.remote = client, server
+	}
+	return c, nil
+}
+
+// NewSRTPSessionContext creates the SRTPContext of a single session. Its
+// keying material is derived by HKDF-SHA256 (RFC 5869) from the pre-shared
+// key psk and the random nonces of client and server. Sessions never share
+// keys even though all of them use the same psk, so the AES counter mode
+// keystream of one session is never reused by another one.
+func NewSRTPSessionContext(psk, clientNonce, serverNonce []byte, isClient bool) (*SRTPContext, error) {
+	keyingMaterial, err := deriveSRTPKeyingMaterial(psk, clientNonce, serverNonce)
+	if err != nil {
+		return nil, err
+	}
+	return NewSRTPContext(keyingMaterial, isClient)
+}
+
+func deriveSRTPKeyingMaterial(psk, clientNonce, serverNonce []byte) ([]byte, error) {
+	if len(psk) < MinSRTPPreSharedKeyLength {
+		return nil, fmt.Errorf("%w: got %v bytes of pre-shared key, expected at least %v", ErrInvalidSRTPKey, len(psk), MinSRTPPreSharedKeyLength)
+	}
+	if len(clientNonce) != srtpNonceLength || len(serverNonce) != srtpNonceLength {
+		return nil, fmt.Errorf("%w: got nonces of %v and %v bytes, expected %v", ErrInvalidSRTPKey, len(clientNonce), len(serverNonce), srtpNonceLength)
+	}
+	salt := make([]byte, 0, 2*srtpNonceLength)
+	salt = append(salt, clientNonce...)
+	salt = append(salt, serverNonce...)
+	keyingMaterial := make([]byte, SRTPKeyingMaterialLength)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, psk, salt, srtpKeyInfo), keyingMaterial); err != nil {
+		return nil, err
+	}
+	return keyingMaterial, nil
+}
+
+// newSRTPNonce returns a random nonce for the handshake of a session.
+func newSRTPNonce() ([]byte, error) {
+	nonce := make([]byte, srtpNonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// SetStatsLogger logs the statistics of every interval of Run to w.
+func (c *SRTPContext) SetStatsLogger(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.logger = log.New(w, "", 0)
+}
+
+// Run logs the statistics of the last second every second until done is
+// closed.
+func (c *SRTPContext) Run(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last SRTPStats
+	for {
+		select {
+		case <-ticker.C:
+			c.lock.Lock()
+			if c.logger != nil {
+				c.logger.Println(c.stats.sub(last).logLine(c.start))
+			}
+			last = c.stats
+			c.lock.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Stats returns the statistics of all packets since the creation of c.
+func (c *SRTPContext) Stats() SRTPStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.stats
+}
+
+// Protect returns the SRTP or SRTCP packet of b. Other packets are returned
+// unchanged.
+func (c *SRTPContext) Protect(b []byte) ([]byte, error) {
+	var protect func([]byte) ([]byte, error)
+	switch {
+	case isRTCP(b):
+		protect = c.protectRTCP
+	case isRTP(b):
+		protect = c.protectRTP
+	default:
+		return b, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	start := time.Now()
+	p, err := protect(b)
+	if err != nil {
+		return nil, err
+	}
+	c.stats.ProtectTime += time.Since(start)
+	c.stats.Protected++
+	c.stats.Bytes += uint64(len(b))
+	c.stats.Overhead += uint64(len(p) - len(b))
+	return p, nil
+}
+
+// Unprotect authenticates and decrypts an SRTP or SRTCP packet. Other
+// packets are returned unchanged.
+func (c *SRTPContext) Unprotect(b []byte) ([]byte, error) {
+	var unprotect func([]byte) ([]byte, error)
+	switch {
+	case isRTCP(b):
+		unprotect = c.unprotectRTCP
+	case isRTP(b):
+		unprotect = c.unprotectRTP
+	default:
+		return b, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	start := time.Now()
+	p, err := unprotect(b)
+	if err != nil {
+		c.stats.Dropped++
+		return nil, err
+	}
+	c.stats.UnprotectTime += time.Since(start)
+	c.stats.Unprotected++
+	return p, nil
+}
+
+func (c *SRTPContext) protectRTP(b []byte) ([]byte, error) {
+	headerLen, err := rtpHeaderLength(b)
+	if err != nil {
+		return nil, err
+	}
+	ssrc := binary.BigEndian.Uint32(b[8:12])
+	stream, ok := c.sendStreams[ssrc]
+	if !ok {
+		stream = &srtpSendStream{}
+		c.sendStreams[ssrc] = stream
+	}
+	index := stream.index(binary.BigEndian.Uint16(b[2:4]))
+
+	out := make([]byte, len(b), len(b)+srtpAuthTagLength)
+	copy(out, b[:headerLen])
+	cipher.NewCTR(c.local.rtpBlock, srtpIV(c.local.rtpSalt, ssrc, index)).XORKeyStream(out[headerLen:], b[headerLen:])
+	var roc [4]byte
+	binary.BigEndian.PutUint32(roc[:], uint32(index>>16))
+	return append(out, srtpAuthTag(c.local.rtpAuth, out, roc[:])...), nil
+}
+
+func (c *SRTPContext) unprotectRTP(b []byte) ([]byte, error) {
+	if len(b) < rtpHeaderLen+srtpAuthTagLength {
+		return nil, ErrSRTPPacketTooShort
+	}
+	packet, tag := b[:len(b)-srtpAuthTagLength], b[len(b)-srtpAuthTagLength:]
+	headerLen, err := rtpHeaderLength(packet)
+	if err != nil {
+		return nil, err
+	}
+	ssrc := binary.BigEndian.Uint32(b[8:12])
+	seq := binary.BigEndian.Uint16(b[2:4])
+	stream, ok := c.receiveStreams[ssrc]
+	if !ok {
+		stream = &srtpReceiveStream{}
+	}
+	roc := stream.estimate(seq)
+	index := uint64(roc)<<16 | uint64(seq)
+	if !stream.replay.check(index) {
+		return nil, ErrSRTPReplayed
+	}
+	var r [4]byte
+	binary.BigEndian.PutUint32(r[:], roc)
+	if !hmac.Equal(tag, srtpAuthTag(c.remote.rtpAuth, packet, r[:])) {
+		return nil, ErrSRTPAuthFailed
+	}
+	c.receiveStreams[ssrc] = stream
+	stream.update(roc, seq)
+
+	out := make([]byte, len(packet))
+	copy(out, packet[:headerLen])
+	cipher.NewCTR(c.remote.rtpBlock, srtpIV(c.remote.rtpSalt, ssrc, index)).XORKeyStream(out[headerLen:], packet[headerLen:])
+	return out, nil
+}
+
+func (c *SRTPContext) protectRTCP(b []byte) ([]byte, error) {
+	ssrc := binary.BigEndian.Uint32(b[4:8])
+	index := c.rtcpIndex[ssrc]
+	if index > srtcpMaxIndex {
+		return nil, ErrSRTCPIndexExhausted
+	}
+	c.rtcpIndex[ssrc] = index + 1
+
+	out := make([]byte, len(b), len(b)+srtcpIndexLength+srtpAuthTagLength)
+	copy(out, b[:8])
+	cipher.NewCTR(c.local.rtcpBlock, srtpIV(c.local.rtcpSalt, ssrc, uint64(index))).XORKeyStream(out[8:], b[8:])
+	var e [srtcpIndexLength]byte
+	binary.BigEndian.PutUint32(e[:], srtcpEncryptedFlag|index)
+	out = append(out, e[:]...)
+	return append(out, srtpAuthTag(c.local.rtcpAuth, out)...), nil
+}
+
+func (c *SRTPContext) unprotectRTCP(b []byte) ([]byte, error) {
+	if len(b) < 8+srtcpIndexLength+srtpAuthTagLength {
+		return nil, ErrSRTPPacketTooShort
+	}
+	authenticated, tag := b[:len(b)-srtpAuthTagLength], b[len(b)-srtpAuthTagLength:]
+	if !hmac.Equal(tag, srtpAuthTag(c.remote.rtcpAuth, authenticated)) {
+		return nil, ErrSRTPAuthFailed
+	}
+	packet := authenticated[:len(authenticated)-srtcpIndexLength]
+	e := binary.BigEndian.Uint32(authenticated[len(packet):])
+	index := e &^ srtcpEncryptedFlag
+	ssrc := binary.BigEndian.Uint32(b[4:8])
+	replay, ok := c.rtcpReplay[ssrc]
+	if !ok {
+		replay = &srtpReplayWindow{}
+		c.rtcpReplay[ssrc] = replay
+	}
+	if !replay.check(uint64(index)) {
+		return nil, ErrSRTPReplayed
+	}
+	replay.accept(uint64(index))
+
+	out := make([]byte, len(packet))
+	copy(out, packet)
+	if e&srtcpEncryptedFlag != 0 {
+		cipher.NewCTR(c.remote.rtcpBlock, srtpIV(c.remote.rtcpSalt, ssrc, uint64(index))).XORKeyStream(out[8:], packet[8:])
+	}
+	return out, nil
+}
+
+// rtpHeaderLength returns the length of the RTP header of b including CSRCs
+// and the header extension.
+func rtpHeaderLength(b []byte) (int, error) {
+	if len(b) < rtpHeaderLen {
+		return 0, ErrSRTPPacketTooShort
+	}
+	n := rtpHeaderLen + 4*int(b[0]&0x0F)
+	if b[0]&0x10 != 0 {
+		if len(b) < n+4 {
+			return 0, ErrSRTPPacketTooShort
+		}
+		n += 4 + 4*int(binary.BigEndian.Uint16(b[n+2:n+4]))
+	}
+	if len(b) < n {
+		return 0, ErrSRTPPacketTooShort
+	}
+	return n, nil
+}
+
+// isRTP checks if b has the version and the minimum length of an RTP packet.
+func isRTP(b []byte) bool {
+	return len(b) >= rtpHeaderLen && b[0]>>6 == 2
+}
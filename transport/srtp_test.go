@@ -0,0 +1,464 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid hex %q: %v", s, err)
+	}
+	return b
+}
+
+func testRTPPacket(seq uint16, ssrc uint32, payload []byte) []byte {
+	b := make([]byte, rtpHeaderLen, rtpHeaderLen+len(payload))
+	b[0] = 0x80
+	b[1] = 96
+	binary.BigEndian.PutUint16(b[2:4], seq)
+	binary.BigEndian.PutUint32(b[4:8], uint32(seq)*90)
+	binary.BigEndian.PutUint32(b[8:12], ssrc)
+	return append(b, payload...)
+}
+
+// testSRTPContexts returns the contexts of client and server sharing the
+// keying material km = 0, 1, 2, ...
+func testSRTPContexts(t *testing.T) (client, server *SRTPContext) {
+	t.Helper()
+	km := make([]byte, SRTPKeyingMaterialLength)
+	for i := range km {
+		km[i] = byte(i)
+	}
+	client, err := NewSRTPContext(km, true)
+	if err != nil {
+		t.Fatalf("NewSRTPContext: %v", err)
+	}
+	server, err = NewSRTPContext(km, false)
+	if err != nil {
+		t.Fatalf("NewSRTPContext: %v", err)
+	}
+	return client, server
+}
+
+// AES-CM keystream of RFC 3711, Appendix B.2
+func TestSRTPKeystream(t *testing.T) {
+	block, err := aes.NewCipher(mustDecodeHex(t, "2B7E151628AED2A6ABF7158809CF4F3C"))
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	salt := mustDecodeHex(t, "F0F1F2F3F4F5F6F7F8F9FAFBFCFD")
+	want := mustDecodeHex(t, "E03EAD0935C95E80E166B16DD92B4EB4"+
+		"D23513162B02D0F72A43A2FE4A5F97AB"+
+		"41E95B3BB0A2E8DD477901E4FCA894C0")
+	got := make([]byte, len(want))
+	cipher.NewCTR(block, srtpIV(salt, 0, 0)).XORKeyStream(got, got)
+	if !bytes.Equal(got, want) {
+		t.Fatalf("keystream = %X, want %X", got, want)
+	}
+}
+
+// key derivation of RFC 3711, Appendix B.3
+func TestSRTPKeyDerivation(t *testing.T) {
+	keys, err := newSRTPSessionKeys(mustDecodeHex(t, "E1F97A0D3E018BE0D64FA32C06DE4139"), mustDecodeHex(t, "0EC675AD498AFEEBB6960B3AABE6"))
+	if err != nil {
+		t.Fatalf("newSRTPSessionKeys: %v", err)
+	}
+	if want := mustDecodeHex(t, "30CBBC08863D8C85D49DB34A9AE1"); !bytes.Equal(keys.rtpSalt, want) {
+		t.Fatalf("session salt = %X, want %X", keys.rtpSalt, want)
+	}
+
+	// the session key is only available as cipher, compare an encrypted
+	// block instead
+	block, err := aes.NewCipher(mustDecodeHex(t, "C61E7A93744F39EE10734AFE3FF7A087"))
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	got, want := make([]byte, aes.BlockSize), make([]byte, aes.BlockSize)
+	keys.rtpBlock.Encrypt(got, got)
+	block.Encrypt(want, want)
+	if !bytes.Equal(got, want) {
+		t.Fatal("session encryption key differs from RFC 3711, Appendix B.3")
+	}
+
+	// likewise, compare a tag of the session authentication key
+	auth := mustDecodeHex(t, "CEBE321F6FF7716B6FD4AB49AF256A156D38BAA4")
+	if !bytes.Equal(srtpAuthTag(keys.rtpAuth, []byte("tag")), srtpAuthTag(hmac.New(sha1.New, auth), []byte("tag"))) {
+		t.Fatal("session authentication key differs from RFC 3711, Appendix B.3")
+	}
+}
+
+// packets of the libsrtp test driver, which uses the master key and salt of
+// RFC 3711, Appendix B.3
+func TestSRTPProtectVectors(t *testing.T) {
+	km := make([]byte, SRTPKeyingMaterialLength)
+	copy(km, mustDecodeHex(t, "E1F97A0D3E018BE0D64FA32C06DE4139"))
+	copy(km[2*srtpMasterKeyLength:], mustDecodeHex(t, "0EC675AD498AFEEBB6960B3AABE6"))
+	payload := bytes.Repeat([]byte{0xab}, 16)
+
+	for _, tc := range []struct {
+		name string
+		// packets are protected in this order, only the last one is
+		// compared
+		packets [][]byte
+		want    string
+	}{
+		{
+			name:    "rtp",
+			packets: [][]byte{append(mustDecodeHex(t, "800f1234decafbadcafebabe"), payload...)},
+			want:    "800f1234decafbadcafebabe4e55dc4ce79978d88ca4d215949d2402b78d6acc99ea179b8dbb",
+		},
+		{
+			// libsrtp starts with SRTCP index 1, RFC 3711 with 0
+			name: "rtcp",
+			packets: [][]byte{
+				append(mustDecodeHex(t, "81c8000bcafebabe"), payload...),
+				append(mustDecodeHex(t, "81c8000bcafebabe"), payload...),
+			},
+			want: "81c8000bcafebabe7128035be487b9bdbef89041f977a5a880000001993e08cd54d6c1230798",
+		},
+		{
+			// seq 1 after 65535 has rollover counter 1, checked against
+			// pion/srtp
+			name: "rollover",
+			packets: [][]byte{
+				append(mustDecodeHex(t, "800fffffdecafbadcafebabe"), payload...),
+				append(mustDecodeHex(t, "800f0001decafbadcafebabe"), payload...),
+			},
+			want: "800f0001decafbadcafebabeb6f1f0a458a238ac3d2f55ac6566b25c051f89495037505c44c7",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewSRTPContext(km, true)
+			if err != nil {
+				t.Fatalf("NewSRTPContext: %v", err)
+			}
+			// the server decrypts the packets of the client
+			s, err := NewSRTPContext(km, false)
+			if err != nil {
+				t.Fatalf("NewSRTPContext: %v", err)
+			}
+			var got []byte
+			for _, p := range tc.packets {
+				got, err = c.Protect(p)
+				if err != nil {
+					t.Fatalf("Protect: %v", err)
+				}
+				d, err := s.Unprotect(got)
+				if err != nil {
+					t.Fatalf("Unprotect: %v", err)
+				}
+				if !bytes.Equal(d, p) {
+					t.Fatalf("Unprotect = %x, want %x", d, p)
+				}
+			}
+			if want := mustDecodeHex(t, tc.want); !bytes.Equal(got, want) {
+				t.Fatalf("Protect = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestSRTPRoundTrip(t *testing.T) {
+	client, server := testSRTPContexts(t)
+	payload := []byte("payload of a video frame")
+
+	p := testRTPPacket(1, 42, payload)
+	e, err := server.Protect(p)
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	if len(e) != len(p)+srtpAuthTagLength || bytes.Contains(e, payload) {
+		t.Fatalf("Protect returned unencrypted packet %x", e)
+	}
+	d, err := client.Unprotect(e)
+	if err != nil {
+		t.Fatalf("Unprotect: %v", err)
+	}
+	if !bytes.Equal(d, p) {
+		t.Fatalf("Unprotect = %x, want %x", d, p)
+	}
+
+	// each endpoint protects with its own keys
+	if _, err := server.Unprotect(e); !errors.Is(err, ErrSRTPAuthFailed) {
+		t.Fatalf("Unprotect of own packet error = %v, want %v", err, ErrSRTPAuthFailed)
+	}
+
+	rtcp := []byte{0x81, 0xc9, 0x00, 0x01, 0x00, 0x00, 0x00, 0x07}
+	for i := uint32(0); i < 3; i++ {
+		e, err := client.Protect(rtcp)
+		if err != nil {
+			t.Fatalf("Protect: %v", err)
+		}
+		if len(e) != len(rtcp)+srtcpIndexLength+srtpAuthTagLength {
+			t.Fatalf("Protect returned %v bytes of SRTCP for %v bytes of RTCP", len(e), len(rtcp))
+		}
+		if index := binary.BigEndian.Uint32(e[len(rtcp):]); index != srtcpEncryptedFlag|i {
+			t.Fatalf("SRTCP index = %x, want %x", index, srtcpEncryptedFlag|i)
+		}
+		d, err := server.Unprotect(e)
+		if err != nil {
+			t.Fatalf("Unprotect: %v", err)
+		}
+		if !bytes.Equal(d, rtcp) {
+			t.Fatalf("Unprotect = %x, want %x", d, rtcp)
+		}
+	}
+
+	// control messages pass unchanged
+	for _, c := range []*SRTPContext{client, server} {
+		for _, f := range []func([]byte) ([]byte, error){c.Protect, c.Unprotect} {
+			if b, err := f(udpKeepalive); err != nil || !bytes.Equal(b, udpKeepalive) {
+				t.Fatalf("control message changed to %q, %v", b, err)
+			}
+		}
+	}
+
+	stats := client.Stats()
+	if stats.Protected != 3 || stats.Unprotected != 1 || stats.Dropped != 0 {
+		t.Fatalf("client stats = %v", stats)
+	}
+	if stats := server.Stats(); stats.Protected != 1 || stats.Unprotected != 3 || stats.Dropped != 1 {
+		t.Fatalf("server stats = %v", stats)
+	}
+}
+
+func TestSRTPAuthentication(t *testing.T) {
+	client, server := testSRTPContexts(t)
+	rtp, err := server.Protect(testRTPPacket(1, 42, []byte("payload")))
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	rtcp, err := server.Protect([]byte{0x81, 0xc8, 0x00, 0x01, 0x00, 0x00, 0x00, 0x2a})
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		modify func([]byte)
+		err    error
+	}{
+		{"rtp header", rtp, func(b []byte) { b[1] ^= 0x01 }, ErrSRTPAuthFailed},
+		{"rtp payload", rtp, func(b []byte) { b[rtpHeaderLen] ^= 0x01 }, ErrSRTPAuthFailed},
+		{"rtp tag", rtp, func(b []byte) { b[len(b)-1] ^= 0x01 }, ErrSRTPAuthFailed},
+		{"rtcp payload", rtcp, func(b []byte) { b[8] ^= 0x01 }, ErrSRTPAuthFailed},
+		{"rtcp index", rtcp, func(b []byte) { b[len(b)-srtpAuthTagLength-1] ^= 0x01 }, ErrSRTPAuthFailed},
+		{"rtcp tag", rtcp, func(b []byte) { b[len(b)-1] ^= 0x01 }, ErrSRTPAuthFailed},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := append([]byte{}, tc.packet...)
+			tc.modify(b)
+			if _, err := client.Unprotect(b); !errors.Is(err, tc.err) {
+				t.Fatalf("Unprotect error = %v, want %v", err, tc.err)
+			}
+		})
+	}
+	for _, packet := range [][]byte{rtp, rtcp} {
+		for i := 0; i < len(packet); i++ {
+			truncated := packet[:i]
+			if _, err := client.Unprotect(truncated); err == nil && (isRTP(truncated) || isRTCP(truncated)) {
+				t.Fatalf("Unprotect accepted packet truncated to %v bytes", i)
+			}
+		}
+	}
+	// the modified packets did not disturb the replay protection
+	for _, packet := range [][]byte{rtp, rtcp} {
+		if _, err := client.Unprotect(packet); err != nil {
+			t.Fatalf("Unprotect: %v", err)
+		}
+	}
+}
+
+func TestSRTPReplay(t *testing.T) {
+	client, server := testSRTPContexts(t)
+	protected := make(map[uint16][]byte)
+	for seq := uint16(0); seq < 4*srtpReplayWindowSize; seq++ {
+		b, err := server.Protect(testRTPPacket(seq, 42, []byte{byte(seq)}))
+		if err != nil {
+			t.Fatalf("Protect: %v", err)
+		}
+		protected[seq] = b
+	}
+	unprotect := func(seq uint16) error {
+		_, err := client.Unprotect(protected[seq])
+		return err
+	}
+
+	for _, tc := range []struct {
+		name string
+		seq  uint16
+		err  error
+	}{
+		{"first", 100, nil},
+		{"replayed", 100, ErrSRTPReplayed},
+		{"reordered", 99, nil},
+		{"reordered replayed", 99, ErrSRTPReplayed},
+		{"next", 101, nil},
+		{"jump", 150, nil},
+		{"gap within window", 120, nil},
+		{"gap replayed", 120, ErrSRTPReplayed},
+		{"oldest in window", 150 - srtpReplayWindowSize + 1, nil},
+		{"behind window", 150 - srtpReplayWindowSize, ErrSRTPReplayed},
+		{"old replayed behind window", 99, ErrSRTPReplayed},
+		{"window moved", 150 + srtpReplayWindowSize, nil},
+		{"behind moved window", 150, ErrSRTPReplayed},
+		{"in moved window", 151, nil},
+	} {
+		if err := unprotect(tc.seq); !errors.Is(err, tc.err) {
+			t.Fatalf("%v: Unprotect of seq %v error = %v, want %v", tc.name, tc.seq, err, tc.err)
+		}
+	}
+
+	// SRTCP has its own replay window
+	rtcp := []byte{0x81, 0xc8, 0x00, 0x01, 0x00, 0x00, 0x00, 0x2a}
+	first, err := server.Protect(rtcp)
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	second, err := server.Protect(rtcp)
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	for _, tc := range []struct {
+		name   string
+		packet []byte
+		err    error
+	}{
+		{"second", second, nil},
+		{"reordered", first, nil},
+		{"replayed", second, ErrSRTPReplayed},
+		{"reordered replayed", first, ErrSRTPReplayed},
+	} {
+		if _, err := client.Unprotect(tc.packet); !errors.Is(err, tc.err) {
+			t.Fatalf("%v: Unprotect of SRTCP error = %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestSRTPRollover(t *testing.T) {
+	client, server := testSRTPContexts(t)
+	// sequence numbers in sending order, the stream wraps three times
+	var seqs []uint16
+	for i := 0; i < 2*65536/4096; i++ {
+		seqs = append(seqs, uint16(65530+i*4096))
+	}
+	for seq := uint16(65530); seq != 10; seq++ {
+		seqs = append(seqs, seq)
+	}
+	protected := make([][]byte, len(seqs))
+	for i, seq := range seqs {
+		b, err := server.Protect(testRTPPacket(seq, 7, []byte{byte(i)}))
+		if err != nil {
+			t.Fatalf("Protect: %v", err)
+		}
+		protected[i] = b
+	}
+	if roc := server.sendStreams[7].roc; roc != 3 {
+		t.Fatalf("rollover counter of sender = %v, want 3", roc)
+	}
+
+	// the packets around the last wrap arrive reordered
+	order := make([]int, 0, len(seqs))
+	for i := 0; i < len(seqs)-16; i++ {
+		order = append(order, i)
+	}
+	n := len(seqs)
+	order = append(order,
+		n-16, n-14, n-15, n-12, n-13, // before the wrap
+		n-10, n-11, // 65535 after 0
+		n-9, n-7, n-8, n-6, n-4, n-5, n-1, n-3, n-2)
+
+	for _, i := range order {
+		d, err := client.Unprotect(protected[i])
+		if err != nil {
+			t.Fatalf("Unprotect of seq %v: %v", seqs[i], err)
+		}
+		if want := testRTPPacket(seqs[i], 7, []byte{byte(i)}); !bytes.Equal(d, want) {
+			t.Fatalf("Unprotect of seq %v = %x, want %x", seqs[i], d, want)
+		}
+	}
+	if stream := client.receiveStreams[7]; stream.roc != 3 || stream.lastSeq != 9 {
+		t.Fatalf("receiver at rollover counter %v and seq %v, want 3 and 9", stream.roc, stream.lastSeq)
+	}
+	// packets before the wrap are still detected as replayed
+	if _, err := client.Unprotect(protected[n-11]); !errors.Is(err, ErrSRTPReplayed) {
+		t.Fatalf("Unprotect of replayed seq %v error = %v, want %v", seqs[n-11], err, ErrSRTPReplayed)
+	}
+}
+
+func TestSRTPSessionKeys(t *testing.T) {
+	psk := bytes.Repeat([]byte{0x42}, MinSRTPPreSharedKeyLength)
+	nonce := func(b byte) []byte { return bytes.Repeat([]byte{b}, srtpNonceLength) }
+
+	km, err := deriveSRTPKeyingMaterial(psk, nonce(1), nonce(2))
+	if err != nil {
+		t.Fatalf("deriveSRTPKeyingMaterial: %v", err)
+	}
+	if len(km) != SRTPKeyingMaterialLength {
+		t.Fatalf("derived %v bytes, want %v", len(km), SRTPKeyingMaterialLength)
+	}
+	for _, tc := range []struct {
+		name                     string
+		clientNonce, serverNonce []byte
+	}{
+		{"client nonce", nonce(3), nonce(2)},
+		{"server nonce", nonce(1), nonce(3)},
+		{"swapped nonces", nonce(2), nonce(1)},
+	} {
+		other, err := deriveSRTPKeyingMaterial(psk, tc.clientNonce, tc.serverNonce)
+		if err != nil {
+			t.Fatalf("deriveSRTPKeyingMaterial: %v", err)
+		}
+		if bytes.Equal(km, other) {
+			t.Fatalf("sessions with different %v share keys", tc.name)
+		}
+	}
+
+	// client and server of a session agree on the keys
+	client, err := NewSRTPSessionContext(psk, nonce(1), nonce(2), true)
+	if err != nil {
+		t.Fatalf("NewSRTPSessionContext: %v", err)
+	}
+	server, err := NewSRTPSessionContext(psk, nonce(1), nonce(2), false)
+	if err != nil {
+		t.Fatalf("NewSRTPSessionContext: %v", err)
+	}
+	other, err := NewSRTPSessionContext(psk, nonce(1), nonce(3), true)
+	if err != nil {
+		t.Fatalf("NewSRTPSessionContext: %v", err)
+	}
+	p := testRTPPacket(1, 42, []byte("payload"))
+	e, err := server.Protect(p)
+	if err != nil {
+		t.Fatalf("Protect: %v", err)
+	}
+	if d, err := client.Unprotect(e); err != nil || !bytes.Equal(d, p) {
+		t.Fatalf("Unprotect = %x, %v, want %x", d, err, p)
+	}
+	if _, err := other.Unprotect(e); !errors.Is(err, ErrSRTPAuthFailed) {
+		t.Fatalf("Unprotect of other session error = %v, want %v", err, ErrSRTPAuthFailed)
+	}
+
+	for _, tc := range []struct {
+		name                          string
+		psk, clientNonce, serverNonce []byte
+	}{
+		{"short key", psk[1:], nonce(1), nonce(2)},
+		{"short client nonce", psk, nonce(1)[1:], nonce(2)},
+		{"long server nonce", psk, nonce(1), append(nonce(2), 0)},
+	} {
+		if _, err := NewSRTPSessionContext(tc.psk, tc.clientNonce, tc.serverNonce, true); !errors.Is(err, ErrInvalidSRTPKey) {
+			t.Fatalf("%v: NewSRTPSessionContext error = %v, want %v", tc.name, err, ErrInvalidSRTPKey)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// FrameExpiredErrorCode is used to cancel streams carrying frames which
+// missed their deadline.
+const FrameExpiredErrorCode quic.ErrorCode = 0x10
+
+// streamSession contains the parts shared by the stream based session
+// handlers: receiving feedback on a unidirectional stream and writing data to
+// new QUIC streams.
+type streamSession struct {
+	session  quic.Session
+	err      chan error
+	feedback chan []byte
+	done     chan struct{}
+
+	// frameDeadline is the time after which a frame is cancelled if it could
+	// not be delivered, 0 disables cancellation.
+	frameDeadline time.Duration
+	frames        uint64
+	expiredFrames uint64
+
+	// roq is the RoQ flow used for framing, nil if RoQ is disabled
+	roq *roqFlow
+}
+
+func newStreamSession(sess quic.Session, frameDeadline time.Duration, roq *roqFlow) *streamSession {
+	return &streamSession{
+		session:       sess,
+		err:           make(chan error, 1),
+		feedback:      make(chan []byte, 1024),
+		done:          make(chan struct{}, 1),
+		frameDeadline: frameDeadline,
+		roq:           roq,
+	}
+}
+
+// handleStreamSession starts a source writing to w and blocks until the
+// source or the session is done or ctx is cancelled.
+func handleStreamSession(ctx context.Context, src SrcFactory, s *streamSession, w io.WriteCloser) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		err := s.AcceptFeedback(ctx)
+		if err != nil {
+			s.fail(err)
+		}
+	}()
+
+	counter := newSessionCounter(w)
+	stop := src.MakeSrc(ctx, counter, s.feedback)
+	defer stop()
+
+	var bye Bye
+	select {
+	case err := <-s.err:
+		bye = counter.bye(CloseServerError, err.Error())
+	case <-s.done:
+		bye = counter.bye(CloseFinished, "")
+	case <-ctx.Done():
+		bye = counter.bye(CloseServerShutdown, "")
+	}
+	log.Printf("closing stream session, sent %v frames, %v expired\n", atomic.LoadUint64(&s.frames), atomic.LoadUint64(&s.expiredFrames))
+	return closeSession(s.session, bye)
+}
+
+func (s *streamSession) Close() error {
+	close(s.done)
+	return nil
+}
+
+// fail ends the session because of err. Only the first error is kept, so
+// that writers do not block on later errors.
+func (s *streamSession) fail(err error) {
+	select {
+	case s.err <- err:
+	default:
+	}
+}
+
+// AcceptFeedback passes the feedback of the client to the source until the
+// feedback stream ends or ctx is done.
+func (s *streamSession) AcceptFeedback(ctx context.Context) error {
+	fbStream, err := s.session.AcceptUniStream(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	log.Println("accepted feedback stream")
+	fbw := sessionFeedback{ctx: ctx, feedback: s.feedback}
+	if s.roq != nil {
+		return s.acceptRoQFeedback(fbStream, fbw)
+	}
+	var size uint32
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Recovered from AcceptFeedback: %v\nread size of %v\n", r, size)
+			panic(r)
+		}
+	}()
+	for {
+		err := binary.Read(fbStream, binary.BigEndian, &size)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fb := make([]byte, size)
+		_, err = io.ReadFull(fbStream, fb)
+		if err != nil {
+			return err
+		}
+		_, err = fbw.Write(fb)
+		if err != nil {
+			// the session ended
+			return nil
+		}
+	}
+}
+
+func (s *streamSession) acceptRoQFeedback(fbStream io.Reader, fbw io.Writer) error {
+	r := s.roq.newStreamReader(fbStream)
+	for {
+		fb, err := r.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fbw.Write(fb)
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// writeStream writes b to a new stream and closes the stream afterwards. frame
+// tells whether b is a media frame, only media frames are counted in the frame
+// statistics. If a frame deadline is set, the data is written asynchronously
+// and the stream is cancelled at deadline: a write blocked until deadline
+// counts as expired frame, data written before deadline is cancelled anyway,
+// so that QUIC does not retransmit it after the deadline. quic-go does not
+// tell when the data of a stream was acknowledged, so such frames count as
+// delivered.
+func (s *streamSession) writeStream(b []byte, deadline time.Time, frame bool) (int, error) {
+	if frame {
+		atomic.AddUint64(&s.frames, 1)
+	}
+	stream, err := s.session.OpenStreamSync(context.Background())
+	if err != nil {
+		log.Println("could not open stream, closing session")
+		s.fail(err)
+		return 0, err
+	}
+	if s.frameDeadline == 0 {
+		return s.write(stream, b, frame)
+	}
+	err = stream.SetWriteDeadline(deadline)
+	if err != nil {
+		return 0, err
+	}
+	go func() {
+		_, err := s.write(stream, b, frame)
+		if err != nil {
+			log.Printf("failed to write frame: %v\n", err)
+			return
+		}
+		// cancelling a stream whose data was acknowledged only sends a
+		// RESET_STREAM frame, which the receiver ignores
+		time.AfterFunc(time.Until(deadline), func() {
+			stream.CancelWrite(FrameExpiredErrorCode)
+		})
+	}()
+	return len(b), nil
+}
+
+func (s *streamSession) write(stream quic.Stream, b []byte, frame bool) (int, error) {
+	n, err := io.Copy(stream, bytes.NewBuffer(b))
+	if err != nil {
+		if nErr, ok := err.(net.Error); ok && nErr.Timeout() && s.frameDeadline > 0 {
+			stream.CancelWrite(FrameExpiredErrorCode)
+			if frame {
+				atomic.AddUint64(&s.expiredFrames, 1)
+			}
+			return 0, err
+		}
+		if sErr, ok := err.(quic.StreamError); ok && sErr.Canceled() {
+			if sErr.ErrorCode() == FrameExpiredErrorCode {
+				// the receiver gave up on this frame
+				if frame {
+					atomic.AddUint64(&s.expiredFrames, 1)
+				}
+				return 0, err
+			}
+			log.Println("stream cancelled, closing session")
+			s.fail(err)
+		}
+		if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
+			log.Println("stream timeout, closing session")
+			s.fail(err)
+		}
+		return 0, err
+	}
+	err = stream.Close()
+	if err != nil {
+		log.Printf("could not Close stream: %v", err)
+	}
+	return int(n), nil
+}
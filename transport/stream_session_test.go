@@ -0,0 +1,47 @@
+package transport
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Frames written before their deadline are cancelled at the deadline anyway,
+// so QUIC does not retransmit them afterwards. RTCP packets are not counted as
+// frames.
+func TestStreamSessionFrameDeadline(t *testing.T) {
+	sess := newTestSession()
+	defer sess.cancel()
+	s := newStreamSession(sess, 50*time.Millisecond, nil)
+
+	if _, err := s.writeStream([]byte("frame"), time.Now().Add(s.frameDeadline), true); err != nil {
+		t.Fatalf("writeStream: %v", err)
+	}
+	sr := []byte{0x80, 0xc8, 0x00, 0x06}
+	if _, err := s.writeStream(sr, time.Now().Add(s.frameDeadline), false); err != nil {
+		t.Fatalf("writeStream: %v", err)
+	}
+	opened := sess.openedStreams()
+	if len(opened) != 2 {
+		t.Fatalf("opened %v streams, want 2", len(opened))
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		frameCode, frameCanceled := opened[0].writeCanceledWith()
+		srCode, srCanceled := opened[1].writeCanceledWith()
+		if frameCanceled && srCanceled {
+			if frameCode != FrameExpiredErrorCode || srCode != FrameExpiredErrorCode {
+				t.Fatalf("streams cancelled with %x and %x, want %x", frameCode, srCode, FrameExpiredErrorCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("streams not cancelled at the deadline")
+		}
+	}
+	if string(opened[0].data()) != "frame" {
+		t.Fatalf("stream = %q, want %q", opened[0].data(), "frame")
+	}
+	if frames, expired := atomic.LoadUint64(&s.frames), atomic.LoadUint64(&s.expiredFrames); frames != 1 || expired != 0 {
+		t.Fatalf("counted %v frames, %v expired, want 1 frame, 0 expired", frames, expired)
+	}
+}
@@ -1,20 +1,23 @@
 package transport
 
 import (
-	"bytes"
 	"context"
 	"encoding/binary"
-	"errors"
-	"fmt"
-	"io"
 	"log"
-	"net"
+	"sync"
+	"time"
 
 	"github.com/lucas-clemente/quic-go"
+	"github.com/pion/rtp"
 )
 
+// StreamPerFrameHandler sends all RTP packets of a video frame on a single
+// QUIC stream. Packets on a stream are prefixed by their length as a 16 bit
+// unsigned integer, or using RoQ framing if enabled.
 type StreamPerFrameHandler struct {
-	src SrcFactory
+	src           SrcFactory
+	frameDeadline time.Duration
+	roq           *roqFlow
 }
 
 func NewStreamPerFrameHandler(src SrcFactory) *StreamPerFrameHandler {
@@ -23,113 +26,122 @@ func NewStreamPerFrameHandler(src SrcFactory) *StreamPerFrameHandler {
 	}
 }
 
-func (m *StreamPerFrameHandler) handle(sess quic.Session) error {
-	errChan := make(chan error, 1)
-	session := &StreamPerFrameSession{
-		session:  sess,
-		err:      errChan,
-		feedback: make(chan []byte, 1024),
-		done:     make(chan struct{}, 1),
-	}
-	go func() {
-		err := session.AcceptFeedback()
-		errChan <- err
-	}()
+// SetFrameDeadline sets the maximum time to deliver a frame, measured from
+// the first packet of the frame. The stream carrying the frame is cancelled
+// when the deadline expires. A deadline of 0 disables cancellation.
+func (m *StreamPerFrameHandler) SetFrameDeadline(deadline time.Duration) {
+	m.frameDeadline = deadline
+}
 
-	cancel := m.src.MakeSrc(session, session.feedback) // nil: QUIC Feedback not implemented for streamperframe
-	defer cancel()
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier.
+func (m *StreamPerFrameHandler) EnableRoQ(flowID uint64) {
+	m.roq = newRoQFlow(flowID)
+}
 
-	var err error
-	select {
-	case err = <-errChan:
-	case <-session.done:
-		err = errors.New("eos")
-	}
-	log.Println("closing streamperframe session")
-	if err != nil {
-		log.Println(err)
-		return session.session.CloseWithError(1, err.Error())
+func (m *StreamPerFrameHandler) handle(ctx context.Context, sess quic.Session) error {
+	session := &StreamPerFrameSession{
+		streamSession: newStreamSession(sess, m.frameDeadline, m.roq),
 	}
-	return session.session.CloseWithError(0, "")
+	return handleStreamSession(ctx, m.src, session.streamSession, session)
 }
 
+// StreamPerFrameSession buffers RTP packets until the marker bit is set or the
+// RTP timestamp changes and then writes the complete frame to a new stream.
 type StreamPerFrameSession struct {
-	session  quic.Session
-	err      chan error
-	feedback chan []byte
-	done     chan struct{}
-}
+	*streamSession
 
-func (m *StreamPerFrameSession) Close() error {
-	close(m.done)
-	return nil
+	lock      sync.Mutex
+	frame     [][]byte
+	timestamp uint32
+	// started is the time the first packet of the current frame was written
+	started time.Time
 }
 
-func (m *StreamPerFrameSession) AcceptFeedback() error {
-	fbStream, err := m.session.AcceptUniStream(context.Background())
+func (m *StreamPerFrameSession) Close() error {
+	m.lock.Lock()
+	err := m.flush()
+	m.lock.Unlock()
 	if err != nil {
-		return err
-	}
-	log.Println("accepted feedback stream")
-	var size uint32
-	defer func() {
-		if r := recover(); r != nil {
-			fmt.Printf("Recovered from AcceptFeedback: %v\nread size of %v\n", r, size)
-			panic(r)
-		}
-	}()
-	for {
-		select {
-		case <-m.done:
-			return nil
-		default:
-		}
-		err := binary.Read(fbStream, binary.BigEndian, &size)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		fb := make([]byte, size)
-		n, err := io.ReadFull(fbStream, fb)
-		if err != nil {
-			log.Println(err)
-			continue
-		}
-		if n != int(size) {
-			log.Printf("got announcement of size %v feedback, but read %v bytes", size, n)
-		}
-		m.feedback <- fb
+		log.Printf("could not write last frame: %v\n", err)
 	}
+	return m.streamSession.Close()
 }
 
 func (m *StreamPerFrameSession) Write(b []byte) (int, error) {
-	stream, err := m.session.OpenStreamSync(context.Background())
+	if isRTCP(b) {
+		return m.writeRTCP(b)
+	}
+	var header rtp.Header
+	err := header.Unmarshal(b)
 	if err != nil {
-		log.Println("could not open stream, closing session")
-		m.err <- err
 		return 0, err
 	}
-	defer func() {
-		if stream != nil {
-			err := stream.Close()
-			if err != nil {
-				log.Printf("could not Close stream: %v", err)
-			}
-		}
-	}()
 
-	n, err := io.Copy(stream, bytes.NewBuffer(b))
-	if err != nil {
-		if sErr, ok := err.(quic.StreamError); ok && sErr.Canceled() {
-			log.Println("stream cancelled, closing session")
-			m.err <- err
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if len(m.frame) > 0 && header.Timestamp != m.timestamp {
+		// missing marker bit, the last frame is complete anyway
+		if err := m.flush(); err != nil {
+			return 0, err
 		}
-		if nErr, ok := err.(net.Error); ok && nErr.Timeout() {
-			log.Println("stream timeout, closing session")
-			m.err <- err
+	}
+	if len(m.frame) == 0 {
+		m.started = time.Now()
+	}
+	packet := make([]byte, len(b))
+	copy(packet, b)
+	m.frame = append(m.frame, packet)
+	m.timestamp = header.Timestamp
+	if header.Marker {
+		if err := m.flush(); err != nil {
+			return 0, err
 		}
-		return 0, err
 	}
+	return len(b), nil
+}
+
+// writeRTCP writes a RTCP packet on its own stream without affecting the
+// current frame.
+func (m *StreamPerFrameSession) writeRTCP(b []byte) (int, error) {
+	packets := [][]byte{append([]byte{}, b...)}
+	var data []byte
+	if m.roq != nil {
+		data = m.roq.marshalStream(packets)
+	} else {
+		data = marshalLengthPrefixed(packets)
+	}
+	_, err := m.writeStream(data, time.Now().Add(m.frameDeadline), false)
+	return len(b), err
+}
+
+func (m *StreamPerFrameSession) flush() error {
+	if len(m.frame) == 0 {
+		return nil
+	}
+	var b []byte
+	if m.roq != nil {
+		b = m.roq.marshalStream(m.frame)
+	} else {
+		b = marshalLengthPrefixed(m.frame)
+	}
+	_, err := m.writeStream(b, m.started.Add(m.frameDeadline), true)
+	m.frame = nil
+	return err
+}
 
-	return int(n), nil
+// marshalLengthPrefixed concatenates packets and prefixes each packet by its
+// length as a 16 bit unsigned integer in network byte order.
+func marshalLengthPrefixed(packets [][]byte) []byte {
+	size := 0
+	for _, p := range packets {
+		size += 2 + len(p)
+	}
+	buf := make([]byte, size)
+	i := 0
+	for _, p := range packets {
+		binary.BigEndian.PutUint16(buf[i:], uint16(len(p)))
+		i += 2
+		i += copy(buf[i:], p)
+	}
+	return buf
 }
@@ -0,0 +1,53 @@
+package transport
+
+import (
+	"context"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// StreamPerPacketHandler sends every RTP packet on a new QUIC stream.
+type StreamPerPacketHandler struct {
+	src           SrcFactory
+	frameDeadline time.Duration
+	roq           *roqFlow
+}
+
+func NewStreamPerPacketHandler(src SrcFactory) *StreamPerPacketHandler {
+	return &StreamPerPacketHandler{
+		src: src,
+	}
+}
+
+// SetFrameDeadline sets the maximum time to deliver a packet, after which the
+// stream carrying it is cancelled. A deadline of 0 disables cancellation.
+func (m *StreamPerPacketHandler) SetFrameDeadline(deadline time.Duration) {
+	m.frameDeadline = deadline
+}
+
+// EnableRoQ enables RTP over QUIC framing using the given flow identifier.
+func (m *StreamPerPacketHandler) EnableRoQ(flowID uint64) {
+	m.roq = newRoQFlow(flowID)
+}
+
+func (m *StreamPerPacketHandler) handle(ctx context.Context, sess quic.Session) error {
+	session := &StreamPerPacketSession{
+		streamSession: newStreamSession(sess, m.frameDeadline, m.roq),
+	}
+	return handleStreamSession(ctx, m.src, session.streamSession, session)
+}
+
+type StreamPerPacketSession struct {
+	*streamSession
+}
+
+func (m *StreamPerPacketSession) Write(b []byte) (int, error) {
+	deadline := time.Now().Add(m.frameDeadline)
+	media := !isRTCP(b)
+	if m.roq != nil {
+		_, err := m.writeStream(m.roq.marshalStream([][]byte{b}), deadline, media)
+		return len(b), err
+	}
+	return m.writeStream(b, deadline, media)
+}
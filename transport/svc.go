@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/pion/rtp"
+)
+
+// TemporalLayerPattern returns the temporal layer of each frame in a periodic
+// group of frames for an L1T2 or L1T3 hierarchical-P structure.
+func TemporalLayerPattern(layers int) ([]int, error) {
+	switch layers {
+	case 1:
+		return []int{0}, nil
+	case 2:
+		return []int{0, 1}, nil
+	case 3:
+		return []int{0, 2, 1, 2}, nil
+	default:
+		return nil, fmt.Errorf("unsupported number of temporal layers: %v", layers)
+	}
+}
+
+// TemporalLayerTagger determines the temporal layer of VP8 RTP packets. The
+// layer is read from the TID field of the VP8 payload descriptor (RFC 7741).
+// Packets without TL0PICIDX and TID can not be assigned to a layer reliably,
+// they are tagged as base layer and are never dropped.
+type TemporalLayerTagger struct {
+	warned bool
+}
+
+func NewTemporalLayerTagger() *TemporalLayerTagger {
+	return &TemporalLayerTagger{}
+}
+
+// Layer returns the temporal layer of packet.
+func (t *TemporalLayerTagger) Layer(packet *rtp.Packet) int {
+	tid, ok := vp8TemporalLayer(packet.Payload)
+	if !ok {
+		if !t.warned {
+			t.warned = true
+			log.Printf("VP8 payload descriptor without TL0PICIDX and TID, sending all packets as base layer\n")
+		}
+		return 0
+	}
+	return tid
+}
+
+// vp8TemporalLayer returns the TID of a VP8 payload descriptor, if the
+// descriptor carries both TL0PICIDX and TID.
+func vp8TemporalLayer(payload []byte) (int, bool) {
+	if len(payload) < 1 || payload[0]&0x80 == 0 {
+		// no extension
+		return 0, false
+	}
+	if len(payload) < 2 {
+		return 0, false
+	}
+	ext := payload[1]
+	i := 2
+	if ext&0x80 != 0 { // I: picture ID
+		if len(payload) <= i {
+			return 0, false
+		}
+		if payload[i]&0x80 != 0 {
+			i += 2
+		} else {
+			i++
+		}
+	}
+	if ext&0x40 == 0 || ext&0x20 == 0 { // L: TL0PICIDX, T: TID
+		return 0, false
+	}
+	i++
+	if len(payload) <= i {
+		return 0, false
+	}
+	return int(payload[i] >> 6), true
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+)
+
+// TCPClient receives RTP packets framed as in RFC 4571 from a TCPServer.
+type TCPClient struct {
+	addr      string
+	writer    io.Writer
+	conn      net.Conn
+	connected chan struct{}
+}
+
+func NewTCPClient(addr string, w io.Writer) *TCPClient {
+	return &TCPClient{
+		addr:      addr,
+		writer:    w,
+		connected: make(chan struct{}),
+	}
+}
+
+// RunFeedbackSender returns a writer for feedback, which is sent to the
+// server until ctx is done.
+func (c *TCPClient) RunFeedbackSender(ctx context.Context) (io.Writer, error) {
+	fbw := FeedbackWriter(make(chan []byte, 1024))
+	go func() {
+		select {
+		case <-c.connected:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			select {
+			case fb := <-fbw:
+				_, err := c.conn.Write(marshalLengthPrefixed([][]byte{fb}))
+				if err != nil {
+					log.Println(err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return fbw, nil
+}
+
+// Run receives the stream until the server closes the connection or ctx is
+// done. The connection is closed when ctx is done and ctx.Err() is returned.
+func (c *TCPClient) Run(ctx context.Context) error {
+	log.Println("running TCP Client")
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	close(c.connected)
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	// the server closes the connection at the end of the stream
+	err = readFrame(conn, c.writer)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sync"
+)
+
+// TCPConnHandler sends RTP packets on a TCP connection using the framing of
+// RFC 4571: Each packet is prefixed by its length as a 16 bit unsigned
+// integer. Feedback from the client is framed the same way.
+type TCPConnHandler struct {
+	src SrcFactory
+}
+
+func NewTCPConnHandler(src SrcFactory) *TCPConnHandler {
+	return &TCPConnHandler{
+		src: src,
+	}
+}
+
+func (h *TCPConnHandler) handle(ctx context.Context, conn net.Conn) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s := &TCPConnSession{
+		conn:     conn,
+		feedback: make(chan []byte, 1024),
+		err:      make(chan error, 1),
+		done:     make(chan struct{}),
+	}
+	go func() {
+		s.err <- s.AcceptFeedback(ctx)
+	}()
+
+	stop := h.src.MakeSrc(ctx, s, s.feedback)
+	defer stop()
+
+	var err error
+	select {
+	case err = <-s.err:
+	case <-s.done:
+	case <-ctx.Done():
+	}
+	log.Println("closing tcp session")
+	return err
+}
+
+type TCPConnSession struct {
+	conn     net.Conn
+	lock     sync.Mutex
+	feedback chan []byte
+	err      chan error
+	done     chan struct{}
+}
+
+// AcceptFeedback passes the feedback of the client to the source until the
+// connection is closed or ctx is done.
+func (s *TCPConnSession) AcceptFeedback(ctx context.Context) error {
+	return readFrame(s.conn, sessionFeedback{ctx: ctx, feedback: s.feedback})
+}
+
+func (s *TCPConnSession) Write(b []byte) (int, error) {
+	if len(b) > 0xFFFF {
+		return 0, errors.New("packet too large for RFC 4571 framing")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	_, err := s.conn.Write(marshalLengthPrefixed([][]byte{b}))
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close is called at the end of the stream, the connection is closed by the
+// server afterwards.
+func (s *TCPConnSession) Close() error {
+	close(s.done)
+	return nil
+}
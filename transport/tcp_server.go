@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"log"
+	"net"
+)
+
+// ConnHandler serves TCP connections. The context passed to handle is
+// cancelled when the server closes all connections.
+type ConnHandler interface {
+	handle(ctx context.Context, conn net.Conn) error
+}
+
+type TCPServer struct {
+	ConnHandler
+	addr string
+
+	lifecycle lifecycle
+}
+
+func NewTCPServer(addr string, options ...func(*TCPServer)) *TCPServer {
+	s := &TCPServer{
+		addr: addr,
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+func SetConnHandler(ch ConnHandler) func(*TCPServer) {
+	return func(s *TCPServer) {
+		s.ConnHandler = ch
+	}
+}
+
+// Run accepts connections until ctx is done or Shutdown is called. Run
+// returns after all connections were closed, cancelling ctx closes all
+// connections right away.
+func (s *TCPServer) Run(ctx context.Context) error {
+	acceptCtx, connCtx, err := s.lifecycle.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.lifecycle.end()
+	log.Println("running TCP server")
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-acceptCtx.Done()
+		err := listener.Close()
+		if err != nil {
+			log.Printf("error while closing listener: %v\n", err)
+		}
+	}()
+	err = s.accept(connCtx, listener)
+	if acceptCtx.Err() != nil {
+		// the listener was closed
+		err = nil
+	}
+	return s.lifecycle.wait(ctx, err)
+}
+
+// Shutdown stops accepting connections and waits until all connections were
+// closed. If ctx expires first, the remaining connections are closed and
+// ctx.Err() is returned. Run returns ErrServerClosed afterwards.
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	return s.lifecycle.shutdown(ctx)
+}
+
+func (s *TCPServer) accept(ctx context.Context, listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		log.Printf("connection accepted: %s", conn.RemoteAddr().String())
+		s.lifecycle.sessions.Add(1)
+		go func() {
+			defer s.lifecycle.sessions.Done()
+			err := s.handle(ctx, conn)
+			if err != nil {
+				log.Printf("connection error: %v\n", err)
+			}
+			err = conn.Close()
+			if err != nil {
+				log.Printf("error while closing connection: %v\n", err)
+			}
+		}()
+	}
+}
@@ -2,34 +2,135 @@ package transport
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// udpHelloInterval is the time after which an unanswered hello is
+	// repeated
+	udpHelloInterval    = 250 * time.Millisecond
+	udpHandshakeTimeout = 5 * time.Second
+	// udpKeepaliveInterval must be well below the idle timeout of the server
+	udpKeepaliveInterval = time.Second
+	// udpReadInterval is the interval in which the client checks whether its
+	// context is done while waiting for packets
+	udpReadInterval = 200 * time.Millisecond
+)
+
+var ErrUDPHandshakeTimeout = errors.New("udp server did not start the session")
+
 type UDPClient struct {
-	addr      string
-	writer    io.Writer
-	conn      net.Conn
-	closeChan chan struct{}
+	addr        string
+	writer      io.Writer
+	conn        net.Conn
+	idleTimeout time.Duration
+
+	// srtpKey is the pre-shared key from which the SRTP keys of the session
+	// are derived, srtp is created from it when the server welcomes the
+	// client
+	srtpKey      []byte
+	srtpStatsLog io.Writer
+	srtpLock     sync.Mutex
+	srtp         *SRTPContext
+
+	// ssrc is the sender SSRC of the feedback, which is the source leaving
+	// the session in the BYE message of the client
+	ssrc uint32
 }
 
 func NewUDPClient(addr string, w io.Writer) *UDPClient {
 	return &UDPClient{
-		addr:      addr,
-		writer:    w,
-		closeChan: make(chan struct{}, 1),
+		addr:        addr,
+		writer:      w,
+		idleTimeout: DefaultUDPIdleTimeout,
+	}
+}
+
+// SetIdleTimeout sets the time after which the client gives up if no packet
+// was received from the server. It must be at least MinUDPIdleTimeout.
+func (c *UDPClient) SetIdleTimeout(timeout time.Duration) error {
+	if timeout < MinUDPIdleTimeout {
+		return fmt.Errorf("%w: got %v, expected at least %v", ErrUDPIdleTimeout, timeout, MinUDPIdleTimeout)
+	}
+	c.idleTimeout = timeout
+	return nil
+}
+
+// EnableSRTP authenticates and decrypts received packets and protects sent
+// feedback using SRTP. The keys of the session are derived from the
+// pre-shared key psk and the nonces of the handshake. If statsLogger is not
+// nil, the SRTP statistics are logged to it.
+func (c *UDPClient) EnableSRTP(psk []byte, statsLogger io.Writer) error {
+	if len(psk) < MinSRTPPreSharedKeyLength {
+		return fmt.Errorf("%w: got %v bytes of pre-shared key, expected at least %v", ErrInvalidSRTPKey, len(psk), MinSRTPPreSharedKeyLength)
 	}
+	c.srtpKey = psk
+	c.srtpStatsLog = statsLogger
+	return nil
 }
 
-func (c *UDPClient) RunFeedbackSender() (io.Writer, chan<- struct{}, error) {
+// srtpContext returns the SRTPContext of the session or nil if SRTP is
+// disabled or the handshake is not complete yet.
+func (c *UDPClient) srtpContext() *SRTPContext {
+	c.srtpLock.Lock()
+	defer c.srtpLock.Unlock()
+	return c.srtp
+}
+
+// startSRTP creates the SRTPContext of the session from the nonces of the
+// handshake. It does nothing if SRTP is disabled.
+func (c *UDPClient) startSRTP(ctx context.Context, clientNonce, serverNonce []byte) error {
+	if c.srtpKey == nil {
+		return nil
+	}
+	srtp, err := NewSRTPSessionContext(c.srtpKey, clientNonce, serverNonce, true)
+	if err != nil {
+		return err
+	}
+	if c.srtpStatsLog != nil {
+		srtp.SetStatsLogger(c.srtpStatsLog)
+	}
+	go srtp.Run(ctx.Done())
+	c.srtpLock.Lock()
+	c.srtp = srtp
+	c.srtpLock.Unlock()
+	return nil
+}
+
+// RunFeedbackSender returns a writer for feedback, which is sent to the
+// server until ctx is done.
+func (c *UDPClient) RunFeedbackSender(ctx context.Context) (io.Writer, error) {
 	fbw := FeedbackWriter(make(chan []byte, 1024))
-	done := make(chan struct{}, 1)
 	go func() {
 		for {
 			select {
 			case fb := <-fbw:
-				_, err := c.conn.Write(fb)
+				if isRTCP(fb) && len(fb) >= 8 {
+					atomic.StoreUint32(&c.ssrc, binary.BigEndian.Uint32(fb[4:8]))
+				}
+				var err error
+				if c.srtpKey != nil {
+					srtp := c.srtpContext()
+					if srtp == nil {
+						// no keys before the server welcomed the client
+						continue
+					}
+					fb, err = srtp.Protect(fb)
+					if err != nil {
+						log.Println(err)
+						continue
+					}
+				}
+				_, err = c.conn.Write(fb)
 				if err != nil {
 					log.Println(err)
 				}
@@ -38,19 +139,17 @@ func (c *UDPClient) RunFeedbackSender() (io.Writer, chan<- struct{}, error) {
 						//return
 					}
 				}
-			case <-done:
+			case <-ctx.Done():
 				return
 			}
 		}
 	}()
-	return fbw, done, nil
-}
-
-func (c *UDPClient) CloseChan() chan struct{} {
-	return c.closeChan
+	return fbw, nil
 }
 
-func (c *UDPClient) Run() error {
+// Run receives the stream until the server ends the session or ctx is done.
+// The client says bye when ctx is done and returns ctx.Err().
+func (c *UDPClient) Run(ctx context.Context) error {
 	log.Println("running UDP Client")
 	serverAddr, err := net.ResolveUDPAddr("udp", c.addr)
 	if err != nil {
@@ -62,30 +161,200 @@ func (c *UDPClient) Run() error {
 	}
 	c.conn = conn
 
-	_, err = conn.Write([]byte("hello"))
+	first, err := c.handshake(ctx)
 	if err != nil {
+		_ = conn.Close()
 		return err
 	}
+	if srtp := c.srtpContext(); srtp != nil {
+		defer func() {
+			log.Println(srtp.Stats())
+		}()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go c.sendKeepalives(done)
+
+	if first != nil {
+		done, err := c.receive(first)
+		if done || err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
 
+	lastReceived := time.Now()
 	buf := make([]byte, 1500)
 	for {
-		select {
-		case <-c.closeChan:
-			return nil
-		default:
+		if ctx.Err() != nil {
+			err := c.sendBye(Bye{Code: CloseClientBye, SSRC: atomic.LoadUint32(&c.ssrc)})
+			if err != nil {
+				log.Printf("could not send bye: %v\n", err)
+			}
+			_ = conn.Close()
+			return ctx.Err()
+		}
+		// wake up regularly to notice when the client is closed
+		err := conn.SetReadDeadline(time.Now().Add(udpReadInterval))
+		if err != nil {
+			return err
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+				log.Println(err)
+			}
+			if time.Since(lastReceived) > c.idleTimeout {
+				_ = conn.Close()
+				return fmt.Errorf("%w: no packet received for %v", ErrSessionTimeout, time.Since(lastReceived))
+			}
+			continue
+		}
+		lastReceived = time.Now()
+		done, err := c.receive(buf[:n])
+		if done || err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+}
+
+// handshake repeats the hello message until the server welcomes the client
+// and then echoes the cookie of the welcome message until the first packet of
+// the session arrives, which is returned. Other packets can not arrive before
+// the welcome message, since the server only starts streaming after the
+// cookie was echoed.
+func (c *UDPClient) handshake(ctx context.Context) ([]byte, error) {
+	clientNonce, err := newSRTPNonce()
+	if err != nil {
+		return nil, err
+	}
+	hello := udpHandshakeMessage(udpHello, clientNonce)
+	var start []byte
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(udpHandshakeTimeout)
+	for time.Now().Before(deadline) {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		msg := hello
+		if start != nil {
+			msg = start
+		}
+		_, err := c.conn.Write(msg)
+		if err != nil {
+			return nil, err
 		}
-		n, _, err := conn.ReadFrom(buf)
+		readDeadline := time.Now().Add(udpHelloInterval)
+		err = c.conn.SetReadDeadline(readDeadline)
 		if err != nil {
-			log.Println(err)
+			return nil, err
 		}
+		for {
+			n, err := c.conn.Read(buf)
+			if err != nil {
+				if nErr, ok := err.(net.Error); !ok || !nErr.Timeout() {
+					// e.g. the server is not running yet
+					log.Println(err)
+					time.Sleep(time.Until(readDeadline))
+				}
+				break
+			}
+			cookie, welcome := parseUDPHandshakeMessage(buf[:n], udpWelcome)
+			switch {
+			case welcome && start == nil:
+				log.Println("udp session welcomed")
+				if err := c.startSRTP(ctx, clientNonce, cookie); err != nil {
+					return nil, err
+				}
+				start = udpHandshakeMessage(udpStart, cookie)
+				_, err := c.conn.Write(start)
+				if err != nil {
+					return nil, err
+				}
+			case welcome:
+				// repeated welcome of a repeated hello
+			case start != nil:
+				// the first packet of the stream or a BYE message, both
+				// protected if SRTP is enabled
+				log.Println("udp session accepted")
+				return buf[:n], nil
+			case isBye(buf[:n]):
+				// the server rejected the session, which is unprotected
+				// because there are no keys before the welcome
+				return buf[:n], nil
+			default:
+				log.Printf("dropping packet before welcome\n")
+			}
+		}
+	}
+	return nil, ErrUDPHandshakeTimeout
+}
 
-		if res := bytes.Compare(buf[:n], []byte("eos")); res == 0 {
-			return conn.Close()
+// sendKeepalives keeps the session open while the client sends no feedback.
+func (c *UDPClient) sendKeepalives(done <-chan struct{}) {
+	ticker := time.NewTicker(udpKeepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := c.conn.Write(udpKeepalive)
+			if err != nil {
+				log.Printf("could not send keepalive: %v\n", err)
+			}
+		case <-done:
+			return
 		}
+	}
+}
 
-		_, err = io.Copy(c.writer, bytes.NewReader(buf[:n]))
-		if err != nil && err != io.EOF {
+// sendBye sends bye to the server, protected by SRTCP if SRTP is enabled.
+func (c *UDPClient) sendBye(bye Bye) error {
+	msg, err := bye.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if srtp := c.srtpContext(); srtp != nil {
+		msg, err = srtp.Protect(msg)
+		if err != nil {
 			return err
 		}
 	}
+	_, err = c.conn.Write(msg)
+	return err
+}
+
+// receive passes a packet of the server to the writer of c. It returns true
+// if the server closed the session and the error of the BYE message. With
+// SRTP, BYE messages are only accepted after they were authenticated, except
+// for BYE messages rejecting the session before the welcome, which carry no
+// stream and are received by the handshake.
+func (c *UDPClient) receive(packet []byte) (bool, error) {
+	if bytes.HasPrefix(packet, udpWelcome) {
+		// repeated welcome of a repeated hello
+		return false, nil
+	}
+	if srtp := c.srtpContext(); srtp != nil {
+		var err error
+		packet, err = srtp.Unprotect(packet)
+		if err != nil {
+			log.Printf("dropping packet: %v\n", err)
+			return false, nil
+		}
+	}
+	if isBye(packet) {
+		bye := Bye{}
+		err := bye.UnmarshalBinary(packet)
+		if err != nil {
+			log.Printf("dropping bye: %v\n", err)
+			return false, nil
+		}
+		log.Printf("received bye: %v\n", bye)
+		return true, byeResult(bye)
+	}
+	_, err := io.Copy(c.writer, bytes.NewReader(packet))
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return false, nil
 }
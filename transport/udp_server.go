@@ -1,17 +1,24 @@
 package transport
 
 import (
+	"context"
 	"log"
 	"net"
 )
 
+// PacketHandler serves the packets received by a UDPServer.
 type PacketHandler interface {
 	handle(conn net.PacketConn, addr net.Addr, buf []byte) error
+	// shutdown rejects new sessions and waits until all sessions ended. The
+	// remaining sessions are closed when ctx is done.
+	shutdown(ctx context.Context) error
 }
 
 type UDPServer struct {
 	PacketHandler
 	addr string
+
+	lifecycle lifecycle
 }
 
 func NewUDPServer(addr string, options ...func(*UDPServer)) *UDPServer {
@@ -30,23 +37,65 @@ func SetPacketHandler(ph PacketHandler) func(*UDPServer) {
 	}
 }
 
-func (s *UDPServer) Run() error {
+// Run serves sessions until ctx is done or Shutdown is called. Packets are
+// read until all sessions ended, cancelling ctx closes all sessions right
+// away.
+func (s *UDPServer) Run(ctx context.Context) error {
+	acceptCtx, sessionCtx, err := s.lifecycle.start(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.lifecycle.end()
 	log.Println("running UDP server")
 	pc, err := net.ListenPacket("udp", s.addr)
 	if err != nil {
 		return err
 	}
-	return s.accept(pc)
+	closed := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.accept(pc, closed)
+	}()
+
+	<-acceptCtx.Done()
+	err = s.shutdown(sessionCtx)
+	if err != nil {
+		log.Printf("closed open sessions: %v\n", err)
+	}
+	close(closed)
+	err = pc.Close()
+	if err != nil {
+		log.Printf("error while closing connection: %v\n", err)
+	}
+	<-done
+	return s.lifecycle.wait(ctx, nil)
+}
+
+// Shutdown rejects new sessions and waits until all sessions ended. If ctx
+// expires first, the remaining sessions are closed and ctx.Err() is returned.
+// Run returns ErrServerClosed afterwards.
+func (s *UDPServer) Shutdown(ctx context.Context) error {
+	return s.lifecycle.shutdown(ctx)
 }
 
-func (s *UDPServer) accept(conn net.PacketConn) error {
+// accept reads packets from conn until closed is closed.
+func (s *UDPServer) accept(conn net.PacketConn, closed <-chan struct{}) {
 	for {
 		buf := make([]byte, 1500)
 		n, addr, err := conn.ReadFrom(buf)
 		if err != nil {
+			select {
+			case <-closed:
+				return
+			default:
+			}
 			log.Printf("Could not read from connection: %v\n", err)
+			continue
 		}
+		s.lifecycle.sessions.Add(1)
 		go func() {
+			defer s.lifecycle.sessions.Done()
 			var err error
 			defer func() {
 				if err != nil {
@@ -0,0 +1,508 @@
+package transport
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// HTTP/3 (RFC 9114) frame types, stream types, settings and error codes used
+// to establish WebTransport sessions (draft-ietf-webtrans-http3-02).
+const (
+	h3FrameData     = 0x00
+	h3FrameHeaders  = 0x01
+	h3FrameSettings = 0x04
+
+	h3StreamControl      = 0x00
+	h3StreamQPACKEncoder = 0x02
+	h3StreamQPACKDecoder = 0x03
+
+	// webTransportUniStream is the stream type of unidirectional WebTransport
+	// streams.
+	webTransportUniStream = 0x54
+	// webTransportBidiStream is the signal value starting bidirectional
+	// WebTransport streams.
+	webTransportBidiStream = 0x41
+
+	// webTransportCloseSessionCapsule is the CLOSE_WEBTRANSPORT_SESSION
+	// capsule (RFC 9297) carrying the application error code and message of
+	// a closed session.
+	webTransportCloseSessionCapsule = 0x2843
+	// maxWebTransportCloseMessage is the longest message of a
+	// CLOSE_WEBTRANSPORT_SESSION capsule.
+	maxWebTransportCloseMessage = 1024
+
+	h3SettingEnableConnectProtocol = 0x08
+	h3SettingDatagram              = 0x33
+	h3SettingDatagramDraft04       = 0xffd277
+	h3SettingEnableWebTransport    = 0x2b603742
+	h3SettingWebTransportMaxSess   = 0xc671706a
+
+	h3NoError              quic.ErrorCode = 0x100
+	h3GeneralProtocolError quic.ErrorCode = 0x101
+	h3StreamCreationError  quic.ErrorCode = 0x103
+	h3RequestRejected      quic.ErrorCode = 0x10b
+
+	// h3ALPN is the ALPN of HTTP/3 over QUIC draft-29. The quic-go fork
+	// does not implement QUIC version 1 and its default version is only
+	// understood by quic-go, so WebTransport sessions use draft-29.
+	h3ALPN = "h3-29"
+
+	// maxH3HeadersSize is the largest accepted HEADERS frame.
+	maxH3HeadersSize = 1 << 14
+
+	webTransportHandshakeTimeout = 10 * time.Second
+	// webTransportCertificateValidity is the maximum validity of certificates
+	// which browsers accept by their hash.
+	webTransportCertificateValidity = 14 * 24 * time.Hour
+)
+
+var (
+	ErrH3UnexpectedFrame    = errors.New("unexpected HTTP/3 frame")
+	ErrH3FrameTooLarge      = errors.New("HTTP/3 frame too large")
+	ErrWebTransportRequest  = errors.New("invalid WebTransport request")
+	ErrWebTransportSessions = errors.New("WebTransport session closed")
+)
+
+// EnableWebTransport accepts WebTransport sessions over HTTP/3 on path
+// instead of raw QUIC sessions. The session handler gets a session which
+// maps streams and datagrams to the WebTransport session, so all handlers can
+// serve browsers. Without a TLS config, a certificate is generated which
+// browsers accept by the hash returned from CertificateHash. Sessions use
+// QUIC draft-29, so only browsers which still implement draft-29 can connect.
+func EnableWebTransport(path string) func(*QUICServer) {
+	return func(s *QUICServer) {
+		s.webTransportPath = path
+		s.quicConfig.EnableDatagrams = true
+		s.quicConfig.Versions = []quic.VersionNumber{quic.VersionDraft29}
+	}
+}
+
+// byteReader reads single bytes from a stream without buffering, so the
+// remaining data of the stream can be passed on after a header was read.
+type byteReader struct {
+	io.Reader
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
+
+func appendH3Frame(b []byte, frameType uint64, payload []byte) []byte {
+	b = appendVarint(b, frameType)
+	b = appendVarint(b, uint64(len(payload)))
+	return append(b, payload...)
+}
+
+// readH3Frame reads the type and payload of the next HTTP/3 frame from r.
+func readH3Frame(r io.Reader, maxSize uint64) (uint64, []byte, error) {
+	br := byteReader{r}
+	frameType, err := readVarint(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	length, err := readVarint(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if length > maxSize {
+		return 0, nil, fmt.Errorf("%w: %v bytes", ErrH3FrameTooLarge, length)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err == io.EOF {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	return frameType, payload, err
+}
+
+// webTransportSettings are the settings sent on the control stream. Both the
+// draft and the final value of the datagram setting are announced to support
+// all browser versions.
+func webTransportSettings() []byte {
+	var settings []byte
+	for _, s := range []uint64{
+		h3SettingEnableConnectProtocol,
+		h3SettingDatagram,
+		h3SettingDatagramDraft04,
+		h3SettingEnableWebTransport,
+		h3SettingWebTransportMaxSess,
+	} {
+		settings = appendVarint(settings, s)
+		settings = appendVarint(settings, 1)
+	}
+	return appendH3Frame(appendVarint(nil, h3StreamControl), h3FrameSettings, settings)
+}
+
+// webTransportSession is a WebTransport session, which is used like a QUIC
+// session. Streams opened on the session carry the WebTransport stream
+// header, accepted streams are the WebTransport streams of the session and
+// datagrams are prefixed by the quarter stream ID of the session. Each QUIC
+// connection carries a single WebTransport session.
+type webTransportSession struct {
+	quic.Session
+
+	// control is the HTTP/3 control stream, which must stay open
+	control quic.SendStream
+	// connect is the stream of the CONNECT request establishing the session
+	connect quic.Stream
+	id      uint64
+	// datagramPrefix is the quarter stream ID of connect
+	datagramPrefix []byte
+
+	ready      chan struct{}
+	uniStreams chan quic.ReceiveStream
+	streams    chan quic.Stream
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	err       error
+}
+
+// acceptWebTransportSession sets up HTTP/3 on sess and waits for a
+// WebTransport CONNECT request on path.
+func acceptWebTransportSession(sess quic.Session, path string) (*webTransportSession, error) {
+	control, err := sess.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	_, err = control.Write(webTransportSettings())
+	if err != nil {
+		return nil, err
+	}
+	w := &webTransportSession{
+		Session:    sess,
+		control:    control,
+		ready:      make(chan struct{}),
+		uniStreams: make(chan quic.ReceiveStream, 16),
+		streams:    make(chan quic.Stream, 16),
+		closed:     make(chan struct{}),
+	}
+	go w.acceptUniStreams()
+
+	ctx, cancel := context.WithTimeout(sess.Context(), webTransportHandshakeTimeout)
+	defer cancel()
+	connect, err := sess.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = w.handleConnect(connect, path)
+	if err != nil {
+		return nil, err
+	}
+	close(w.ready)
+	go w.acceptStreams()
+	log.Printf("accepted WebTransport session %v\n", w.id)
+	return w, nil
+}
+
+// handleConnect reads the CONNECT request from stream and answers it.
+func (w *webTransportSession) handleConnect(stream quic.Stream, path string) error {
+	frameType, payload, err := readH3Frame(stream, maxH3HeadersSize)
+	if err != nil {
+		return err
+	}
+	if frameType != h3FrameHeaders {
+		stream.CancelRead(h3GeneralProtocolError)
+		stream.CancelWrite(h3GeneralProtocolError)
+		return fmt.Errorf("%w: %v", ErrH3UnexpectedFrame, frameType)
+	}
+	fields, err := decodeQPACK(payload)
+	if err != nil {
+		stream.CancelRead(h3GeneralProtocolError)
+		stream.CancelWrite(h3GeneralProtocolError)
+		return err
+	}
+	headers := make(map[string]string)
+	for _, f := range fields {
+		headers[f.name] = f.value
+	}
+	status := "200"
+	switch {
+	case headers[":method"] != "CONNECT" || headers[":protocol"] != "webtransport":
+		status = "400"
+	case headers[":path"] != path:
+		status = "404"
+	}
+	response := []headerField{{":status", status}}
+	if status == "200" {
+		response = append(response, headerField{"sec-webtransport-http3-draft", "draft02"})
+	}
+	_, err = stream.Write(appendH3Frame(nil, h3FrameHeaders, encodeQPACK(response)))
+	if err != nil {
+		return err
+	}
+	if status != "200" {
+		_ = stream.Close()
+		return fmt.Errorf("%w: %v %v %v", ErrWebTransportRequest, headers[":method"], headers[":protocol"], headers[":path"])
+	}
+	w.connect = stream
+	w.id = uint64(stream.StreamID())
+	w.datagramPrefix = appendVarint(nil, w.id/4)
+	return nil
+}
+
+func (w *webTransportSession) close(err error) {
+	w.closeOnce.Do(func() {
+		w.err = err
+		close(w.closed)
+	})
+}
+
+func (w *webTransportSession) acceptUniStreams() {
+	for {
+		stream, err := w.Session.AcceptUniStream(context.Background())
+		if err != nil {
+			w.close(err)
+			return
+		}
+		go w.handleUniStream(stream)
+	}
+}
+
+// handleUniStream reads the type of a unidirectional stream. WebTransport
+// streams are passed to AcceptUniStream, the HTTP/3 control and QPACK
+// streams of the client are drained.
+func (w *webTransportSession) handleUniStream(stream quic.ReceiveStream) {
+	r := byteReader{stream}
+	streamType, err := readVarint(r)
+	if err != nil {
+		return
+	}
+	switch streamType {
+	case h3StreamControl, h3StreamQPACKEncoder, h3StreamQPACKDecoder:
+		// settings of the client are not needed and without dynamic table
+		// there are no QPACK instructions
+		_, _ = io.Copy(ioutil.Discard, stream)
+	case webTransportUniStream:
+		id, err := readVarint(r)
+		if err != nil {
+			return
+		}
+		if !w.waitReady() {
+			return
+		}
+		if id != w.id {
+			stream.CancelRead(h3RequestRejected)
+			return
+		}
+		select {
+		case w.uniStreams <- stream:
+		case <-w.closed:
+		}
+	default:
+		stream.CancelRead(h3StreamCreationError)
+	}
+}
+
+func (w *webTransportSession) acceptStreams() {
+	for {
+		stream, err := w.Session.AcceptStream(context.Background())
+		if err != nil {
+			w.close(err)
+			return
+		}
+		go w.handleStream(stream)
+	}
+}
+
+// handleStream passes bidirectional WebTransport streams of the session to
+// AcceptStream. The client must not send further HTTP/3 requests.
+func (w *webTransportSession) handleStream(stream quic.Stream) {
+	r := byteReader{stream}
+	signal, err := readVarint(r)
+	if err != nil {
+		return
+	}
+	if signal != webTransportBidiStream {
+		stream.CancelRead(h3RequestRejected)
+		stream.CancelWrite(h3RequestRejected)
+		return
+	}
+	id, err := readVarint(r)
+	if err != nil {
+		return
+	}
+	if id != w.id {
+		stream.CancelRead(h3RequestRejected)
+		stream.CancelWrite(h3RequestRejected)
+		return
+	}
+	select {
+	case w.streams <- stream:
+	case <-w.closed:
+	}
+}
+
+// waitReady waits until the session was established and returns false if the
+// session was closed before.
+func (w *webTransportSession) waitReady() bool {
+	select {
+	case <-w.ready:
+		return true
+	case <-w.closed:
+		return false
+	}
+}
+
+func (w *webTransportSession) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case stream := <-w.streams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.closed:
+		return nil, w.err
+	}
+}
+
+func (w *webTransportSession) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case stream := <-w.uniStreams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-w.closed:
+		return nil, w.err
+	}
+}
+
+func (w *webTransportSession) OpenStream() (quic.Stream, error) {
+	stream, err := w.Session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, w.writeStreamHeader(stream, webTransportBidiStream)
+}
+
+func (w *webTransportSession) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	stream, err := w.Session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, w.writeStreamHeader(stream, webTransportBidiStream)
+}
+
+func (w *webTransportSession) OpenUniStream() (quic.SendStream, error) {
+	stream, err := w.Session.OpenUniStream()
+	if err != nil {
+		return nil, err
+	}
+	return stream, w.writeStreamHeader(stream, webTransportUniStream)
+}
+
+func (w *webTransportSession) OpenUniStreamSync(ctx context.Context) (quic.SendStream, error) {
+	stream, err := w.Session.OpenUniStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return stream, w.writeStreamHeader(stream, webTransportUniStream)
+}
+
+func (w *webTransportSession) writeStreamHeader(stream io.Writer, streamType uint64) error {
+	_, err := stream.Write(appendVarint(appendVarint(nil, streamType), w.id))
+	return err
+}
+
+func (w *webTransportSession) SendMessage(b []byte) error {
+	msg := make([]byte, 0, len(w.datagramPrefix)+len(b))
+	msg = append(msg, w.datagramPrefix...)
+	return w.Session.SendMessage(append(msg, b...))
+}
+
+// ReceiveMessage returns the next datagram of the session. Datagrams of other
+// sessions are dropped.
+func (w *webTransportSession) ReceiveMessage() ([]byte, error) {
+	for {
+		msg, err := w.Session.ReceiveMessage()
+		if err != nil {
+			return nil, err
+		}
+		id, n, err := parseVarint(msg)
+		if err != nil || id != w.id/4 {
+			log.Printf("dropping datagram of unknown WebTransport session\n")
+			continue
+		}
+		return msg[n:], nil
+	}
+}
+
+// CloseWithError closes the session by sending code and desc in a
+// CLOSE_WEBTRANSPORT_SESSION capsule on the CONNECT stream and closing the
+// stream, so the browser gets the close code of the session. The connection
+// is closed without error afterwards, because the session was closed cleanly.
+func (w *webTransportSession) CloseWithError(code quic.ErrorCode, desc string) error {
+	_, err := w.connect.Write(appendH3Frame(nil, h3FrameData, webTransportCloseCapsule(code, desc)))
+	if err != nil {
+		log.Printf("could not send WebTransport close capsule: %v\n", err)
+	}
+	if err := w.connect.Close(); err != nil {
+		log.Printf("could not close WebTransport CONNECT stream: %v\n", err)
+	}
+	w.close(ErrWebTransportSessions)
+	return w.Session.CloseWithError(h3NoError, desc)
+}
+
+// webTransportCloseCapsule encodes the CLOSE_WEBTRANSPORT_SESSION capsule of
+// code and desc. WebTransport error codes have 32 bits, which holds all close
+// codes. desc is truncated to maxWebTransportCloseMessage bytes.
+func webTransportCloseCapsule(code quic.ErrorCode, desc string) []byte {
+	if len(desc) > maxWebTransportCloseMessage {
+		desc = desc[:maxWebTransportCloseMessage]
+	}
+	value := make([]byte, 4, 4+len(desc))
+	binary.BigEndian.PutUint32(value, uint32(code))
+	value = append(value, desc...)
+	b := appendVarint(nil, webTransportCloseSessionCapsule)
+	b = appendVarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+// generateWebTransportTLSConfig creates a self-signed ECDSA certificate with a
+// validity short enough for browsers to accept it by its hash.
+func generateWebTransportTLSConfig() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(webTransportCertificateValidity - time.Hour),
+		DNSNames:     []string{"localhost"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{certDER},
+			PrivateKey:  key,
+		}},
+		NextProtos: []string{h3ALPN},
+	}, nil
+}
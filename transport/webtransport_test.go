@@ -0,0 +1,555 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// testStream is a QUIC stream reading from r, which records the data written
+// to it and how it was closed.
+type testStream struct {
+	quic.Stream
+	id quic.StreamID
+	r  io.Reader
+
+	lock          sync.Mutex
+	written       bytes.Buffer
+	closed        bool
+	readCanceled  bool
+	readCode      quic.ErrorCode
+	writeCanceled bool
+	writeCode     quic.ErrorCode
+}
+
+func newTestStream(id quic.StreamID, data ...[]byte) *testStream {
+	return &testStream{id: id, r: bytes.NewReader(bytes.Join(data, nil))}
+}
+
+func (s *testStream) StreamID() quic.StreamID    { return s.id }
+func (s *testStream) Read(b []byte) (int, error) { return s.r.Read(b) }
+
+func (s *testStream) Write(b []byte) (int, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.written.Write(b)
+}
+
+func (s *testStream) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	return nil
+}
+
+func (s *testStream) CancelRead(code quic.ErrorCode) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.readCanceled, s.readCode = true, code
+}
+
+func (s *testStream) CancelWrite(code quic.ErrorCode) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.writeCanceled, s.writeCode = true, code
+}
+
+func (s *testStream) SetWriteDeadline(t time.Time) error { return nil }
+
+func (s *testStream) writeCanceledWith() (quic.ErrorCode, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.writeCode, s.writeCanceled
+}
+
+func (s *testStream) readCanceledWith() (quic.ErrorCode, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.readCode, s.readCanceled
+}
+
+func (s *testStream) data() []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]byte{}, s.written.Bytes()...)
+}
+
+// testSession is a QUIC session whose peer is played by the test: streams and
+// datagrams of the peer are passed on the channels, opened streams and sent
+// datagrams are recorded.
+type testSession struct {
+	quic.Session
+	ctx        context.Context
+	cancel     context.CancelFunc
+	streams    chan quic.Stream
+	uniStreams chan quic.ReceiveStream
+	datagrams  chan []byte
+
+	lock       sync.Mutex
+	nextBidiID quic.StreamID
+	nextUniID  quic.StreamID
+	opened     []*testStream
+	sent       [][]byte
+	closed     bool
+	closeCode  quic.ErrorCode
+}
+
+func newTestSession() *testSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &testSession{
+		ctx:        ctx,
+		cancel:     cancel,
+		streams:    make(chan quic.Stream, 8),
+		uniStreams: make(chan quic.ReceiveStream, 8),
+		datagrams:  make(chan []byte, 8),
+		// server initiated streams
+		nextBidiID: 1,
+		nextUniID:  3,
+	}
+}
+
+func (s *testSession) Context() context.Context { return s.ctx }
+
+func (s *testSession) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case stream := <-s.streams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *testSession) AcceptUniStream(ctx context.Context) (quic.ReceiveStream, error) {
+	select {
+	case stream := <-s.uniStreams:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *testSession) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stream := newTestStream(s.nextBidiID)
+	s.nextBidiID += 4
+	s.opened = append(s.opened, stream)
+	return stream, nil
+}
+
+func (s *testSession) OpenUniStream() (quic.SendStream, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	stream := newTestStream(s.nextUniID)
+	s.nextUniID += 4
+	s.opened = append(s.opened, stream)
+	return stream, nil
+}
+
+func (s *testSession) openedStreams() []*testStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]*testStream{}, s.opened...)
+}
+
+func (s *testSession) SendMessage(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sent = append(s.sent, append([]byte{}, b...))
+	return nil
+}
+
+func (s *testSession) ReceiveMessage() ([]byte, error) {
+	select {
+	case msg := <-s.datagrams:
+		return msg, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+func (s *testSession) CloseWithError(code quic.ErrorCode, desc string) error {
+	s.lock.Lock()
+	s.closed, s.closeCode = true, code
+	s.lock.Unlock()
+	s.cancel()
+	return nil
+}
+
+// huffmanEncode encodes s with the Huffman code of HPACK as browsers do for
+// most string literals.
+func huffmanEncode(s string) []byte {
+	var out []byte
+	var bits uint64
+	var n uint
+	for i := 0; i < len(s); i++ {
+		bits = bits<<huffmanCodeLen[s[i]] | uint64(huffmanCodes[s[i]])
+		n += uint(huffmanCodeLen[s[i]])
+		for n >= 8 {
+			n -= 8
+			out = append(out, byte(bits>>n))
+		}
+	}
+	if n > 0 {
+		// padding with the most significant bits of EOS
+		out = append(out, byte(bits<<(8-n))|byte(0xFF>>n))
+	}
+	return out
+}
+
+// browserConnectRequest is a CONNECT request as encoded by browsers: pseudo
+// header fields reference the static table, values are Huffman encoded.
+func browserConnectRequest(path string) []byte {
+	huffman := func(b []byte, prefix uint, s string) []byte {
+		h := huffmanEncode(s)
+		return append(appendQPACKInt(b, 1<<prefix, prefix, uint64(len(h))), h...)
+	}
+	b := []byte{0, 0}
+	// indexed :method CONNECT and :scheme https
+	b = appendQPACKInt(b, 0xC0, 6, 15)
+	b = appendQPACKInt(b, 0xC0, 6, 23)
+	// :authority and :path with static name reference
+	b = huffman(appendQPACKInt(b, 0x50, 4, 0), 7, "localhost:4242")
+	b = huffman(appendQPACKInt(b, 0x50, 4, 1), 7, path)
+	// :protocol with literal name
+	b = append(appendQPACKInt(b, 0x20, 3, uint64(len(":protocol"))), ":protocol"...)
+	b = huffman(b, 7, "webtransport")
+	// origin with static name reference
+	b = huffman(appendQPACKInt(b, 0x50, 4, 90), 7, "https://localhost:8080")
+	return appendH3Frame(nil, h3FrameHeaders, b)
+}
+
+func connectRequest(fields ...headerField) []byte {
+	return appendH3Frame(nil, h3FrameHeaders, encodeQPACK(fields))
+}
+
+func TestQPACKDecode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		data []byte
+		want []headerField
+		err  error
+	}{
+		{
+			// RFC 9204, Appendix B.1
+			name: "literal with name reference",
+			data: []byte{0x00, 0x00, 0x51, 0x0b, '/', 'i', 'n', 'd', 'e', 'x', '.', 'h', 't', 'm', 'l'},
+			want: []headerField{{":path", "/index.html"}},
+		},
+		{
+			// Huffman code of RFC 7541, Appendix C.4.1
+			name: "huffman",
+			data: []byte{0x00, 0x00, 0x50, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff},
+			want: []headerField{{":authority", "www.example.com"}},
+		},
+		{
+			name: "indexed",
+			data: []byte{0x00, 0x00, 0xcf, 0xd9},
+			want: []headerField{{":method", "CONNECT"}, {":status", "200"}},
+		},
+		{
+			name: "literal name",
+			data: []byte{0x00, 0x00, 0x23, 'a', 'b', 'c', 0x01, 'd'},
+			want: []headerField{{"abc", "d"}},
+		},
+		{name: "dynamic table", data: []byte{0x01, 0x00}, err: ErrQPACKDynamicTable},
+		{name: "dynamic reference", data: []byte{0x00, 0x00, 0x81}, err: ErrQPACKDynamicTable},
+		{name: "post-base index", data: []byte{0x00, 0x00, 0x10}, err: ErrQPACKDynamicTable},
+		{name: "static index", data: []byte{0x00, 0x00, 0xff, 0x40}, err: ErrQPACKInvalidIndex},
+		{name: "truncated value", data: []byte{0x00, 0x00, 0x51, 0x0b, '/'}, err: ErrQPACKTruncated},
+		{name: "invalid padding", data: []byte{0x00, 0x00, 0x50, 0x81, 0x00}, err: ErrQPACKInvalidHuffman},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := decodeQPACK(tc.data)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("decodeQPACK error = %v, want %v", err, tc.err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("decodeQPACK = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	fields := []headerField{{":status", "200"}, {"sec-webtransport-http3-draft", "draft02"}, {":status", "404"}}
+	got, err := decodeQPACK(encodeQPACK(fields))
+	if err != nil {
+		t.Fatalf("decodeQPACK of encoded fields: %v", err)
+	}
+	if !reflect.DeepEqual(got, fields) {
+		t.Fatalf("decodeQPACK of encoded fields = %v, want %v", got, fields)
+	}
+}
+
+func TestWebTransportSettings(t *testing.T) {
+	b := webTransportSettings()
+	r := bytes.NewReader(b)
+	streamType, err := readVarint(r)
+	if err != nil || streamType != h3StreamControl {
+		t.Fatalf("stream type = %v, %v, want control stream", streamType, err)
+	}
+	frameType, payload, err := readH3Frame(r, uint64(len(b)))
+	if err != nil || frameType != h3FrameSettings {
+		t.Fatalf("frame type = %v, %v, want SETTINGS", frameType, err)
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%v bytes after SETTINGS frame", r.Len())
+	}
+	settings := make(map[uint64]uint64)
+	for len(payload) > 0 {
+		id, n, err := parseVarint(payload)
+		if err != nil {
+			t.Fatalf("invalid setting identifier: %v", err)
+		}
+		payload = payload[n:]
+		value, n, err := parseVarint(payload)
+		if err != nil {
+			t.Fatalf("invalid setting value: %v", err)
+		}
+		payload = payload[n:]
+		if _, ok := settings[id]; ok {
+			t.Fatalf("setting %x repeated", id)
+		}
+		settings[id] = value
+	}
+	for _, id := range []uint64{
+		h3SettingEnableConnectProtocol,
+		h3SettingDatagram,
+		h3SettingDatagramDraft04,
+		h3SettingEnableWebTransport,
+	} {
+		if settings[id] != 1 {
+			t.Fatalf("setting %x = %v, want 1", id, settings[id])
+		}
+	}
+}
+
+func TestWebTransportConnect(t *testing.T) {
+	valid := []headerField{
+		{":method", "CONNECT"},
+		{":protocol", "webtransport"},
+		{":scheme", "https"},
+		{":authority", "localhost:4242"},
+		{":path", "/stream"},
+	}
+	with := func(name, value string) []byte {
+		fields := make([]headerField, len(valid))
+		copy(fields, valid)
+		for i := range fields {
+			if fields[i].name == name {
+				fields[i].value = value
+			}
+		}
+		return connectRequest(fields...)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		request []byte
+		status  string
+		err     error
+	}{
+		{"browser", browserConnectRequest("/stream"), "200", nil},
+		{"valid", connectRequest(valid...), "200", nil},
+		{"method", with(":method", "GET"), "400", ErrWebTransportRequest},
+		{"protocol", with(":protocol", "websocket"), "400", ErrWebTransportRequest},
+		{"path", browserConnectRequest("/other"), "404", ErrWebTransportRequest},
+		{"unexpected frame", appendH3Frame(nil, h3FrameSettings, nil), "", ErrH3UnexpectedFrame},
+		{"too large", appendH3Frame(nil, h3FrameHeaders, make([]byte, maxH3HeadersSize+1)), "", ErrH3FrameTooLarge},
+		{"truncated", browserConnectRequest("/stream")[:20], "", io.ErrUnexpectedEOF},
+		{"dynamic table", appendH3Frame(nil, h3FrameHeaders, []byte{0x02, 0x00}), "", ErrQPACKDynamicTable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stream := newTestStream(4, tc.request)
+			w := &webTransportSession{}
+			err := w.handleConnect(stream, "/stream")
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("handleConnect error = %v, want %v", err, tc.err)
+			}
+
+			response := stream.data()
+			if tc.status == "" {
+				if len(response) > 0 {
+					t.Fatalf("answered invalid request with %x", response)
+				}
+				if tc.err == ErrH3UnexpectedFrame && !(stream.readCanceled && stream.writeCanceled && stream.readCode == h3GeneralProtocolError) {
+					t.Fatal("stream of unexpected frame not cancelled")
+				}
+				return
+			}
+			frameType, payload, err := readH3Frame(bytes.NewReader(response), maxH3HeadersSize)
+			if err != nil || frameType != h3FrameHeaders {
+				t.Fatalf("response frame = %v, %v, want HEADERS", frameType, err)
+			}
+			fields, err := decodeQPACK(payload)
+			if err != nil {
+				t.Fatalf("decodeQPACK of response: %v", err)
+			}
+			want := []headerField{{":status", tc.status}}
+			if tc.status == "200" {
+				want = append(want, headerField{"sec-webtransport-http3-draft", "draft02"})
+			}
+			if !reflect.DeepEqual(fields, want) {
+				t.Fatalf("response = %v, want %v", fields, want)
+			}
+			if tc.err != nil {
+				if !stream.closed {
+					t.Fatal("stream of rejected request not closed")
+				}
+				return
+			}
+			if w.id != 4 || !bytes.Equal(w.datagramPrefix, []byte{1}) || w.connect != stream {
+				t.Fatalf("session id %v and datagram prefix %x, want 4 and 01", w.id, w.datagramPrefix)
+			}
+		})
+	}
+}
+
+// acceptTestSession establishes a WebTransport session on the CONNECT stream
+// 4 of a test session.
+func acceptTestSession(t *testing.T) (*testSession, *webTransportSession, *testStream) {
+	t.Helper()
+	sess := newTestSession()
+	connect := newTestStream(4, browserConnectRequest("/stream"))
+	sess.streams <- connect
+	w, err := acceptWebTransportSession(sess, "/stream")
+	if err != nil {
+		t.Fatalf("acceptWebTransportSession: %v", err)
+	}
+	return sess, w, connect
+}
+
+func TestWebTransportSession(t *testing.T) {
+	sess, w, connect := acceptTestSession(t)
+	defer sess.cancel()
+
+	opened := sess.openedStreams()
+	if len(opened) != 1 || !bytes.Equal(opened[0].data(), webTransportSettings()) {
+		t.Fatal("control stream does not start with the SETTINGS frame")
+	}
+	if len(connect.data()) == 0 {
+		t.Fatal("CONNECT request not answered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the control stream of the client is drained, streams of other sessions
+	// are rejected
+	sess.uniStreams <- newTestStream(2, webTransportSettings())
+	other := newTestStream(6, appendVarint(appendVarint(nil, webTransportUniStream), 8), []byte("other"))
+	sess.uniStreams <- other
+	sess.uniStreams <- newTestStream(10, appendVarint(appendVarint(nil, webTransportUniStream), 4), []byte("feedback"))
+	uni, err := w.AcceptUniStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptUniStream: %v", err)
+	}
+	if b, err := ioutil.ReadAll(uni); err != nil || string(b) != "feedback" {
+		t.Fatalf("uni stream = %q, %v, want %q", b, err, "feedback")
+	}
+	// streams are handled concurrently
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		if code, ok := other.readCanceledWith(); ok {
+			if code != h3RequestRejected {
+				t.Fatalf("uni stream of other session cancelled with %x, want %x", code, h3RequestRejected)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("uni stream of other session not rejected")
+		}
+	}
+
+	sess.streams <- newTestStream(8, appendVarint(appendVarint(nil, webTransportBidiStream), 4), []byte("request"))
+	bidi, err := w.AcceptStream(ctx)
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	if b, err := ioutil.ReadAll(bidi); err != nil || string(b) != "request" {
+		t.Fatalf("stream = %q, %v, want %q", b, err, "request")
+	}
+
+	// opened streams carry the stream header of the session
+	s, err := w.OpenUniStream()
+	if err != nil {
+		t.Fatalf("OpenUniStream: %v", err)
+	}
+	if _, err := s.Write([]byte("frame")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if b, want := s.(*testStream).data(), append(appendVarint(appendVarint(nil, webTransportUniStream), 4), "frame"...); !bytes.Equal(b, want) {
+		t.Fatalf("uni stream = %x, want %x", b, want)
+	}
+
+	// datagrams are prefixed by the quarter stream ID of the CONNECT stream
+	if err := w.SendMessage([]byte("packet")); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if want := append([]byte{0x01}, "packet"...); !reflect.DeepEqual(sess.sent, [][]byte{want}) {
+		t.Fatalf("sent datagrams %x, want %x", sess.sent, want)
+	}
+	sess.datagrams <- append([]byte{0x02}, "other"...)
+	sess.datagrams <- append([]byte{0x01}, "feedback"...)
+	msg, err := w.ReceiveMessage()
+	if err != nil || string(msg) != "feedback" {
+		t.Fatalf("ReceiveMessage = %q, %v, want %q", msg, err, "feedback")
+	}
+}
+
+func TestWebTransportSessionWithoutConnect(t *testing.T) {
+	sess := newTestSession()
+	sess.cancel()
+	if _, err := acceptWebTransportSession(sess, "/stream"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("acceptWebTransportSession error = %v, want %v", err, context.Canceled)
+	}
+
+	sess = newTestSession()
+	defer sess.cancel()
+	sess.streams <- newTestStream(0, connectRequest(headerField{":method", "GET"}, headerField{":path", "/stream"}))
+	if _, err := acceptWebTransportSession(sess, "/stream"); !errors.Is(err, ErrWebTransportRequest) {
+		t.Fatalf("acceptWebTransportSession error = %v, want %v", err, ErrWebTransportRequest)
+	}
+}
+
+func TestWebTransportClose(t *testing.T) {
+	sess, w, connect := acceptTestSession(t)
+	defer sess.cancel()
+
+	answered := len(connect.data())
+	if err := w.CloseWithError(quic.ErrorCode(CloseServerBusy), "busy"); err != nil {
+		t.Fatalf("CloseWithError: %v", err)
+	}
+	// DATA frame with a CLOSE_WEBTRANSPORT_SESSION capsule carrying the close
+	// code and message
+	want := []byte{
+		0x00, 0x0b, // DATA frame of 11 bytes
+		0x68, 0x43, 0x08, // capsule type 0x2843, length 8
+		0x00, 0x00, 0x00, 0x04, // close code
+		'b', 'u', 's', 'y',
+	}
+	if b := connect.data()[answered:]; !bytes.Equal(b, want) {
+		t.Fatalf("CONNECT stream closed with %x, want %x", b, want)
+	}
+	connect.lock.Lock()
+	closed := connect.closed
+	connect.lock.Unlock()
+	if !closed {
+		t.Fatal("CONNECT stream not closed")
+	}
+	sess.lock.Lock()
+	defer sess.lock.Unlock()
+	if !sess.closed || sess.closeCode != h3NoError {
+		t.Fatalf("connection closed %v with %x, want closed with %x", sess.closed, sess.closeCode, h3NoError)
+	}
+}
@@ -0,0 +1,620 @@
+'use strict';
+
+// Browser receiver for `serve --webtransport`. Receives RTP packets over
+// WebTransport datagrams or streams, depacketizes H.264 or VP8, decodes the
+// frames with WebCodecs and sends RFC 8888 congestion control feedback if the
+// server uses a congestion controller.
+
+// FEEDBACK_INTERVAL_MS is the interval of congestion control feedback.
+const FEEDBACK_INTERVAL_MS = 50;
+// MAX_PENDING_FRAMES is the number of incomplete frames after which the
+// receiver gives up on the oldest frame and waits for the next key frame.
+const MAX_PENDING_FRAMES = 30;
+// NTP_EPOCH_OFFSET is the number of seconds between 1900 and 1970.
+const NTP_EPOCH_OFFSET = 2208988800;
+
+const statsElement = document.getElementById('stats');
+const canvas = document.getElementById('video');
+const context2d = canvas.getContext('2d');
+
+const stats = {
+  packets: 0,
+  bytes: 0,
+  frames: 0,
+  decoded: 0,
+  dropped: 0,
+  feedback: 0,
+};
+
+document.getElementById('start').addEventListener('click', async (event) => {
+  event.target.disabled = true;
+  try {
+    await run();
+  } catch (e) {
+    showStatus(`error: ${e}`);
+  }
+});
+
+function showStatus(status) {
+  statsElement.textContent = status;
+}
+
+function nowMs() {
+  return performance.timeOrigin + performance.now();
+}
+
+// ntpMiddle32 returns the middle 32 bits of the NTP timestamp of a time in ms.
+function ntpMiddle32(ms) {
+  const seconds = ms / 1000 + NTP_EPOCH_OFFSET;
+  return Number(BigInt(Math.floor(seconds * 65536)) & 0xffffffffn);
+}
+
+function base64ToBytes(s) {
+  return Uint8Array.from(atob(s), (c) => c.charCodeAt(0));
+}
+
+// seqDiff returns the distance from sequence number a to b.
+function seqDiff(a, b) {
+  return ((b - a + 0x10000) & 0xffff) << 16 >> 16;
+}
+
+async function run() {
+  const config = await (await fetch('config.json')).json();
+  if (config.handler === 'hybrid') {
+    throw new Error('the hybrid handler is not supported');
+  }
+  const depacketizer = newDepacketizer(config.codec);
+  const url = `https://${location.hostname}:${config.port}${config.path}`;
+  const transport = new WebTransport(url, {
+    serverCertificateHashes: [{
+      algorithm: 'sha-256',
+      value: base64ToBytes(config.certificateHash),
+    }],
+  });
+  await transport.ready;
+  showStatus(`connected to ${url}`);
+
+  const receiver = new Receiver(config, depacketizer);
+  let feedback = null;
+  if (config.feedback) {
+    feedback = new FeedbackSender(transport, config.handler === 'datagram');
+    receiver.onPacket = (packet, arrival) => feedback.record(packet, arrival);
+  }
+  const statsTimer = setInterval(() => {
+    showStatus(Object.entries(stats).map(([k, v]) => `${k}: ${v}`).join('\n'));
+  }, 1000);
+
+  try {
+    if (config.handler === 'datagram') {
+      await readDatagrams(transport, receiver);
+    } else {
+      await readStreams(transport, receiver, config.handler);
+    }
+    const { closeCode, reason } = await transport.closed;
+    console.log(`session closed with code ${closeCode}: ${reason}`);
+  } finally {
+    clearInterval(statsTimer);
+    if (feedback) {
+      feedback.stop();
+    }
+    receiver.close();
+  }
+}
+
+async function readDatagrams(transport, receiver) {
+  const reader = transport.datagrams.readable.getReader();
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    receiver.receive(value);
+  }
+}
+
+async function readStreams(transport, receiver, handler) {
+  const reader = transport.incomingBidirectionalStreams.getReader();
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) {
+      return;
+    }
+    readStream(value.readable, receiver, handler).catch((e) => {
+      stats.dropped++;
+      console.log(`stream failed: ${e}`);
+    });
+  }
+}
+
+// readStream reads the packets of a stream. The streamperpacket handler sends
+// a single packet per stream, the other handlers prefix each packet by its
+// 16 bit length.
+async function readStream(readable, receiver, handler) {
+  const reader = readable.getReader();
+  let buffer = new Uint8Array(0);
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (value) {
+      const b = new Uint8Array(buffer.length + value.length);
+      b.set(buffer);
+      b.set(value, buffer.length);
+      buffer = b;
+    }
+    if (handler !== 'streamperpacket') {
+      let offset = 0;
+      while (buffer.length - offset >= 2) {
+        const size = (buffer[offset] << 8) | buffer[offset + 1];
+        if (buffer.length - offset - 2 < size) {
+          break;
+        }
+        receiver.receive(buffer.subarray(offset + 2, offset + 2 + size));
+        offset += 2 + size;
+      }
+      buffer = buffer.slice(offset);
+    }
+    if (done) {
+      if (handler === 'streamperpacket' && buffer.length > 0) {
+        receiver.receive(buffer);
+      }
+      return;
+    }
+  }
+}
+
+function parseRTP(b) {
+  if (b.length < 12 || b[0] >> 6 !== 2) {
+    return null;
+  }
+  const view = new DataView(b.buffer, b.byteOffset, b.byteLength);
+  let offset = 12 + (b[0] & 0x0f) * 4;
+  if (b[0] & 0x10) {
+    if (b.length < offset + 4) {
+      return null;
+    }
+    offset += 4 + view.getUint16(offset + 2) * 4;
+  }
+  let end = b.length;
+  if (b[0] & 0x20) {
+    end -= b[b.length - 1];
+  }
+  if (end < offset) {
+    return null;
+  }
+  return {
+    marker: (b[1] & 0x80) !== 0,
+    payloadType: b[1] & 0x7f,
+    seq: view.getUint16(2),
+    timestamp: view.getUint32(4),
+    ssrc: view.getUint32(8),
+    payload: b.subarray(offset, end),
+  };
+}
+
+function isRTCP(b) {
+  return b.length >= 8 && b[0] >> 6 === 2 && b[1] >= 192 && b[1] <= 223;
+}
+
+// Receiver reassembles frames from RTP packets, which may arrive out of
+// order on streams, and passes complete frames to the decoder.
+class Receiver {
+  constructor(config, depacketizer) {
+    this.payloadType = config.payloadType;
+    this.depacketizer = depacketizer;
+    this.onPacket = null;
+    // frames maps RTP timestamps to the packets of a frame
+    this.frames = new Map();
+    // nextSeq is the first sequence number of the next frame, null after a
+    // loss until the next frame start
+    this.nextSeq = null;
+    this.waitKeyFrame = true;
+    this.decoder = this.newDecoder();
+    this.configured = null;
+  }
+
+  // newDecoder creates a decoder drawing to the canvas. Decoders are closed on
+  // errors, so the receiver starts over with a new decoder at the next key
+  // frame.
+  newDecoder() {
+    return new VideoDecoder({
+      output: (frame) => {
+        stats.decoded++;
+        if (canvas.width !== frame.displayWidth || canvas.height !== frame.displayHeight) {
+          canvas.width = frame.displayWidth;
+          canvas.height = frame.displayHeight;
+        }
+        context2d.drawImage(frame, 0, 0);
+        frame.close();
+      },
+      error: (e) => {
+        console.log(`decoder error: ${e}`);
+        this.decoder = this.newDecoder();
+        this.configured = null;
+        this.waitKeyFrame = true;
+      },
+    });
+  }
+
+  receive(b) {
+    const arrival = nowMs();
+    stats.packets++;
+    stats.bytes += b.length;
+    if (isRTCP(b)) {
+      return;
+    }
+    const packet = parseRTP(b);
+    if (packet === null) {
+      return;
+    }
+    if (this.onPacket) {
+      this.onPacket(packet, arrival);
+    }
+    if (packet.payloadType !== this.payloadType) {
+      return;
+    }
+    let frame = this.frames.get(packet.timestamp);
+    if (!frame) {
+      frame = { timestamp: packet.timestamp, packets: new Map(), markerSeq: null };
+      this.frames.set(packet.timestamp, frame);
+    }
+    frame.packets.set(packet.seq, packet);
+    if (packet.marker) {
+      frame.markerSeq = packet.seq;
+    }
+    this.emitFrames();
+  }
+
+  // completeFrame returns the packets of frame in order if all packets from
+  // firstSeq to the marker were received.
+  completeFrame(frame, firstSeq) {
+    if (frame.markerSeq === null || !frame.packets.has(firstSeq)) {
+      return null;
+    }
+    const count = seqDiff(firstSeq, frame.markerSeq) + 1;
+    if (count <= 0 || count !== frame.packets.size) {
+      return null;
+    }
+    const packets = [];
+    for (let i = 0; i < count; i++) {
+      const p = frame.packets.get((firstSeq + i) & 0xffff);
+      if (!p) {
+        return null;
+      }
+      packets.push(p);
+    }
+    return packets;
+  }
+
+  emitFrames() {
+    for (;;) {
+      let next = null;
+      let packets = null;
+      for (const frame of this.frames.values()) {
+        let firstSeq = this.nextSeq;
+        if (firstSeq === null) {
+          // after a loss any complete frame starting with a frame start is
+          // accepted
+          firstSeq = frame.packets.keys().next().value;
+          for (const seq of frame.packets.keys()) {
+            if (seqDiff(seq, firstSeq) < 0) {
+              firstSeq = seq;
+            }
+          }
+          if (!this.depacketizer.isFrameStart(frame.packets.get(firstSeq).payload)) {
+            continue;
+          }
+        }
+        packets = this.completeFrame(frame, firstSeq);
+        if (packets !== null) {
+          next = frame;
+          break;
+        }
+      }
+      if (next === null) {
+        break;
+      }
+      this.frames.delete(next.timestamp);
+      this.nextSeq = (next.markerSeq + 1) & 0xffff;
+      this.decode(next, packets);
+    }
+    if (this.frames.size > MAX_PENDING_FRAMES) {
+      stats.dropped += this.frames.size;
+      this.frames.clear();
+      this.nextSeq = null;
+      this.waitKeyFrame = true;
+    }
+  }
+
+  decode(frame, packets) {
+    stats.frames++;
+    const data = this.depacketizer.depacketize(packets.map((p) => p.payload));
+    if (data === null || data.data.length === 0) {
+      stats.dropped++;
+      this.waitKeyFrame = true;
+      return;
+    }
+    if (this.waitKeyFrame && !data.key) {
+      stats.dropped++;
+      return;
+    }
+    if (data.key && this.configured !== data.codec) {
+      this.decoder.configure({ codec: data.codec, optimizeForLatency: true });
+      this.configured = data.codec;
+    }
+    if (this.configured === null) {
+      stats.dropped++;
+      return;
+    }
+    this.waitKeyFrame = false;
+    this.decoder.decode(new EncodedVideoChunk({
+      type: data.key ? 'key' : 'delta',
+      timestamp: Math.round(frame.timestamp / 90 * 1000),
+      data: data.data,
+    }));
+  }
+
+  close() {
+    if (this.decoder.state !== 'closed') {
+      this.decoder.close();
+    }
+  }
+}
+
+function newDepacketizer(codec) {
+  switch (codec) {
+    case 'h264':
+      return new H264Depacketizer();
+    case 'vp8':
+      return new VP8Depacketizer();
+    default:
+      throw new Error(`codec ${codec} is not supported`);
+  }
+}
+
+function concat(chunks) {
+  const size = chunks.reduce((n, c) => n + c.length, 0);
+  const b = new Uint8Array(size);
+  let offset = 0;
+  for (const c of chunks) {
+    b.set(c, offset);
+    offset += c.length;
+  }
+  return b;
+}
+
+function hex(b) {
+  return b.toString(16).padStart(2, '0');
+}
+
+// H264Depacketizer converts RTP payloads (RFC 6184) to Annex B frames.
+class H264Depacketizer {
+  isFrameStart(payload) {
+    if (payload.length < 2) {
+      return false;
+    }
+    const type = payload[0] & 0x1f;
+    return type !== 28 || (payload[1] & 0x80) !== 0;
+  }
+
+  depacketize(payloads) {
+    const startCode = new Uint8Array([0, 0, 0, 1]);
+    const nalus = [];
+    let fragments = null;
+    for (const p of payloads) {
+      if (p.length < 1) {
+        return null;
+      }
+      const type = p[0] & 0x1f;
+      if (type >= 1 && type <= 23) {
+        nalus.push(p);
+      } else if (type === 24) {
+        let offset = 1;
+        while (offset + 2 <= p.length) {
+          const size = (p[offset] << 8) | p[offset + 1];
+          offset += 2;
+          if (offset + size > p.length) {
+            return null;
+          }
+          nalus.push(p.subarray(offset, offset + size));
+          offset += size;
+        }
+      } else if (type === 28) {
+        if (p.length < 2) {
+          return null;
+        }
+        const start = (p[1] & 0x80) !== 0;
+        const end = (p[1] & 0x40) !== 0;
+        if (start) {
+          fragments = [new Uint8Array([(p[0] & 0xe0) | (p[1] & 0x1f)])];
+        } else if (fragments === null) {
+          return null;
+        }
+        fragments.push(p.subarray(2));
+        if (end) {
+          nalus.push(concat(fragments));
+          fragments = null;
+        }
+      } else {
+        return null;
+      }
+    }
+    let key = false;
+    let codec = null;
+    const chunks = [];
+    for (const nalu of nalus) {
+      const type = nalu[0] & 0x1f;
+      if (type === 5) {
+        key = true;
+      }
+      if (type === 7 && nalu.length >= 4) {
+        codec = `avc1.${hex(nalu[1])}${hex(nalu[2])}${hex(nalu[3])}`;
+      }
+      chunks.push(startCode, nalu);
+    }
+    if (key && codec === null) {
+      codec = this.codec;
+    }
+    if (codec !== null) {
+      this.codec = codec;
+    }
+    return { key: key && codec !== null, codec, data: concat(chunks) };
+  }
+}
+
+// VP8Depacketizer removes the VP8 payload descriptors (RFC 7741).
+class VP8Depacketizer {
+  descriptorLength(p) {
+    if (p.length < 1) {
+      return -1;
+    }
+    let offset = 1;
+    if (p[0] & 0x80) {
+      if (p.length < 2) {
+        return -1;
+      }
+      const x = p[1];
+      offset++;
+      if (x & 0x80) {
+        offset += p[offset] & 0x80 ? 2 : 1;
+      }
+      if (x & 0x40) {
+        offset++;
+      }
+      if (x & 0x30) {
+        offset++;
+      }
+    }
+    return offset <= p.length ? offset : -1;
+  }
+
+  isFrameStart(payload) {
+    return payload.length > 0 && (payload[0] & 0x10) !== 0 && (payload[0] & 0x07) === 0;
+  }
+
+  depacketize(payloads) {
+    if (!this.isFrameStart(payloads[0])) {
+      return null;
+    }
+    const chunks = [];
+    for (const p of payloads) {
+      const offset = this.descriptorLength(p);
+      if (offset < 0) {
+        return null;
+      }
+      chunks.push(p.subarray(offset));
+    }
+    const data = concat(chunks);
+    return { key: data.length > 0 && (data[0] & 0x01) === 0, codec: 'vp8', data };
+  }
+}
+
+// FeedbackSender sends RFC 8888 congestion control feedback for the received
+// RTP packets, as datagrams or length prefixed on a unidirectional stream.
+class FeedbackSender {
+  constructor(transport, datagrams) {
+    this.ssrc = crypto.getRandomValues(new Uint32Array(1))[0];
+    // arrivals maps SSRCs to maps of sequence numbers to arrival times
+    this.arrivals = new Map();
+    // nextSeq maps SSRCs to the first sequence number of the next report
+    this.nextSeq = new Map();
+    if (datagrams) {
+      this.writer = transport.datagrams.writable.getWriter();
+      this.frame = (b) => b;
+    } else {
+      this.writer = transport.createUnidirectionalStream().then((s) => s.getWriter());
+      this.frame = (b) => {
+        const framed = new Uint8Array(4 + b.length);
+        new DataView(framed.buffer).setUint32(0, b.length);
+        framed.set(b, 4);
+        return framed;
+      };
+    }
+    this.timer = setInterval(() => this.send(), FEEDBACK_INTERVAL_MS);
+  }
+
+  record(packet, arrival) {
+    let arrivals = this.arrivals.get(packet.ssrc);
+    if (!arrivals) {
+      arrivals = new Map();
+      this.arrivals.set(packet.ssrc, arrivals);
+    }
+    const next = this.nextSeq.get(packet.ssrc);
+    if (next !== undefined && seqDiff(next, packet.seq) < 0) {
+      // already reported as lost
+      return;
+    }
+    arrivals.set(packet.seq, arrival);
+  }
+
+  marshal(reportTime) {
+    const blocks = [];
+    for (const [ssrc, arrivals] of this.arrivals) {
+      if (arrivals.size === 0) {
+        continue;
+      }
+      let begin = this.nextSeq.get(ssrc);
+      let end = null;
+      for (const seq of arrivals.keys()) {
+        if (begin === undefined || seqDiff(begin, seq) < 0) {
+          begin = seq;
+        }
+        if (end === null || seqDiff(end, seq) > 0) {
+          end = seq;
+        }
+      }
+      const count = Math.min(seqDiff(begin, end) + 1, 16384);
+      const block = new Uint8Array(8 + 2 * count + (count % 2) * 2);
+      const view = new DataView(block.buffer);
+      view.setUint32(0, ssrc);
+      view.setUint16(4, begin);
+      view.setUint16(6, count);
+      for (let i = 0; i < count; i++) {
+        const seq = (begin + i) & 0xffff;
+        const arrival = arrivals.get(seq);
+        if (arrival === undefined) {
+          continue;
+        }
+        const ato = Math.min(Math.max(Math.round((reportTime - arrival) * 1.024), 0), 0x1ffe);
+        view.setUint16(8 + 2 * i, 0x8000 | ato);
+        arrivals.delete(seq);
+      }
+      this.nextSeq.set(ssrc, (begin + count) & 0xffff);
+      blocks.push(block);
+    }
+    if (blocks.length === 0) {
+      return null;
+    }
+    const length = 8 + blocks.reduce((n, b) => n + b.length, 0) + 4;
+    const b = new Uint8Array(length);
+    const view = new DataView(b.buffer);
+    b[0] = 0x80 | 11;
+    b[1] = 205;
+    view.setUint16(2, length / 4 - 1);
+    view.setUint32(4, this.ssrc);
+    let offset = 8;
+    for (const block of blocks) {
+      b.set(block, offset);
+      offset += block.length;
+    }
+    view.setUint32(offset, ntpMiddle32(reportTime));
+    return b;
+  }
+
+  async send() {
+    const reportTime = nowMs();
+    const feedback = this.marshal(reportTime);
+    if (feedback === null) {
+      return;
+    }
+    try {
+      const writer = await this.writer;
+      await writer.write(this.frame(feedback));
+      stats.feedback++;
+    } catch (e) {
+      console.log(`could not send feedback: ${e}`);
+    }
+  }
+
+  stop() {
+    clearInterval(this.timer);
+  }
+}